@@ -125,7 +125,8 @@ func main() {
 	passportService := gonest.NewPassportService(logger)
 
 	// Create auth controller
-	authController := gonest.NewAuthController(authService, passportService, logger)
+	mfaService := gonest.NewMFAService(gonest.DefaultTOTPConfig("GoNest Advanced"), nil, authService, logger)
+	authController := gonest.NewAuthController(authService, passportService, logger).WithMFA(mfaService)
 
 	// Create module
 	userModule := gonest.NewModule("UserModule").
@@ -151,6 +152,8 @@ func main() {
 		authGroup := app.Group("/auth")
 		authGroup.POST("/login", authController.Login)
 		authGroup.POST("/refresh", authController.RefreshToken)
+		authGroup.POST("/logout", authController.Logout)
+		authGroup.POST("/mfa/verify", authController.VerifyMFA)
 
 		// Protected routes
 		apiGroup := app.Group("/api")
@@ -166,6 +169,9 @@ func main() {
 		userGroup.POST("", userController.CreateUser)
 		userGroup.GET("/:id", userController.GetUser)
 		userGroup.GET("/profile", userController.GetProfile)
+		apiGroup.POST("/auth/logout-all", authController.LogoutAll)
+		apiGroup.POST("/auth/mfa/enroll", authController.EnrollMFA)
+		apiGroup.POST("/auth/mfa/confirm", authController.ConfirmMFA)
 
 		// Health check
 		app.GET("/health", func(c echo.Context) error {
@@ -0,0 +1,352 @@
+package gonest
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// API keys have the form gn_<prefix>_<secret>. The prefix is stored in clear
+// text to look the key up; only a SHA-256 hash of the full key is stored.
+const apiKeyPrefix = "gn"
+
+// API key errors
+var (
+	ErrAPIKeyInvalid  = errors.New("invalid API key")
+	ErrAPIKeyExpired  = errors.New("API key has expired")
+	ErrAPIKeyRevoked  = errors.New("API key has been revoked")
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// APIKey is the stored representation of an API key
+type APIKey struct {
+	ID         string                 `json:"id"`
+	Prefix     string                 `json:"prefix"`
+	Hash       string                 `json:"-"`
+	Name       string                 `json:"name"`
+	OwnerID    string                 `json:"owner_id"`
+	Scopes     []string               `json:"scopes"`
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"`
+	ExpiresAt  time.Time              `json:"expires_at,omitempty"`
+	LastUsedAt time.Time              `json:"last_used_at,omitempty"`
+	RevokedAt  time.Time              `json:"revoked_at,omitempty"`
+}
+
+// IsExpired checks if the key has expired
+func (ak *APIKey) IsExpired() bool {
+	return !ak.ExpiresAt.IsZero() && time.Now().After(ak.ExpiresAt)
+}
+
+// IsRevoked checks if the key has been revoked
+func (ak *APIKey) IsRevoked() bool {
+	return !ak.RevokedAt.IsZero()
+}
+
+// APIKeyStore persists API keys
+type APIKeyStore interface {
+	Save(ctx context.Context, key *APIKey) error
+	Get(ctx context.Context, id string) (*APIKey, error)
+	GetByPrefix(ctx context.Context, prefix string) (*APIKey, error)
+	List(ctx context.Context, ownerID string) ([]*APIKey, error)
+	Revoke(ctx context.Context, id string, at time.Time) error
+	TouchLastUsed(ctx context.Context, id string, at time.Time) error
+}
+
+// MemoryAPIKeyStore implements an in-memory API key store
+type MemoryAPIKeyStore struct {
+	keys     map[string]*APIKey
+	prefixes map[string]string
+	mutex    sync.RWMutex
+}
+
+// NewMemoryAPIKeyStore creates a new memory API key store
+func NewMemoryAPIKeyStore() *MemoryAPIKeyStore {
+	return &MemoryAPIKeyStore{
+		keys:     make(map[string]*APIKey),
+		prefixes: make(map[string]string),
+	}
+}
+
+// Save stores an API key
+func (mks *MemoryAPIKeyStore) Save(ctx context.Context, key *APIKey) error {
+	mks.mutex.Lock()
+	defer mks.mutex.Unlock()
+
+	stored := *key
+	mks.keys[key.ID] = &stored
+	mks.prefixes[key.Prefix] = key.ID
+	return nil
+}
+
+// Get retrieves an API key by ID
+func (mks *MemoryAPIKeyStore) Get(ctx context.Context, id string) (*APIKey, error) {
+	mks.mutex.RLock()
+	defer mks.mutex.RUnlock()
+
+	key, exists := mks.keys[id]
+	if !exists {
+		return nil, ErrAPIKeyNotFound
+	}
+
+	result := *key
+	return &result, nil
+}
+
+// GetByPrefix retrieves an API key by its prefix
+func (mks *MemoryAPIKeyStore) GetByPrefix(ctx context.Context, prefix string) (*APIKey, error) {
+	mks.mutex.RLock()
+	id, exists := mks.prefixes[prefix]
+	mks.mutex.RUnlock()
+
+	if !exists {
+		return nil, ErrAPIKeyNotFound
+	}
+	return mks.Get(ctx, id)
+}
+
+// List returns the keys of an owner, newest first
+func (mks *MemoryAPIKeyStore) List(ctx context.Context, ownerID string) ([]*APIKey, error) {
+	mks.mutex.RLock()
+	defer mks.mutex.RUnlock()
+
+	var keys []*APIKey
+	for _, key := range mks.keys {
+		if key.OwnerID == ownerID {
+			result := *key
+			keys = append(keys, &result)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.After(keys[j].CreatedAt)
+	})
+	return keys, nil
+}
+
+// Revoke marks an API key as revoked
+func (mks *MemoryAPIKeyStore) Revoke(ctx context.Context, id string, at time.Time) error {
+	mks.mutex.Lock()
+	defer mks.mutex.Unlock()
+
+	key, exists := mks.keys[id]
+	if !exists {
+		return ErrAPIKeyNotFound
+	}
+	key.RevokedAt = at
+	return nil
+}
+
+// TouchLastUsed records when an API key was last used
+func (mks *MemoryAPIKeyStore) TouchLastUsed(ctx context.Context, id string, at time.Time) error {
+	mks.mutex.Lock()
+	defer mks.mutex.Unlock()
+
+	key, exists := mks.keys[id]
+	if !exists {
+		return ErrAPIKeyNotFound
+	}
+	key.LastUsedAt = at
+	return nil
+}
+
+// apiKeyTouchInterval is how stale last_used may get before Verify writes
+// it again, so busy keys do not cause a store write on every request
+const apiKeyTouchInterval = time.Minute
+
+// IssueAPIKeyRequest describes a key to issue
+type IssueAPIKeyRequest struct {
+	Name     string
+	OwnerID  string
+	Scopes   []string
+	Metadata map[string]interface{}
+	// TTL of zero issues a key that does not expire
+	TTL time.Duration
+}
+
+// APIKeyService issues, verifies and revokes API keys
+type APIKeyService struct {
+	store  APIKeyStore
+	logger *logrus.Logger
+}
+
+// NewAPIKeyService creates a new API key service
+func NewAPIKeyService(store APIKeyStore, logger *logrus.Logger) *APIKeyService {
+	if store == nil {
+		store = NewMemoryAPIKeyStore()
+	}
+
+	return &APIKeyService{
+		store:  store,
+		logger: logger,
+	}
+}
+
+// Issue creates a new API key. The plain text key is only returned here.
+func (aks *APIKeyService) Issue(ctx context.Context, req IssueAPIKeyRequest) (string, *APIKey, error) {
+	prefix := generateTokenID()[:12]
+	plaintext := apiKeyPrefix + "_" + prefix + "_" + randomURLString(32)
+
+	key := &APIKey{
+		ID:        generateTokenID(),
+		Prefix:    prefix,
+		Hash:      hashAPIKey(plaintext),
+		Name:      req.Name,
+		OwnerID:   req.OwnerID,
+		Scopes:    req.Scopes,
+		Metadata:  req.Metadata,
+		CreatedAt: time.Now(),
+	}
+	if req.TTL > 0 {
+		key.ExpiresAt = key.CreatedAt.Add(req.TTL)
+	}
+
+	if err := aks.store.Save(ctx, key); err != nil {
+		return "", nil, err
+	}
+
+	if aks.logger != nil {
+		aks.logger.WithFields(logrus.Fields{
+			"key_id":   key.ID,
+			"owner_id": key.OwnerID,
+		}).Info("Issued API key")
+	}
+
+	return plaintext, key, nil
+}
+
+// Verify checks a plain text key and records its use, at most once per minute
+func (aks *APIKeyService) Verify(ctx context.Context, plaintext string) (*APIKey, error) {
+	parts := strings.SplitN(plaintext, "_", 3)
+	if len(parts) != 3 || parts[0] != apiKeyPrefix || parts[1] == "" || parts[2] == "" {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	key, err := aks.store.GetByPrefix(ctx, parts[1])
+	if errors.Is(err, ErrAPIKeyNotFound) {
+		return nil, ErrAPIKeyInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashAPIKey(plaintext)), []byte(key.Hash)) != 1 {
+		return nil, ErrAPIKeyInvalid
+	}
+
+	if key.IsRevoked() {
+		return nil, ErrAPIKeyRevoked
+	}
+	if key.IsExpired() {
+		return nil, ErrAPIKeyExpired
+	}
+
+	now := time.Now()
+	if now.Sub(key.LastUsedAt) >= apiKeyTouchInterval {
+		if err := aks.store.TouchLastUsed(ctx, key.ID, now); err != nil && aks.logger != nil {
+			aks.logger.WithError(err).Warn("Failed to record API key usage")
+		}
+		key.LastUsedAt = now
+	}
+
+	return key, nil
+}
+
+// Revoke revokes an API key
+func (aks *APIKeyService) Revoke(ctx context.Context, id string) error {
+	return aks.store.Revoke(ctx, id, time.Now())
+}
+
+// List returns the keys of an owner
+func (aks *APIKeyService) List(ctx context.Context, ownerID string) ([]*APIKey, error) {
+	return aks.store.List(ctx, ownerID)
+}
+
+// hashAPIKey hashes a plain text key for storage
+func hashAPIKey(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
+
+// APIKeyStrategy authenticates requests carrying an API key
+type APIKeyStrategy struct {
+	service    *APIKeyService
+	header     string
+	queryParam string
+}
+
+// NewAPIKeyStrategy creates a strategy reading the X-API-Key header or the api_key query parameter
+func NewAPIKeyStrategy(service *APIKeyService) *APIKeyStrategy {
+	return &APIKeyStrategy{
+		service:    service,
+		header:     "X-API-Key",
+		queryParam: "api_key",
+	}
+}
+
+// WithHeader sets the header the key is read from
+func (aks *APIKeyStrategy) WithHeader(header string) *APIKeyStrategy {
+	aks.header = header
+	return aks
+}
+
+// WithQueryParam sets the query parameter the key is read from; empty disables it
+func (aks *APIKeyStrategy) WithQueryParam(param string) *APIKeyStrategy {
+	aks.queryParam = param
+	return aks
+}
+
+// Authenticate verifies a key string or the key carried by an echo.Context.
+// Key scopes become the user's roles.
+func (aks *APIKeyStrategy) Authenticate(ctx context.Context, credentials interface{}) (*AuthUser, error) {
+	var plaintext string
+
+	switch creds := credentials.(type) {
+	case echo.Context:
+		plaintext = creds.Request().Header.Get(aks.header)
+		if plaintext == "" && aks.queryParam != "" {
+			plaintext = creds.QueryParam(aks.queryParam)
+		}
+	case string:
+		plaintext = creds
+	default:
+		return nil, errors.New("invalid credentials format")
+	}
+
+	if plaintext == "" {
+		return nil, ErrNoCredentials
+	}
+
+	key, err := aks.service.Verify(ctx, plaintext)
+	if err != nil {
+		return nil, err
+	}
+
+	metadata := make(map[string]interface{}, len(key.Metadata)+2)
+	for k, v := range key.Metadata {
+		metadata[k] = v
+	}
+	metadata["api_key_id"] = key.ID
+	metadata["auth_method"] = "api_key"
+
+	return &AuthUser{
+		ID:       key.OwnerID,
+		Username: key.Name,
+		Roles:    key.Scopes,
+		Metadata: metadata,
+	}, nil
+}
+
+// GetName returns strategy name
+func (aks *APIKeyStrategy) GetName() string {
+	return "apikey"
+}
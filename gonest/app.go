@@ -25,6 +25,7 @@ type Application struct {
 	InterceptorRegistry     *InterceptorRegistry
 	PipeRegistry            *PipeRegistry
 	ExceptionFilterRegistry *ExceptionFilterRegistry
+	ExceptionHandler        *GlobalExceptionHandler
 	WebSocketGateway        *WebSocketGateway
 	DatabaseService         *DatabaseService
 	MongoDBService          *MongoDBService
@@ -49,6 +50,11 @@ type Config struct {
 	WriteTimeout time.Duration
 	Database     *DatabaseConfig
 	MongoDB      *MongoDBConfig
+	// ProblemDetails renders errors as application/problem+json when set
+	ProblemDetails *ProblemDetailsConfig
+	// Security configures CORS, security headers and CSRF protection;
+	// nil uses DefaultSecurityConfig for the environment
+	Security *SecurityConfig
 }
 
 // DefaultConfig returns default configuration
@@ -116,6 +122,12 @@ func (ab *ApplicationBuilder) Logger(logger *logrus.Logger) *ApplicationBuilder
 	return ab
 }
 
+// ExceptionHandler sets the global exception handler
+func (ab *ApplicationBuilder) ExceptionHandler(handler *GlobalExceptionHandler) *ApplicationBuilder {
+	ab.app.ExceptionHandler = handler
+	return ab
+}
+
 // Database sets the database service
 func (ab *ApplicationBuilder) Database(database *DatabaseService) *ApplicationBuilder {
 	ab.app.DatabaseService = database
@@ -157,10 +169,21 @@ func (app *Application) Initialize() error {
 	// Set up Echo
 	app.Echo.Logger.SetOutput(app.Logger.Writer())
 
+	// Route all errors and panics through the exception filters
+	app.setupExceptionHandler()
+
 	// Add default middleware
 	app.Echo.Use(middleware.Logger())
-	app.Echo.Use(middleware.Recover())
-	app.Echo.Use(middleware.CORS())
+	app.Echo.Use(RecoverMiddleware())
+
+	// Add security middleware
+	if app.Config.Security == nil {
+		app.Config.Security = DefaultSecurityConfig(app.Config.Environment)
+	}
+	if err := app.Config.Security.Validate(); err != nil {
+		return fmt.Errorf("invalid security config: %v", err)
+	}
+	app.Echo.Use(SecurityMiddleware(app.Config.Security)...)
 
 	// Initialize lifecycle manager if not set
 	if app.LifecycleManager == nil {
@@ -214,6 +237,21 @@ func (app *Application) Initialize() error {
 	return nil
 }
 
+// setupExceptionHandler installs the global exception handler as Echo's error handler
+func (app *Application) setupExceptionHandler() {
+	if app.ExceptionHandler == nil {
+		app.ExceptionHandler = NewGlobalExceptionHandler(app.Logger)
+	}
+	// A supplied handler keeps problem details it was configured with
+	if app.Config.ProblemDetails != nil && app.ExceptionHandler.ProblemDetailsConfig() == nil {
+		app.ExceptionHandler.UseProblemDetails(app.Config.ProblemDetails)
+	}
+
+	app.ExceptionHandler.setRegisteredFilters(app.ExceptionFilterRegistry.Sorted())
+
+	app.Echo.HTTPErrorHandler = app.ExceptionHandler.HTTPErrorHandler
+}
+
 // registerDefaultLifecycleHooks registers default lifecycle hooks
 func (app *Application) registerDefaultLifecycleHooks() {
 	// Register database lifecycle hook if database service exists
@@ -6,8 +6,10 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
+	"unicode"
 
 	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
@@ -35,6 +37,13 @@ type JWTConfig struct {
 	ParseTokenFilter        func(string, echo.Context) (string, error)
 	TokenExpiry             time.Duration
 	RefreshExpiry           time.Duration
+	TokenStore              TokenStore
+	// KeyManager signs tokens with rotating keys and a kid header. Its
+	// OverlapWindow must cover max(TokenExpiry, RefreshExpiry).
+	KeyManager *KeyManager
+	// KeyProvider verifies tokens by kid, e.g. against a RemoteJWKS.
+	// Defaults to KeyManager when not set.
+	KeyProvider KeyProvider
 }
 
 // DefaultJWTConfig returns default JWT configuration
@@ -47,6 +56,7 @@ func DefaultJWTConfig() *JWTConfig {
 		Claims:        jwt.MapClaims{},
 		TokenExpiry:   24 * time.Hour,
 		RefreshExpiry: 7 * 24 * time.Hour,
+		TokenStore:    NewMemoryTokenStore(),
 	}
 }
 
@@ -57,9 +67,33 @@ type JWTClaims struct {
 	Email    string                 `json:"email"`
 	Roles    []string               `json:"roles"`
 	Metadata map[string]interface{} `json:"metadata"`
+	// AMR lists the authentication methods used, e.g. pwd, otp, mfa
+	AMR []string `json:"amr,omitempty"`
+	MFA bool     `json:"mfa,omitempty"`
+	// MFAAt is when multi-factor authentication was completed
+	MFAAt *jwt.NumericDate `json:"mfa_at,omitempty"`
+	// FamilyID links an access token to the refresh token family it was
+	// issued with, so reuse detection can revoke it
+	FamilyID string `json:"fid,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// ToAuthUser converts the claims to an authenticated user
+func (jc *JWTClaims) ToAuthUser() *AuthUser {
+	user := &AuthUser{
+		ID:       jc.UserID,
+		Username: jc.Username,
+		Email:    jc.Email,
+		Roles:    jc.Roles,
+		Metadata: jc.Metadata,
+		AMR:      jc.AMR,
+	}
+	if jc.MFAAt != nil {
+		user.MFAAt = jc.MFAAt.Time
+	}
+	return user
+}
+
 // AuthUser represents an authenticated user
 type AuthUser struct {
 	ID       string                 `json:"id"`
@@ -67,6 +101,18 @@ type AuthUser struct {
 	Email    string                 `json:"email"`
 	Roles    []string               `json:"roles"`
 	Metadata map[string]interface{} `json:"metadata"`
+	AMR      []string               `json:"amr,omitempty"`
+	MFAAt    time.Time              `json:"mfa_at,omitzero"`
+}
+
+// HasMFA checks if the user completed multi-factor authentication
+func (au *AuthUser) HasMFA() bool {
+	for _, method := range au.AMR {
+		if method == AMRMFA {
+			return true
+		}
+	}
+	return false
 }
 
 // AuthService provides authentication functionality
@@ -81,14 +127,61 @@ func NewAuthService(config *JWTConfig, logger *logrus.Logger) *AuthService {
 		config = DefaultJWTConfig()
 	}
 
+	if config.TokenStore == nil {
+		config.TokenStore = NewMemoryTokenStore()
+	}
+	if store, ok := config.TokenStore.(*MemoryTokenStore); ok {
+		// User revocations must outlive the access tokens they invalidate
+		store.extendRetention(config.TokenExpiry)
+	}
+
+	if config.KeyManager != nil && logger != nil &&
+		(config.KeyManager.config.OverlapWindow < config.TokenExpiry ||
+			config.KeyManager.config.OverlapWindow < config.RefreshExpiry) {
+		logger.WithField("overlap_window", config.KeyManager.config.OverlapWindow).
+			Warn("Key overlap window is shorter than the token lifetime, tokens will fail verification after rotation")
+	}
+
 	return &AuthService{
 		config: config,
 		logger: logger,
 	}
 }
 
+// TokenPair holds an access token and its refresh token
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+}
+
 // GenerateToken generates a JWT token for a user
 func (as *AuthService) GenerateToken(user *AuthUser) (string, error) {
+	return as.generateAccessToken(user, "")
+}
+
+// GenerateTokenPair generates an access token and a refresh token starting
+// a new token family
+func (as *AuthService) GenerateTokenPair(ctx context.Context, user *AuthUser) (*TokenPair, error) {
+	familyID := generateTokenID()
+
+	accessToken, err := as.generateAccessToken(user, familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := as.issueRefreshToken(ctx, user, generateTokenID(), familyID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+	}, nil
+}
+
+// generateAccessToken signs an access token bound to a refresh token family
+func (as *AuthService) generateAccessToken(user *AuthUser, familyID string) (string, error) {
 	if as.config.TokenGenerator != nil {
 		return as.config.TokenGenerator(user)
 	}
@@ -99,7 +192,12 @@ func (as *AuthService) GenerateToken(user *AuthUser) (string, error) {
 		Email:    user.Email,
 		Roles:    user.Roles,
 		Metadata: user.Metadata,
+		AMR:      user.AMR,
+		MFA:      user.HasMFA(),
+		MFAAt:    mfaTimeClaim(user),
+		FamilyID: familyID,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        generateTokenID(),
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(as.config.TokenExpiry)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			NotBefore: jwt.NewNumericDate(time.Now()),
@@ -108,30 +206,89 @@ func (as *AuthService) GenerateToken(user *AuthUser) (string, error) {
 		},
 	}
 
-	token := jwt.NewWithClaims(as.config.SigningMethod, claims)
+	return as.signClaims(claims)
+}
 
-	if as.config.SecretKey != "" {
-		return token.SignedString([]byte(as.config.SecretKey))
-	} else if as.config.PrivateKey != nil {
-		return token.SignedString(as.config.PrivateKey)
+// mfaTimeClaim returns the MFA time claim of a user who completed MFA
+func mfaTimeClaim(user *AuthUser) *jwt.NumericDate {
+	if !user.HasMFA() || user.MFAAt.IsZero() {
+		return nil
 	}
+	return jwt.NewNumericDate(user.MFAAt)
+}
 
-	return "", errors.New("no signing key configured")
+// removeMethod returns the authentication methods without method
+func removeMethod(methods []string, method string) []string {
+	var result []string
+	for _, m := range methods {
+		if m != method {
+			result = append(result, m)
+		}
+	}
+	return result
 }
 
-// GenerateRefreshToken generates a refresh token
+// GenerateRefreshToken generates a refresh token starting a new token family
 func (as *AuthService) GenerateRefreshToken(user *AuthUser) (string, error) {
+	return as.issueRefreshToken(context.Background(), user, generateTokenID(), generateTokenID())
+}
+
+// issueRefreshToken signs a refresh token and records it in the token store
+func (as *AuthService) issueRefreshToken(ctx context.Context, user *AuthUser, id, familyID string) (string, error) {
+	now := time.Now()
+	expiresAt := now.Add(as.config.RefreshExpiry)
+
 	claims := &JWTClaims{
-		UserID: user.ID,
+		UserID:   user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+		Roles:    user.Roles,
+		Metadata: user.Metadata,
+		// Tokens issued by a refresh have to complete MFA again
+		AMR: removeMethod(user.AMR, AMRMFA),
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(as.config.RefreshExpiry)),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			NotBefore: jwt.NewNumericDate(time.Now()),
+			ID:        id,
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
 			Issuer:    "gonest-refresh",
 			Subject:   user.ID,
 		},
 	}
 
+	token, err := as.signClaims(claims)
+	if err != nil {
+		return "", err
+	}
+
+	record := &RefreshTokenRecord{
+		ID:        id,
+		FamilyID:  familyID,
+		UserID:    user.ID,
+		IssuedAt:  now,
+		ExpiresAt: expiresAt,
+	}
+	if err := as.config.TokenStore.SaveRefreshToken(ctx, record); err != nil {
+		return "", fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return token, nil
+}
+
+// signClaims signs claims with the configured key
+func (as *AuthService) signClaims(claims *JWTClaims) (string, error) {
+	if as.config.KeyManager != nil {
+		key := as.config.KeyManager.ActiveKey()
+		method := jwt.GetSigningMethod(key.Algorithm)
+		if method == nil {
+			return "", fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, key.Algorithm)
+		}
+
+		token := jwt.NewWithClaims(method, claims)
+		token.Header["kid"] = key.ID
+		return token.SignedString(key.PrivateKey)
+	}
+
 	token := jwt.NewWithClaims(as.config.SigningMethod, claims)
 
 	if as.config.SecretKey != "" {
@@ -143,8 +300,127 @@ func (as *AuthService) GenerateRefreshToken(user *AuthUser) (string, error) {
 	return "", errors.New("no signing key configured")
 }
 
+// validateRefreshToken validates a refresh token and loads its record
+func (as *AuthService) validateRefreshToken(ctx context.Context, tokenString string) (*JWTClaims, *RefreshTokenRecord, error) {
+	claims, err := as.ValidateTokenContext(ctx, tokenString)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if claims.RegisteredClaims.Issuer != "gonest-refresh" || claims.RegisteredClaims.ID == "" {
+		return nil, nil, errors.New("not a refresh token")
+	}
+
+	record, err := as.config.TokenStore.GetRefreshToken(ctx, claims.RegisteredClaims.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return claims, record, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new token pair.
+// The presented token is consumed; presenting it again revokes its whole
+// family, including the access tokens issued with it, since that means the
+// token was stolen or replayed.
+func (as *AuthService) RotateRefreshToken(ctx context.Context, refreshToken string) (*TokenPair, *AuthUser, error) {
+	claims, record, err := as.validateRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if record.Revoked {
+		return nil, nil, ErrTokenRevoked
+	}
+
+	nextID := generateTokenID()
+	if _, err := as.config.TokenStore.ConsumeRefreshToken(ctx, record.ID, nextID); err != nil {
+		if errors.Is(err, ErrRefreshTokenReused) {
+			if as.logger != nil {
+				as.logger.WithFields(logrus.Fields{
+					"user_id":   record.UserID,
+					"family_id": record.FamilyID,
+				}).Warn("Refresh token reuse detected, revoking token family")
+			}
+			if revokeErr := as.revokeFamily(ctx, record.FamilyID); revokeErr != nil {
+				return nil, nil, revokeErr
+			}
+		}
+		return nil, nil, err
+	}
+
+	user := claims.ToAuthUser()
+
+	accessToken, err := as.generateAccessToken(user, record.FamilyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nextRefreshToken, err := as.issueRefreshToken(ctx, user, nextID, record.FamilyID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: nextRefreshToken,
+	}, user, nil
+}
+
+// RevokeRefreshToken revokes the family of a refresh token
+func (as *AuthService) RevokeRefreshToken(ctx context.Context, refreshToken string) error {
+	_, record, err := as.validateRefreshToken(ctx, refreshToken)
+	if err != nil {
+		return err
+	}
+
+	return as.revokeFamily(ctx, record.FamilyID)
+}
+
+// revokeFamily revokes the refresh tokens of a family and denies the access
+// tokens issued with them. Access tokens outlive the family entry by at most
+// TokenExpiry, so the denylist entry expires after that.
+func (as *AuthService) revokeFamily(ctx context.Context, familyID string) error {
+	if err := as.config.TokenStore.RevokeFamily(ctx, familyID); err != nil {
+		return err
+	}
+
+	return as.config.TokenStore.DenyAccessToken(ctx, familyDenylistID(familyID), time.Now().Add(as.config.TokenExpiry))
+}
+
+// familyDenylistID returns the denylist entry of a token family
+func familyDenylistID(familyID string) string {
+	return "family:" + familyID
+}
+
+// RevokeAccessToken adds an access token to the denylist until it expires
+func (as *AuthService) RevokeAccessToken(ctx context.Context, accessToken string) error {
+	claims, err := as.ValidateAccessToken(ctx, accessToken)
+	if err != nil {
+		return err
+	}
+
+	if claims.RegisteredClaims.ID == "" || claims.RegisteredClaims.ExpiresAt == nil {
+		return errors.New("token cannot be revoked")
+	}
+
+	return as.config.TokenStore.DenyAccessToken(ctx, claims.RegisteredClaims.ID, claims.RegisteredClaims.ExpiresAt.Time)
+}
+
+// RevokeAllForUser revokes every refresh token of a user and every access
+// token issued to them up to now
+func (as *AuthService) RevokeAllForUser(ctx context.Context, userID string) error {
+	return as.config.TokenStore.RevokeUser(ctx, userID, time.Now())
+}
+
 // ValidateToken validates a JWT token
 func (as *AuthService) ValidateToken(tokenString string) (*JWTClaims, error) {
+	return as.ValidateTokenContext(context.Background(), tokenString)
+}
+
+// ValidateTokenContext validates a JWT token, resolving its key with the
+// request context so remote key fetches are cancelled with the request
+func (as *AuthService) ValidateTokenContext(ctx context.Context, tokenString string) (*JWTClaims, error) {
 	if as.config.ParseTokenFunc != nil {
 		claims, err := as.config.ParseTokenFunc(tokenString)
 		if err != nil {
@@ -157,6 +433,22 @@ func (as *AuthService) ValidateToken(tokenString string) (*JWTClaims, error) {
 	}
 
 	token, err := jwt.ParseWithClaims(tokenString, &JWTClaims{}, func(token *jwt.Token) (interface{}, error) {
+		if provider := as.keyProvider(); provider != nil {
+			kid, _ := token.Header["kid"].(string)
+			if kid == "" {
+				return nil, errors.New("token has no kid header")
+			}
+
+			publicKey, algorithm, err := provider.PublicKey(ctx, kid)
+			if err != nil {
+				return nil, err
+			}
+			if algorithm != "" && algorithm != token.Method.Alg() {
+				return nil, fmt.Errorf("token algorithm %s does not match key algorithm %s", token.Method.Alg(), algorithm)
+			}
+			return publicKey, nil
+		}
+
 		if as.config.SecretKey != "" {
 			return []byte(as.config.SecretKey), nil
 		} else if as.config.PublicKey != nil {
@@ -176,6 +468,77 @@ func (as *AuthService) ValidateToken(tokenString string) (*JWTClaims, error) {
 	return nil, errors.New("invalid token")
 }
 
+// keyProvider returns the provider used to resolve verification keys by kid
+func (as *AuthService) keyProvider() KeyProvider {
+	if as.config.KeyProvider != nil {
+		return as.config.KeyProvider
+	}
+	if as.config.KeyManager != nil {
+		return as.config.KeyManager
+	}
+	return nil
+}
+
+// ValidateAccessToken validates a JWT token and rejects refresh tokens
+func (as *AuthService) ValidateAccessToken(ctx context.Context, tokenString string) (*JWTClaims, error) {
+	claims, err := as.ValidateTokenContext(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	switch claims.RegisteredClaims.Issuer {
+	case "gonest-refresh":
+		return nil, errors.New("refresh token cannot be used for authentication")
+	case mfaChallengeIssuer:
+		return nil, errors.New("MFA challenge token cannot be used for authentication")
+	}
+
+	return claims, nil
+}
+
+// AuthenticateToken validates an access token and checks it against the
+// denylist and the user's revocation time
+func (as *AuthService) AuthenticateToken(ctx context.Context, tokenString string) (*JWTClaims, error) {
+	claims, err := as.ValidateAccessToken(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.RegisteredClaims.ID != "" {
+		denied, err := as.config.TokenStore.IsAccessTokenDenied(ctx, claims.RegisteredClaims.ID)
+		if err != nil {
+			return nil, err
+		}
+		if denied {
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	if claims.FamilyID != "" {
+		denied, err := as.config.TokenStore.IsAccessTokenDenied(ctx, familyDenylistID(claims.FamilyID))
+		if err != nil {
+			return nil, err
+		}
+		if denied {
+			return nil, ErrTokenRevoked
+		}
+	}
+
+	revokedAt, err := as.config.TokenStore.UserRevokedAt(ctx, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	// iat has second precision, so tokens issued within the second of the
+	// revocation are rejected as well
+	if !revokedAt.IsZero() && claims.RegisteredClaims.IssuedAt != nil &&
+		claims.RegisteredClaims.IssuedAt.Unix() <= revokedAt.Unix() {
+		return nil, ErrTokenRevoked
+	}
+
+	return claims, nil
+}
+
 // ExtractToken extracts token from request
 func (as *AuthService) ExtractToken(c echo.Context) (string, error) {
 	auth := c.Request().Header.Get("Authorization")
@@ -221,7 +584,7 @@ func (as *AuthService) JWTMiddleware() echo.MiddlewareFunc {
 				return echo.NewHTTPError(http.StatusUnauthorized, "missing or invalid token")
 			}
 
-			claims, err := as.ValidateToken(tokenString)
+			claims, err := as.AuthenticateToken(c.Request().Context(), tokenString)
 			if err != nil {
 				if as.config.ErrorHandler != nil {
 					return as.config.ErrorHandler(c, err)
@@ -229,15 +592,9 @@ func (as *AuthService) JWTMiddleware() echo.MiddlewareFunc {
 				return echo.NewHTTPError(http.StatusUnauthorized, "invalid token")
 			}
 
-			user := &AuthUser{
-				ID:       claims.UserID,
-				Username: claims.Username,
-				Email:    claims.Email,
-				Roles:    claims.Roles,
-				Metadata: claims.Metadata,
-			}
+			user := claims.ToAuthUser()
 
-			c.Set(as.config.ContextKey, user)
+			as.setUser(c, user)
 
 			if as.config.SuccessHandler != nil {
 				as.config.SuccessHandler(c)
@@ -248,6 +605,14 @@ func (as *AuthService) JWTMiddleware() echo.MiddlewareFunc {
 	}
 }
 
+// setUser stores the user under the configured context key and for GetCurrentUser
+func (as *AuthService) setUser(c echo.Context, user *AuthUser) {
+	SetCurrentUser(c, user)
+	if as.config.ContextKey != "" && as.config.ContextKey != "user" {
+		c.Set(as.config.ContextKey, user)
+	}
+}
+
 // RequireRoles middleware that requires specific roles
 func (as *AuthService) RequireRoles(roles ...string) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
@@ -287,21 +652,15 @@ func (as *AuthService) OptionalAuth() echo.MiddlewareFunc {
 				return next(c)
 			}
 
-			claims, err := as.ValidateToken(tokenString)
+			claims, err := as.AuthenticateToken(c.Request().Context(), tokenString)
 			if err != nil {
 				// Invalid token, continue without authentication
 				return next(c)
 			}
 
-			user := &AuthUser{
-				ID:       claims.UserID,
-				Username: claims.Username,
-				Email:    claims.Email,
-				Roles:    claims.Roles,
-				Metadata: claims.Metadata,
-			}
+			user := claims.ToAuthUser()
 
-			c.Set(as.config.ContextKey, user)
+			as.setUser(c, user)
 			return next(c)
 		}
 	}
@@ -316,16 +675,97 @@ func GetCurrentUser(c echo.Context) (*AuthUser, error) {
 	return user, nil
 }
 
-// AuthStrategy interface for different authentication strategies
+// SetCurrentUser stores the authenticated user in context for GetCurrentUser and RoleGuard.
+// The user is also added to the request context for UserFromContext.
+func SetCurrentUser(c echo.Context, user *AuthUser) {
+	c.Set("user", user)
+	c.Set("user_roles", user.Roles)
+	c.SetRequest(c.Request().WithContext(context.WithValue(c.Request().Context(), userContextKey{}, user)))
+}
+
+// userContextKey is the request context key of the authenticated user
+type userContextKey struct{}
+
+// UserFromContext returns the authenticated user of a request context
+func UserFromContext(ctx context.Context) (*AuthUser, bool) {
+	user, ok := ctx.Value(userContextKey{}).(*AuthUser)
+	return user, ok
+}
+
+// clientIPContextKey is the request context key of the client IP
+type clientIPContextKey struct{}
+
+// WithClientIP returns a context carrying the client IP of a request
+func WithClientIP(ctx context.Context, ip string) context.Context {
+	return context.WithValue(ctx, clientIPContextKey{}, ip)
+}
+
+// clientIPFromContext returns the client IP of a context, or an empty string
+func clientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPContextKey{}).(string)
+	return ip
+}
+
+// ErrNoCredentials is returned by strategies when the request carries no credentials they understand
+var ErrNoCredentials = errors.New("no credentials provided")
+
+// AuthStrategy interface for different authentication strategies.
+// Strategies used by AuthGuard receive the echo.Context as credentials and
+// return ErrNoCredentials when the request has nothing for them to check.
 type AuthStrategy interface {
 	Authenticate(ctx context.Context, credentials interface{}) (*AuthUser, error)
 	GetName() string
 }
 
+// JWTStrategy authenticates bearer tokens issued by an AuthService
+type JWTStrategy struct {
+	authService *AuthService
+}
+
+// NewJWTStrategy creates a new JWT strategy
+func NewJWTStrategy(authService *AuthService) *JWTStrategy {
+	return &JWTStrategy{authService: authService}
+}
+
+// Authenticate validates a token string or the token carried by an echo.Context
+func (js *JWTStrategy) Authenticate(ctx context.Context, credentials interface{}) (*AuthUser, error) {
+	var tokenString string
+
+	switch creds := credentials.(type) {
+	case echo.Context:
+		token, err := js.authService.ExtractToken(creds)
+		if err != nil {
+			return nil, ErrNoCredentials
+		}
+		tokenString = token
+	case string:
+		tokenString = creds
+	default:
+		return nil, errors.New("invalid credentials format")
+	}
+
+	if tokenString == "" {
+		return nil, ErrNoCredentials
+	}
+
+	claims, err := js.authService.AuthenticateToken(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims.ToAuthUser(), nil
+}
+
+// GetName returns strategy name
+func (js *JWTStrategy) GetName() string {
+	return "jwt"
+}
+
 // LocalStrategy implements username/password authentication
 type LocalStrategy struct {
-	validator func(username, password string) (*AuthUser, error)
-	name      string
+	validator        func(username, password string) (*AuthUser, error)
+	contextValidator func(ctx context.Context, username, password string) (*AuthUser, error)
+	name             string
 }
 
 // NewLocalStrategy creates a new local strategy
@@ -336,6 +776,15 @@ func NewLocalStrategy(validator func(username, password string) (*AuthUser, erro
 	}
 }
 
+// NewLocalStrategyWithContext creates a local strategy whose validator
+// receives the request context, e.g. PasswordService.LocalValidator
+func NewLocalStrategyWithContext(validator func(ctx context.Context, username, password string) (*AuthUser, error)) *LocalStrategy {
+	return &LocalStrategy{
+		contextValidator: validator,
+		name:             "local",
+	}
+}
+
 // Authenticate authenticates using username and password
 func (ls *LocalStrategy) Authenticate(ctx context.Context, credentials interface{}) (*AuthUser, error) {
 	creds, ok := credentials.(map[string]string)
@@ -353,6 +802,9 @@ func (ls *LocalStrategy) Authenticate(ctx context.Context, credentials interface
 		return nil, errors.New("password required")
 	}
 
+	if ls.contextValidator != nil {
+		return ls.contextValidator(ctx, username, password)
+	}
 	return ls.validator(username, password)
 }
 
@@ -381,6 +833,12 @@ func (ps *PassportService) Use(strategy AuthStrategy) {
 	ps.logger.Infof("Registered auth strategy: %s", strategy.GetName())
 }
 
+// Get retrieves a registered strategy by name
+func (ps *PassportService) Get(name string) (AuthStrategy, bool) {
+	strategy, exists := ps.strategies[name]
+	return strategy, exists
+}
+
 // Authenticate authenticates using a specific strategy
 func (ps *PassportService) Authenticate(ctx context.Context, strategyName string, credentials interface{}) (*AuthUser, error) {
 	strategy, exists := ps.strategies[strategyName]
@@ -395,6 +853,8 @@ func (ps *PassportService) Authenticate(ctx context.Context, strategyName string
 type AuthController struct {
 	authService     *AuthService
 	passportService *PassportService
+	mfaService      *MFAService
+	validator       *DTOValidator
 	logger          *logrus.Logger
 }
 
@@ -403,10 +863,17 @@ func NewAuthController(authService *AuthService, passportService *PassportServic
 	return &AuthController{
 		authService:     authService,
 		passportService: passportService,
+		validator:       NewDTOValidator(),
 		logger:          logger,
 	}
 }
 
+// WithMFA enables the two-step login for users with MFA enabled
+func (ac *AuthController) WithMFA(mfaService *MFAService) *AuthController {
+	ac.mfaService = mfaService
+	return ac
+}
+
 // LoginRequest represents a login request
 type LoginRequest struct {
 	Username string `json:"username" validate:"required"`
@@ -421,6 +888,7 @@ type LoginResponse struct {
 	TokenType    string    `json:"token_type"`
 	ExpiresIn    int64     `json:"expires_in"`
 	User         *AuthUser `json:"user"`
+	ReturnTo     string    `json:"return_to,omitempty"`
 }
 
 // Login handles user login
@@ -430,7 +898,7 @@ func (ac *AuthController) Login(c echo.Context) error {
 		return BadRequestException("Invalid request format")
 	}
 
-	if err := ValidateStruct(&req, nil); err != nil {
+	if err := ValidateStruct(&req, ac.validator); err != nil {
 		return BadRequestException(fmt.Sprintf("Validation failed: %v", err))
 	}
 
@@ -444,35 +912,148 @@ func (ac *AuthController) Login(c echo.Context) error {
 		"password": req.Password,
 	}
 
-	user, err := ac.passportService.Authenticate(c.Request().Context(), strategy, credentials)
+	ctx := WithClientIP(c.Request().Context(), c.RealIP())
+	user, err := ac.passportService.Authenticate(ctx, strategy, credentials)
 	if err != nil {
 		ac.logger.WithError(err).Warn("Authentication failed")
 		return UnauthorizedException("Invalid credentials")
 	}
 
-	accessToken, err := ac.authService.GenerateToken(user)
-	if err != nil {
-		ac.logger.WithError(err).Error("Failed to generate access token")
-		return InternalServerErrorException("Failed to generate token")
+	if strategy == "local" {
+		user.AMR = appendUnique(user.AMR, AMRPassword)
 	}
 
-	refreshToken, err := ac.authService.GenerateRefreshToken(user)
+	if ac.mfaService != nil && ac.mfaService.IsEnabled(c.Request().Context(), user.ID) {
+		challenge, err := ac.mfaService.IssueChallenge(user)
+		if err != nil {
+			ac.logger.WithError(err).Error("Failed to issue MFA challenge")
+			return InternalServerErrorException("Failed to start multi-factor authentication")
+		}
+
+		return c.JSON(http.StatusOK, &MFAChallengeResponse{
+			MFARequired:    true,
+			ChallengeToken: challenge,
+			ExpiresIn:      int64(ac.mfaService.config.ChallengeExpiry.Seconds()),
+		})
+	}
+
+	return ac.issueTokens(c, user, "")
+}
+
+// issueTokens responds with a new access and refresh token for the user
+func (ac *AuthController) issueTokens(c echo.Context, user *AuthUser, returnTo string) error {
+	pair, err := ac.authService.GenerateTokenPair(c.Request().Context(), user)
 	if err != nil {
-		ac.logger.WithError(err).Error("Failed to generate refresh token")
-		return InternalServerErrorException("Failed to generate refresh token")
+		ac.logger.WithError(err).Error("Failed to generate tokens")
+		return InternalServerErrorException("Failed to generate token")
 	}
 
 	response := &LoginResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
+		AccessToken:  pair.AccessToken,
+		RefreshToken: pair.RefreshToken,
 		TokenType:    "Bearer",
 		ExpiresIn:    int64(ac.authService.config.TokenExpiry.Seconds()),
 		User:         user,
+		ReturnTo:     returnTo,
 	}
 
 	return c.JSON(http.StatusOK, response)
 }
 
+// MFAChallengeResponse is returned by Login when a second factor is required
+type MFAChallengeResponse struct {
+	MFARequired    bool   `json:"mfa_required"`
+	ChallengeToken string `json:"challenge_token"`
+	ExpiresIn      int64  `json:"expires_in"`
+}
+
+// VerifyMFARequest completes a login with a TOTP or recovery code
+type VerifyMFARequest struct {
+	ChallengeToken string `json:"challenge_token" validate:"required"`
+	Code           string `json:"code" validate:"required"`
+}
+
+// VerifyMFA completes the second login step and issues tokens
+func (ac *AuthController) VerifyMFA(c echo.Context) error {
+	if ac.mfaService == nil {
+		return NotFoundException("Multi-factor authentication is not enabled")
+	}
+
+	var req VerifyMFARequest
+	if err := c.Bind(&req); err != nil {
+		return BadRequestException("Invalid request format")
+	}
+
+	if err := ValidateStruct(&req, ac.validator); err != nil {
+		return BadRequestException(fmt.Sprintf("Validation failed: %v", err))
+	}
+
+	user, err := ac.mfaService.CompleteChallenge(c.Request().Context(), req.ChallengeToken, req.Code)
+	if err != nil {
+		ac.logger.WithError(err).Warn("MFA verification failed")
+		if errors.Is(err, ErrMFATooManyAttempts) {
+			return NewHTTPException(http.StatusTooManyRequests, "Too many failed verification attempts")
+		}
+		return UnauthorizedException("Invalid verification code")
+	}
+
+	return ac.issueTokens(c, user, "")
+}
+
+// EnrollMFA starts TOTP enrollment for the current user
+func (ac *AuthController) EnrollMFA(c echo.Context) error {
+	if ac.mfaService == nil {
+		return NotFoundException("Multi-factor authentication is not enabled")
+	}
+
+	user, err := GetCurrentUser(c)
+	if err != nil {
+		return UnauthorizedException("User not authenticated")
+	}
+
+	enrollment, err := ac.mfaService.Enroll(c.Request().Context(), user)
+	if err != nil {
+		return ConflictException(err.Error())
+	}
+
+	return c.JSON(http.StatusOK, enrollment)
+}
+
+// ConfirmMFARequest confirms TOTP enrollment
+type ConfirmMFARequest struct {
+	Code string `json:"code" validate:"required"`
+}
+
+// ConfirmMFA enables MFA for the current user and returns recovery codes
+func (ac *AuthController) ConfirmMFA(c echo.Context) error {
+	if ac.mfaService == nil {
+		return NotFoundException("Multi-factor authentication is not enabled")
+	}
+
+	user, err := GetCurrentUser(c)
+	if err != nil {
+		return UnauthorizedException("User not authenticated")
+	}
+
+	var req ConfirmMFARequest
+	if err := c.Bind(&req); err != nil {
+		return BadRequestException("Invalid request format")
+	}
+
+	if err := ValidateStruct(&req, ac.validator); err != nil {
+		return BadRequestException(fmt.Sprintf("Validation failed: %v", err))
+	}
+
+	codes, err := ac.mfaService.ConfirmEnrollment(c.Request().Context(), user.ID, req.Code)
+	if err != nil {
+		return BadRequestException("Invalid verification code")
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"recovery_codes": codes,
+	})
+}
+
 // RefreshTokenRequest represents a refresh token request
 type RefreshTokenRequest struct {
 	RefreshToken string `json:"refresh_token" validate:"required"`
@@ -485,42 +1066,153 @@ func (ac *AuthController) RefreshToken(c echo.Context) error {
 		return BadRequestException("Invalid request format")
 	}
 
-	if err := ValidateStruct(&req, nil); err != nil {
+	if err := ValidateStruct(&req, ac.validator); err != nil {
 		return BadRequestException(fmt.Sprintf("Validation failed: %v", err))
 	}
 
-	claims, err := ac.authService.ValidateToken(req.RefreshToken)
+	tokens, user, err := ac.authService.RotateRefreshToken(c.Request().Context(), req.RefreshToken)
 	if err != nil {
+		ac.logger.WithError(err).Warn("Refresh token rejected")
 		return UnauthorizedException("Invalid refresh token")
 	}
 
-	// Verify it's a refresh token
-	if claims.RegisteredClaims.Issuer != "gonest-refresh" {
-		return UnauthorizedException("Invalid refresh token")
+	response := &LoginResponse{
+		AccessToken:  tokens.AccessToken,
+		RefreshToken: tokens.RefreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int64(ac.authService.config.TokenExpiry.Seconds()),
+		User:         user,
 	}
 
-	user := &AuthUser{
-		ID:       claims.UserID,
-		Username: claims.Username,
-		Email:    claims.Email,
-		Roles:    claims.Roles,
-		Metadata: claims.Metadata,
+	return c.JSON(http.StatusOK, response)
+}
+
+// LogoutRequest represents a logout request
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// Logout revokes the presented refresh token family and access token
+func (ac *AuthController) Logout(c echo.Context) error {
+	var req LogoutRequest
+	if err := c.Bind(&req); err != nil {
+		return BadRequestException("Invalid request format")
+	}
+
+	ctx := c.Request().Context()
+
+	if req.RefreshToken != "" {
+		if err := ac.authService.RevokeRefreshToken(ctx, req.RefreshToken); err != nil {
+			ac.logger.WithError(err).Warn("Failed to revoke refresh token")
+		}
 	}
 
-	accessToken, err := ac.authService.GenerateToken(user)
+	if accessToken, err := ac.authService.ExtractToken(c); err == nil {
+		if err := ac.authService.RevokeAccessToken(ctx, accessToken); err != nil {
+			ac.logger.WithError(err).Warn("Failed to revoke access token")
+		}
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// LogoutAll revokes every token of the current user on all devices
+func (ac *AuthController) LogoutAll(c echo.Context) error {
+	user, err := GetCurrentUser(c)
 	if err != nil {
-		ac.logger.WithError(err).Error("Failed to generate access token")
-		return InternalServerErrorException("Failed to generate token")
+		return UnauthorizedException("User not authenticated")
 	}
 
-	response := &LoginResponse{
-		AccessToken: accessToken,
-		TokenType:   "Bearer",
-		ExpiresIn:   int64(ac.authService.config.TokenExpiry.Seconds()),
-		User:        user,
+	if err := ac.authService.RevokeAllForUser(c.Request().Context(), user.ID); err != nil {
+		ac.logger.WithError(err).Error("Failed to revoke user tokens")
+		return InternalServerErrorException("Failed to revoke tokens")
 	}
 
-	return c.JSON(http.StatusOK, response)
+	return c.NoContent(http.StatusNoContent)
+}
+
+// RegisterOIDCRoutes registers the login and callback routes of the OIDC
+// strategies in the passport service on a group, e.g. /auth:
+// GET /oidc/:provider redirects to the provider and
+// GET /oidc/:provider/callback completes the login
+func (ac *AuthController) RegisterOIDCRoutes(group *echo.Group) {
+	group.GET("/oidc/:provider", ac.OIDCLogin)
+	group.GET("/oidc/:provider/callback", ac.OIDCCallback)
+}
+
+// oidcStrategy looks up the OIDC strategy named by the provider route parameter
+func (ac *AuthController) oidcStrategy(c echo.Context) (*OIDCStrategy, error) {
+	strategy, exists := ac.passportService.Get(c.Param("provider"))
+	if !exists {
+		return nil, NotFoundException("Unknown identity provider")
+	}
+
+	oidcStrategy, ok := strategy.(*OIDCStrategy)
+	if !ok {
+		return nil, NotFoundException("Unknown identity provider")
+	}
+	return oidcStrategy, nil
+}
+
+// localReturnPath returns path if it is a local absolute path, or an empty
+// string, to avoid open redirects. Browsers treat backslashes as slashes and
+// drop tabs and newlines, so "/\evil.com" would leave the site.
+func localReturnPath(path string) string {
+	if !strings.HasPrefix(path, "/") || strings.HasPrefix(path, "//") {
+		return ""
+	}
+	for _, r := range path {
+		if r == '\\' || unicode.IsControl(r) {
+			return ""
+		}
+	}
+
+	parsed, err := url.Parse(path)
+	if err != nil || parsed.Scheme != "" || parsed.Host != "" || parsed.User != nil {
+		return ""
+	}
+	return path
+}
+
+// OIDCLogin redirects the user to the identity provider
+func (ac *AuthController) OIDCLogin(c echo.Context) error {
+	strategy, err := ac.oidcStrategy(c)
+	if err != nil {
+		return err
+	}
+
+	authURL, err := strategy.AuthorizationURL(c.Request().Context(), localReturnPath(c.QueryParam("return_to")))
+	if err != nil {
+		ac.logger.WithError(err).Error("Failed to create authorization URL")
+		return InternalServerErrorException("Identity provider unavailable")
+	}
+
+	return c.Redirect(http.StatusFound, authURL)
+}
+
+// OIDCCallback completes the login with the identity provider and issues tokens
+func (ac *AuthController) OIDCCallback(c echo.Context) error {
+	strategy, err := ac.oidcStrategy(c)
+	if err != nil {
+		return err
+	}
+
+	user, state, err := strategy.HandleCallback(c.Request().Context(), c)
+	if err != nil {
+		ac.logger.WithError(err).Warn("OIDC authentication failed")
+		return UnauthorizedException("Authentication failed")
+	}
+
+	return ac.issueTokens(c, user, state.ReturnTo)
+}
+
+// JWKS serves the public keys of the auth service key manager on JWKSPath
+func (ac *AuthController) JWKS(c echo.Context) error {
+	if ac.authService.config.KeyManager == nil {
+		return NotFoundException("No signing keys are published")
+	}
+
+	return ac.authService.config.KeyManager.JWKSHandler()(c)
 }
 
 // GetProfile returns current user profile
@@ -0,0 +1,101 @@
+package gonest
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestRotateRefreshTokenKeepsClaims(t *testing.T) {
+	config := DefaultJWTConfig()
+	config.SecretKey = "test-secret-key-with-enough-length"
+	as := NewAuthService(config, nil)
+	ctx := context.Background()
+
+	user := &AuthUser{
+		ID:       "u1",
+		Username: "alice",
+		Email:    "alice@example.com",
+		Roles:    []string{"admin"},
+		Metadata: map[string]interface{}{"tenant_id": "acme"},
+	}
+	pair, err := as.GenerateTokenPair(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Claims must survive several rotations, not only the first
+	for i := 0; i < 2; i++ {
+		if pair, _, err = as.RotateRefreshToken(ctx, pair.RefreshToken); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	claims, err := as.ValidateToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != "u1" || claims.Username != "alice" || claims.Email != "alice@example.com" {
+		t.Fatalf("unexpected identity claims %+v", claims)
+	}
+	if len(claims.Roles) != 1 || claims.Roles[0] != "admin" {
+		t.Fatalf("unexpected roles %v", claims.Roles)
+	}
+	if claims.Metadata["tenant_id"] != "acme" {
+		t.Fatalf("expected the metadata to be kept, got %v", claims.Metadata)
+	}
+}
+
+func TestMFAGuardRequiresRecentMFA(t *testing.T) {
+	config := DefaultJWTConfig()
+	config.SecretKey = "test-secret-key-with-enough-length"
+	as := NewAuthService(config, nil)
+	ctx := context.Background()
+	guard := NewMFAGuard().WithMaxAge(time.Hour)
+
+	allowed := func(user *AuthUser) bool {
+		c := echo.New().NewContext(httptest.NewRequest("GET", "/", nil), httptest.NewRecorder())
+		SetCurrentUser(c, user)
+		ok, _ := guard.CanActivate(c)
+		return ok
+	}
+
+	user := &AuthUser{ID: "u1", AMR: []string{AMRPassword, AMROTP, AMRMFA}, MFAAt: time.Now()}
+	pair, err := as.GenerateTokenPair(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := as.ValidateToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowed(claims.ToAuthUser()) {
+		t.Fatal("expected a token issued right after MFA to pass the guard")
+	}
+
+	stale := claims.ToAuthUser()
+	stale.MFAAt = time.Now().Add(-2 * time.Hour)
+	if allowed(stale) {
+		t.Fatal("expected MFA older than the max age to be rejected")
+	}
+
+	// Refreshed tokens have to complete MFA again
+	pair, _, err = as.RotateRefreshToken(ctx, pair.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err = as.ValidateToken(pair.AccessToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.MFA || claims.ToAuthUser().HasMFA() {
+		t.Fatalf("expected mfa to be dropped from rotated tokens, got %v", claims.AMR)
+	}
+	if allowed(claims.ToAuthUser()) {
+		t.Fatal("expected a rotated token to fail the guard")
+	}
+}
@@ -2,18 +2,29 @@ package gonest
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/maphash"
+	"math"
+	"math/rand/v2"
 	"net/http"
-	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
 
+// ErrCacheMiss is returned by providers when a key is missing or expired
+var ErrCacheMiss = errors.New("key not found")
+
 // CacheProvider interface for different cache implementations
 type CacheProvider interface {
 	Get(ctx context.Context, key string) ([]byte, error)
@@ -37,150 +48,381 @@ func (ci *CacheItem) IsExpired() bool {
 	return !ci.ExpiresAt.IsZero() && time.Now().After(ci.ExpiresAt)
 }
 
-// MemoryCache implements in-memory caching
+// ErrCacheValueTooLarge is returned when a value exceeds the byte limit of a cache shard
+var ErrCacheValueTooLarge = errors.New("value exceeds cache capacity")
+
+// MemoryCacheConfig configures a MemoryCache
+type MemoryCacheConfig struct {
+	// MaxEntries limits the number of entries; 0 means unlimited
+	MaxEntries int
+	// MaxBytes limits the size of keys and values; 0 means unlimited
+	MaxBytes int64
+	Policy   EvictionPolicy
+	// Shards splits the cache to reduce lock contention; limits are divided
+	// evenly between shards
+	Shards          int
+	CleanupInterval time.Duration
+}
+
+// Smallest per-shard limits before a MemoryCache uses fewer shards
+const (
+	minShardEntries = 64
+	minShardBytes   = 1 << 20
+)
+
+// DefaultMemoryCacheConfig returns default memory cache configuration
+func DefaultMemoryCacheConfig() *MemoryCacheConfig {
+	return &MemoryCacheConfig{
+		Policy:          EvictionLRU,
+		Shards:          16,
+		CleanupInterval: time.Minute,
+	}
+}
+
+// CacheStats holds cache statistics
+type CacheStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+	Entries     int    `json:"entries"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// HitRatio returns the share of lookups that were hits
+func (cs CacheStats) HitRatio() float64 {
+	total := cs.Hits + cs.Misses
+	if total == 0 {
+		return 0
+	}
+	return float64(cs.Hits) / float64(total)
+}
+
+// memoryCacheShard is a locked partition of a MemoryCache
+type memoryCacheShard struct {
+	entries    map[string]*cacheEntry
+	queue      evictionQueue
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+	mutex      sync.Mutex
+}
+
+// MemoryCache implements in-memory caching with bounded size and eviction
 type MemoryCache struct {
-	items  map[string]*CacheItem
-	mutex  sync.RWMutex
-	logger *logrus.Logger
+	config      *MemoryCacheConfig
+	shards      []*memoryCacheShard
+	seed        maphash.Seed
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   atomic.Uint64
+	expirations atomic.Uint64
+	done        chan struct{}
+	closeOnce   sync.Once
+	logger      *logrus.Logger
 }
 
-// NewMemoryCache creates a new memory cache
+// NewMemoryCache creates a new memory cache with the default configuration
 func NewMemoryCache(logger *logrus.Logger) *MemoryCache {
+	return NewMemoryCacheWithConfig(DefaultMemoryCacheConfig(), logger)
+}
+
+// NewMemoryCacheWithConfig creates a new memory cache
+func NewMemoryCacheWithConfig(config *MemoryCacheConfig, logger *logrus.Logger) *MemoryCache {
+	if config == nil {
+		config = DefaultMemoryCacheConfig()
+	}
+	copied := *config
+	config = &copied
+
+	if config.Shards <= 0 {
+		config.Shards = 16
+	}
+	// Small caches use fewer shards so per-shard limits stay meaningful
+	for config.Shards > 1 &&
+		((config.MaxEntries > 0 && config.MaxEntries/config.Shards < minShardEntries) ||
+			(config.MaxBytes > 0 && config.MaxBytes/int64(config.Shards) < minShardBytes)) {
+		config.Shards /= 2
+	}
+	if config.Policy == "" {
+		config.Policy = EvictionLRU
+	}
+	if config.CleanupInterval <= 0 {
+		config.CleanupInterval = time.Minute
+	}
+
 	mc := &MemoryCache{
-		items:  make(map[string]*CacheItem),
+		config: config,
+		shards: make([]*memoryCacheShard, config.Shards),
+		seed:   maphash.MakeSeed(),
+		done:   make(chan struct{}),
 		logger: logger,
 	}
 
+	maxEntries := ceilDiv(int64(config.MaxEntries), int64(config.Shards))
+	maxBytes := ceilDiv(config.MaxBytes, int64(config.Shards))
+	for i := range mc.shards {
+		mc.shards[i] = &memoryCacheShard{
+			entries:    make(map[string]*cacheEntry),
+			queue:      newEvictionQueue(config.Policy, int(maxEntries)),
+			maxEntries: int(maxEntries),
+			maxBytes:   maxBytes,
+		}
+	}
+
 	// Start cleanup goroutine
 	go mc.cleanup()
 
 	return mc
 }
 
-// Get retrieves a value from cache
-func (mc *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
-	mc.mutex.RLock()
-	defer mc.mutex.RUnlock()
+// ceilDiv divides rounding up
+func ceilDiv(a, b int64) int64 {
+	return (a + b - 1) / b
+}
+
+// shard returns the shard of a key
+func (mc *MemoryCache) shard(key string) *memoryCacheShard {
+	return mc.shards[maphash.String(mc.seed, key)%uint64(len(mc.shards))]
+}
 
-	item, exists := mc.items[key]
+// lookup returns a live entry, removing it if expired. The shard mutex must be held.
+func (mc *MemoryCache) lookup(shard *memoryCacheShard, key string) *cacheEntry {
+	entry, exists := shard.entries[key]
 	if !exists {
-		return nil, errors.New("key not found")
+		return nil
 	}
+	if entry.item.IsExpired() {
+		shard.removeEntry(entry)
+		mc.expirations.Add(1)
+		return nil
+	}
+	return entry
+}
 
-	if item.IsExpired() {
-		go mc.Delete(context.Background(), key) // Async cleanup
-		return nil, errors.New("key expired")
+// removeEntry removes an entry. The shard mutex must be held.
+func (s *memoryCacheShard) removeEntry(entry *cacheEntry) {
+	s.queue.remove(entry)
+	delete(s.entries, entry.key)
+	s.bytes -= entry.size
+}
+
+// Get retrieves a value from cache
+func (mc *MemoryCache) Get(ctx context.Context, key string) ([]byte, error) {
+	shard := mc.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	entry := mc.lookup(shard, key)
+	if entry == nil {
+		mc.misses.Add(1)
+		return nil, ErrCacheMiss
 	}
 
-	return item.Value, nil
+	shard.queue.access(entry)
+	mc.hits.Add(1)
+	return entry.item.Value, nil
 }
 
-// Set stores a value in cache
+// Set stores a value in cache, evicting entries to stay within limits
 func (mc *MemoryCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
-	mc.mutex.Lock()
-	defer mc.mutex.Unlock()
+	shard := mc.shard(key)
+	size := int64(len(key) + len(value))
+	if shard.maxBytes > 0 && size > shard.maxBytes {
+		return ErrCacheValueTooLarge
+	}
 
-	item := &CacheItem{
+	now := time.Now()
+	item := CacheItem{
 		Value:     value,
-		CreatedAt: time.Now(),
+		CreatedAt: now,
 	}
-
 	if expiration > 0 {
-		item.ExpiresAt = time.Now().Add(expiration)
+		item.ExpiresAt = now.Add(expiration)
+	}
+
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if entry, exists := shard.entries[key]; exists {
+		shard.bytes += size - entry.size
+		entry.item = item
+		entry.size = size
+		shard.queue.access(entry)
+	} else {
+		entry = &cacheEntry{key: key, item: item, size: size}
+		shard.entries[key] = entry
+		shard.bytes += size
+		shard.queue.add(entry)
 	}
 
-	mc.items[key] = item
+	for shard.overCapacity() {
+		victim := shard.queue.victim()
+		if victim == nil {
+			break
+		}
+		shard.removeEntry(victim)
+		mc.evictions.Add(1)
+	}
 	return nil
 }
 
+// overCapacity checks if the shard exceeds its limits. The shard mutex must be held.
+func (s *memoryCacheShard) overCapacity() bool {
+	return (s.maxEntries > 0 && len(s.entries) > s.maxEntries) ||
+		(s.maxBytes > 0 && s.bytes > s.maxBytes)
+}
+
 // Delete removes a value from cache
 func (mc *MemoryCache) Delete(ctx context.Context, key string) error {
-	mc.mutex.Lock()
-	defer mc.mutex.Unlock()
+	shard := mc.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
 
-	delete(mc.items, key)
+	if entry, exists := shard.entries[key]; exists {
+		shard.removeEntry(entry)
+	}
 	return nil
 }
 
 // Clear removes all items from cache
 func (mc *MemoryCache) Clear(ctx context.Context) error {
-	mc.mutex.Lock()
-	defer mc.mutex.Unlock()
-
-	mc.items = make(map[string]*CacheItem)
+	for _, shard := range mc.shards {
+		shard.mutex.Lock()
+		shard.entries = make(map[string]*cacheEntry)
+		shard.queue.reset()
+		shard.bytes = 0
+		shard.mutex.Unlock()
+	}
 	return nil
 }
 
 // Exists checks if a key exists in cache
 func (mc *MemoryCache) Exists(ctx context.Context, key string) (bool, error) {
-	mc.mutex.RLock()
-	defer mc.mutex.RUnlock()
+	shard := mc.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
 
-	item, exists := mc.items[key]
-	if !exists {
-		return false, nil
-	}
-
-	if item.IsExpired() {
-		go mc.Delete(context.Background(), key) // Async cleanup
-		return false, nil
-	}
-
-	return true, nil
+	return mc.lookup(shard, key) != nil, nil
 }
 
 // TTL returns the time-to-live for a key
 func (mc *MemoryCache) TTL(ctx context.Context, key string) (time.Duration, error) {
-	mc.mutex.RLock()
-	defer mc.mutex.RUnlock()
+	shard := mc.shard(key)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
 
-	item, exists := mc.items[key]
-	if !exists {
-		return 0, errors.New("key not found")
+	entry := mc.lookup(shard, key)
+	if entry == nil {
+		return 0, ErrCacheMiss
 	}
 
-	if item.ExpiresAt.IsZero() {
+	if entry.item.ExpiresAt.IsZero() {
 		return -1, nil // No expiration
 	}
 
-	if item.IsExpired() {
-		return 0, nil
-	}
-
-	return time.Until(item.ExpiresAt), nil
+	return time.Until(entry.item.ExpiresAt), nil
 }
 
-// Keys returns all keys matching a pattern
+// Keys returns all keys matching a glob pattern
 func (mc *MemoryCache) Keys(ctx context.Context, pattern string) ([]string, error) {
-	mc.mutex.RLock()
-	defer mc.mutex.RUnlock()
-
 	var keys []string
-	for key := range mc.items {
-		// Simple pattern matching (for now, just return all keys if pattern is "*")
-		if pattern == "*" || key == pattern {
-			if item := mc.items[key]; !item.IsExpired() {
+	for _, shard := range mc.shards {
+		shard.mutex.Lock()
+		for key, entry := range shard.entries {
+			if matchGlob(pattern, key) && !entry.item.IsExpired() {
 				keys = append(keys, key)
 			}
 		}
+		shard.mutex.Unlock()
 	}
 
 	return keys, nil
 }
 
-// cleanup removes expired items periodically
+// Stats returns cache statistics
+func (mc *MemoryCache) Stats() CacheStats {
+	stats := CacheStats{
+		Hits:        mc.hits.Load(),
+		Misses:      mc.misses.Load(),
+		Evictions:   mc.evictions.Load(),
+		Expirations: mc.expirations.Load(),
+	}
+
+	for _, shard := range mc.shards {
+		shard.mutex.Lock()
+		stats.Entries += len(shard.entries)
+		stats.Bytes += shard.bytes
+		shard.mutex.Unlock()
+	}
+	return stats
+}
+
+// Close stops the cleanup goroutine
+func (mc *MemoryCache) Close() error {
+	mc.closeOnce.Do(func() {
+		close(mc.done)
+	})
+	return nil
+}
+
+// matchGlob matches a key against a Redis-style glob pattern supporting
+// '*', '?' and backslash escapes
+func matchGlob(pattern, key string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if pattern == "" {
+				return true
+			}
+			for i := 0; i <= len(key); i++ {
+				if matchGlob(pattern, key[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if key == "" {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if key == "" || pattern[0] != key[0] {
+				return false
+			}
+			pattern, key = pattern[1:], key[1:]
+		}
+	}
+	return key == ""
+}
+
+// cleanup removes expired items periodically, one shard at a time
 func (mc *MemoryCache) cleanup() {
-	ticker := time.NewTicker(5 * time.Minute)
+	ticker := time.NewTicker(mc.config.CleanupInterval)
 	defer ticker.Stop()
 
-	for range ticker.C {
-		mc.mutex.Lock()
-		for key, item := range mc.items {
-			if item.IsExpired() {
-				delete(mc.items, key)
+	for {
+		select {
+		case <-mc.done:
+			return
+		case <-ticker.C:
+			for _, shard := range mc.shards {
+				shard.mutex.Lock()
+				for _, entry := range shard.entries {
+					if entry.item.IsExpired() {
+						shard.removeEntry(entry)
+						mc.expirations.Add(1)
+					}
+				}
+				shard.mutex.Unlock()
 			}
 		}
-		mc.mutex.Unlock()
 	}
 }
 
@@ -189,6 +431,13 @@ type CacheService struct {
 	provider  CacheProvider
 	logger    *logrus.Logger
 	keyPrefix string
+	calls     *cacheCalls
+}
+
+// cacheCalls tracks the fetches in flight, shared by copies of a CacheService
+type cacheCalls struct {
+	calls map[string]*cacheCall
+	mutex sync.Mutex
 }
 
 // NewCacheService creates a new cache service
@@ -197,6 +446,7 @@ func NewCacheService(provider CacheProvider, logger *logrus.Logger) *CacheServic
 		provider:  provider,
 		logger:    logger,
 		keyPrefix: "gonest:",
+		calls:     &cacheCalls{calls: make(map[string]*cacheCall)},
 	}
 }
 
@@ -205,61 +455,407 @@ func (cs *CacheService) SetKeyPrefix(prefix string) {
 	cs.keyPrefix = prefix
 }
 
-// generateKey generates a cache key with prefix
-func (cs *CacheService) generateKey(key string) string {
-	return cs.keyPrefix + key
+// generateKey generates a cache key with prefix, scoped to the context's tenant
+func (cs *CacheService) generateKey(ctx context.Context, key string) string {
+	return cs.keyPrefix + tenantKey(ctx, key)
 }
 
 // Get retrieves and unmarshals a value from cache
 func (cs *CacheService) Get(ctx context.Context, key string, dest interface{}) error {
-	data, err := cs.provider.Get(ctx, cs.generateKey(key))
+	data, err := cs.provider.Get(ctx, cs.generateKey(ctx, key))
+	if err != nil {
+		return err
+	}
+
+	envelope, err := decodeEnvelope(data)
 	if err != nil {
 		return err
 	}
+	if envelope == nil {
+		return json.Unmarshal(data, dest)
+	}
+
+	if !cs.versionsValid(ctx, envelope.Versions) {
+		return ErrCacheMiss
+	}
+	if envelope.Error != "" {
+		return envelope.cachedError()
+	}
+	if !envelope.ExpiresAt.IsZero() && time.Now().After(envelope.ExpiresAt) {
+		return ErrCacheMiss // Only GetOrSet serves stale values
+	}
+	return json.Unmarshal(envelope.Value, dest)
+}
+
+// Set marshals and stores a value in cache. Tags allow evicting it with
+// InvalidateTags; values depending on the key are invalidated.
+func (cs *CacheService) Set(ctx context.Context, key string, value interface{}, expiration time.Duration, tags ...string) error {
+	return cs.Put(ctx, key, value, &GetOrSetOptions{Expiration: expiration, Tags: tags})
+}
+
+// GetOrSetOptions configures GetOrSetWithOptions and Put
+type GetOrSetOptions struct {
+	Expiration time.Duration
+	// StaleTTL keeps values this long past expiration; stale values are
+	// served while a background refresh runs
+	StaleTTL time.Duration
+	// EarlyExpirationBeta enables probabilistic early refresh before
+	// expiration, weighted by the fetch duration; 1 is a typical value
+	EarlyExpirationBeta float64
+	// ErrorTTL caches fetch errors for this long
+	ErrorTTL time.Duration
+	// RefreshTimeout bounds background refreshes
+	RefreshTimeout time.Duration
+	// Tags are stored with the value; InvalidateTags evicts it
+	Tags []string
+	// Dependencies are keys whose change, through Set, Delete or a fetch,
+	// invalidates the value
+	Dependencies []string
+	// Unless prevents caching of fetched values for which it returns true
+	Unless func(value interface{}) bool
+}
+
+// envelope reports whether values are stored with metadata
+func (o *GetOrSetOptions) envelope() bool {
+	return o.StaleTTL > 0 || o.EarlyExpirationBeta > 0 || o.ErrorTTL > 0 || len(o.Tags) > 0 || len(o.Dependencies) > 0
+}
+
+// CachedError is returned by GetOrSet while a fetch error without an HTTP
+// status is negatively cached. Errors with a status, HTTPException or
+// echo.HTTPError, are returned as an HTTPException with the same status.
+type CachedError struct {
+	Message string
+}
+
+func (e *CachedError) Error() string {
+	return e.Message
+}
+
+// cacheEnvelopeMarker prefixes values stored with metadata; JSON never starts with it
+const cacheEnvelopeMarker = 0x1e
+
+// cacheEnvelope is the stored form of a value with metadata
+type cacheEnvelope struct {
+	Value json.RawMessage `json:"v,omitempty"`
+	Error string          `json:"e,omitempty"`
+	// Status and Code are the HTTP status and error code of a cached error
+	Status    int       `json:"s,omitempty"`
+	Code      string    `json:"c,omitempty"`
+	ExpiresAt time.Time `json:"x,omitempty"`
+	// Delta is how long the fetch took
+	Delta time.Duration `json:"d,omitempty"`
+	// Versions maps the version key of each tag and dependency to its
+	// version when the value was stored
+	Versions map[string]string `json:"t,omitempty"`
+}
+
+// errorEnvelope records a fetch error with its HTTP status, if any
+func errorEnvelope(err error, versions map[string]string) *cacheEnvelope {
+	envelope := &cacheEnvelope{Error: err.Error(), Versions: versions}
+
+	var httpException *HTTPException
+	var httpError *echo.HTTPError
+	switch {
+	case errors.As(err, &httpException):
+		envelope.Error = httpException.Message
+		envelope.Status = httpException.Status
+		envelope.Code = httpException.Code
+	case errors.As(err, &httpError):
+		envelope.Error = fmt.Sprint(httpError.Message)
+		envelope.Status = httpError.Code
+	}
+	return envelope
+}
+
+// cachedError rebuilds the error of an envelope
+func (e *cacheEnvelope) cachedError() error {
+	if e.Status != 0 {
+		return NewHTTPException(e.Status, e.Error).WithCode(e.Code)
+	}
+	return &CachedError{Message: e.Error}
+}
+
+// decodeEnvelope decodes stored data, returning nil for values stored without metadata
+func decodeEnvelope(data []byte) (*cacheEnvelope, error) {
+	if len(data) == 0 || data[0] != cacheEnvelopeMarker {
+		return nil, nil
+	}
+
+	var envelope cacheEnvelope
+	if err := json.Unmarshal(data[1:], &envelope); err != nil {
+		return nil, err
+	}
+	return &envelope, nil
+}
+
+// legacyCacheEnvelope is the unmarked envelope format written before
+// dependencies; Tags maps each tag to its version
+type legacyCacheEnvelope struct {
+	Value     json.RawMessage   `json:"v,omitempty"`
+	Error     string            `json:"e,omitempty"`
+	ExpiresAt time.Time         `json:"x,omitempty"`
+	Delta     time.Duration     `json:"d,omitempty"`
+	Tags      map[string]string `json:"t,omitempty"`
+}
+
+// decodeLegacyEnvelope decodes data in the legacy envelope format, returning
+// nil unless it is an object with only envelope fields and a value or error
+func (cs *CacheService) decodeLegacyEnvelope(ctx context.Context, data []byte) *cacheEnvelope {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(data, &fields) != nil {
+		return nil
+	}
+	if _, hasValue := fields["v"]; !hasValue {
+		if _, hasError := fields["e"]; !hasError {
+			return nil
+		}
+	}
+	for field := range fields {
+		switch field {
+		case "v", "e", "x", "d", "t":
+		default:
+			return nil
+		}
+	}
+
+	var legacy legacyCacheEnvelope
+	if json.Unmarshal(data, &legacy) != nil {
+		return nil
+	}
+
+	envelope := &cacheEnvelope{
+		Value:     legacy.Value,
+		Error:     legacy.Error,
+		ExpiresAt: legacy.ExpiresAt,
+		Delta:     legacy.Delta,
+	}
+	if len(legacy.Tags) > 0 {
+		envelope.Versions = make(map[string]string, len(legacy.Tags))
+		for tag, version := range legacy.Tags {
+			envelope.Versions[cs.tagKey(ctx, tag)] = version
+		}
+	}
+	return envelope
+}
+
+// cacheCall is an in-flight fetch shared by concurrent callers of a key
+type cacheCall struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
 
-	return json.Unmarshal(data, dest)
+// GetOrSet retrieves a value or fetches and stores it if not found.
+// Concurrent misses of a key share a single fetch.
+func (cs *CacheService) GetOrSet(ctx context.Context, key string, dest interface{}, fetch func(ctx context.Context) (interface{}, error), expiration time.Duration) error {
+	return cs.GetOrSetWithOptions(ctx, key, dest, fetch, &GetOrSetOptions{Expiration: expiration})
 }
 
-// Set marshals and stores a value in cache
-func (cs *CacheService) Set(ctx context.Context, key string, value interface{}, expiration time.Duration) error {
+// GetOrSetWithOptions retrieves a value or fetches and stores it if not found,
+// with optional stale-while-revalidate, early expiration and error caching
+func (cs *CacheService) GetOrSetWithOptions(ctx context.Context, key string, dest interface{}, fetch func(ctx context.Context) (interface{}, error), options *GetOrSetOptions) error {
+	fullKey := cs.generateKey(ctx, key)
+
+	if data, err := cs.provider.Get(ctx, fullKey); err == nil {
+		envelope, err := decodeEnvelope(data)
+		if err == nil && envelope == nil && options.envelope() {
+			envelope = cs.decodeLegacyEnvelope(ctx, data)
+		}
+		switch {
+		case err != nil:
+		case envelope == nil:
+			if json.Unmarshal(data, dest) == nil {
+				return nil // Cache hit
+			}
+		case cs.versionsValid(ctx, envelope.Versions):
+			if envelope.Error != "" {
+				return envelope.cachedError()
+			}
+
+			fresh := envelope.ExpiresAt.IsZero() || time.Now().Before(envelope.ExpiresAt)
+			if fresh || options.StaleTTL > 0 {
+				if !fresh || shouldRefreshEarly(envelope, options.EarlyExpirationBeta) {
+					cs.refresh(ctx, fullKey, fetch, options)
+				}
+				if json.Unmarshal(envelope.Value, dest) == nil {
+					return nil
+				}
+			}
+		}
+	}
+
+	// Cache miss, fetch once for all concurrent callers
+	for {
+		data, shared, err := cs.load(ctx, fullKey, fetch, options, true)
+		if err != nil {
+			// The leading caller was cancelled; retry while our own context is alive
+			if shared && ctx.Err() == nil && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+				continue
+			}
+			return err
+		}
+		return json.Unmarshal(data, dest)
+	}
+}
+
+// shouldRefreshEarly decides whether to refresh a fresh value before it
+// expires, with a probability rising as expiration nears (XFetch)
+func shouldRefreshEarly(envelope *cacheEnvelope, beta float64) bool {
+	if beta <= 0 || envelope.ExpiresAt.IsZero() {
+		return false
+	}
+
+	threshold := float64(envelope.Delta) * beta * -math.Log(rand.Float64())
+	return threshold >= float64(time.Until(envelope.ExpiresAt))
+}
+
+// refresh fetches a key in the background unless a fetch is already in flight
+func (cs *CacheService) refresh(ctx context.Context, fullKey string, fetch func(ctx context.Context) (interface{}, error), options *GetOrSetOptions) {
+	cs.calls.mutex.Lock()
+	_, inFlight := cs.calls.calls[fullKey]
+	cs.calls.mutex.Unlock()
+	if inFlight {
+		return
+	}
+
+	timeout := options.RefreshTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+		defer cancel()
+
+		if _, _, err := cs.load(ctx, fullKey, fetch, options, false); err != nil {
+			cs.logger.WithError(err).WithField("key", fullKey).Warn("Background cache refresh failed")
+		}
+	}()
+}
+
+// load runs a fetch for a key, joining the fetch already in flight if any.
+// shared reports whether the result came from another caller's fetch.
+func (cs *CacheService) load(ctx context.Context, fullKey string, fetch func(ctx context.Context) (interface{}, error), options *GetOrSetOptions, cacheErrors bool) ([]byte, bool, error) {
+	cs.calls.mutex.Lock()
+	if call, exists := cs.calls.calls[fullKey]; exists {
+		cs.calls.mutex.Unlock()
+		select {
+		case <-call.done:
+			return call.data, true, call.err
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+	}
+
+	call := &cacheCall{
+		done: make(chan struct{}),
+		err:  errors.New("cache fetch panicked"),
+	}
+	cs.calls.calls[fullKey] = call
+	cs.calls.mutex.Unlock()
+
+	defer func() {
+		cs.calls.mutex.Lock()
+		delete(cs.calls.calls, fullKey)
+		cs.calls.mutex.Unlock()
+		close(call.done)
+	}()
+
+	call.data, call.err = cs.fetchAndStore(ctx, fullKey, fetch, options, cacheErrors)
+	return call.data, false, call.err
+}
+
+// fetchAndStore calls the fetch function and caches its result
+func (cs *CacheService) fetchAndStore(ctx context.Context, fullKey string, fetch func(ctx context.Context) (interface{}, error), options *GetOrSetOptions, cacheErrors bool) ([]byte, error) {
+	// Versions are read before fetching so that an invalidation during the
+	// fetch leaves the stored value invalid
+	versions, err := cs.versions(ctx, cs.versionKeys(ctx, options), true)
+	storable := err == nil
+	if err != nil {
+		cs.logger.WithError(err).Warn("Failed to read cache tag versions")
+	}
+
+	start := time.Now()
+	value, err := fetch(ctx)
+	delta := time.Since(start)
+
+	if err != nil {
+		if storable && cacheErrors && options.ErrorTTL > 0 && !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded) {
+			if storeErr := cs.store(ctx, fullKey, errorEnvelope(err, versions), options.ErrorTTL); storeErr != nil {
+				cs.logger.WithError(storeErr).Warn("Failed to cache error")
+			}
+		}
+		return nil, err
+	}
+
 	data, err := json.Marshal(value)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return cs.provider.Set(ctx, cs.generateKey(key), data, expiration)
+	if storable && (options.Unless == nil || !options.Unless(value)) {
+		if err := cs.storeValue(ctx, fullKey, data, delta, versions, options); err != nil {
+			cs.logger.WithError(err).Warn("Failed to cache value")
+		}
+	}
+	return data, nil
 }
 
-// GetOrSet retrieves a value or sets it if not found
-func (cs *CacheService) GetOrSet(ctx context.Context, key string, dest interface{}, provider func() (interface{}, error), expiration time.Duration) error {
-	err := cs.Get(ctx, key, dest)
-	if err == nil {
-		return nil // Cache hit
+// storeValue stores marshaled data in the format selected by the options
+// and invalidates values depending on the key
+func (cs *CacheService) storeValue(ctx context.Context, fullKey string, data []byte, delta time.Duration, versions map[string]string, options *GetOrSetOptions) error {
+	var err error
+	if options.envelope() {
+		envelope := &cacheEnvelope{Value: data, Delta: delta, Versions: versions}
+		expiration := options.Expiration
+		if expiration > 0 {
+			envelope.ExpiresAt = time.Now().Add(expiration)
+			expiration += options.StaleTTL
+		}
+		err = cs.store(ctx, fullKey, envelope, expiration)
+	} else {
+		err = cs.provider.Set(ctx, fullKey, data, options.Expiration)
+	}
+	if err != nil {
+		return err
 	}
 
-	// Cache miss, get from provider
-	value, err := provider()
+	return cs.touch(ctx, fullKey)
+}
+
+// store writes an envelope to the provider
+func (cs *CacheService) store(ctx context.Context, fullKey string, envelope *cacheEnvelope, expiration time.Duration) error {
+	data, err := json.Marshal(envelope)
 	if err != nil {
 		return err
 	}
 
-	// Store in cache
-	if err := cs.Set(ctx, key, value, expiration); err != nil {
-		cs.logger.WithError(err).Warn("Failed to cache value")
+	return cs.provider.Set(ctx, fullKey, append([]byte{cacheEnvelopeMarker}, data...), expiration)
+}
+
+// Put stores a value in the format GetOrSetWithOptions reads with the same options
+func (cs *CacheService) Put(ctx context.Context, key string, value interface{}, options *GetOrSetOptions) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
 	}
 
-	// Set the destination value
-	valueBytes, err := json.Marshal(value)
+	versions, err := cs.versions(ctx, cs.versionKeys(ctx, options), true)
 	if err != nil {
 		return err
 	}
 
-	return json.Unmarshal(valueBytes, dest)
+	return cs.storeValue(ctx, cs.generateKey(ctx, key), data, 0, versions, options)
 }
 
-// Delete removes a value from cache
+// Delete removes a value from cache and invalidates values depending on it
 func (cs *CacheService) Delete(ctx context.Context, key string) error {
-	return cs.provider.Delete(ctx, cs.generateKey(key))
+	fullKey := cs.generateKey(ctx, key)
+	if err := cs.provider.Delete(ctx, fullKey); err != nil {
+		return err
+	}
+
+	return cs.touch(ctx, fullKey)
 }
 
 // Clear removes all cached values
@@ -269,7 +865,7 @@ func (cs *CacheService) Clear(ctx context.Context) error {
 
 // Exists checks if a key exists in cache
 func (cs *CacheService) Exists(ctx context.Context, key string) (bool, error) {
-	return cs.provider.Exists(ctx, cs.generateKey(key))
+	return cs.provider.Exists(ctx, cs.generateKey(ctx, key))
 }
 
 // Cache decorator configuration
@@ -278,6 +874,13 @@ type CacheConfig struct {
 	TTL        time.Duration
 	Condition  func(echo.Context) bool
 	KeyBuilder func(echo.Context) string
+	// Tags returns the tags of a response, evaluated after the handler ran
+	Tags func(echo.Context) []string
+	// WeakETag generates weak instead of strong ETags
+	WeakETag bool
+	// AllowAuthenticated caches responses to authenticated requests. The key
+	// must then distinguish users, e.g. through KeyBuilder or Vary.
+	AllowAuthenticated bool
 }
 
 // CacheInterceptor provides caching functionality for HTTP requests
@@ -294,7 +897,10 @@ func NewCacheInterceptor(cacheService *CacheService, logger *logrus.Logger) *Cac
 	}
 }
 
-// Middleware returns cache middleware
+// Middleware returns cache middleware following HTTP caching rules: responses
+// get an ETag, conditional requests are answered with 304, Cache-Control of
+// requests and responses is honored and the request headers named by Vary
+// are part of the cache key
 func (ci *CacheInterceptor) Middleware(config *CacheConfig) echo.MiddlewareFunc {
 	if config == nil {
 		config = &CacheConfig{
@@ -310,124 +916,312 @@ func (ci *CacheInterceptor) Middleware(config *CacheConfig) echo.MiddlewareFunc
 			}
 
 			// Only cache GET requests
-			if c.Request().Method != "GET" {
+			req := c.Request()
+			if req.Method != http.MethodGet {
 				return next(c)
 			}
 
-			// Generate cache key
-			var cacheKey string
-			if config.KeyBuilder != nil {
-				cacheKey = config.KeyBuilder(c)
-			} else if config.Key != "" {
-				cacheKey = config.Key
-			} else {
-				cacheKey = fmt.Sprintf("http:%s:%s", c.Request().Method, c.Request().URL.Path)
-				if c.Request().URL.RawQuery != "" {
-					cacheKey += "?" + c.Request().URL.RawQuery
-				}
+			requestDirectives := parseCacheControl(req.Header.Get(echo.HeaderCacheControl))
+			if _, noStore := requestDirectives["no-store"]; noStore {
+				return next(c)
+			}
+			if !config.AllowAuthenticated && isAuthenticatedRequest(c) {
+				return next(c)
 			}
 
-			// Try to get from cache
-			var cachedResponse CachedResponse
-			err := ci.cacheService.Get(c.Request().Context(), cacheKey, &cachedResponse)
-			if err == nil {
-				// Cache hit
-				// Cache hit for key: %s
-				c.Response().Header().Set("X-Cache", "HIT")
-
-				// Set headers
-				for key, value := range cachedResponse.Headers {
-					c.Response().Header().Set(key, value)
+			// Generate cache key, including the headers the response varies on
+			ctx := req.Context()
+			baseKey := cacheRequestKey(c, config)
+			var vary []string
+			varyIndexed := ci.cacheService.Get(ctx, baseKey+":vary", &vary) == nil
+
+			// Try to get from cache unless the client asks for revalidation
+			_, noCache := requestDirectives["no-cache"]
+			if !noCache && req.Header.Get("Pragma") != "no-cache" {
+				var cachedResponse CachedResponse
+				err := ci.cacheService.Get(ctx, cacheVariantKey(baseKey, vary, req.Header), &cachedResponse)
+				if err == nil && cachedResponse.acceptable(requestDirectives) {
+					return serveCachedResponse(c, &cachedResponse)
 				}
-
-				return c.Blob(http.StatusOK, cachedResponse.ContentType, cachedResponse.Body)
 			}
 
-			// Cache miss, execute handler and cache response
-			// Cache miss for key: %s
+			// Cache miss, buffer the response to tag and store it
 			c.Response().Header().Set("X-Cache", "MISS")
 
-			// Create a custom response writer to capture the response
+			res := c.Response()
+			writer := res.Writer
 			rec := &ResponseRecorder{
-				ResponseWriter: c.Response().Writer,
-				statusCode:     200,
-				headers:        make(map[string]string),
+				ResponseWriter: writer,
+				statusCode:     http.StatusOK,
 			}
-			c.Response().Writer = rec
-
-			// Execute the handler
-			err = next(c)
-			if err != nil {
+			res.Writer = rec
+
+			err := next(c)
+			res.Writer = writer
+			if err != nil || !rec.written {
+				if rec.written {
+					writer.WriteHeader(rec.statusCode)
+					writer.Write(rec.body)
+				}
 				return err
 			}
 
-			// Cache the response if successful
-			if rec.statusCode >= 200 && rec.statusCode < 300 {
-				cachedResponse := CachedResponse{
-					StatusCode:  rec.statusCode,
-					ContentType: rec.headers["Content-Type"],
-					Headers:     rec.headers,
-					Body:        rec.body,
-					CachedAt:    time.Now(),
-				}
+			header := res.Header()
+			if rec.statusCode == http.StatusOK && header.Get("ETag") == "" {
+				header.Set("ETag", computeETag(rec.body, config.WeakETag))
+			}
 
-				if cacheErr := ci.cacheService.Set(c.Request().Context(), cacheKey, cachedResponse, config.TTL); cacheErr != nil {
-					ci.logger.WithError(cacheErr).Warn("Failed to cache response")
-				} else {
-					// Cached response for key: %s
-				}
+			if ttl, ok := responseCacheTTL(c, config, rec.statusCode); ok {
+				ci.storeResponse(c, config, baseKey, varyIndexed, rec, ttl)
 			}
 
-			return nil
+			if rec.statusCode == http.StatusOK && etagMatches(req.Header.Get("If-None-Match"), header.Get("ETag")) {
+				res.Status = http.StatusNotModified
+				res.Size = 0
+				writer.WriteHeader(http.StatusNotModified)
+				return nil
+			}
+
+			writer.WriteHeader(rec.statusCode)
+			_, err = writer.Write(rec.body)
+			return err
+		}
+	}
+}
+
+// storeResponse stores a buffered response under the variant key of its Vary headers
+func (ci *CacheInterceptor) storeResponse(c echo.Context, config *CacheConfig, baseKey string, varyIndexed bool, rec *ResponseRecorder, ttl time.Duration) {
+	ctx := c.Request().Context()
+	header := c.Response().Header()
+
+	vary := parseVary(header.Values(echo.HeaderVary))
+	if len(vary) > 0 {
+		if err := ci.cacheService.Set(ctx, baseKey+":vary", vary, ttl); err != nil {
+			ci.logger.WithError(err).Warn("Failed to cache response")
+			return
+		}
+	} else if varyIndexed {
+		ci.cacheService.Delete(ctx, baseKey+":vary")
+	}
+
+	headers := header.Clone()
+	for _, name := range []string{"X-Cache", "Age", echo.HeaderContentLength} {
+		headers.Del(name)
+	}
+
+	cachedResponse := CachedResponse{
+		StatusCode:  rec.statusCode,
+		ContentType: header.Get(echo.HeaderContentType),
+		Headers:     headers,
+		Body:        rec.body,
+		CachedAt:    time.Now(),
+	}
+
+	var tags []string
+	if config.Tags != nil {
+		tags = config.Tags(c)
+	}
+
+	if err := ci.cacheService.Set(ctx, cacheVariantKey(baseKey, vary, c.Request().Header), cachedResponse, ttl, tags...); err != nil {
+		ci.logger.WithError(err).Warn("Failed to cache response")
+	}
+}
+
+// serveCachedResponse writes a cached response, or 304 if the client's copy is current
+func serveCachedResponse(c echo.Context, cachedResponse *CachedResponse) error {
+	header := c.Response().Header()
+	for name, values := range cachedResponse.Headers {
+		header[name] = values
+	}
+	header.Set("X-Cache", "HIT")
+	header.Set("Age", strconv.Itoa(int(time.Since(cachedResponse.CachedAt).Seconds())))
+
+	if etagMatches(c.Request().Header.Get("If-None-Match"), header.Get("ETag")) {
+		return c.NoContent(http.StatusNotModified)
+	}
+	return c.Blob(cachedResponse.StatusCode, cachedResponse.ContentType, cachedResponse.Body)
+}
+
+// cacheRequestKey returns the cache key of a request before Vary is applied
+func cacheRequestKey(c echo.Context, config *CacheConfig) string {
+	if config.KeyBuilder != nil {
+		return config.KeyBuilder(c)
+	}
+	if config.Key != "" {
+		return config.Key
+	}
+
+	cacheKey := fmt.Sprintf("http:%s:%s", c.Request().Method, c.Request().URL.Path)
+	if c.Request().URL.RawQuery != "" {
+		cacheKey += "?" + c.Request().URL.RawQuery
+	}
+	return cacheKey
+}
+
+// cacheVariantKey appends a hash of the varying request headers to a key
+func cacheVariantKey(baseKey string, vary []string, header http.Header) string {
+	if len(vary) == 0 {
+		return baseKey
+	}
+
+	hash := sha256.New()
+	for _, name := range vary {
+		hash.Write([]byte(name + ":" + strings.Join(header.Values(name), ",") + "\n"))
+	}
+	return baseKey + "#" + hex.EncodeToString(hash.Sum(nil)[:8])
+}
+
+// responseCacheTTL decides whether a response may be stored and for how long
+func responseCacheTTL(c echo.Context, config *CacheConfig, statusCode int) (time.Duration, bool) {
+	if statusCode < 200 || statusCode >= 300 || statusCode == http.StatusPartialContent {
+		return 0, false
+	}
+
+	header := c.Response().Header()
+	if header.Get(echo.HeaderSetCookie) != "" {
+		return 0, false
+	}
+	for _, name := range parseVary(header.Values(echo.HeaderVary)) {
+		if name == "*" {
+			return 0, false
+		}
+	}
+
+	directives := parseCacheControl(strings.Join(header.Values(echo.HeaderCacheControl), ","))
+	for _, directive := range []string{"no-store", "no-cache", "private"} {
+		if _, exists := directives[directive]; exists {
+			return 0, false
+		}
+	}
+
+	// Shared caches may store authenticated responses marked public
+	_, public := directives["public"]
+	_, sharedMaxAge := directives["s-maxage"]
+	if !config.AllowAuthenticated && !public && !sharedMaxAge && isAuthenticatedRequest(c) {
+		return 0, false
+	}
+
+	for _, directive := range []string{"s-maxage", "max-age"} {
+		if value, exists := directives[directive]; exists {
+			seconds, err := strconv.Atoi(value)
+			if err != nil || seconds <= 0 {
+				return 0, false
+			}
+			return time.Duration(seconds) * time.Second, true
+		}
+	}
+	return config.TTL, true
+}
+
+// isAuthenticatedRequest reports whether a request carries credentials or an authenticated user
+func isAuthenticatedRequest(c echo.Context) bool {
+	if c.Request().Header.Get(echo.HeaderAuthorization) != "" {
+		return true
+	}
+	_, err := GetCurrentUser(c)
+	return err == nil
+}
+
+// parseCacheControl parses Cache-Control directives into lowercase names and unquoted values
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		name, argument, _ := strings.Cut(part, "=")
+		directives[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(argument), `"`)
+	}
+	return directives
+}
+
+// parseVary returns the sorted canonical header names of Vary values
+func parseVary(values []string) []string {
+	var names []string
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = appendUnique(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// computeETag returns an ETag derived from a response body
+func computeETag(body []byte, weak bool) string {
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	if weak {
+		return "W/" + etag
+	}
+	return etag
+}
+
+// etagMatches compares an ETag with If-None-Match using weak comparison
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" || etag == "" {
+		return false
+	}
+
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
 		}
 	}
+	return false
 }
 
 // CachedResponse represents a cached HTTP response
 type CachedResponse struct {
-	StatusCode  int               `json:"status_code"`
-	ContentType string            `json:"content_type"`
-	Headers     map[string]string `json:"headers"`
-	Body        []byte            `json:"body"`
-	CachedAt    time.Time         `json:"cached_at"`
+	StatusCode  int         `json:"status_code"`
+	ContentType string      `json:"content_type"`
+	Headers     http.Header `json:"headers"`
+	Body        []byte      `json:"body"`
+	CachedAt    time.Time   `json:"cached_at"`
+}
+
+// acceptable checks a cached response against the request's max-age
+func (cr *CachedResponse) acceptable(requestDirectives map[string]string) bool {
+	value, exists := requestDirectives["max-age"]
+	if !exists {
+		return true
+	}
+
+	maxAge, err := strconv.Atoi(value)
+	return err == nil && time.Since(cr.CachedAt) <= time.Duration(maxAge)*time.Second
 }
 
-// ResponseRecorder captures HTTP response data
+// ResponseRecorder buffers the status and body of a response; headers are
+// written to the underlying response directly
 type ResponseRecorder struct {
-	ResponseWriter interface{}
+	ResponseWriter http.ResponseWriter
 	statusCode     int
-	headers        map[string]string
 	body           []byte
+	written        bool
 }
 
 // Write captures response body
 func (rr *ResponseRecorder) Write(data []byte) (int, error) {
+	rr.written = true
 	rr.body = append(rr.body, data...)
-	if writer, ok := rr.ResponseWriter.(interface{ Write([]byte) (int, error) }); ok {
-		return writer.Write(data)
-	}
 	return len(data), nil
 }
 
-// Header captures response headers
+// Header returns the headers of the underlying response
 func (rr *ResponseRecorder) Header() http.Header {
-	if writer, ok := rr.ResponseWriter.(interface{ Header() http.Header }); ok {
-		return writer.Header()
-	}
-	return make(http.Header)
+	return rr.ResponseWriter.Header()
 }
 
-// WriteHeader captures status code and headers
+// WriteHeader captures status code
 func (rr *ResponseRecorder) WriteHeader(statusCode int) {
+	rr.written = true
 	rr.statusCode = statusCode
-
-	// Capture headers
-	header := rr.Header()
-	rr.headers["Content-Type"] = header.Get("Content-Type")
-
-	if writer, ok := rr.ResponseWriter.(interface{ WriteHeader(int) }); ok {
-		writer.WriteHeader(statusCode)
-	}
 }
 
 // CacheManager provides cache management utilities
@@ -482,72 +1276,144 @@ func (cm *CacheManager) ClearAll(ctx context.Context) error {
 	return nil
 }
 
-// Cacheable decorator function
-func Cacheable(key string, ttl time.Duration) func(interface{}) interface{} {
-	return func(fn interface{}) interface{} {
-		fnValue := reflect.ValueOf(fn)
-		fnType := fnValue.Type()
+// CachedOptions configures the typed cache wrappers
+type CachedOptions[K any, V any] struct {
+	TTL time.Duration
+	// StaleTTL and ErrorTTL behave as in GetOrSetOptions
+	StaleTTL time.Duration
+	ErrorTTL time.Duration
+	// Condition decides from the argument whether the cache is used at all
+	Condition func(arg K) bool
+	// Unless prevents caching of a result
+	Unless func(arg K, result V) bool
+	// Tags returns the tags stored with the result for an argument
+	Tags func(arg K) []string
+}
 
-		if fnType.Kind() != reflect.Func {
-			panic("Cacheable can only be applied to functions")
+// getOrSetOptions converts the options for an argument
+func (o *CachedOptions[K, V]) getOrSetOptions(arg K) *GetOrSetOptions {
+	options := &GetOrSetOptions{
+		Expiration: o.TTL,
+		StaleTTL:   o.StaleTTL,
+		ErrorTTL:   o.ErrorTTL,
+	}
+	if o.Tags != nil {
+		options.Tags = o.Tags(arg)
+	}
+	if o.Unless != nil {
+		options.Unless = func(value interface{}) bool {
+			// A nil interface result does not assert to V
+			result, _ := value.(V)
+			return o.Unless(arg, result)
 		}
-
-		return reflect.MakeFunc(fnType, func(args []reflect.Value) []reflect.Value {
-			// This is a simplified implementation
-			// In a real implementation, you would:
-			// 1. Generate cache key from function name and args
-			// 2. Check cache for existing result
-			// 3. If miss, call original function and cache result
-			// 4. Return cached or computed result
-
-			// For now, just call the original function
-			return fnValue.Call(args)
-		}).Interface()
 	}
+	return options
 }
 
-// CacheEvict decorator for cache invalidation
-func CacheEvict(key string, allEntries bool) func(interface{}) interface{} {
-	return func(fn interface{}) interface{} {
-		fnValue := reflect.ValueOf(fn)
-		fnType := fnValue.Type()
+// Cached wraps a function so its results are cached under the key derived from its argument
+func Cached[K any, V any](svc *CacheService, keyFn func(arg K) string, ttl time.Duration, fn func(ctx context.Context, arg K) (V, error)) func(ctx context.Context, arg K) (V, error) {
+	return CachedWithOptions(svc, keyFn, fn, &CachedOptions[K, V]{TTL: ttl})
+}
 
-		if fnType.Kind() != reflect.Func {
-			panic("CacheEvict can only be applied to functions")
+// CachedWithOptions wraps a function like Cached with conditions, tags and stale serving
+func CachedWithOptions[K any, V any](svc *CacheService, keyFn func(arg K) string, fn func(ctx context.Context, arg K) (V, error), options *CachedOptions[K, V]) func(ctx context.Context, arg K) (V, error) {
+	return func(ctx context.Context, arg K) (V, error) {
+		if options.Condition != nil && !options.Condition(arg) {
+			return fn(ctx, arg)
 		}
 
-		return reflect.MakeFunc(fnType, func(args []reflect.Value) []reflect.Value {
-			// Execute the original function
-			results := fnValue.Call(args)
+		var result V
+		err := svc.GetOrSetWithOptions(ctx, keyFn(arg), &result, func(ctx context.Context) (interface{}, error) {
+			value, err := fn(ctx, arg)
+			if err != nil {
+				return nil, err
+			}
+			return value, nil
+		}, options.getOrSetOptions(arg))
+		return result, err
+	}
+}
+
+// CachePut wraps a function so it always runs and its result replaces the cached value
+func CachePut[K any, V any](svc *CacheService, keyFn func(arg K) string, ttl time.Duration, fn func(ctx context.Context, arg K) (V, error)) func(ctx context.Context, arg K) (V, error) {
+	return CachePutWithOptions(svc, keyFn, fn, &CachedOptions[K, V]{TTL: ttl})
+}
 
-			// After execution, evict cache entries
-			// This would require access to the cache service
-			// Implementation would go here
+// CachePutWithOptions wraps a function like CachePut, storing results in the
+// format read by CachedWithOptions with the same options
+func CachePutWithOptions[K any, V any](svc *CacheService, keyFn func(arg K) string, fn func(ctx context.Context, arg K) (V, error), options *CachedOptions[K, V]) func(ctx context.Context, arg K) (V, error) {
+	return func(ctx context.Context, arg K) (V, error) {
+		result, err := fn(ctx, arg)
+		if err != nil {
+			return result, err
+		}
+		if options.Condition != nil && !options.Condition(arg) {
+			return result, nil
+		}
+		if options.Unless != nil && options.Unless(arg, result) {
+			return result, nil
+		}
 
-			return results
-		}).Interface()
+		if err := svc.Put(ctx, keyFn(arg), result, options.getOrSetOptions(arg)); err != nil {
+			svc.logger.WithError(err).Warn("Failed to cache value")
+		}
+		return result, nil
 	}
 }
 
-// CachePut decorator for updating cache
-func CachePut(key string, condition func(interface{}) bool) func(interface{}) interface{} {
-	return func(fn interface{}) interface{} {
-		fnValue := reflect.ValueOf(fn)
-		fnType := fnValue.Type()
+// CacheEvictOptions configures CacheEvict
+type CacheEvictOptions[K any] struct {
+	// Keys returns the keys to delete for an argument
+	Keys func(arg K) []string
+	// Tags returns the tags to invalidate for an argument
+	Tags func(arg K) []string
+	// AllEntries clears the whole cache
+	AllEntries bool
+	// BeforeInvocation evicts before calling the function, even if it fails
+	BeforeInvocation bool
+	// Condition decides from the argument whether to evict
+	Condition func(arg K) bool
+}
 
-		if fnType.Kind() != reflect.Func {
-			panic("CachePut can only be applied to functions")
+// CacheEvict wraps a function so cache entries are evicted when it succeeds
+func CacheEvict[K any, V any](svc *CacheService, options *CacheEvictOptions[K], fn func(ctx context.Context, arg K) (V, error)) func(ctx context.Context, arg K) (V, error) {
+	evict := func(ctx context.Context, arg K) {
+		if options.Condition != nil && !options.Condition(arg) {
+			return
 		}
 
-		return reflect.MakeFunc(fnType, func(args []reflect.Value) []reflect.Value {
-			// Execute the original function
-			results := fnValue.Call(args)
+		var err error
+		if options.AllEntries {
+			err = svc.Clear(ctx)
+		} else {
+			if options.Keys != nil {
+				for _, key := range options.Keys(arg) {
+					if deleteErr := svc.Delete(ctx, key); deleteErr != nil && err == nil {
+						err = deleteErr
+					}
+				}
+			}
+			if options.Tags != nil {
+				if tagErr := svc.InvalidateTags(ctx, options.Tags(arg)...); tagErr != nil && err == nil {
+					err = tagErr
+				}
+			}
+		}
+		if err != nil {
+			svc.logger.WithError(err).Warn("Failed to evict cache entries")
+		}
+	}
 
-			// After execution, update cache with result
-			// This would require access to the cache service
-			// Implementation would go here
+	return func(ctx context.Context, arg K) (V, error) {
+		if options.BeforeInvocation {
+			evict(ctx, arg)
+			return fn(ctx, arg)
+		}
 
-			return results
-		}).Interface()
+		result, err := fn(ctx, arg)
+		if err == nil {
+			evict(ctx, arg)
+		}
+		return result, err
 	}
 }
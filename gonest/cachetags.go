@@ -0,0 +1,127 @@
+package gonest
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+// Cache tags and dependencies are tracked with version keys stored in the
+// provider itself, so invalidation works with any provider and needs no key
+// scan. A tagged value records the version of each of its tags when stored
+// and is treated as missing once any of them changed. Invalidating a tag
+// deletes its version key; the next tagged write creates a new version.
+
+// multiGetter is implemented by providers reading several keys in one round trip
+type multiGetter interface {
+	GetMulti(ctx context.Context, keys []string) (map[string][]byte, error)
+}
+
+// tagKey returns the version key of a tag
+func (cs *CacheService) tagKey(ctx context.Context, tag string) string {
+	return cs.generateKey(ctx, "_tag:"+tag)
+}
+
+// dependencyKey returns the version key tracking changes of a full cache key
+func (cs *CacheService) dependencyKey(fullKey string) string {
+	return cs.keyPrefix + "_dep:" + strings.TrimPrefix(fullKey, cs.keyPrefix)
+}
+
+// versionKeys returns the version keys of the tags and dependencies of the options
+func (cs *CacheService) versionKeys(ctx context.Context, options *GetOrSetOptions) []string {
+	keys := make([]string, 0, len(options.Tags)+len(options.Dependencies))
+	for _, tag := range options.Tags {
+		keys = append(keys, cs.tagKey(ctx, tag))
+	}
+	for _, dependency := range options.Dependencies {
+		keys = append(keys, cs.dependencyKey(cs.generateKey(ctx, dependency)))
+	}
+	return keys
+}
+
+// versions returns the current version of each version key, optionally creating missing ones
+func (cs *CacheService) versions(ctx context.Context, keys []string, create bool) (map[string]string, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var found map[string][]byte
+	if provider, ok := cs.provider.(multiGetter); ok {
+		var err error
+		if found, err = provider.GetMulti(ctx, keys); err != nil {
+			return nil, err
+		}
+	} else {
+		found = make(map[string][]byte, len(keys))
+		for _, key := range keys {
+			value, err := cs.provider.Get(ctx, key)
+			if err == nil {
+				found[key] = value
+			} else if !errors.Is(err, ErrCacheMiss) {
+				return nil, err
+			}
+		}
+	}
+
+	versions := make(map[string]string, len(keys))
+	for _, key := range keys {
+		if version, exists := found[key]; exists {
+			versions[key] = string(version)
+			continue
+		}
+		if !create {
+			continue
+		}
+
+		version := generateTokenID()
+		if err := cs.provider.Set(ctx, key, []byte(version), 0); err != nil {
+			return nil, err
+		}
+		versions[key] = version
+	}
+	return versions, nil
+}
+
+// versionsValid reports whether the versions stored with a value are still current
+func (cs *CacheService) versionsValid(ctx context.Context, stored map[string]string) bool {
+	if len(stored) == 0 {
+		return true
+	}
+
+	keys := make([]string, 0, len(stored))
+	for key := range stored {
+		keys = append(keys, key)
+	}
+
+	current, err := cs.versions(ctx, keys, false)
+	if err != nil {
+		return false
+	}
+	for key, version := range stored {
+		if current[key] != version {
+			return false
+		}
+	}
+	return true
+}
+
+// touch invalidates the values depending on a full cache key. The version key
+// only exists once a value depends on the key, so other keys cost no write.
+func (cs *CacheService) touch(ctx context.Context, fullKey string) error {
+	dependencyKey := cs.dependencyKey(fullKey)
+	exists, err := cs.provider.Exists(ctx, dependencyKey)
+	if err != nil || !exists {
+		return err
+	}
+	return cs.provider.Delete(ctx, dependencyKey)
+}
+
+// InvalidateTags invalidates every value stored with any of the tags
+func (cs *CacheService) InvalidateTags(ctx context.Context, tags ...string) error {
+	for _, tag := range tags {
+		if err := cs.provider.Delete(ctx, cs.tagKey(ctx, tag)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,209 @@
+package gonest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ErrorCode describes an application error with a stable code
+type ErrorCode struct {
+	Code    string `json:"code"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+	DocsURL string `json:"docs_url,omitempty"`
+}
+
+// Error implements error interface so codes can be used with errors.Is
+func (ec *ErrorCode) Error() string {
+	return ec.Code
+}
+
+// ErrorCatalog holds the error codes of an application
+type ErrorCatalog struct {
+	codes map[string]*ErrorCode
+	mutex sync.RWMutex
+}
+
+// NewErrorCatalog creates a new error catalog
+func NewErrorCatalog() *ErrorCatalog {
+	return &ErrorCatalog{
+		codes: make(map[string]*ErrorCode),
+	}
+}
+
+// DefaultErrorCatalog is the catalog used by DefineError
+var DefaultErrorCatalog = NewErrorCatalog()
+
+// DefineError declares an error code in the default catalog
+func DefineError(code string, status int, message, docsURL string) *ErrorCode {
+	return DefaultErrorCatalog.Define(code, status, message, docsURL)
+}
+
+// Define declares an error code. The message is a fmt template filled with
+// the arguments passed to Err. Defining the same code twice panics, since
+// codes are declared once at package initialization.
+func (ec *ErrorCatalog) Define(code string, status int, message, docsURL string) *ErrorCode {
+	ec.mutex.Lock()
+	defer ec.mutex.Unlock()
+
+	if _, exists := ec.codes[code]; exists {
+		panic(fmt.Sprintf("error code '%s' is already defined", code))
+	}
+
+	errorCode := &ErrorCode{
+		Code:    code,
+		Status:  status,
+		Message: message,
+		DocsURL: docsURL,
+	}
+	ec.codes[code] = errorCode
+	return errorCode
+}
+
+// Get retrieves an error code
+func (ec *ErrorCatalog) Get(code string) (*ErrorCode, bool) {
+	ec.mutex.RLock()
+	defer ec.mutex.RUnlock()
+
+	errorCode, exists := ec.codes[code]
+	return errorCode, exists
+}
+
+// All returns all error codes sorted by code
+func (ec *ErrorCatalog) All() []*ErrorCode {
+	ec.mutex.RLock()
+	defer ec.mutex.RUnlock()
+
+	codes := make([]*ErrorCode, 0, len(ec.codes))
+	for _, errorCode := range ec.codes {
+		codes = append(codes, errorCode)
+	}
+
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i].Code < codes[j].Code
+	})
+	return codes
+}
+
+// ExportJSON writes the catalog as a JSON array
+func (ec *ErrorCatalog) ExportJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(ec.All())
+}
+
+// ExportMarkdown writes the catalog as a Markdown table
+func (ec *ErrorCatalog) ExportMarkdown(w io.Writer) error {
+	var builder strings.Builder
+
+	builder.WriteString("| Code | Status | Message | Documentation |\n")
+	builder.WriteString("|------|--------|---------|---------------|\n")
+
+	for _, errorCode := range ec.All() {
+		docs := ""
+		if errorCode.DocsURL != "" {
+			docs = fmt.Sprintf("[link](%s)", markdownURLEscaper.Replace(errorCode.DocsURL))
+		}
+
+		fmt.Fprintf(&builder, "| `%s` | %d %s | %s | %s |\n",
+			errorCode.Code,
+			errorCode.Status,
+			http.StatusText(errorCode.Status),
+			markdownCellEscaper.Replace(errorCode.Message),
+			docs,
+		)
+	}
+
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
+
+// markdownCellEscaper keeps text within a Markdown table cell
+var markdownCellEscaper = strings.NewReplacer("|", "\\|", "\r\n", "<br>", "\n", "<br>", "\r", "<br>")
+
+// markdownURLEscaper percent-encodes characters ending a Markdown link target or table row
+var markdownURLEscaper = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29", "|", "%7C", "<", "%3C", ">", "%3E", "\r", "%0D", "\n", "%0A")
+
+// DomainError is an occurrence of a catalog error code
+type DomainError struct {
+	Code    *ErrorCode
+	Args    []interface{}
+	Details interface{}
+	Cause   error
+}
+
+// Err creates a domain error for a catalog code
+func Err(code *ErrorCode, args ...interface{}) *DomainError {
+	return &DomainError{
+		Code: code,
+		Args: args,
+	}
+}
+
+// Error implements error interface
+func (de *DomainError) Error() string {
+	return de.Message()
+}
+
+// Message renders the message template with the error arguments
+func (de *DomainError) Message() string {
+	if len(de.Args) == 0 {
+		return de.Code.Message
+	}
+	return fmt.Sprintf(de.Code.Message, de.Args...)
+}
+
+// WithDetails adds details to the error
+func (de *DomainError) WithDetails(details interface{}) *DomainError {
+	de.Details = details
+	return de
+}
+
+// Wrap records the underlying cause of the error
+func (de *DomainError) Wrap(cause error) *DomainError {
+	de.Cause = cause
+	return de
+}
+
+// Unwrap returns the underlying cause
+func (de *DomainError) Unwrap() error {
+	return de.Cause
+}
+
+// Is reports whether the error has the given catalog code
+func (de *DomainError) Is(target error) bool {
+	switch t := target.(type) {
+	case *ErrorCode:
+		return de.Code == t
+	case *DomainError:
+		return de.Code == t.Code
+	}
+	return false
+}
+
+// As allows errors.As to extract an *HTTPException from a domain error,
+// so the exception filters render it like any other HTTP exception
+func (de *DomainError) As(target interface{}) bool {
+	if exception, ok := target.(**HTTPException); ok {
+		*exception = de.ToHTTPException()
+		return true
+	}
+	return false
+}
+
+// ToHTTPException converts the domain error to an HTTP exception
+func (de *DomainError) ToHTTPException() *HTTPException {
+	exception := NewHTTPException(de.Code.Status, de.Message()).WithCode(de.Code.Code)
+	if de.Details != nil {
+		exception.WithDetails(de.Details)
+	}
+	if de.Code.DocsURL != "" {
+		exception.WithType(de.Code.DocsURL)
+	}
+	return exception
+}
@@ -11,6 +11,7 @@ type Controller struct {
 	Path       string
 	Handlers   map[string]*Handler
 	Middleware []echo.MiddlewareFunc
+	Metadata   map[string]interface{}
 }
 
 // Handler represents an HTTP handler with metadata
@@ -19,6 +20,7 @@ type Handler struct {
 	Path        string
 	HandlerFunc echo.HandlerFunc
 	Middleware  []echo.MiddlewareFunc
+	Metadata    map[string]interface{}
 }
 
 // ControllerDecoratorFunc is a function type that can be used to decorate controllers
@@ -59,7 +61,8 @@ func Patch(path string) Route {
 
 // ControllerBuilder provides a fluent interface for building controllers
 type ControllerBuilder struct {
-	controller *Controller
+	controller  *Controller
+	lastHandler *Handler
 }
 
 // NewController creates a new controller
@@ -68,6 +71,7 @@ func NewController() *ControllerBuilder {
 		controller: &Controller{
 			Handlers:   make(map[string]*Handler),
 			Middleware: make([]echo.MiddlewareFunc, 0),
+			Metadata:   make(map[string]interface{}),
 		},
 	}
 }
@@ -84,6 +88,25 @@ func (cb *ControllerBuilder) Middleware(middleware ...echo.MiddlewareFunc) *Cont
 	return cb
 }
 
+// Metadata attaches metadata to the controller and all of its routes
+func (cb *ControllerBuilder) Metadata(entries ...MetadataEntry) *ControllerBuilder {
+	for _, entry := range entries {
+		cb.controller.Metadata[entry.Key] = entry.Value
+	}
+	return cb
+}
+
+// RouteMetadata attaches metadata to the most recently added route
+func (cb *ControllerBuilder) RouteMetadata(entries ...MetadataEntry) *ControllerBuilder {
+	if cb.lastHandler == nil {
+		panic("RouteMetadata must be called after adding a route")
+	}
+	for _, entry := range entries {
+		cb.lastHandler.Metadata[entry.Key] = entry.Value
+	}
+	return cb
+}
+
 // Get adds a GET route handler
 func (cb *ControllerBuilder) Get(path string, handler echo.HandlerFunc, middleware ...echo.MiddlewareFunc) *ControllerBuilder {
 	cb.addHandler(http.MethodGet, path, handler, middleware...)
@@ -117,12 +140,14 @@ func (cb *ControllerBuilder) Patch(path string, handler echo.HandlerFunc, middle
 // addHandler adds a handler to the controller
 func (cb *ControllerBuilder) addHandler(method, path string, handler echo.HandlerFunc, middleware ...echo.MiddlewareFunc) {
 	key := method + ":" + path
-	cb.controller.Handlers[key] = &Handler{
+	cb.lastHandler = &Handler{
 		Method:      method,
 		Path:        path,
 		HandlerFunc: handler,
 		Middleware:  middleware,
+		Metadata:    make(map[string]interface{}),
 	}
+	cb.controller.Handlers[key] = cb.lastHandler
 }
 
 // Build returns the built controller
@@ -158,6 +183,8 @@ func (cr *ControllerRegistry) RegisterAll(controllers []interface{}) {
 
 // SetupRoutes sets up all controller routes on an Echo instance
 func (cr *ControllerRegistry) SetupRoutes(e *echo.Echo) {
+	metadataStore := MetadataStoreFor(e)
+
 	for _, controller := range cr.controllers {
 		group := e.Group(controller.Path)
 
@@ -168,7 +195,8 @@ func (cr *ControllerRegistry) SetupRoutes(e *echo.Echo) {
 
 		// Register all handlers
 		for _, handler := range controller.Handlers {
-			group.Add(handler.Method, handler.Path, handler.HandlerFunc, handler.Middleware...)
+			route := group.Add(handler.Method, handler.Path, handler.HandlerFunc, handler.Middleware...)
+			metadataStore.Register(route.Method, route.Path, controller.Metadata, handler.Metadata)
 		}
 	}
 }
@@ -1,8 +1,10 @@
 package gonest
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
@@ -63,6 +65,11 @@ type RepositoryInterface interface {
 type BaseRepository struct {
 	db     *sql.DB
 	logger *logrus.Logger
+	// tenantColumn restricts queries to the tenant of ctx when set
+	tenantColumn string
+	ctx          context.Context
+	conditions   []string
+	args         []interface{}
 }
 
 // NewBaseRepository creates a new base repository
@@ -70,11 +77,62 @@ func NewBaseRepository(db *sql.DB, logger *logrus.Logger) *BaseRepository {
 	return &BaseRepository{
 		db:     db,
 		logger: logger,
+		ctx:    context.Background(),
 	}
 }
 
+// WithTenantColumn returns a copy of the repository scoped to the tenant stored in the given column
+func (r *BaseRepository) WithTenantColumn(column string) *BaseRepository {
+	clone := r.clone()
+	clone.tenantColumn = column
+	return clone
+}
+
+// WithContext returns a copy of the repository bound to a request context
+func (r *BaseRepository) WithContext(ctx context.Context) *BaseRepository {
+	clone := r.clone()
+	clone.ctx = ctx
+	return clone
+}
+
+// clone copies the repository and its query state
+func (r *BaseRepository) clone() *BaseRepository {
+	clone := *r
+	clone.conditions = append([]string{}, r.conditions...)
+	clone.args = append([]interface{}{}, r.args...)
+	return &clone
+}
+
+// WhereClause returns the WHERE conditions and arguments of the repository,
+// including the tenant condition. Conditions use $N placeholders.
+func (r *BaseRepository) WhereClause() (string, []interface{}, error) {
+	conditions := r.conditions
+	args := r.args
+
+	if r.tenantColumn != "" {
+		tenantID, ok := TenantFromContext(r.ctx)
+		if !ok {
+			return "", nil, ErrNoTenant
+		}
+		args = append(append([]interface{}{}, args...), tenantID)
+		conditions = append(append([]string{}, conditions...), fmt.Sprintf("%s = $%d", r.tenantColumn, len(args)))
+	}
+
+	return strings.Join(conditions, " AND "), args, nil
+}
+
 // Create creates a new record
 func (r *BaseRepository) Create(model interface{}) error {
+	if r.tenantColumn != "" {
+		tenantID, ok := TenantFromContext(r.ctx)
+		if !ok {
+			return ErrNoTenant
+		}
+		if tenantModel, ok := model.(TenantAware); ok {
+			tenantModel.SetTenantID(tenantID)
+		}
+	}
+
 	// Implementation would use reflection to generate SQL
 	r.logger.Infof("Creating record: %T", model)
 	return nil
@@ -82,6 +140,10 @@ func (r *BaseRepository) Create(model interface{}) error {
 
 // FindByID finds a record by ID
 func (r *BaseRepository) FindByID(id interface{}, model interface{}) error {
+	if _, _, err := r.WhereClause(); err != nil {
+		return err
+	}
+
 	// Implementation would use reflection to generate SQL
 	r.logger.Infof("Finding record by ID: %v", id)
 	return nil
@@ -89,6 +151,10 @@ func (r *BaseRepository) FindByID(id interface{}, model interface{}) error {
 
 // FindAll finds all records
 func (r *BaseRepository) FindAll(models interface{}) error {
+	if _, _, err := r.WhereClause(); err != nil {
+		return err
+	}
+
 	// Implementation would use reflection to generate SQL
 	r.logger.Info("Finding all records")
 	return nil
@@ -96,6 +162,10 @@ func (r *BaseRepository) FindAll(models interface{}) error {
 
 // Update updates a record
 func (r *BaseRepository) Update(model interface{}) error {
+	if _, _, err := r.WhereClause(); err != nil {
+		return err
+	}
+
 	// Implementation would use reflection to generate SQL
 	r.logger.Infof("Updating record: %T", model)
 	return nil
@@ -103,6 +173,10 @@ func (r *BaseRepository) Update(model interface{}) error {
 
 // Delete deletes a record
 func (r *BaseRepository) Delete(model interface{}) error {
+	if _, _, err := r.WhereClause(); err != nil {
+		return err
+	}
+
 	// Implementation would use reflection to generate SQL
 	r.logger.Infof("Deleting record: %T", model)
 	return nil
@@ -110,8 +184,10 @@ func (r *BaseRepository) Delete(model interface{}) error {
 
 // Where adds a WHERE clause
 func (r *BaseRepository) Where(query string, args ...interface{}) RepositoryInterface {
-	// Implementation would build query
-	return r
+	clone := r.clone()
+	clone.conditions = append(clone.conditions, query)
+	clone.args = append(clone.args, args...)
+	return clone
 }
 
 // Order adds an ORDER BY clause
@@ -93,13 +93,28 @@ type DTOValidator struct {
 	validator *validator.Validate
 }
 
-// NewDTOValidator creates a new DTO validator
+// NewDTOValidator creates a new DTO validator.
+// The password tag enforces DefaultPasswordPolicy until RegisterPasswordRule is called.
 func NewDTOValidator() *DTOValidator {
+	v := validator.New()
+	v.RegisterValidation("password", DefaultPasswordPolicy().ValidationFunc())
+
 	return &DTOValidator{
-		validator: validator.New(),
+		validator: v,
 	}
 }
 
+// RegisterValidation registers a custom validation rule
+func (dv *DTOValidator) RegisterValidation(tag string, fn validator.Func) error {
+	return dv.validator.RegisterValidation(tag, fn)
+}
+
+// RegisterPasswordRule makes the password tag enforce a policy.
+// Like RegisterValidation, it must be called before the first validation.
+func (dv *DTOValidator) RegisterPasswordRule(policy *PasswordPolicy) error {
+	return dv.validator.RegisterValidation("password", policy.ValidationFunc())
+}
+
 // Validate validates a DTO instance
 func (dv *DTOValidator) Validate(dto interface{}) error {
 	return dv.validator.Struct(dto)
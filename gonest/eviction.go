@@ -0,0 +1,378 @@
+package gonest
+
+import (
+	"container/heap"
+	"container/list"
+	"hash/maphash"
+)
+
+// EvictionPolicy selects which entries a bounded MemoryCache evicts
+type EvictionPolicy string
+
+// Eviction policies
+const (
+	// EvictionLRU evicts the least recently used entry
+	EvictionLRU EvictionPolicy = "lru"
+	// EvictionLFU evicts the least frequently used entry, oldest first on ties
+	EvictionLFU EvictionPolicy = "lfu"
+	// EvictionTinyLFU uses a small LRU window in front of a segmented LRU
+	// whose admission is decided by an approximate frequency sketch
+	EvictionTinyLFU EvictionPolicy = "tinylfu"
+)
+
+// cacheEntry is an entry of a MemoryCache shard
+type cacheEntry struct {
+	key  string
+	item CacheItem
+	size int64
+
+	// policy bookkeeping
+	element   *list.Element
+	segment   int
+	frequency uint64
+	tick      uint64
+	index     int
+}
+
+// evictionQueue tracks entries of a shard and picks eviction victims
+type evictionQueue interface {
+	add(entry *cacheEntry)
+	access(entry *cacheEntry)
+	remove(entry *cacheEntry)
+	victim() *cacheEntry
+	reset()
+}
+
+// newEvictionQueue creates the queue of a policy; capacity is the entry limit of the shard, 0 if unbounded
+func newEvictionQueue(policy EvictionPolicy, capacity int) evictionQueue {
+	switch policy {
+	case EvictionLFU:
+		return &lfuQueue{}
+	case EvictionTinyLFU:
+		return newTinyLFUQueue(capacity)
+	}
+	return &lruQueue{entries: list.New()}
+}
+
+// lruQueue orders entries by recency
+type lruQueue struct {
+	entries *list.List
+}
+
+func (q *lruQueue) add(entry *cacheEntry) {
+	entry.element = q.entries.PushFront(entry)
+}
+
+func (q *lruQueue) access(entry *cacheEntry) {
+	q.entries.MoveToFront(entry.element)
+}
+
+func (q *lruQueue) remove(entry *cacheEntry) {
+	q.entries.Remove(entry.element)
+}
+
+func (q *lruQueue) victim() *cacheEntry {
+	if back := q.entries.Back(); back != nil {
+		return back.Value.(*cacheEntry)
+	}
+	return nil
+}
+
+func (q *lruQueue) reset() {
+	q.entries.Init()
+}
+
+// lfuQueue is a min-heap of entries by frequency, then by last access
+type lfuQueue struct {
+	entries []*cacheEntry
+	clock   uint64
+}
+
+func (q *lfuQueue) Len() int { return len(q.entries) }
+
+func (q *lfuQueue) Less(i, j int) bool {
+	if q.entries[i].frequency != q.entries[j].frequency {
+		return q.entries[i].frequency < q.entries[j].frequency
+	}
+	return q.entries[i].tick < q.entries[j].tick
+}
+
+func (q *lfuQueue) Swap(i, j int) {
+	q.entries[i], q.entries[j] = q.entries[j], q.entries[i]
+	q.entries[i].index = i
+	q.entries[j].index = j
+}
+
+func (q *lfuQueue) Push(x interface{}) {
+	entry := x.(*cacheEntry)
+	entry.index = len(q.entries)
+	q.entries = append(q.entries, entry)
+}
+
+func (q *lfuQueue) Pop() interface{} {
+	last := q.entries[len(q.entries)-1]
+	q.entries[len(q.entries)-1] = nil
+	q.entries = q.entries[:len(q.entries)-1]
+	return last
+}
+
+func (q *lfuQueue) add(entry *cacheEntry) {
+	q.clock++
+	entry.frequency = 1
+	entry.tick = q.clock
+	heap.Push(q, entry)
+}
+
+func (q *lfuQueue) access(entry *cacheEntry) {
+	q.clock++
+	entry.frequency++
+	entry.tick = q.clock
+	heap.Fix(q, entry.index)
+}
+
+func (q *lfuQueue) remove(entry *cacheEntry) {
+	heap.Remove(q, entry.index)
+}
+
+func (q *lfuQueue) victim() *cacheEntry {
+	if len(q.entries) == 0 {
+		return nil
+	}
+	return q.entries[0]
+}
+
+func (q *lfuQueue) reset() {
+	q.entries = nil
+}
+
+// W-TinyLFU segments
+const (
+	segmentWindow = iota
+	segmentProbation
+	segmentProtected
+)
+
+// tinyLFUQueue implements W-TinyLFU: new entries enter a small LRU window,
+// then move to the probation segment of a segmented LRU. When the cache is
+// full, the entry most recently moved out of the window competes with the
+// probation victim and the one with the lower estimated frequency is evicted.
+type tinyLFUQueue struct {
+	capacity  int
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	sketch    *frequencySketch
+	// candidate is the entry most recently moved out of the window that has
+	// not yet won or lost admission against the probation victim
+	candidate *cacheEntry
+}
+
+func newTinyLFUQueue(capacity int) *tinyLFUQueue {
+	return &tinyLFUQueue{
+		capacity:  capacity,
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		sketch:    newFrequencySketch(capacity),
+	}
+}
+
+// limits returns the window and protected segment sizes
+func (q *tinyLFUQueue) limits() (int, int) {
+	capacity := q.capacity
+	if capacity <= 0 {
+		capacity = q.window.Len() + q.probation.Len() + q.protected.Len()
+	}
+
+	window := capacity / 100
+	if window < 1 {
+		window = 1
+	}
+	protected := (capacity - window) * 8 / 10
+	return window, protected
+}
+
+func (q *tinyLFUQueue) add(entry *cacheEntry) {
+	q.sketch.increment(entry.key)
+	entry.segment = segmentWindow
+	entry.element = q.window.PushFront(entry)
+
+	windowLimit, _ := q.limits()
+	for q.window.Len() > windowLimit {
+		candidate := q.window.Back().Value.(*cacheEntry)
+		q.window.Remove(candidate.element)
+		candidate.segment = segmentProbation
+		candidate.element = q.probation.PushFront(candidate)
+		q.candidate = candidate
+	}
+}
+
+func (q *tinyLFUQueue) access(entry *cacheEntry) {
+	q.sketch.increment(entry.key)
+	if entry == q.candidate {
+		q.candidate = nil
+	}
+
+	switch entry.segment {
+	case segmentWindow:
+		q.window.MoveToFront(entry.element)
+	case segmentProtected:
+		q.protected.MoveToFront(entry.element)
+	case segmentProbation:
+		q.probation.Remove(entry.element)
+		entry.segment = segmentProtected
+		entry.element = q.protected.PushFront(entry)
+
+		_, protectedLimit := q.limits()
+		for q.protected.Len() > protectedLimit && q.protected.Len() > 0 {
+			demoted := q.protected.Back().Value.(*cacheEntry)
+			q.protected.Remove(demoted.element)
+			demoted.segment = segmentProbation
+			demoted.element = q.probation.PushFront(demoted)
+		}
+	}
+}
+
+func (q *tinyLFUQueue) remove(entry *cacheEntry) {
+	if entry == q.candidate {
+		q.candidate = nil
+	}
+	switch entry.segment {
+	case segmentWindow:
+		q.window.Remove(entry.element)
+	case segmentProbation:
+		q.probation.Remove(entry.element)
+	case segmentProtected:
+		q.protected.Remove(entry.element)
+	}
+}
+
+// victim returns the entry to evict. A pending window candidate competes with
+// the oldest other probation entry and is admitted if it is used more often.
+func (q *tinyLFUQueue) victim() *cacheEntry {
+	if candidate := q.candidate; candidate != nil {
+		victim := q.oldestExcept(candidate)
+		if victim == nil {
+			return candidate
+		}
+		if q.sketch.estimate(candidate.key) > q.sketch.estimate(victim.key) {
+			q.candidate = nil
+			return victim
+		}
+		return candidate
+	}
+
+	switch {
+	case q.probation.Len() > 0:
+		return q.probation.Back().Value.(*cacheEntry)
+	case q.protected.Len() > 0:
+		return q.protected.Back().Value.(*cacheEntry)
+	case q.window.Len() > 0:
+		return q.window.Back().Value.(*cacheEntry)
+	}
+	return nil
+}
+
+// oldestExcept returns the least recently used probation or protected entry other than entry
+func (q *tinyLFUQueue) oldestExcept(entry *cacheEntry) *cacheEntry {
+	for _, segment := range []*list.List{q.probation, q.protected} {
+		for element := segment.Back(); element != nil; element = element.Prev() {
+			if element.Value.(*cacheEntry) != entry {
+				return element.Value.(*cacheEntry)
+			}
+		}
+	}
+	return nil
+}
+
+func (q *tinyLFUQueue) reset() {
+	q.window.Init()
+	q.probation.Init()
+	q.protected.Init()
+	q.candidate = nil
+	q.sketch.clear()
+}
+
+// frequencySketch is a count-min sketch with 4 rows of saturating counters.
+// Counters are halved periodically so old popularity fades.
+type frequencySketch struct {
+	rows       [4][]uint8
+	mask       uint64
+	seed       maphash.Seed
+	additions  int
+	sampleSize int
+}
+
+func newFrequencySketch(capacity int) *frequencySketch {
+	if capacity < 64 {
+		capacity = 64
+	}
+
+	width := 1
+	for width < capacity {
+		width <<= 1
+	}
+
+	sketch := &frequencySketch{
+		mask:       uint64(width - 1),
+		seed:       maphash.MakeSeed(),
+		sampleSize: 10 * capacity,
+	}
+	for i := range sketch.rows {
+		sketch.rows[i] = make([]uint8, width)
+	}
+	return sketch
+}
+
+// indexes returns the counter index of a key in each row
+func (fs *frequencySketch) indexes(key string) [4]uint64 {
+	hash := maphash.String(fs.seed, key)
+	var indexes [4]uint64
+	for i := range indexes {
+		indexes[i] = (hash >> (uint(i) * 16)) & fs.mask
+		hash = hash*0x9E3779B97F4A7C15 + uint64(i)
+	}
+	return indexes
+}
+
+func (fs *frequencySketch) increment(key string) {
+	for i, index := range fs.indexes(key) {
+		if fs.rows[i][index] < 15 {
+			fs.rows[i][index]++
+		}
+	}
+
+	fs.additions++
+	if fs.additions >= fs.sampleSize {
+		fs.age()
+	}
+}
+
+func (fs *frequencySketch) estimate(key string) uint8 {
+	estimate := uint8(15)
+	for i, index := range fs.indexes(key) {
+		if fs.rows[i][index] < estimate {
+			estimate = fs.rows[i][index]
+		}
+	}
+	return estimate
+}
+
+// age halves all counters
+func (fs *frequencySketch) age() {
+	for i := range fs.rows {
+		for j := range fs.rows[i] {
+			fs.rows[i][j] >>= 1
+		}
+	}
+	fs.additions /= 2
+}
+
+func (fs *frequencySketch) clear() {
+	for i := range fs.rows {
+		for j := range fs.rows[i] {
+			fs.rows[i][j] = 0
+		}
+	}
+	fs.additions = 0
+}
@@ -1,9 +1,13 @@
 package gonest
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"reflect"
+	"runtime/debug"
+	"sort"
 
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
@@ -63,6 +67,122 @@ func (efr *ExceptionFilterRegistry) GetAll() map[string]*ExceptionFilterMetadata
 	return efr.filters
 }
 
+// Sorted returns the registered filters ordered by ascending priority, so
+// higher priority filters are registered last and win ties
+func (efr *ExceptionFilterRegistry) Sorted() []ExceptionFilter {
+	names := make([]string, 0, len(efr.filters))
+	for name := range efr.filters {
+		names = append(names, name)
+	}
+
+	sort.Slice(names, func(i, j int) bool {
+		pi, pj := efr.filters[names[i]].Priority, efr.filters[names[j]].Priority
+		if pi != pj {
+			return pi < pj
+		}
+		return names[i] < names[j]
+	})
+
+	filters := make([]ExceptionFilter, 0, len(names))
+	for _, name := range names {
+		filters = append(filters, efr.filters[name].Filter)
+	}
+	return filters
+}
+
+// TypedExceptionFilter is an exception filter that declares the error type it catches
+type TypedExceptionFilter interface {
+	ExceptionFilter
+	CatchType() reflect.Type
+}
+
+// typedExceptionFilter adapts a typed handler function to TypedExceptionFilter
+type typedExceptionFilter[T error] struct {
+	handler func(exception T, ctx echo.Context) error
+}
+
+// Catch creates a filter that handles errors of type T, matched with errors.As semantics
+func Catch[T error](handler func(exception T, ctx echo.Context) error) TypedExceptionFilter {
+	return &typedExceptionFilter[T]{handler: handler}
+}
+
+// CatchType returns the error type handled by the filter
+func (tef *typedExceptionFilter[T]) CatchType() reflect.Type {
+	return reflect.TypeOf((*T)(nil)).Elem()
+}
+
+// Catch handles the exception if it matches T
+func (tef *typedExceptionFilter[T]) Catch(exception interface{}, ctx echo.Context) error {
+	value, _, ok := matchException(exception, tef.CatchType())
+	if !ok {
+		return nil
+	}
+	return tef.handler(value.(T), ctx)
+}
+
+// matchException finds the first error in the chain assignable to target.
+// It follows errors.As semantics and also reports how deep in the chain the
+// match was found.
+func matchException(exception interface{}, target reflect.Type) (interface{}, int, bool) {
+	err, ok := exception.(error)
+	if !ok {
+		if exception != nil && reflect.TypeOf(exception).AssignableTo(target) {
+			return exception, 0, true
+		}
+		return nil, 0, false
+	}
+
+	level := []error{err}
+	for depth := 0; len(level) > 0; depth++ {
+		var next []error
+		for _, current := range level {
+			if current == nil {
+				continue
+			}
+
+			if reflect.TypeOf(current).AssignableTo(target) {
+				return current, depth, true
+			}
+
+			if as, ok := current.(interface{ As(interface{}) bool }); ok {
+				ptr := reflect.New(target)
+				if as.As(ptr.Interface()) {
+					return ptr.Elem().Interface(), depth, true
+				}
+			}
+
+			switch unwrapper := current.(type) {
+			case interface{ Unwrap() error }:
+				next = append(next, unwrapper.Unwrap())
+			case interface{ Unwrap() []error }:
+				next = append(next, unwrapper.Unwrap()...)
+			}
+		}
+		level = next
+	}
+
+	return nil, 0, false
+}
+
+// MetadataKeyExceptionFilters is the metadata key for controller and route scoped exception filters
+const MetadataKeyExceptionFilters = "exception_filters"
+
+// UseFilters scopes exception filters to a controller or route.
+// Use it with ControllerBuilder.Metadata or ControllerBuilder.RouteMetadata.
+func UseFilters(filters ...ExceptionFilter) MetadataEntry {
+	return SetMetadata(MetadataKeyExceptionFilters, filters)
+}
+
+// scopedFilters reads the exception filters attached to the current route
+func scopedFilters(ctx echo.Context, lookup func(echo.Context, string) (interface{}, bool)) []ExceptionFilter {
+	value, ok := lookup(ctx, MetadataKeyExceptionFilters)
+	if !ok {
+		return nil
+	}
+	filters, _ := value.([]ExceptionFilter)
+	return filters
+}
+
 // ExceptionFilter decorators
 type ExceptionFilterDecorator struct {
 	Filters []string
@@ -73,11 +193,31 @@ func UseExceptionFilters(filters ...string) ExceptionFilterDecorator {
 	return ExceptionFilterDecorator{Filters: filters}
 }
 
+// PanicException wraps a value recovered from a panic
+type PanicException struct {
+	Value interface{}
+	Stack []byte
+}
+
+// Error implements error interface
+func (pe *PanicException) Error() string {
+	return fmt.Sprintf("panic: %v", pe.Value)
+}
+
+// Unwrap returns the panic value if it is an error
+func (pe *PanicException) Unwrap() error {
+	if err, ok := pe.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
 // HTTPException represents an HTTP error
 type HTTPException struct {
 	Status  int
 	Message string
 	Code    string
+	Type    string
 	Details interface{}
 }
 
@@ -100,6 +240,12 @@ func (he *HTTPException) WithCode(code string) *HTTPException {
 	return he
 }
 
+// WithType sets a URI documenting the error, used as the problem type
+func (he *HTTPException) WithType(uri string) *HTTPException {
+	he.Type = uri
+	return he
+}
+
 // WithDetails adds details to the exception
 func (he *HTTPException) WithDetails(details interface{}) *HTTPException {
 	he.Details = details
@@ -153,7 +299,8 @@ func (ve *ValidationException) Error() string {
 
 // HTTPExceptionFilter handles HTTP exceptions
 type HTTPExceptionFilter struct {
-	Logger *logrus.Logger
+	Logger  *logrus.Logger
+	Problem *ProblemDetailsConfig
 }
 
 // NewHTTPExceptionFilter creates a new HTTP exception filter
@@ -161,6 +308,11 @@ func NewHTTPExceptionFilter(logger *logrus.Logger) *HTTPExceptionFilter {
 	return &HTTPExceptionFilter{Logger: logger}
 }
 
+// CatchType returns the error type handled by the filter
+func (hef *HTTPExceptionFilter) CatchType() reflect.Type {
+	return reflect.TypeOf(&HTTPException{})
+}
+
 // Catch handles HTTP exceptions
 func (hef *HTTPExceptionFilter) Catch(exception interface{}, ctx echo.Context) error {
 	if httpException, ok := exception.(*HTTPException); ok {
@@ -171,6 +323,10 @@ func (hef *HTTPExceptionFilter) Catch(exception interface{}, ctx echo.Context) e
 			"method":  ctx.Request().Method,
 		}).Error("HTTP Exception caught")
 
+		if hef.Problem != nil {
+			return writeProblem(ctx, hef.Problem.FromHTTPException(httpException, ctx))
+		}
+
 		response := map[string]interface{}{
 			"error":  httpException.Message,
 			"status": httpException.Status,
@@ -182,6 +338,10 @@ func (hef *HTTPExceptionFilter) Catch(exception interface{}, ctx echo.Context) e
 			response["code"] = httpException.Code
 		}
 
+		if httpException.Type != "" {
+			response["type"] = httpException.Type
+		}
+
 		if httpException.Details != nil {
 			response["details"] = httpException.Details
 		}
@@ -194,7 +354,8 @@ func (hef *HTTPExceptionFilter) Catch(exception interface{}, ctx echo.Context) e
 
 // ValidationExceptionFilter handles validation exceptions
 type ValidationExceptionFilter struct {
-	Logger *logrus.Logger
+	Logger  *logrus.Logger
+	Problem *ProblemDetailsConfig
 }
 
 // NewValidationExceptionFilter creates a new validation exception filter
@@ -202,6 +363,11 @@ func NewValidationExceptionFilter(logger *logrus.Logger) *ValidationExceptionFil
 	return &ValidationExceptionFilter{Logger: logger}
 }
 
+// CatchType returns the error type handled by the filter
+func (vef *ValidationExceptionFilter) CatchType() reflect.Type {
+	return reflect.TypeOf(&ValidationException{})
+}
+
 // Catch handles validation exceptions
 func (vef *ValidationExceptionFilter) Catch(exception interface{}, ctx echo.Context) error {
 	if validationException, ok := exception.(*ValidationException); ok {
@@ -211,6 +377,12 @@ func (vef *ValidationExceptionFilter) Catch(exception interface{}, ctx echo.Cont
 			"method": ctx.Request().Method,
 		}).Error("Validation Exception caught")
 
+		if vef.Problem != nil {
+			problem := vef.Problem.NewProblem(ctx, http.StatusBadRequest, "Validation failed", "")
+			problem.Extensions["errors"] = validationException.Errors
+			return writeProblem(ctx, problem)
+		}
+
 		response := map[string]interface{}{
 			"error":   "Validation failed",
 			"status":  http.StatusBadRequest,
@@ -227,7 +399,8 @@ func (vef *ValidationExceptionFilter) Catch(exception interface{}, ctx echo.Cont
 
 // GenericExceptionFilter handles generic exceptions
 type GenericExceptionFilter struct {
-	Logger *logrus.Logger
+	Logger  *logrus.Logger
+	Problem *ProblemDetailsConfig
 }
 
 // NewGenericExceptionFilter creates a new generic exception filter
@@ -245,6 +418,15 @@ func (gef *GenericExceptionFilter) Catch(exception interface{}, ctx echo.Context
 		"method":    ctx.Request().Method,
 	}).Error("Generic Exception caught")
 
+	if gef.Problem != nil {
+		problem := gef.Problem.NewProblem(ctx, http.StatusInternalServerError, "", "")
+		if gef.Problem.ExposeInternalErrors {
+			problem.Detail = fmt.Sprintf("%v", exception)
+			problem.Extensions["exception"] = reflect.TypeOf(exception).String()
+		}
+		return writeProblem(ctx, problem)
+	}
+
 	// Return a generic error response
 	response := map[string]interface{}{
 		"error":  "Internal server error",
@@ -266,12 +448,15 @@ func NewExceptionFilterChain(filters ...ExceptionFilter) *ExceptionFilterChain {
 	return &ExceptionFilterChain{filters: filters}
 }
 
-// Catch applies all filters in sequence
+// Catch applies filters in sequence until one of them writes a response
 func (efc *ExceptionFilterChain) Catch(exception interface{}, ctx echo.Context) error {
 	for _, filter := range efc.filters {
 		if err := filter.Catch(exception, ctx); err != nil {
 			return err
 		}
+		if ctx.Response().Committed {
+			return nil
+		}
 	}
 	return nil
 }
@@ -303,7 +488,11 @@ func ExceptionFilterMiddleware(filters ...ExceptionFilter) echo.MiddlewareFunc {
 // GlobalExceptionHandler handles all exceptions globally
 type GlobalExceptionHandler struct {
 	filters []ExceptionFilter
-	logger  *logrus.Logger
+	// registered holds the filters of the application's registry, replaced
+	// on every Initialize so they are never added twice
+	registered []ExceptionFilter
+	logger     *logrus.Logger
+	problem    *ProblemDetailsConfig
 }
 
 // NewGlobalExceptionHandler creates a new global exception handler
@@ -318,10 +507,160 @@ func NewGlobalExceptionHandler(logger *logrus.Logger) *GlobalExceptionHandler {
 	}
 }
 
-// Handle handles an exception using all registered filters
+// Handle handles an exception using the most specific matching filter.
+// Route-level filters are consulted first, then controller-level filters and
+// finally global filters. Within a scope, typed filters matching the exception
+// win over catch-all filters; the match closest to the top of the error chain
+// is preferred, then concrete types over interfaces, and remaining ties go to
+// the most recently registered filter. Typed filters are matched against the
+// original error first, so Catch[*echo.HTTPError] sees Echo errors before
+// they are converted to *HTTPException.
 func (geh *GlobalExceptionHandler) Handle(exception interface{}, ctx echo.Context) error {
-	chain := NewExceptionFilterChain(geh.filters...)
-	return chain.Catch(exception, ctx)
+	normalized := normalizeException(exception)
+
+	global := make([]ExceptionFilter, 0, len(geh.filters)+len(geh.registered))
+	global = append(append(global, geh.filters...), geh.registered...)
+
+	scopes := [][]ExceptionFilter{
+		scopedFilters(ctx, GetHandlerMetadata),
+		scopedFilters(ctx, GetControllerMetadata),
+		global,
+	}
+
+	for _, filters := range scopes {
+		handled, err := catchInScope(filters, exception, normalized, ctx)
+		if err != nil || handled {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HTTPErrorHandler routes errors returned by handlers and middleware through
+// the exception filters. Install it as echo.Echo.HTTPErrorHandler.
+func (geh *GlobalExceptionHandler) HTTPErrorHandler(err error, ctx echo.Context) {
+	if ctx.Response().Committed {
+		return
+	}
+
+	if handleErr := geh.Handle(err, ctx); handleErr != nil {
+		geh.logger.WithError(handleErr).Error("Exception filter failed")
+	}
+
+	if !ctx.Response().Committed {
+		geh.writeFallback(ctx)
+	}
+}
+
+// writeFallback writes a generic error response when no filter responded
+func (geh *GlobalExceptionHandler) writeFallback(ctx echo.Context) {
+	var err error
+	if geh.problem != nil {
+		err = writeProblem(ctx, geh.problem.NewProblem(ctx, http.StatusInternalServerError, "", ""))
+	} else {
+		err = ctx.JSON(http.StatusInternalServerError, map[string]interface{}{
+			"error":  "Internal server error",
+			"status": http.StatusInternalServerError,
+		})
+	}
+
+	if err != nil {
+		geh.logger.WithError(err).Error("Failed to write error response")
+	}
+}
+
+// catchInScope applies the filters of a single scope and reports whether the
+// exception was handled. Typed filters match the original exception, then its
+// normalized form; catch-all filters receive the normalized form.
+func catchInScope(filters []ExceptionFilter, original, exception interface{}, ctx echo.Context) (bool, error) {
+	var (
+		best         ExceptionFilter
+		bestValue    interface{}
+		bestDepth    int
+		bestConcrete bool
+		catchAll     []ExceptionFilter
+	)
+
+	for _, filter := range filters {
+		typed, ok := filter.(TypedExceptionFilter)
+		if !ok || typed.CatchType() == nil {
+			catchAll = append(catchAll, filter)
+			continue
+		}
+
+		catchType := typed.CatchType()
+		value, depth, matched := matchException(original, catchType)
+		if !matched {
+			value, depth, matched = matchException(exception, catchType)
+		}
+		if !matched {
+			continue
+		}
+
+		concrete := catchType.Kind() != reflect.Interface
+		if best == nil || depth < bestDepth || (depth == bestDepth && (concrete || !bestConcrete)) {
+			best, bestValue, bestDepth, bestConcrete = filter, value, depth, concrete
+		}
+	}
+
+	if best != nil {
+		if err := best.Catch(bestValue, ctx); err != nil {
+			return true, err
+		}
+		if ctx.Response().Committed {
+			return true, nil
+		}
+	}
+
+	// Catch-all filters run most recently registered first
+	for i := len(catchAll) - 1; i >= 0; i-- {
+		if err := catchAll[i].Catch(exception, ctx); err != nil {
+			return true, err
+		}
+		if ctx.Response().Committed {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// normalizeException converts framework errors into exceptions understood by the built-in filters
+func normalizeException(exception interface{}) interface{} {
+	var echoErr *echo.HTTPError
+	if err, ok := exception.(error); ok && errors.As(err, &echoErr) {
+		message, ok := echoErr.Message.(string)
+		if !ok {
+			message = fmt.Sprintf("%v", echoErr.Message)
+		}
+		return NewHTTPException(echoErr.Code, message)
+	}
+	return exception
+}
+
+// RecoverMiddleware converts panics into *PanicException errors so that they
+// are handled by the exception filters like any other error
+func RecoverMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					if r == http.ErrAbortHandler {
+						panic(r)
+					}
+					err = &PanicException{Value: r, Stack: debug.Stack()}
+				}
+			}()
+
+			return next(c)
+		}
+	}
+}
+
+// setRegisteredFilters replaces the filters taken from the application's registry
+func (geh *GlobalExceptionHandler) setRegisteredFilters(filters []ExceptionFilter) {
+	geh.registered = filters
 }
 
 // AddFilter adds a filter to the global handler
@@ -329,9 +668,172 @@ func (geh *GlobalExceptionHandler) AddFilter(filter ExceptionFilter) {
 	geh.filters = append(geh.filters, filter)
 }
 
+// UseProblemDetails renders every error handled by the built-in filters as
+// application/problem+json. Passing nil restores the legacy JSON format.
+func (geh *GlobalExceptionHandler) UseProblemDetails(config *ProblemDetailsConfig) *GlobalExceptionHandler {
+	geh.problem = config
+	for _, filter := range geh.filters {
+		switch f := filter.(type) {
+		case *HTTPExceptionFilter:
+			f.Problem = config
+		case *ValidationExceptionFilter:
+			f.Problem = config
+		case *GenericExceptionFilter:
+			f.Problem = config
+		}
+	}
+	return geh
+}
+
+// ProblemDetailsConfig returns the active problem details configuration, or nil
+func (geh *GlobalExceptionHandler) ProblemDetailsConfig() *ProblemDetailsConfig {
+	return geh.problem
+}
+
 // Built-in exception filter instances
 var (
 	HTTPExceptionFilterInstance       = NewHTTPExceptionFilter(nil)
 	ValidationExceptionFilterInstance = NewValidationExceptionFilter(nil)
 	GenericExceptionFilterInstance    = NewGenericExceptionFilter(nil)
 )
+
+// MIMEApplicationProblemJSON is the media type for RFC 7807 problem details
+const MIMEApplicationProblemJSON = "application/problem+json"
+
+// ProblemDetails represents an RFC 7807 problem details object
+type ProblemDetails struct {
+	Type       string                 `json:"type"`
+	Title      string                 `json:"title"`
+	Status     int                    `json:"status"`
+	Detail     string                 `json:"detail,omitempty"`
+	Instance   string                 `json:"instance,omitempty"`
+	TraceID    string                 `json:"traceId,omitempty"`
+	Extensions map[string]interface{} `json:"-"`
+}
+
+// MarshalJSON flattens extension members into the top-level object.
+// Extensions never override the standard members.
+func (pd *ProblemDetails) MarshalJSON() ([]byte, error) {
+	result := make(map[string]interface{}, len(pd.Extensions)+6)
+	for key, value := range pd.Extensions {
+		result[key] = value
+	}
+
+	result["type"] = pd.Type
+	result["title"] = pd.Title
+	result["status"] = pd.Status
+	if pd.Detail != "" {
+		result["detail"] = pd.Detail
+	}
+	if pd.Instance != "" {
+		result["instance"] = pd.Instance
+	}
+	if pd.TraceID != "" {
+		result["traceId"] = pd.TraceID
+	}
+
+	return json.Marshal(result)
+}
+
+// ProblemDetailsConfig controls how errors are rendered as problem details
+type ProblemDetailsConfig struct {
+	// TypeBaseURI is prepended to error codes to build the problem type URI.
+	// Problems without a code use "about:blank".
+	TypeBaseURI string
+	// ExposeInternalErrors includes messages and details of 5xx errors.
+	// Disable it in production to avoid leaking internals.
+	ExposeInternalErrors bool
+	// TraceIDHeader is the request/response header carrying the trace ID
+	TraceIDHeader string
+	// TraceIDFunc overrides trace ID extraction
+	TraceIDFunc func(echo.Context) string
+}
+
+// DefaultProblemDetailsConfig returns a problem details configuration for an environment.
+// Internal error details are only exposed outside of production.
+func DefaultProblemDetailsConfig(environment string) *ProblemDetailsConfig {
+	return &ProblemDetailsConfig{
+		ExposeInternalErrors: environment != "production",
+		TraceIDHeader:        echo.HeaderXRequestID,
+	}
+}
+
+// NewProblem creates a problem for the current request
+func (pdc *ProblemDetailsConfig) NewProblem(ctx echo.Context, status int, detail, code string) *ProblemDetails {
+	problem := &ProblemDetails{
+		Type:       pdc.typeURI(code),
+		Title:      http.StatusText(status),
+		Status:     status,
+		Detail:     detail,
+		Instance:   ctx.Request().URL.Path,
+		TraceID:    pdc.traceID(ctx),
+		Extensions: make(map[string]interface{}),
+	}
+
+	if code != "" {
+		problem.Extensions["code"] = code
+	}
+
+	return problem
+}
+
+// FromHTTPException converts an HTTP exception into a problem
+func (pdc *ProblemDetailsConfig) FromHTTPException(he *HTTPException, ctx echo.Context) *ProblemDetails {
+	internal := he.Status >= http.StatusInternalServerError && !pdc.ExposeInternalErrors
+
+	detail := he.Message
+	if internal {
+		detail = ""
+	}
+
+	problem := pdc.NewProblem(ctx, he.Status, detail, he.Code)
+	if he.Type != "" {
+		problem.Type = he.Type
+	}
+
+	if he.Details != nil && !internal {
+		if details, ok := he.Details.(map[string]interface{}); ok {
+			for key, value := range details {
+				problem.Extensions[key] = value
+			}
+		} else {
+			problem.Extensions["details"] = he.Details
+		}
+	}
+
+	return problem
+}
+
+// typeURI builds the problem type URI for an error code
+func (pdc *ProblemDetailsConfig) typeURI(code string) string {
+	if code == "" || pdc.TypeBaseURI == "" {
+		return "about:blank"
+	}
+	return pdc.TypeBaseURI + code
+}
+
+// traceID resolves the trace ID for the current request
+func (pdc *ProblemDetailsConfig) traceID(ctx echo.Context) string {
+	if pdc.TraceIDFunc != nil {
+		return pdc.TraceIDFunc(ctx)
+	}
+
+	header := pdc.TraceIDHeader
+	if header == "" {
+		header = echo.HeaderXRequestID
+	}
+
+	if id := ctx.Response().Header().Get(header); id != "" {
+		return id
+	}
+	return ctx.Request().Header.Get(header)
+}
+
+// writeProblem writes a problem details response
+func writeProblem(ctx echo.Context, problem *ProblemDetails) error {
+	data, err := json.Marshal(problem)
+	if err != nil {
+		return err
+	}
+	return ctx.Blob(problem.Status, MIMEApplicationProblemJSON, data)
+}
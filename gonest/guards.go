@@ -1,8 +1,11 @@
 package gonest
 
 import (
+	"errors"
 	"net/http"
 	"reflect"
+	"sync"
+	"time"
 
 	"github.com/labstack/echo/v4"
 )
@@ -71,29 +74,73 @@ func UseGuards(guards ...string) GuardDecorator {
 	return GuardDecorator{Guards: guards}
 }
 
-// AuthGuard is a basic authentication guard
+// MetadataKeyPublic is the metadata key marking routes that skip authentication
+const MetadataKeyPublic = "is_public"
+
+// Public marks a controller or route as not requiring authentication
+func Public() MetadataEntry {
+	return SetMetadata(MetadataKeyPublic, true)
+}
+
+// IsPublic reports whether the current route is marked as public
+func IsPublic(ctx echo.Context) bool {
+	public, _ := GetMetadata(ctx, MetadataKeyPublic)
+	isPublic, _ := public.(bool)
+	return isPublic
+}
+
+// AuthGuard authenticates requests with one or more strategies tried in order
 type AuthGuard struct {
-	JWTSecret string
+	JWTSecret  string
+	Strategies []AuthStrategy
 }
 
-// NewAuthGuard creates a new authentication guard
+// NewAuthGuard creates an authentication guard validating HS256 tokens signed with jwtSecret
 func NewAuthGuard(jwtSecret string) *AuthGuard {
-	return &AuthGuard{JWTSecret: jwtSecret}
+	config := DefaultJWTConfig()
+	config.SecretKey = jwtSecret
+
+	return &AuthGuard{
+		JWTSecret:  jwtSecret,
+		Strategies: []AuthStrategy{NewJWTStrategy(NewAuthService(config, nil))},
+	}
+}
+
+// NewAuthGuardWithService creates an authentication guard backed by an AuthService
+func NewAuthGuardWithService(authService *AuthService) *AuthGuard {
+	return NewAuthGuardWithStrategies(NewJWTStrategy(authService))
+}
+
+// NewAuthGuardWithStrategies creates an authentication guard trying each strategy in order
+func NewAuthGuardWithStrategies(strategies ...AuthStrategy) *AuthGuard {
+	return &AuthGuard{Strategies: strategies}
 }
 
-// CanActivate checks if the request is authenticated
+// CanActivate authenticates the request and stores the current user.
+// Routes marked with Public are always allowed.
 func (ag *AuthGuard) CanActivate(ctx echo.Context) (bool, error) {
-	token := ctx.Request().Header.Get("Authorization")
-	if token == "" {
-		return false, echo.NewHTTPError(http.StatusUnauthorized, "Authorization header required")
+	if IsPublic(ctx) {
+		return true, nil
 	}
 
-	// Basic token validation (in real app, validate JWT)
-	if len(token) < 10 {
-		return false, echo.NewHTTPError(http.StatusUnauthorized, "Invalid token")
+	var authErr error
+	for _, strategy := range ag.Strategies {
+		user, err := strategy.Authenticate(ctx.Request().Context(), ctx)
+		if err == nil && user != nil {
+			SetCurrentUser(ctx, user)
+			return true, nil
+		}
+
+		if err != nil && !errors.Is(err, ErrNoCredentials) && authErr == nil {
+			authErr = err
+		}
 	}
 
-	return true, nil
+	if authErr != nil {
+		return false, echo.NewHTTPError(http.StatusUnauthorized, "Invalid credentials")
+	}
+
+	return false, echo.NewHTTPError(http.StatusUnauthorized, "Authentication required")
 }
 
 // RoleGuard is a role-based authorization guard
@@ -109,9 +156,13 @@ func NewRoleGuard(roles ...string) *RoleGuard {
 // CanActivate checks if the user has required roles
 func (rg *RoleGuard) CanActivate(ctx echo.Context) (bool, error) {
 	// Extract user roles from context (set by AuthGuard)
-	userRoles, ok := ctx.Get("user_roles").([]string)
-	if !ok {
-		return false, echo.NewHTTPError(http.StatusForbidden, "User roles not found")
+	var userRoles []string
+	if user, err := GetCurrentUser(ctx); err == nil {
+		userRoles = user.Roles
+	} else if roles, ok := ctx.Get("user_roles").([]string); ok {
+		userRoles = roles
+	} else {
+		return false, echo.NewHTTPError(http.StatusUnauthorized, "User not authenticated")
 	}
 
 	// Check if user has any of the required roles
@@ -126,10 +177,19 @@ func (rg *RoleGuard) CanActivate(ctx echo.Context) (bool, error) {
 	return false, echo.NewHTTPError(http.StatusForbidden, "Insufficient permissions")
 }
 
-// RateLimitGuard is a rate limiting guard
+// RateLimitGuard is a rate limiting guard limiting each client per route.
+// Routes can override or skip its limit with Throttle and SkipThrottle
+// using the profile name "default".
 type RateLimitGuard struct {
 	MaxRequests int
 	Window      int // in seconds
+	// Store holds the counters, a memory store if nil; use a shared store
+	// when running several replicas
+	Store RateLimitStore
+
+	throttler *Throttler
+	err       error
+	once      sync.Once
 }
 
 // NewRateLimitGuard creates a new rate limiting guard
@@ -140,11 +200,35 @@ func NewRateLimitGuard(maxRequests, window int) *RateLimitGuard {
 	}
 }
 
-// CanActivate checks if the request is within rate limits
+// WithStore sets the store holding the counters
+func (rlg *RateLimitGuard) WithStore(store RateLimitStore) *RateLimitGuard {
+	rlg.Store = store
+	return rlg
+}
+
+// CanActivate checks if the request is within rate limits. A guard without
+// a positive limit and window rejects every request.
 func (rlg *RateLimitGuard) CanActivate(ctx echo.Context) (bool, error) {
-	// In a real implementation, this would check against Redis or memory store
-	// For now, we'll just return true
-	return true, nil
+	rlg.once.Do(func() {
+		if rlg.MaxRequests <= 0 || rlg.Window <= 0 {
+			rlg.err = echo.NewHTTPError(http.StatusInternalServerError, "Rate limit guard requires a positive limit and window")
+			return
+		}
+
+		config := DefaultThrottlerConfig()
+		config.Profiles = []ThrottlerProfile{{
+			Name:     "default",
+			Limit:    int64(rlg.MaxRequests),
+			Window:   time.Duration(rlg.Window) * time.Second,
+			PerRoute: true,
+		}}
+		config.Store = rlg.Store
+		rlg.throttler = NewThrottler(config, nil)
+	})
+	if rlg.err != nil {
+		return false, rlg.err
+	}
+	return rlg.throttler.CanActivate(ctx)
 }
 
 // GuardMiddleware creates middleware from guards
@@ -0,0 +1,704 @@
+package gonest
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// JWKSPath is the well-known path of the JWKS endpoint
+const JWKSPath = "/.well-known/jwks.json"
+
+// Key errors
+var (
+	ErrKeyNotFound          = errors.New("signing key not found")
+	ErrUnsupportedAlgorithm = errors.New("unsupported signing algorithm")
+)
+
+// KeyProvider resolves the public key used to verify a token by its kid
+type KeyProvider interface {
+	PublicKey(ctx context.Context, kid string) (crypto.PublicKey, string, error)
+}
+
+// SigningKey is an asymmetric key used to sign tokens
+type SigningKey struct {
+	ID         string
+	Algorithm  string
+	PrivateKey crypto.Signer
+	CreatedAt  time.Time
+	// RetiresAt is set when the key is rotated out; the key keeps verifying
+	// tokens until then but no longer signs new ones
+	RetiresAt time.Time
+}
+
+// GenerateSigningKey generates a new RS256 or ES256 signing key
+func GenerateSigningKey(algorithm string) (*SigningKey, error) {
+	var privateKey crypto.Signer
+	var err error
+
+	switch algorithm {
+	case "RS256":
+		privateKey, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		privateKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, algorithm)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &SigningKey{
+		ID:         generateTokenID(),
+		Algorithm:  algorithm,
+		PrivateKey: privateKey,
+		CreatedAt:  time.Now(),
+	}, nil
+}
+
+// PublicKey returns the public half of the key
+func (sk *SigningKey) PublicKey() crypto.PublicKey {
+	return sk.PrivateKey.Public()
+}
+
+// KeyManagerConfig holds key manager configuration
+type KeyManagerConfig struct {
+	Algorithm        string
+	RotationInterval time.Duration
+	// OverlapWindow is how long a rotated key keeps verifying tokens and
+	// stays published. It must be at least the longest lifetime of a token
+	// signed with the key, i.e. max(TokenExpiry, RefreshExpiry), or tokens
+	// signed just before a rotation stop verifying early.
+	OverlapWindow time.Duration
+	// Store shares keys between replicas. Without a store keys only live in
+	// the process, so every replica signs with and publishes its own keys;
+	// use it without a store for a single replica only.
+	Store KeyStore
+	// SyncInterval is how often keys are reloaded from the store. A rotated
+	// key starts signing one interval after it was created, once every
+	// replica has loaded it. Defaults to one minute.
+	SyncInterval time.Duration
+}
+
+// DefaultKeyManagerConfig returns default key manager configuration
+func DefaultKeyManagerConfig() *KeyManagerConfig {
+	return &KeyManagerConfig{
+		Algorithm:        "RS256",
+		RotationInterval: 30 * 24 * time.Hour,
+		// Covers the default 7 day refresh token lifetime
+		OverlapWindow: 7 * 24 * time.Hour,
+		SyncInterval:  time.Minute,
+	}
+}
+
+// KeyManager holds the signing keys of an application and rotates them
+type KeyManager struct {
+	config *KeyManagerConfig
+	keys   map[string]*SigningKey
+	active *SigningKey
+	logger *logrus.Logger
+	stop   chan struct{}
+	mutex  sync.RWMutex
+}
+
+// NewKeyManager creates a new key manager. With a store it loads the shared
+// keys and only generates a key when the store has none; otherwise it
+// generates a fresh active key.
+func NewKeyManager(config *KeyManagerConfig, logger *logrus.Logger) (*KeyManager, error) {
+	if config == nil {
+		config = DefaultKeyManagerConfig()
+	}
+	copied := *config
+	config = &copied
+
+	if config.SyncInterval <= 0 {
+		config.SyncInterval = time.Minute
+	}
+
+	km := &KeyManager{
+		config: config,
+		keys:   make(map[string]*SigningKey),
+		logger: logger,
+	}
+
+	if config.Store != nil {
+		if err := km.Sync(context.Background()); err != nil {
+			return nil, err
+		}
+		if km.ActiveKey() != nil {
+			return km, nil
+		}
+	}
+
+	if _, err := km.Rotate(); err != nil {
+		return nil, err
+	}
+
+	return km, nil
+}
+
+// AddKey adds an existing key. Active keys become the signing key.
+func (km *KeyManager) AddKey(key *SigningKey, active bool) {
+	km.mutex.Lock()
+	var changed []*SigningKey
+	km.keys[key.ID] = key
+	if active {
+		changed = km.retireAll(key, time.Now())
+		km.active = key
+	}
+	saved := copyKeys(append(changed, key))
+	km.mutex.Unlock()
+
+	if err := km.save(context.Background(), saved); err != nil && km.logger != nil {
+		km.logger.WithError(err).WithField("kid", key.ID).Error("Failed to save signing key")
+	}
+}
+
+// Rotate generates a new signing key and retires the current one after the overlap window
+func (km *KeyManager) Rotate() (*SigningKey, error) {
+	key, err := GenerateSigningKey(km.config.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	km.mutex.Lock()
+	now := time.Now()
+	changed := km.retireAll(key, now)
+	km.keys[key.ID] = key
+	km.active = key
+	km.pruneExpired(now)
+	// Publish the new key before the retirement of the old ones
+	saved := copyKeys(append([]*SigningKey{key}, changed...))
+	km.mutex.Unlock()
+
+	if err := km.save(context.Background(), saved); err != nil {
+		return nil, err
+	}
+
+	if km.logger != nil {
+		km.logger.WithFields(logrus.Fields{
+			"kid":       key.ID,
+			"algorithm": key.Algorithm,
+		}).Info("Rotated signing key")
+	}
+
+	return key, nil
+}
+
+// retireAll schedules every key but the given one to stop verifying tokens
+// after the overlap window and returns the keys it changed. With a store a
+// retired key keeps signing until its successor activates, so the window
+// starts one sync interval later.
+func (km *KeyManager) retireAll(keep *SigningKey, now time.Time) []*SigningKey {
+	retiresAt := now.Add(km.config.OverlapWindow)
+	if km.config.Store != nil {
+		retiresAt = retiresAt.Add(km.config.SyncInterval)
+	}
+
+	var changed []*SigningKey
+	for _, key := range km.keys {
+		if key != keep && key.RetiresAt.IsZero() {
+			key.RetiresAt = retiresAt
+			changed = append(changed, key)
+		}
+	}
+	return changed
+}
+
+// pruneExpired removes retired keys whose overlap window has passed
+func (km *KeyManager) pruneExpired(now time.Time) []string {
+	var pruned []string
+	for id, key := range km.keys {
+		if key.expired(now) {
+			delete(km.keys, id)
+			pruned = append(pruned, id)
+		}
+	}
+	return pruned
+}
+
+// expired checks if a retired key's overlap window has passed
+func (sk *SigningKey) expired(now time.Time) bool {
+	return !sk.RetiresAt.IsZero() && now.After(sk.RetiresAt)
+}
+
+// copyKeys copies keys so they can be saved outside the lock
+func copyKeys(keys []*SigningKey) []*SigningKey {
+	copies := make([]*SigningKey, len(keys))
+	for i, key := range keys {
+		copied := *key
+		copies[i] = &copied
+	}
+	return copies
+}
+
+// save writes keys to the store, if any
+func (km *KeyManager) save(ctx context.Context, keys []*SigningKey) error {
+	if km.config.Store == nil {
+		return nil
+	}
+
+	for _, key := range keys {
+		if err := km.config.Store.SaveKey(ctx, key); err != nil {
+			return fmt.Errorf("failed to save signing key: %w", err)
+		}
+	}
+	return nil
+}
+
+// Sync reloads the keys from the store and removes expired ones from it.
+// It does nothing without a store.
+func (km *KeyManager) Sync(ctx context.Context) error {
+	store := km.config.Store
+	if store == nil {
+		return nil
+	}
+
+	loaded, err := store.LoadKeys(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load signing keys: %w", err)
+	}
+
+	keys := make(map[string]*SigningKey, len(loaded))
+	for _, key := range loaded {
+		keys[key.ID] = key
+	}
+
+	km.mutex.Lock()
+	km.keys = keys
+	pruned := km.pruneExpired(time.Now())
+	km.mutex.Unlock()
+
+	for _, id := range pruned {
+		if err := store.DeleteKey(ctx, id); err != nil {
+			return fmt.Errorf("failed to delete signing key: %w", err)
+		}
+	}
+	return nil
+}
+
+// ActiveKey returns the key used to sign new tokens
+func (km *KeyManager) ActiveKey() *SigningKey {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	if km.config.Store != nil {
+		return km.selectActive(time.Now())
+	}
+	return km.active
+}
+
+// selectActive picks the signing key of a shared key set, so every replica
+// agrees on it: the newest key created at least one sync interval ago,
+// preferring keys that are not retired, or else the oldest key
+func (km *KeyManager) selectActive(now time.Time) *SigningKey {
+	activation := now.Add(-km.config.SyncInterval)
+
+	var active, oldest *SigningKey
+	for _, key := range km.keys {
+		if key.expired(now) {
+			continue
+		}
+		if oldest == nil || key.CreatedAt.Before(oldest.CreatedAt) {
+			oldest = key
+		}
+		if key.CreatedAt.After(activation) {
+			continue
+		}
+		if active == nil ||
+			(active.RetiresAt.IsZero() == key.RetiresAt.IsZero() && key.CreatedAt.After(active.CreatedAt)) ||
+			(!active.RetiresAt.IsZero() && key.RetiresAt.IsZero()) {
+			active = key
+		}
+	}
+
+	if active == nil {
+		return oldest
+	}
+	return active
+}
+
+// Keys returns all keys that still verify tokens, oldest first
+func (km *KeyManager) Keys() []*SigningKey {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	now := time.Now()
+	keys := make([]*SigningKey, 0, len(km.keys))
+	for _, key := range km.keys {
+		if !key.expired(now) {
+			keys = append(keys, key)
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+	})
+	return keys
+}
+
+// PublicKey returns the verification key for a kid
+func (km *KeyManager) PublicKey(ctx context.Context, kid string) (crypto.PublicKey, string, error) {
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	key, exists := km.keys[kid]
+	if !exists || key.expired(time.Now()) {
+		return nil, "", ErrKeyNotFound
+	}
+
+	return key.PublicKey(), key.Algorithm, nil
+}
+
+// Start rotates keys on the configured interval until Stop is called.
+// With a store it also reloads the keys every sync interval and only
+// rotates when no replica has rotated within the rotation interval.
+func (km *KeyManager) Start() {
+	km.mutex.Lock()
+	if km.stop != nil || (km.config.RotationInterval <= 0 && km.config.Store == nil) {
+		km.mutex.Unlock()
+		return
+	}
+	stop := make(chan struct{})
+	km.stop = stop
+	km.mutex.Unlock()
+
+	interval := km.config.RotationInterval
+	if km.config.Store != nil {
+		interval = km.config.SyncInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				km.tick()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// tick runs one scheduled sync and rotation
+func (km *KeyManager) tick() {
+	if err := km.Sync(context.Background()); err != nil {
+		if km.logger != nil {
+			km.logger.WithError(err).Error("Failed to sync signing keys")
+		}
+		return
+	}
+
+	if km.config.RotationInterval <= 0 || !km.rotationDue(time.Now()) {
+		return
+	}
+
+	if _, err := km.Rotate(); err != nil && km.logger != nil {
+		km.logger.WithError(err).Error("Failed to rotate signing key")
+	}
+}
+
+// rotationDue checks if the newest key is older than the rotation interval
+func (km *KeyManager) rotationDue(now time.Time) bool {
+	if km.config.Store == nil {
+		return true
+	}
+
+	km.mutex.RLock()
+	defer km.mutex.RUnlock()
+
+	for _, key := range km.keys {
+		if now.Sub(key.CreatedAt) < km.config.RotationInterval {
+			return false
+		}
+	}
+	return true
+}
+
+// Stop stops scheduled key rotation
+func (km *KeyManager) Stop() {
+	km.mutex.Lock()
+	defer km.mutex.Unlock()
+
+	if km.stop != nil {
+		close(km.stop)
+		km.stop = nil
+	}
+}
+
+// JWKS returns the public keys as a JSON Web Key Set
+func (km *KeyManager) JWKS() *JWKSet {
+	keys := km.Keys()
+	set := &JWKSet{Keys: make([]JWK, 0, len(keys))}
+
+	for _, key := range keys {
+		jwk, err := NewJWK(key.ID, key.Algorithm, key.PublicKey())
+		if err != nil {
+			continue
+		}
+		set.Keys = append(set.Keys, *jwk)
+	}
+
+	return set
+}
+
+// JWKSHandler serves the JSON Web Key Set, typically on JWKSPath
+func (km *KeyManager) JWKSHandler() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set("Cache-Control", "public, max-age=300")
+		return c.JSON(http.StatusOK, km.JWKS())
+	}
+}
+
+// JWK represents a JSON Web Key (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet represents a JSON Web Key Set
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// NewJWK encodes a public key as a JWK
+func NewJWK(kid, algorithm string, publicKey crypto.PublicKey) (*JWK, error) {
+	encode := base64.RawURLEncoding.EncodeToString
+
+	switch key := publicKey.(type) {
+	case *rsa.PublicKey:
+		return &JWK{
+			Kty: "RSA",
+			Kid: kid,
+			Use: "sig",
+			Alg: algorithm,
+			N:   encode(key.N.Bytes()),
+			E:   encode(big.NewInt(int64(key.E)).Bytes()),
+		}, nil
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return &JWK{
+			Kty: "EC",
+			Kid: kid,
+			Use: "sig",
+			Alg: algorithm,
+			Crv: key.Curve.Params().Name,
+			X:   encode(key.X.FillBytes(make([]byte, size))),
+			Y:   encode(key.Y.FillBytes(make([]byte, size))),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported public key type %T", publicKey)
+}
+
+// PublicKey decodes the JWK into a public key
+func (j *JWK) PublicKey() (crypto.PublicKey, error) {
+	decode := base64.RawURLEncoding.DecodeString
+
+	switch j.Kty {
+	case "RSA":
+		n, err := decode(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus: %w", err)
+		}
+		e, err := decode(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA exponent: %w", err)
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve '%s'", j.Crv)
+		}
+		x, err := decode(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC x coordinate: %w", err)
+		}
+		y, err := decode(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("invalid EC y coordinate: %w", err)
+		}
+		key := &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on curve")
+		}
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type '%s'", j.Kty)
+}
+
+// RemoteJWKS verifies tokens against a JWKS published by another service
+type RemoteJWKS struct {
+	url        string
+	client     *http.Client
+	cacheTTL   time.Duration
+	minRefresh time.Duration
+	keys       map[string]JWK
+	fetchedAt  time.Time
+	attemptAt  time.Time
+	refresh    *jwksRefresh
+	mutex      sync.Mutex
+}
+
+// jwksRefresh is a key set fetch shared by all callers waiting for it
+type jwksRefresh struct {
+	done chan struct{}
+	err  error
+}
+
+// NewRemoteJWKS creates a remote JWKS that caches keys for cacheTTL.
+// An unknown kid triggers a refetch, at most once per minute.
+func NewRemoteJWKS(url string, cacheTTL time.Duration) *RemoteJWKS {
+	return &RemoteJWKS{
+		url:        url,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		cacheTTL:   cacheTTL,
+		minRefresh: time.Minute,
+		keys:       make(map[string]JWK),
+	}
+}
+
+// WithHTTPClient sets the HTTP client used to fetch keys
+func (rj *RemoteJWKS) WithHTTPClient(client *http.Client) *RemoteJWKS {
+	rj.client = client
+	return rj
+}
+
+// PublicKey returns the verification key for a kid, fetching the key set when needed.
+// Concurrent callers share a single fetch, which runs outside the lock.
+func (rj *RemoteJWKS) PublicKey(ctx context.Context, kid string) (crypto.PublicKey, string, error) {
+	rj.mutex.Lock()
+	now := time.Now()
+	jwk, exists := rj.keys[kid]
+	expired := now.Sub(rj.fetchedAt) > rj.cacheTTL
+	canRefresh := rj.attemptAt.IsZero() || now.Sub(rj.attemptAt) > rj.minRefresh
+
+	var refresh *jwksRefresh
+	if rj.refresh != nil {
+		refresh = rj.refresh
+	} else if (expired || !exists) && canRefresh {
+		refresh = &jwksRefresh{done: make(chan struct{})}
+		rj.refresh = refresh
+		rj.attemptAt = now
+		go rj.run(ctx, refresh)
+	}
+	rj.mutex.Unlock()
+
+	if refresh != nil {
+		select {
+		case <-refresh.done:
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+
+		rj.mutex.Lock()
+		jwk, exists = rj.keys[kid]
+		rj.mutex.Unlock()
+
+		// Keep serving cached keys when the remote is unavailable
+		if refresh.err != nil && !exists {
+			return nil, "", refresh.err
+		}
+	}
+
+	if !exists {
+		return nil, "", ErrKeyNotFound
+	}
+
+	publicKey, err := jwk.PublicKey()
+	if err != nil {
+		return nil, "", err
+	}
+	return publicKey, jwk.Alg, nil
+}
+
+// run performs a shared fetch. It is detached from the cancellation of the
+// caller that started it, since other callers may be waiting on it.
+func (rj *RemoteJWKS) run(ctx context.Context, refresh *jwksRefresh) {
+	keys, err := rj.fetch(context.WithoutCancel(ctx))
+
+	rj.mutex.Lock()
+	if err == nil {
+		rj.keys = keys
+		rj.fetchedAt = time.Now()
+	}
+	refresh.err = err
+	rj.refresh = nil
+	rj.mutex.Unlock()
+
+	close(refresh.done)
+}
+
+// fetch downloads the key set
+func (rj *RemoteJWKS) fetch(ctx context.Context) (map[string]JWK, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rj.url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := rj.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch JWKS: unexpected status %d", resp.StatusCode)
+	}
+
+	var set JWKSet
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, fmt.Errorf("failed to decode JWKS: %w", err)
+	}
+
+	keys := make(map[string]JWK, len(set.Keys))
+	for _, key := range set.Keys {
+		if key.Kid != "" && (key.Use == "" || key.Use == "sig") {
+			keys[key.Kid] = key
+		}
+	}
+
+	return keys, nil
+}
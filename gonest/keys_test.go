@@ -0,0 +1,296 @@
+package gonest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newKeyManagerAuthService(t *testing.T, km *KeyManager, provider KeyProvider) *AuthService {
+	t.Helper()
+
+	config := DefaultJWTConfig()
+	config.KeyManager = km
+	config.KeyProvider = provider
+	return NewAuthService(config, nil)
+}
+
+func TestKeyManagerRotationKeepsOldTokensValid(t *testing.T) {
+	km, err := NewKeyManager(&KeyManagerConfig{Algorithm: "ES256", OverlapWindow: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	as := newKeyManagerAuthService(t, km, nil)
+
+	token, err := as.GenerateToken(&AuthUser{ID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := km.ActiveKey()
+
+	if _, err := km.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if km.ActiveKey().ID == oldKey.ID {
+		t.Fatal("rotation did not change the active key")
+	}
+
+	if _, err := as.ValidateToken(token); err != nil {
+		t.Fatalf("token signed before rotation should verify during the overlap window: %v", err)
+	}
+	if got := len(km.JWKS().Keys); got != 2 {
+		t.Fatalf("JWKS should publish both keys during the overlap window, got %d", got)
+	}
+
+	// Simulate the end of the overlap window
+	km.mutex.Lock()
+	oldKey.RetiresAt = time.Now().Add(-time.Second)
+	km.mutex.Unlock()
+
+	if _, err := as.ValidateToken(token); !errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected ErrKeyNotFound after the overlap window, got %v", err)
+	}
+	if got := len(km.JWKS().Keys); got != 1 {
+		t.Fatalf("JWKS should only publish the active key, got %d", got)
+	}
+}
+
+func TestDefaultKeyManagerConfigCoversRefreshTokens(t *testing.T) {
+	jwtConfig := DefaultJWTConfig()
+	overlap := DefaultKeyManagerConfig().OverlapWindow
+
+	if overlap < jwtConfig.TokenExpiry || overlap < jwtConfig.RefreshExpiry {
+		t.Fatalf("default overlap window %s is shorter than the default token lifetimes", overlap)
+	}
+}
+
+func TestRemoteJWKSVerifiesTokens(t *testing.T) {
+	km, err := NewKeyManager(&KeyManagerConfig{Algorithm: "RS256", OverlapWindow: time.Hour}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+	e := echo.New()
+	handler := km.JWKSHandler()
+	e.GET(JWKSPath, func(c echo.Context) error {
+		fetches.Add(1)
+		return handler(c)
+	})
+	server := httptest.NewServer(e)
+	defer server.Close()
+
+	issuer := newKeyManagerAuthService(t, km, nil)
+	remote := NewRemoteJWKS(server.URL+JWKSPath, time.Hour)
+	verifier := newKeyManagerAuthService(t, nil, remote)
+
+	token, err := issuer.GenerateToken(&AuthUser{ID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := verifier.ValidateToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserID != "u1" {
+		t.Fatalf("unexpected subject %q", claims.UserID)
+	}
+	if _, err := verifier.ValidateToken(token); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("expected cached keys to be reused, got %d fetches", got)
+	}
+
+	// A token signed with a new key triggers a refetch
+	remote.minRefresh = 0
+	if _, err := km.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := issuer.GenerateToken(&AuthUser{ID: "u2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := verifier.ValidateToken(rotated); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Fatalf("expected a refetch for an unknown kid, got %d fetches", got)
+	}
+}
+
+func TestRemoteJWKSRateLimitsUnknownKidRefreshes(t *testing.T) {
+	var fetches atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"keys":[]}`))
+	}))
+	defer server.Close()
+
+	remote := NewRemoteJWKS(server.URL, time.Hour)
+	for i := 0; i < 5; i++ {
+		if _, _, err := remote.PublicKey(context.Background(), "unknown"); !errors.Is(err, ErrKeyNotFound) {
+			t.Fatalf("expected ErrKeyNotFound, got %v", err)
+		}
+	}
+
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("expected unknown kids to refetch at most once per interval, got %d fetches", got)
+	}
+}
+
+func TestRemoteJWKSSharesConcurrentFetches(t *testing.T) {
+	km, err := NewKeyManager(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		e := echo.New()
+		c := e.NewContext(r, w)
+		km.JWKSHandler()(c)
+	}))
+	defer server.Close()
+
+	remote := NewRemoteJWKS(server.URL, time.Hour)
+	kid := km.ActiveKey().ID
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := remote.PublicKey(context.Background(), kid)
+			errs <- err
+		}()
+	}
+
+	// Callers whose context ends stop waiting without cancelling the fetch
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, err := remote.PublicKey(ctx, kid); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("expected a single shared fetch, got %d", got)
+	}
+}
+
+func TestRemoteJWKSServesCachedKeysWhenUnavailable(t *testing.T) {
+	km, err := NewKeyManager(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var failing atomic.Bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		km.JWKSHandler()(echo.New().NewContext(r, w))
+	}))
+	defer server.Close()
+
+	remote := NewRemoteJWKS(server.URL, time.Hour)
+	kid := km.ActiveKey().ID
+	if _, _, err := remote.PublicKey(context.Background(), kid); err != nil {
+		t.Fatal(err)
+	}
+
+	failing.Store(true)
+	remote.cacheTTL = 0
+	remote.minRefresh = 0
+
+	if _, _, err := remote.PublicKey(context.Background(), kid); err != nil {
+		t.Fatalf("expected the cached key to be served, got %v", err)
+	}
+	if _, _, err := remote.PublicKey(context.Background(), "unknown"); err == nil || errors.Is(err, ErrKeyNotFound) {
+		t.Fatalf("expected the fetch error for an uncached kid, got %v", err)
+	}
+}
+
+func TestKeyManagersShareKeysThroughStore(t *testing.T) {
+	ctx := context.Background()
+	config := &KeyManagerConfig{
+		Algorithm:     "ES256",
+		OverlapWindow: time.Hour,
+		Store:         NewMemoryKeyStore(),
+		SyncInterval:  time.Minute,
+	}
+
+	first, err := NewKeyManager(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewKeyManager(config, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.ActiveKey().ID != second.ActiveKey().ID {
+		t.Fatal("replicas sharing a store should sign with the same key")
+	}
+
+	oldKey := first.ActiveKey()
+	newKey, err := first.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The rotated key is published everywhere before it signs
+	for _, km := range []*KeyManager{first, second} {
+		if km.ActiveKey().ID != oldKey.ID {
+			t.Fatal("the rotated key should not sign before the sync interval has passed")
+		}
+		if _, _, err := km.PublicKey(ctx, newKey.ID); err != nil {
+			t.Fatalf("the rotated key should be published: %v", err)
+		}
+	}
+
+	// Simulate the end of the sync interval
+	for _, km := range []*KeyManager{first, second} {
+		km.mutex.Lock()
+		km.keys[newKey.ID].CreatedAt = time.Now().Add(-time.Minute)
+		km.mutex.Unlock()
+	}
+
+	as := newKeyManagerAuthService(t, first, nil)
+	token, err := as.GenerateToken(&AuthUser{ID: "u1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.ActiveKey().ID != newKey.ID || second.ActiveKey().ID != newKey.ID {
+		t.Fatal("the rotated key should sign once the sync interval has passed")
+	}
+	if _, err := newKeyManagerAuthService(t, second, nil).ValidateToken(token); err != nil {
+		t.Fatalf("a token signed by one replica should verify on another: %v", err)
+	}
+}
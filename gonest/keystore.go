@@ -0,0 +1,166 @@
+package gonest
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"fmt"
+	"sync"
+)
+
+// KeyStore persists signing keys so that replicas share them
+type KeyStore interface {
+	// SaveKey inserts a key or updates the retirement of an existing one
+	SaveKey(ctx context.Context, key *SigningKey) error
+	LoadKeys(ctx context.Context) ([]*SigningKey, error)
+	DeleteKey(ctx context.Context, id string) error
+}
+
+// MemoryKeyStore implements an in-memory key store, shared by key managers
+// of the same process
+type MemoryKeyStore struct {
+	keys  map[string]SigningKey
+	mutex sync.RWMutex
+}
+
+// NewMemoryKeyStore creates a new memory key store
+func NewMemoryKeyStore() *MemoryKeyStore {
+	return &MemoryKeyStore{
+		keys: make(map[string]SigningKey),
+	}
+}
+
+// SaveKey stores a signing key
+func (mks *MemoryKeyStore) SaveKey(ctx context.Context, key *SigningKey) error {
+	mks.mutex.Lock()
+	defer mks.mutex.Unlock()
+
+	mks.keys[key.ID] = *key
+	return nil
+}
+
+// LoadKeys returns copies of all stored keys
+func (mks *MemoryKeyStore) LoadKeys(ctx context.Context) ([]*SigningKey, error) {
+	mks.mutex.RLock()
+	defer mks.mutex.RUnlock()
+
+	keys := make([]*SigningKey, 0, len(mks.keys))
+	for _, key := range mks.keys {
+		copied := key
+		keys = append(keys, &copied)
+	}
+	return keys, nil
+}
+
+// DeleteKey removes a signing key
+func (mks *MemoryKeyStore) DeleteKey(ctx context.Context, id string) error {
+	mks.mutex.Lock()
+	defer mks.mutex.Unlock()
+
+	delete(mks.keys, id)
+	return nil
+}
+
+// SQLKeyStore implements a key store on top of database/sql.
+// Private keys are stored unencrypted as PKCS #8 PEM, so access to the
+// table must be restricted like any other secret.
+type SQLKeyStore struct {
+	db *sql.DB
+}
+
+// NewSQLKeyStore creates a new SQL key store
+func NewSQLKeyStore(db *sql.DB) *SQLKeyStore {
+	return &SQLKeyStore{db: db}
+}
+
+// CreateTables creates the table used by the key store
+func (sks *SQLKeyStore) CreateTables(ctx context.Context) error {
+	query := `CREATE TABLE IF NOT EXISTS gonest_signing_keys (
+		id VARCHAR(64) PRIMARY KEY,
+		algorithm VARCHAR(16) NOT NULL,
+		private_key TEXT NOT NULL,
+		created_at TIMESTAMP NOT NULL,
+		retires_at TIMESTAMP NULL
+	)`
+	if _, err := sks.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to create key store table: %w", err)
+	}
+	return nil
+}
+
+// SaveKey stores a signing key
+func (sks *SQLKeyStore) SaveKey(ctx context.Context, key *SigningKey) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("failed to encode signing key: %w", err)
+	}
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	var retiresAt sql.NullTime
+	if !key.RetiresAt.IsZero() {
+		retiresAt = sql.NullTime{Time: key.RetiresAt, Valid: true}
+	}
+
+	query := `INSERT INTO gonest_signing_keys (id, algorithm, private_key, created_at, retires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (id) DO UPDATE SET retires_at = EXCLUDED.retires_at`
+	_, err = sks.db.ExecContext(ctx, query, key.ID, key.Algorithm, string(encoded), key.CreatedAt, retiresAt)
+	return err
+}
+
+// LoadKeys returns all stored keys
+func (sks *SQLKeyStore) LoadKeys(ctx context.Context) ([]*SigningKey, error) {
+	rows, err := sks.db.QueryContext(ctx, `SELECT id, algorithm, private_key, created_at, retires_at FROM gonest_signing_keys`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []*SigningKey
+	for rows.Next() {
+		var key SigningKey
+		var encoded string
+		var retiresAt sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Algorithm, &encoded, &key.CreatedAt, &retiresAt); err != nil {
+			return nil, err
+		}
+
+		signer, err := decodeSigningKey(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing key '%s': %w", key.ID, err)
+		}
+		key.PrivateKey = signer
+		if retiresAt.Valid {
+			key.RetiresAt = retiresAt.Time
+		}
+		keys = append(keys, &key)
+	}
+	return keys, rows.Err()
+}
+
+// DeleteKey removes a signing key
+func (sks *SQLKeyStore) DeleteKey(ctx context.Context, id string) error {
+	_, err := sks.db.ExecContext(ctx, `DELETE FROM gonest_signing_keys WHERE id = $1`, id)
+	return err
+}
+
+// decodeSigningKey decodes a PKCS #8 PEM private key
+func decodeSigningKey(encoded string) (crypto.Signer, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found")
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := privateKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", privateKey)
+	}
+	return signer, nil
+}
@@ -0,0 +1,1372 @@
+package gonest
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// This file holds a minimal Lua 5.1 interpreter, so tests run the Redis
+// scripts themselves rather than their Go emulations. It supports the
+// subset the scripts use: locals, assignments, if statements, return,
+// tables, function calls and the usual operators, with the math, cjson and
+// redis libraries. Other syntax fails to parse, so a script that outgrows
+// the subset fails its tests instead of being skipped.
+
+// luaValue is nil, bool, float64, string, *luaTable or luaFunction
+type luaValue interface{}
+
+// luaFunction is a function callable from Lua
+type luaFunction func(args []luaValue) ([]luaValue, error)
+
+// luaTable is a Lua table
+type luaTable struct {
+	fields map[luaValue]luaValue
+}
+
+func newLuaTable() *luaTable {
+	return &luaTable{fields: make(map[luaValue]luaValue)}
+}
+
+func (t *luaTable) get(key luaValue) luaValue {
+	return t.fields[key]
+}
+
+func (t *luaTable) set(key, value luaValue) {
+	if value == nil {
+		delete(t.fields, key)
+		return
+	}
+	t.fields[key] = value
+}
+
+// length returns the border of the array part
+func (t *luaTable) length() int {
+	n := 0
+	for t.fields[float64(n+1)] != nil {
+		n++
+	}
+	return n
+}
+
+// luaScope holds the local variables of a block
+type luaScope struct {
+	vars    map[string]*luaValue
+	parent  *luaScope
+	globals map[string]luaValue
+}
+
+func (s *luaScope) child() *luaScope {
+	return &luaScope{vars: make(map[string]*luaValue), parent: s, globals: s.globals}
+}
+
+func (s *luaScope) lookup(name string) (*luaValue, bool) {
+	for scope := s; scope != nil; scope = scope.parent {
+		if slot, ok := scope.vars[name]; ok {
+			return slot, true
+		}
+	}
+	return nil, false
+}
+
+func (s *luaScope) get(name string) luaValue {
+	if slot, ok := s.lookup(name); ok {
+		return *slot
+	}
+	return s.globals[name]
+}
+
+func (s *luaScope) assign(name string, value luaValue) {
+	if slot, ok := s.lookup(name); ok {
+		*slot = value
+		return
+	}
+	s.globals[name] = value
+}
+
+func (s *luaScope) declare(name string, value luaValue) {
+	s.vars[name] = &value
+}
+
+// Lexer
+
+type luaTokenKind int
+
+const (
+	luaTokenEOF luaTokenKind = iota
+	luaTokenName
+	luaTokenNumber
+	luaTokenString
+	luaTokenSymbol
+)
+
+type luaToken struct {
+	kind  luaTokenKind
+	text  string
+	num   float64
+	line  int
+	isKey bool
+}
+
+var luaKeywords = map[string]bool{
+	"and": true, "break": true, "do": true, "else": true, "elseif": true, "end": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "local": true,
+	"nil": true, "not": true, "or": true, "repeat": true, "return": true, "then": true,
+	"true": true, "until": true, "while": true,
+}
+
+func luaLex(source string) ([]luaToken, error) {
+	var tokens []luaToken
+	line := 1
+	i := 0
+	for i < len(source) {
+		c := source[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case strings.HasPrefix(source[i:], "--"):
+			if strings.HasPrefix(source[i:], "--[[") {
+				end := strings.Index(source[i:], "]]")
+				if end < 0 {
+					return nil, fmt.Errorf("line %d: unfinished long comment", line)
+				}
+				line += strings.Count(source[i:i+end], "\n")
+				i += end + 2
+				continue
+			}
+			for i < len(source) && source[i] != '\n' {
+				i++
+			}
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(source) && (source[i] == '_' || source[i] >= 'a' && source[i] <= 'z' ||
+				source[i] >= 'A' && source[i] <= 'Z' || source[i] >= '0' && source[i] <= '9') {
+				i++
+			}
+			word := source[start:i]
+			tokens = append(tokens, luaToken{kind: luaTokenName, text: word, line: line, isKey: luaKeywords[word]})
+		case c >= '0' && c <= '9' || c == '.' && i+1 < len(source) && source[i+1] >= '0' && source[i+1] <= '9':
+			start := i
+			for i < len(source) && (source[i] >= '0' && source[i] <= '9' || source[i] == '.' ||
+				source[i] == 'e' || source[i] == 'E' ||
+				(source[i] == '-' || source[i] == '+') && (source[i-1] == 'e' || source[i-1] == 'E')) {
+				i++
+			}
+			num, err := strconv.ParseFloat(source[start:i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: malformed number '%s'", line, source[start:i])
+			}
+			tokens = append(tokens, luaToken{kind: luaTokenNumber, num: num, line: line})
+		case c == '\'' || c == '"':
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(source) || source[i] == '\n' {
+					return nil, fmt.Errorf("line %d: unfinished string", line)
+				}
+				if source[i] == c {
+					i++
+					break
+				}
+				if source[i] == '\\' && i+1 < len(source) {
+					i++
+					switch source[i] {
+					case 'n':
+						sb.WriteByte('\n')
+					case 't':
+						sb.WriteByte('\t')
+					case 'r':
+						sb.WriteByte('\r')
+					default:
+						sb.WriteByte(source[i])
+					}
+					i++
+					continue
+				}
+				sb.WriteByte(source[i])
+				i++
+			}
+			tokens = append(tokens, luaToken{kind: luaTokenString, text: sb.String(), line: line})
+		default:
+			symbol := ""
+			for _, candidate := range []string{"...", "==", "~=", "<=", ">=", "..", "+", "-", "*", "/", "%", "^", "#",
+				"<", ">", "=", "(", ")", "{", "}", "[", "]", ";", ":", ",", "."} {
+				if strings.HasPrefix(source[i:], candidate) {
+					symbol = candidate
+					break
+				}
+			}
+			if symbol == "" {
+				return nil, fmt.Errorf("line %d: unexpected character '%c'", line, c)
+			}
+			tokens = append(tokens, luaToken{kind: luaTokenSymbol, text: symbol, line: line})
+			i += len(symbol)
+		}
+	}
+	return append(tokens, luaToken{kind: luaTokenEOF, line: line}), nil
+}
+
+// AST
+
+type luaExpr interface {
+	eval(s *luaScope) (luaValue, error)
+}
+
+// luaMultiExpr is an expression that can produce several values
+type luaMultiExpr interface {
+	evalMulti(s *luaScope) ([]luaValue, error)
+}
+
+type luaStmt interface {
+	exec(s *luaScope) (values []luaValue, returned bool, err error)
+}
+
+type luaConst struct{ value luaValue }
+
+func (e luaConst) eval(*luaScope) (luaValue, error) { return e.value, nil }
+
+type luaName struct{ name string }
+
+func (e luaName) eval(s *luaScope) (luaValue, error) { return s.get(e.name), nil }
+
+type luaIndex struct {
+	object, key luaExpr
+	line        int
+}
+
+func (e luaIndex) eval(s *luaScope) (luaValue, error) {
+	object, err := e.object.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	key, err := e.key.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	table, ok := object.(*luaTable)
+	if !ok {
+		return nil, fmt.Errorf("line %d: attempt to index a %s value", e.line, luaTypeName(object))
+	}
+	return table.get(key), nil
+}
+
+type luaCall struct {
+	function luaExpr
+	args     []luaExpr
+	line     int
+}
+
+func (e luaCall) evalMulti(s *luaScope) ([]luaValue, error) {
+	value, err := e.function.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	function, ok := value.(luaFunction)
+	if !ok {
+		return nil, fmt.Errorf("line %d: attempt to call a %s value", e.line, luaTypeName(value))
+	}
+	args, err := luaEvalList(s, e.args)
+	if err != nil {
+		return nil, err
+	}
+	results, err := function(args)
+	if err != nil {
+		return nil, fmt.Errorf("line %d: %w", e.line, err)
+	}
+	return results, nil
+}
+
+func (e luaCall) eval(s *luaScope) (luaValue, error) {
+	results, err := e.evalMulti(s)
+	if err != nil || len(results) == 0 {
+		return nil, err
+	}
+	return results[0], nil
+}
+
+type luaTableField struct {
+	key   luaExpr // nil for positional fields
+	value luaExpr
+}
+
+type luaTableConstructor struct{ fields []luaTableField }
+
+func (e luaTableConstructor) eval(s *luaScope) (luaValue, error) {
+	table := newLuaTable()
+	position := 1
+	for i, field := range e.fields {
+		if field.key == nil {
+			// A trailing call expands to all its values
+			if multi, ok := field.value.(luaMultiExpr); ok && i == len(e.fields)-1 {
+				values, err := multi.evalMulti(s)
+				if err != nil {
+					return nil, err
+				}
+				for _, value := range values {
+					table.set(float64(position), value)
+					position++
+				}
+				continue
+			}
+			value, err := field.value.eval(s)
+			if err != nil {
+				return nil, err
+			}
+			table.set(float64(position), value)
+			position++
+			continue
+		}
+		key, err := field.key.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		value, err := field.value.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		table.set(key, value)
+	}
+	return table, nil
+}
+
+type luaUnary struct {
+	op      string
+	operand luaExpr
+	line    int
+}
+
+func (e luaUnary) eval(s *luaScope) (luaValue, error) {
+	value, err := e.operand.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "not":
+		return !luaTruthy(value), nil
+	case "-":
+		n, ok := luaToNumber(value)
+		if !ok {
+			return nil, fmt.Errorf("line %d: attempt to perform arithmetic on a %s value", e.line, luaTypeName(value))
+		}
+		return -n, nil
+	case "#":
+		switch v := value.(type) {
+		case string:
+			return float64(len(v)), nil
+		case *luaTable:
+			return float64(v.length()), nil
+		}
+		return nil, fmt.Errorf("line %d: attempt to get length of a %s value", e.line, luaTypeName(value))
+	}
+	return nil, fmt.Errorf("line %d: unknown operator %s", e.line, e.op)
+}
+
+type luaBinary struct {
+	op          string
+	left, right luaExpr
+	line        int
+}
+
+func (e luaBinary) eval(s *luaScope) (luaValue, error) {
+	left, err := e.left.eval(s)
+	if err != nil {
+		return nil, err
+	}
+	switch e.op {
+	case "and":
+		if !luaTruthy(left) {
+			return left, nil
+		}
+		return e.right.eval(s)
+	case "or":
+		if luaTruthy(left) {
+			return left, nil
+		}
+		return e.right.eval(s)
+	}
+
+	right, err := e.right.eval(s)
+	if err != nil {
+		return nil, err
+	}
+
+	switch e.op {
+	case "==":
+		return luaEqual(left, right), nil
+	case "~=":
+		return !luaEqual(left, right), nil
+	case "<", "<=", ">", ">=":
+		return luaCompare(e.op, left, right, e.line)
+	case "..":
+		ls, lok := luaToString(left)
+		rs, rok := luaToString(right)
+		if !lok || !rok {
+			return nil, fmt.Errorf("line %d: attempt to concatenate a %s value", e.line, luaTypeName(left))
+		}
+		return ls + rs, nil
+	}
+
+	a, aok := luaToNumber(left)
+	b, bok := luaToNumber(right)
+	if !aok || !bok {
+		operand := left
+		if aok {
+			operand = right
+		}
+		return nil, fmt.Errorf("line %d: attempt to perform arithmetic on a %s value", e.line, luaTypeName(operand))
+	}
+	switch e.op {
+	case "+":
+		return a + b, nil
+	case "-":
+		return a - b, nil
+	case "*":
+		return a * b, nil
+	case "/":
+		return a / b, nil
+	case "%":
+		return a - math.Floor(a/b)*b, nil
+	case "^":
+		return math.Pow(a, b), nil
+	}
+	return nil, fmt.Errorf("line %d: unknown operator %s", e.line, e.op)
+}
+
+type luaLocal struct {
+	names  []string
+	values []luaExpr
+}
+
+func (st luaLocal) exec(s *luaScope) ([]luaValue, bool, error) {
+	values, err := luaEvalList(s, st.values)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, name := range st.names {
+		var value luaValue
+		if i < len(values) {
+			value = values[i]
+		}
+		s.declare(name, value)
+	}
+	return nil, false, nil
+}
+
+type luaAssign struct {
+	targets []luaExpr
+	values  []luaExpr
+	line    int
+}
+
+func (st luaAssign) exec(s *luaScope) ([]luaValue, bool, error) {
+	values, err := luaEvalList(s, st.values)
+	if err != nil {
+		return nil, false, err
+	}
+	for i, target := range st.targets {
+		var value luaValue
+		if i < len(values) {
+			value = values[i]
+		}
+		switch t := target.(type) {
+		case luaName:
+			s.assign(t.name, value)
+		case luaIndex:
+			object, err := t.object.eval(s)
+			if err != nil {
+				return nil, false, err
+			}
+			key, err := t.key.eval(s)
+			if err != nil {
+				return nil, false, err
+			}
+			table, ok := object.(*luaTable)
+			if !ok {
+				return nil, false, fmt.Errorf("line %d: attempt to index a %s value", st.line, luaTypeName(object))
+			}
+			table.set(key, value)
+		default:
+			return nil, false, fmt.Errorf("line %d: cannot assign", st.line)
+		}
+	}
+	return nil, false, nil
+}
+
+type luaCallStmt struct{ call luaCall }
+
+func (st luaCallStmt) exec(s *luaScope) ([]luaValue, bool, error) {
+	_, err := st.call.evalMulti(s)
+	return nil, false, err
+}
+
+type luaIf struct {
+	conditions []luaExpr
+	blocks     []luaBlock
+	elseBlock  luaBlock
+}
+
+func (st luaIf) exec(s *luaScope) ([]luaValue, bool, error) {
+	for i, condition := range st.conditions {
+		value, err := condition.eval(s)
+		if err != nil {
+			return nil, false, err
+		}
+		if luaTruthy(value) {
+			return st.blocks[i].exec(s.child())
+		}
+	}
+	if st.elseBlock != nil {
+		return st.elseBlock.exec(s.child())
+	}
+	return nil, false, nil
+}
+
+type luaReturn struct{ values []luaExpr }
+
+func (st luaReturn) exec(s *luaScope) ([]luaValue, bool, error) {
+	values, err := luaEvalList(s, st.values)
+	return values, true, err
+}
+
+type luaBlock []luaStmt
+
+func (b luaBlock) exec(s *luaScope) ([]luaValue, bool, error) {
+	for _, st := range b {
+		values, returned, err := st.exec(s)
+		if err != nil || returned {
+			return values, returned, err
+		}
+	}
+	return nil, false, nil
+}
+
+// luaEvalList evaluates an expression list; a trailing call expands to all its values
+func luaEvalList(s *luaScope, exprs []luaExpr) ([]luaValue, error) {
+	values := make([]luaValue, 0, len(exprs))
+	for i, expr := range exprs {
+		if multi, ok := expr.(luaMultiExpr); ok && i == len(exprs)-1 {
+			results, err := multi.evalMulti(s)
+			if err != nil {
+				return nil, err
+			}
+			return append(values, results...), nil
+		}
+		value, err := expr.eval(s)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// Parser
+
+type luaParser struct {
+	tokens []luaToken
+	pos    int
+}
+
+func parseLua(source string) (luaBlock, error) {
+	tokens, err := luaLex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &luaParser{tokens: tokens}
+	block, err := p.block()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != luaTokenEOF {
+		return nil, p.errorf("unexpected '%s'", p.peek().text)
+	}
+	return block, nil
+}
+
+func (p *luaParser) peek() luaToken { return p.tokens[p.pos] }
+
+func (p *luaParser) next() luaToken {
+	token := p.tokens[p.pos]
+	if token.kind != luaTokenEOF {
+		p.pos++
+	}
+	return token
+}
+
+func (p *luaParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", p.peek().line, fmt.Sprintf(format, args...))
+}
+
+// is checks if the next token is a keyword or symbol
+func (p *luaParser) is(text string) bool {
+	token := p.peek()
+	return (token.kind == luaTokenSymbol || token.isKey) && token.text == text
+}
+
+func (p *luaParser) accept(text string) bool {
+	if p.is(text) {
+		p.next()
+		return true
+	}
+	return false
+}
+
+func (p *luaParser) expect(text string) error {
+	if !p.accept(text) {
+		return p.errorf("'%s' expected near '%s'", text, p.peek().text)
+	}
+	return nil
+}
+
+func (p *luaParser) name() (string, error) {
+	token := p.peek()
+	if token.kind != luaTokenName || token.isKey {
+		return "", p.errorf("name expected near '%s'", token.text)
+	}
+	p.next()
+	return token.text, nil
+}
+
+// blockEnd checks if the next token ends a block
+func (p *luaParser) blockEnd() bool {
+	return p.peek().kind == luaTokenEOF || p.is("end") || p.is("else") || p.is("elseif")
+}
+
+func (p *luaParser) block() (luaBlock, error) {
+	var block luaBlock
+	for !p.blockEnd() {
+		if p.accept(";") {
+			continue
+		}
+		if p.accept("return") {
+			var values []luaExpr
+			if !p.blockEnd() && !p.is(";") {
+				var err error
+				if values, err = p.exprList(); err != nil {
+					return nil, err
+				}
+			}
+			p.accept(";")
+			if !p.blockEnd() {
+				return nil, p.errorf("'end' expected after return")
+			}
+			return append(block, luaReturn{values: values}), nil
+		}
+		st, err := p.statement()
+		if err != nil {
+			return nil, err
+		}
+		block = append(block, st)
+	}
+	return block, nil
+}
+
+func (p *luaParser) statement() (luaStmt, error) {
+	line := p.peek().line
+	switch {
+	case p.accept("local"):
+		var names []string
+		for {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, name)
+			if !p.accept(",") {
+				break
+			}
+		}
+		var values []luaExpr
+		if p.accept("=") {
+			var err error
+			if values, err = p.exprList(); err != nil {
+				return nil, err
+			}
+		}
+		return luaLocal{names: names, values: values}, nil
+
+	case p.accept("if"):
+		var st luaIf
+		for {
+			condition, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("then"); err != nil {
+				return nil, err
+			}
+			block, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			st.conditions = append(st.conditions, condition)
+			st.blocks = append(st.blocks, block)
+			if !p.accept("elseif") {
+				break
+			}
+		}
+		if p.accept("else") {
+			block, err := p.block()
+			if err != nil {
+				return nil, err
+			}
+			st.elseBlock = block
+		}
+		return st, p.expect("end")
+	}
+
+	if p.peek().isKey {
+		return nil, p.errorf("unsupported statement '%s'", p.peek().text)
+	}
+
+	first, err := p.suffixedExpr()
+	if err != nil {
+		return nil, err
+	}
+	if call, ok := first.(luaCall); ok && !p.is("=") && !p.is(",") {
+		return luaCallStmt{call: call}, nil
+	}
+
+	targets := []luaExpr{first}
+	for p.accept(",") {
+		target, err := p.suffixedExpr()
+		if err != nil {
+			return nil, err
+		}
+		targets = append(targets, target)
+	}
+	for _, target := range targets {
+		switch target.(type) {
+		case luaName, luaIndex:
+		default:
+			return nil, p.errorf("syntax error near '%s'", p.peek().text)
+		}
+	}
+	if err := p.expect("="); err != nil {
+		return nil, err
+	}
+	values, err := p.exprList()
+	if err != nil {
+		return nil, err
+	}
+	return luaAssign{targets: targets, values: values, line: line}, nil
+}
+
+func (p *luaParser) exprList() ([]luaExpr, error) {
+	var exprs []luaExpr
+	for {
+		expr, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+		if !p.accept(",") {
+			return exprs, nil
+		}
+	}
+}
+
+// luaBinaryPriority holds the left and right priority of binary operators
+var luaBinaryPriority = map[string][2]int{
+	"or": {1, 1}, "and": {2, 2},
+	"<": {3, 3}, ">": {3, 3}, "<=": {3, 3}, ">=": {3, 3}, "~=": {3, 3}, "==": {3, 3},
+	"..": {5, 4}, "+": {6, 6}, "-": {6, 6},
+	"*": {7, 7}, "/": {7, 7}, "%": {7, 7},
+	"^": {10, 9},
+}
+
+// luaUnaryPriority is the priority of unary operators
+const luaUnaryPriority = 8
+
+// expr parses an expression whose operators bind tighter than limit
+func (p *luaParser) expr(limit int) (luaExpr, error) {
+	var left luaExpr
+	line := p.peek().line
+	if p.is("not") || p.is("-") || p.is("#") {
+		op := p.next().text
+		operand, err := p.expr(luaUnaryPriority)
+		if err != nil {
+			return nil, err
+		}
+		left = luaUnary{op: op, operand: operand, line: line}
+	} else {
+		var err error
+		if left, err = p.simpleExpr(); err != nil {
+			return nil, err
+		}
+	}
+
+	for {
+		token := p.peek()
+		if token.kind != luaTokenSymbol && !token.isKey {
+			return left, nil
+		}
+		priority, ok := luaBinaryPriority[token.text]
+		if !ok || priority[0] <= limit {
+			return left, nil
+		}
+		p.next()
+		right, err := p.expr(priority[1])
+		if err != nil {
+			return nil, err
+		}
+		left = luaBinary{op: token.text, left: left, right: right, line: token.line}
+	}
+}
+
+func (p *luaParser) simpleExpr() (luaExpr, error) {
+	token := p.peek()
+	switch {
+	case token.kind == luaTokenNumber:
+		p.next()
+		return luaConst{value: token.num}, nil
+	case token.kind == luaTokenString:
+		p.next()
+		return luaConst{value: token.text}, nil
+	case p.accept("nil"):
+		return luaConst{}, nil
+	case p.accept("true"):
+		return luaConst{value: true}, nil
+	case p.accept("false"):
+		return luaConst{value: false}, nil
+	case p.is("{"):
+		return p.tableConstructor()
+	}
+	return p.suffixedExpr()
+}
+
+func (p *luaParser) primaryExpr() (luaExpr, error) {
+	if p.accept("(") {
+		expr, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		// Parentheses truncate a call to its first value
+		if _, ok := expr.(luaMultiExpr); ok {
+			return luaSingle{expr: expr}, nil
+		}
+		return expr, nil
+	}
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	return luaName{name: name}, nil
+}
+
+// luaSingle truncates a call to its first value
+type luaSingle struct{ expr luaExpr }
+
+func (e luaSingle) eval(s *luaScope) (luaValue, error) { return e.expr.eval(s) }
+
+func (p *luaParser) suffixedExpr() (luaExpr, error) {
+	expr, err := p.primaryExpr()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		line := p.peek().line
+		switch {
+		case p.accept("."):
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			expr = luaIndex{object: expr, key: luaConst{value: name}, line: line}
+		case p.accept("["):
+			key, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			expr = luaIndex{object: expr, key: key, line: line}
+		case p.accept("("):
+			var args []luaExpr
+			if !p.is(")") {
+				if args, err = p.exprList(); err != nil {
+					return nil, err
+				}
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			expr = luaCall{function: expr, args: args, line: line}
+		default:
+			return expr, nil
+		}
+	}
+}
+
+func (p *luaParser) tableConstructor() (luaExpr, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var table luaTableConstructor
+	for !p.is("}") {
+		var field luaTableField
+		switch {
+		case p.accept("["):
+			key, err := p.expr(0)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			if err := p.expect("="); err != nil {
+				return nil, err
+			}
+			field.key = key
+		case p.peek().kind == luaTokenName && !p.peek().isKey && p.tokens[p.pos+1].text == "=" &&
+			p.tokens[p.pos+1].kind == luaTokenSymbol:
+			field.key = luaConst{value: p.next().text}
+			p.next()
+		}
+		value, err := p.expr(0)
+		if err != nil {
+			return nil, err
+		}
+		field.value = value
+		table.fields = append(table.fields, field)
+		if !p.accept(",") && !p.accept(";") {
+			break
+		}
+	}
+	return table, p.expect("}")
+}
+
+// Values
+
+func luaTruthy(value luaValue) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	}
+	return true
+}
+
+func luaTypeName(value luaValue) string {
+	switch value.(type) {
+	case nil:
+		return "nil"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *luaTable:
+		return "table"
+	case luaFunction:
+		return "function"
+	}
+	return "userdata"
+}
+
+func luaToNumber(value luaValue) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		return n, err == nil
+	}
+	return 0, false
+}
+
+// luaFormatNumber formats a number like Lua's tostring
+func luaFormatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'g', 14, 64)
+}
+
+func luaToString(value luaValue) (string, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case float64:
+		return luaFormatNumber(v), true
+	}
+	return "", false
+}
+
+func luaEqual(a, b luaValue) bool {
+	if ta, ok := a.(*luaTable); ok {
+		tb, ok := b.(*luaTable)
+		return ok && ta == tb
+	}
+	if _, ok := a.(luaFunction); ok {
+		return false
+	}
+	return a == b
+}
+
+func luaCompare(op string, left, right luaValue, line int) (luaValue, error) {
+	var less, equal bool
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return nil, fmt.Errorf("line %d: attempt to compare number with %s", line, luaTypeName(right))
+		}
+		less, equal = l < r, l == r
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return nil, fmt.Errorf("line %d: attempt to compare string with %s", line, luaTypeName(right))
+		}
+		less, equal = l < r, l == r
+	default:
+		return nil, fmt.Errorf("line %d: attempt to compare two %s values", line, luaTypeName(left))
+	}
+	switch op {
+	case "<":
+		return less, nil
+	case "<=":
+		return less || equal, nil
+	case ">":
+		return !less && !equal, nil
+	}
+	return !less, nil
+}
+
+// Libraries
+
+func luaNumberArg(args []luaValue, i int, name string) (float64, error) {
+	if i < len(args) {
+		if n, ok := luaToNumber(args[i]); ok {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("bad argument #%d to '%s' (number expected)", i+1, name)
+}
+
+func luaMathLibrary() *luaTable {
+	math1 := func(name string, f func(float64) float64) luaFunction {
+		return func(args []luaValue) ([]luaValue, error) {
+			n, err := luaNumberArg(args, 0, name)
+			if err != nil {
+				return nil, err
+			}
+			return []luaValue{f(n)}, nil
+		}
+	}
+	extreme := func(name string, better func(a, b float64) bool) luaFunction {
+		return func(args []luaValue) ([]luaValue, error) {
+			result, err := luaNumberArg(args, 0, name)
+			if err != nil {
+				return nil, err
+			}
+			for i := 1; i < len(args); i++ {
+				n, err := luaNumberArg(args, i, name)
+				if err != nil {
+					return nil, err
+				}
+				if better(n, result) {
+					result = n
+				}
+			}
+			return []luaValue{result}, nil
+		}
+	}
+
+	library := newLuaTable()
+	library.set("floor", math1("floor", math.Floor))
+	library.set("ceil", math1("ceil", math.Ceil))
+	library.set("abs", math1("abs", math.Abs))
+	library.set("max", extreme("max", func(a, b float64) bool { return a > b }))
+	library.set("min", extreme("min", func(a, b float64) bool { return a < b }))
+	library.set("huge", math.Inf(1))
+	return library
+}
+
+func luaCJSONLibrary() *luaTable {
+	library := newLuaTable()
+	library.set("encode", luaFunction(func(args []luaValue) ([]luaValue, error) {
+		if len(args) == 0 {
+			return nil, fmt.Errorf("bad argument #1 to 'encode'")
+		}
+		var sb strings.Builder
+		if err := luaEncodeJSON(&sb, args[0]); err != nil {
+			return nil, err
+		}
+		return []luaValue{sb.String()}, nil
+	}))
+	library.set("decode", luaFunction(func(args []luaValue) ([]luaValue, error) {
+		text, ok := luaToString(firstLuaValue(args))
+		if !ok {
+			return nil, fmt.Errorf("bad argument #1 to 'decode' (string expected)")
+		}
+		var decoded interface{}
+		if err := json.Unmarshal([]byte(text), &decoded); err != nil {
+			return nil, err
+		}
+		return []luaValue{luaFromJSON(decoded)}, nil
+	}))
+	return library
+}
+
+func firstLuaValue(args []luaValue) luaValue {
+	if len(args) == 0 {
+		return nil
+	}
+	return args[0]
+}
+
+// luaEncodeJSON encodes like cjson: numbers with 14 significant digits,
+// tables with keys 1..n as arrays and other tables as objects
+func luaEncodeJSON(sb *strings.Builder, value luaValue) error {
+	switch v := value.(type) {
+	case nil:
+		sb.WriteString("null")
+	case bool:
+		sb.WriteString(strconv.FormatBool(v))
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return fmt.Errorf("Cannot serialise number: must not be NaN or Inf")
+		}
+		sb.WriteString(luaFormatNumber(v))
+	case string:
+		encoded, _ := json.Marshal(v)
+		sb.Write(encoded)
+	case *luaTable:
+		if n := v.length(); n > 0 && n == len(v.fields) {
+			sb.WriteByte('[')
+			for i := 1; i <= n; i++ {
+				if i > 1 {
+					sb.WriteByte(',')
+				}
+				if err := luaEncodeJSON(sb, v.get(float64(i))); err != nil {
+					return err
+				}
+			}
+			sb.WriteByte(']')
+			return nil
+		}
+		keys := make([]string, 0, len(v.fields))
+		values := make(map[string]luaValue, len(v.fields))
+		for key, field := range v.fields {
+			name, ok := luaToString(key)
+			if !ok {
+				return fmt.Errorf("Cannot serialise table: table key must be a number or string")
+			}
+			keys = append(keys, name)
+			values[name] = field
+		}
+		sort.Strings(keys)
+		sb.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			encoded, _ := json.Marshal(key)
+			sb.Write(encoded)
+			sb.WriteByte(':')
+			if err := luaEncodeJSON(sb, values[key]); err != nil {
+				return err
+			}
+		}
+		sb.WriteByte('}')
+	default:
+		return fmt.Errorf("Cannot serialise %s", luaTypeName(value))
+	}
+	return nil
+}
+
+func luaFromJSON(value interface{}) luaValue {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		table := newLuaTable()
+		for key, field := range v {
+			table.set(key, luaFromJSON(field))
+		}
+		return table
+	case []interface{}:
+		table := newLuaTable()
+		for i, item := range v {
+			table.set(float64(i+1), luaFromJSON(item))
+		}
+		return table
+	}
+	return value
+}
+
+// luaFromRedis converts a command reply to Lua like Redis does: nil bulk
+// replies become false and status replies become {ok = status}
+func luaFromRedis(reply interface{}) (luaValue, error) {
+	switch v := reply.(type) {
+	case nil:
+		return false, nil
+	case int64:
+		return float64(v), nil
+	case []byte:
+		return string(v), nil
+	case string:
+		table := newLuaTable()
+		table.set("ok", v)
+		return table, nil
+	case RedisError:
+		return nil, v
+	case []interface{}:
+		table := newLuaTable()
+		for i, item := range v {
+			converted, err := luaFromRedis(item)
+			if err != nil {
+				return nil, err
+			}
+			table.set(float64(i+1), converted)
+		}
+		return table, nil
+	}
+	return nil, fmt.Errorf("unsupported reply %T", reply)
+}
+
+// luaToRedis converts a script result like Redis does: numbers are
+// truncated to integers and arrays stop at the first nil
+func luaToRedis(value luaValue) interface{} {
+	switch v := value.(type) {
+	case float64:
+		return int64(v)
+	case string:
+		return []byte(v)
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return nil
+	case *luaTable:
+		if message, ok := v.get("err").(string); ok {
+			return RedisError(message)
+		}
+		if status, ok := v.get("ok").(string); ok {
+			return status
+		}
+		var items []interface{}
+		for i := 1; v.get(float64(i)) != nil; i++ {
+			items = append(items, luaToRedis(v.get(float64(i))))
+		}
+		return items
+	}
+	return nil
+}
+
+// newLuaMockRedisScript runs a Lua script with the test interpreter, for
+// MockRedisServer.RegisterScript. Commands run through call.
+func newLuaMockRedisScript(source string) (MockRedisScript, error) {
+	chunk, err := parseLua(source)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(call func(args ...string) interface{}, keys []string, args [][]byte) interface{} {
+		keyTable, argTable := newLuaTable(), newLuaTable()
+		for i, key := range keys {
+			keyTable.set(float64(i+1), key)
+		}
+		for i, arg := range args {
+			argTable.set(float64(i+1), string(arg))
+		}
+
+		redis := newLuaTable()
+		redis.set("call", luaFunction(func(values []luaValue) ([]luaValue, error) {
+			if len(values) == 0 {
+				return nil, fmt.Errorf("Please specify at least one argument for redis.call()")
+			}
+			commandArgs := make([]string, len(values))
+			for i, value := range values {
+				switch v := value.(type) {
+				case string:
+					commandArgs[i] = v
+				case float64:
+					commandArgs[i] = strconv.FormatFloat(v, 'g', 17, 64)
+				default:
+					return nil, fmt.Errorf("Lua redis() command arguments must be strings or integers")
+				}
+			}
+			converted, err := luaFromRedis(call(commandArgs...))
+			if err != nil {
+				return nil, err
+			}
+			return []luaValue{converted}, nil
+		}))
+
+		globals := map[string]luaValue{
+			"KEYS":  keyTable,
+			"ARGV":  argTable,
+			"redis": redis,
+			"math":  luaMathLibrary(),
+			"cjson": luaCJSONLibrary(),
+			"tonumber": luaFunction(func(values []luaValue) ([]luaValue, error) {
+				if n, ok := luaToNumber(firstLuaValue(values)); ok {
+					return []luaValue{n}, nil
+				}
+				return []luaValue{nil}, nil
+			}),
+			"tostring": luaFunction(func(values []luaValue) ([]luaValue, error) {
+				value := firstLuaValue(values)
+				if text, ok := luaToString(value); ok {
+					return []luaValue{text}, nil
+				}
+				return []luaValue{fmt.Sprint(value)}, nil
+			}),
+			"type": luaFunction(func(values []luaValue) ([]luaValue, error) {
+				return []luaValue{luaTypeName(firstLuaValue(values))}, nil
+			}),
+		}
+
+		scope := &luaScope{vars: make(map[string]*luaValue), globals: globals}
+		results, _, err := chunk.exec(scope)
+		if err != nil {
+			return RedisError("ERR Error running script: " + err.Error())
+		}
+		return luaToRedis(firstLuaValue(results))
+	}, nil
+}
+
+func TestLuaInterpreter(t *testing.T) {
+	tests := map[string]interface{}{
+		`return 1 + 2 * 3 ^ 2 / 3`:                   int64(7),
+		`return -7 % 3`:                              int64(2),
+		`return 2 ^ 3 ^ 2`:                           int64(512),
+		`return (nil or 4) and 5`:                    int64(5),
+		`return not nil == true`:                     int64(1),
+		`return #{1, 2, 3} .. ''`:                    []byte("3"),
+		`local a, b = 1 return b == nil and a`:       int64(1),
+		`local t = {x = 1} t.x = t.x + 1 return t.x`: int64(2),
+		`local x = 1 if x > 1 then x = 10 elseif x == 1 then x = 20 else x = 30 end return x`: int64(20),
+		`return cjson.encode(cjson.decode('{"a":[1,2.5]}'))`:                                  []byte(`{"a":[1,2.5]}`),
+		`return math.max(1, 3, 2) + math.floor(-1.5) + tonumber('4')`:                         int64(5),
+		`return {1, 'a', nil, 3}`:                    []interface{}{int64(1), []byte("a")},
+		`return redis.call('GET', KEYS[1]) == false`: int64(1),
+	}
+
+	for source, want := range tests {
+		script, err := newLuaMockRedisScript(source)
+		if err != nil {
+			t.Fatalf("%s: %v", source, err)
+		}
+		call := func(args ...string) interface{} { return nil }
+		got := script(call, []string{"key"}, nil)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %#v, want %#v", source, got, want)
+		}
+	}
+
+	if _, err := newLuaMockRedisScript(`for i = 1, 2 do end`); err == nil {
+		t.Error("expected unsupported syntax to fail to parse")
+	}
+}
@@ -0,0 +1,151 @@
+package gonest
+
+import (
+	"runtime"
+	"sync"
+	"weak"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Route metadata is attached to controllers and handlers when they are built
+// and resolved at request time, so that global middleware such as guards and
+// exception handlers can read it before route-level middleware runs.
+
+// metadataContextKey is the echo context key for metadata set by MetadataMiddleware
+const metadataContextKey = "gonest.metadata"
+
+// MetadataEntry is a key/value pair attached to a controller or route
+type MetadataEntry struct {
+	Key   string
+	Value interface{}
+}
+
+// SetMetadata creates a metadata entry
+func SetMetadata(key string, value interface{}) MetadataEntry {
+	return MetadataEntry{Key: key, Value: value}
+}
+
+// RouteMetadata holds the metadata of a registered route
+type RouteMetadata struct {
+	Controller map[string]interface{}
+	Handler    map[string]interface{}
+}
+
+// MetadataStore maps registered routes to their metadata
+type MetadataStore struct {
+	routes map[string]*RouteMetadata
+	mutex  sync.RWMutex
+}
+
+// NewMetadataStore creates a new metadata store
+func NewMetadataStore() *MetadataStore {
+	return &MetadataStore{
+		routes: make(map[string]*RouteMetadata),
+	}
+}
+
+// Register stores metadata for a route
+func (ms *MetadataStore) Register(method, path string, controller, handler map[string]interface{}) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	ms.routes[method+" "+path] = &RouteMetadata{
+		Controller: controller,
+		Handler:    handler,
+	}
+}
+
+// Lookup retrieves metadata for a route
+func (ms *MetadataStore) Lookup(method, path string) (*RouteMetadata, bool) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+
+	metadata, exists := ms.routes[method+" "+path]
+	return metadata, exists
+}
+
+// metadataStores holds one metadata store per Echo instance. Instances are
+// referenced weakly, so a store is dropped once its instance is collected.
+var metadataStores sync.Map
+
+// MetadataStoreFor returns the metadata store of an Echo instance
+func MetadataStoreFor(e *echo.Echo) *MetadataStore {
+	key := weak.Make(e)
+	if store, ok := metadataStores.Load(key); ok {
+		return store.(*MetadataStore)
+	}
+
+	store, loaded := metadataStores.LoadOrStore(key, NewMetadataStore())
+	if !loaded {
+		runtime.AddCleanup(e, func(key weak.Pointer[echo.Echo]) {
+			metadataStores.Delete(key)
+		}, key)
+	}
+	return store.(*MetadataStore)
+}
+
+// MetadataMiddleware attaches metadata to routes that are not registered through a controller
+func MetadataMiddleware(entries ...MetadataEntry) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			values, ok := c.Get(metadataContextKey).(map[string]interface{})
+			if !ok {
+				values = make(map[string]interface{})
+				c.Set(metadataContextKey, values)
+			}
+			for _, entry := range entries {
+				values[entry.Key] = entry.Value
+			}
+			return next(c)
+		}
+	}
+}
+
+// GetMetadata resolves a metadata value for the current route.
+// Handler metadata takes precedence over controller metadata.
+func GetMetadata(c echo.Context, key string) (interface{}, bool) {
+	if value, ok := GetHandlerMetadata(c, key); ok {
+		return value, true
+	}
+	return GetControllerMetadata(c, key)
+}
+
+// GetHandlerMetadata resolves a handler-level metadata value for the current route
+func GetHandlerMetadata(c echo.Context, key string) (interface{}, bool) {
+	if values, ok := c.Get(metadataContextKey).(map[string]interface{}); ok {
+		if value, exists := values[key]; exists {
+			return value, true
+		}
+	}
+
+	if metadata := lookupRouteMetadata(c); metadata != nil {
+		if value, exists := metadata.Handler[key]; exists {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// GetControllerMetadata resolves a controller-level metadata value for the current route
+func GetControllerMetadata(c echo.Context, key string) (interface{}, bool) {
+	if metadata := lookupRouteMetadata(c); metadata != nil {
+		if value, exists := metadata.Controller[key]; exists {
+			return value, true
+		}
+	}
+	return nil, false
+}
+
+// lookupRouteMetadata finds the metadata registered for the matched route
+func lookupRouteMetadata(c echo.Context) *RouteMetadata {
+	if c.Echo() == nil || c.Path() == "" {
+		return nil
+	}
+
+	metadata, exists := MetadataStoreFor(c.Echo()).Lookup(c.Request().Method, c.Path())
+	if !exists {
+		return nil
+	}
+	return metadata
+}
@@ -0,0 +1,619 @@
+package gonest
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Authentication method references (RFC 8176) recorded in the amr claim
+const (
+	AMRPassword = "pwd"
+	AMROTP      = "otp"
+	AMRMFA      = "mfa"
+)
+
+// mfaChallengeIssuer is the issuer of MFA challenge tokens
+const mfaChallengeIssuer = "gonest-mfa"
+
+// MetadataKeyRequireMFA marks routes that require multi-factor authentication
+const MetadataKeyRequireMFA = "require_mfa"
+
+// MFA errors
+var (
+	ErrMFANotEnrolled     = errors.New("multi-factor authentication is not enrolled")
+	ErrMFAInvalidCode     = errors.New("invalid verification code")
+	ErrMFAChallengeFailed = errors.New("invalid or expired MFA challenge")
+	ErrMFATooManyAttempts = errors.New("too many failed verification attempts")
+)
+
+// TOTPConfig holds TOTP (RFC 6238) configuration
+type TOTPConfig struct {
+	Issuer string
+	Digits int
+	Period time.Duration
+	// Skew is the number of periods accepted before and after the current one
+	Skew               int
+	RecoveryCodes      int
+	RecoveryCodeLength int
+	// ChallengeExpiry is the lifetime of the token between the two login steps
+	ChallengeExpiry time.Duration
+	// MaxChallengeAttempts wrong codes burn a challenge token
+	MaxChallengeAttempts int
+	// MaxFailures wrong codes within FailureWindow block challenges of a user
+	MaxFailures   int
+	FailureWindow time.Duration
+}
+
+// DefaultTOTPConfig returns default TOTP configuration
+func DefaultTOTPConfig(issuer string) *TOTPConfig {
+	return &TOTPConfig{
+		Issuer:             issuer,
+		Digits:             6,
+		Period:             30 * time.Second,
+		Skew:               1,
+		RecoveryCodes:      10,
+		RecoveryCodeLength: 10,
+		ChallengeExpiry:    5 * time.Minute,
+		// Six digit codes give an attacker about one guess in 100,000 per attempt
+		MaxChallengeAttempts: 5,
+		MaxFailures:          10,
+		FailureWindow:        15 * time.Minute,
+	}
+}
+
+// GenerateTOTPSecret generates a random base32 encoded TOTP secret
+func GenerateTOTPSecret() (string, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret), nil
+}
+
+// GenerateTOTPCode computes the TOTP code of a base32 secret at a time
+func GenerateTOTPCode(secret string, at time.Time, config *TOTPConfig) (string, error) {
+	key, err := decodeTOTPSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotpCode(key, uint64(at.Unix()/int64(config.Period.Seconds())), config.Digits), nil
+}
+
+// decodeTOTPSecret decodes a base32 secret, with or without padding
+func decodeTOTPSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.TrimRight(strings.ReplaceAll(secret, " ", ""), "="))
+	return base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+}
+
+// hotpCode computes an HOTP (RFC 4226) code
+func hotpCode(key []byte, counter uint64, digits int) string {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, counter)
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(buf)
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%mod)
+}
+
+// MFAEnrollment is the MFA state of a user
+type MFAEnrollment struct {
+	UserID        string
+	Secret        string
+	Confirmed     bool
+	RecoveryCodes []string // SHA-256 hashes
+	LastUsedStep  int64
+	CreatedAt     time.Time
+}
+
+// MFAStore persists MFA enrollments
+type MFAStore interface {
+	Get(ctx context.Context, userID string) (*MFAEnrollment, error)
+	Save(ctx context.Context, enrollment *MFAEnrollment) error
+	Delete(ctx context.Context, userID string) error
+}
+
+// MemoryMFAStore implements an in-memory MFA store
+type MemoryMFAStore struct {
+	enrollments map[string]*MFAEnrollment
+	mutex       sync.RWMutex
+}
+
+// NewMemoryMFAStore creates a new memory MFA store
+func NewMemoryMFAStore() *MemoryMFAStore {
+	return &MemoryMFAStore{
+		enrollments: make(map[string]*MFAEnrollment),
+	}
+}
+
+// Get retrieves the enrollment of a user
+func (mms *MemoryMFAStore) Get(ctx context.Context, userID string) (*MFAEnrollment, error) {
+	mms.mutex.RLock()
+	defer mms.mutex.RUnlock()
+
+	enrollment, exists := mms.enrollments[userID]
+	if !exists {
+		return nil, ErrMFANotEnrolled
+	}
+
+	result := *enrollment
+	result.RecoveryCodes = append([]string(nil), enrollment.RecoveryCodes...)
+	return &result, nil
+}
+
+// Save stores an enrollment
+func (mms *MemoryMFAStore) Save(ctx context.Context, enrollment *MFAEnrollment) error {
+	mms.mutex.Lock()
+	defer mms.mutex.Unlock()
+
+	stored := *enrollment
+	stored.RecoveryCodes = append([]string(nil), enrollment.RecoveryCodes...)
+	mms.enrollments[enrollment.UserID] = &stored
+	return nil
+}
+
+// Delete removes an enrollment
+func (mms *MemoryMFAStore) Delete(ctx context.Context, userID string) error {
+	mms.mutex.Lock()
+	defer mms.mutex.Unlock()
+
+	delete(mms.enrollments, userID)
+	return nil
+}
+
+// MFAEnrollmentResponse holds what a user needs to set up an authenticator app
+type MFAEnrollmentResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// MFAService manages TOTP enrollment, verification and login challenges
+type MFAService struct {
+	config      *TOTPConfig
+	store       MFAStore
+	authService *AuthService
+	// attempts counts failures and claims used codes, so it must be shared
+	// between instances for replay protection and throttling to hold
+	attempts RateLimitStore
+	logger   *logrus.Logger
+}
+
+// NewMFAService creates a new MFA service. Challenge tokens are signed by authService.
+func NewMFAService(config *TOTPConfig, store MFAStore, authService *AuthService, logger *logrus.Logger) *MFAService {
+	if config == nil {
+		config = DefaultTOTPConfig("GoNest")
+	}
+	if store == nil {
+		store = NewMemoryMFAStore()
+	}
+
+	return &MFAService{
+		config:      config,
+		store:       store,
+		authService: authService,
+		attempts:    NewMemoryRateLimitStore(),
+		logger:      logger,
+	}
+}
+
+// WithAttemptStore sets the store counting failed attempts and used codes,
+// e.g. a RedisRateLimitStore shared by all instances
+func (ms *MFAService) WithAttemptStore(store RateLimitStore) *MFAService {
+	ms.attempts = store
+	return ms
+}
+
+// Enroll starts TOTP enrollment. It must be confirmed with a valid code before it is enforced.
+func (ms *MFAService) Enroll(ctx context.Context, user *AuthUser) (*MFAEnrollmentResponse, error) {
+	if existing, err := ms.store.Get(ctx, user.ID); err == nil && existing.Confirmed {
+		return nil, errors.New("multi-factor authentication is already enabled")
+	}
+
+	secret, err := GenerateTOTPSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	enrollment := &MFAEnrollment{
+		UserID:    user.ID,
+		Secret:    secret,
+		CreatedAt: time.Now(),
+	}
+	if err := ms.store.Save(ctx, enrollment); err != nil {
+		return nil, err
+	}
+
+	account := user.Email
+	if account == "" {
+		account = user.Username
+	}
+	if account == "" {
+		account = user.ID
+	}
+
+	return &MFAEnrollmentResponse{
+		Secret: secret,
+		URI:    ms.ProvisioningURI(secret, account),
+	}, nil
+}
+
+// ProvisioningURI builds the otpauth:// URI shown as a QR code
+func (ms *MFAService) ProvisioningURI(secret, account string) string {
+	params := url.Values{}
+	params.Set("secret", secret)
+	params.Set("issuer", ms.config.Issuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", fmt.Sprintf("%d", ms.config.Digits))
+	params.Set("period", fmt.Sprintf("%d", int(ms.config.Period.Seconds())))
+
+	label := url.PathEscape(ms.config.Issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + params.Encode()
+}
+
+// ConfirmEnrollment enables MFA once the user proves the authenticator works.
+// The returned recovery codes are only available here.
+func (ms *MFAService) ConfirmEnrollment(ctx context.Context, userID, code string) ([]string, error) {
+	enrollment, err := ms.store.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	step, ok := ms.validateTOTP(enrollment, code, time.Now())
+	if !ok {
+		return nil, ErrMFAInvalidCode
+	}
+	if err := ms.claimStep(ctx, userID, step); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, ms.config.RecoveryCodes)
+	enrollment.RecoveryCodes = make([]string, len(codes))
+	for i := range codes {
+		codes[i] = generateRecoveryCode(ms.config.RecoveryCodeLength)
+		enrollment.RecoveryCodes[i] = hashRecoveryCode(codes[i])
+	}
+
+	enrollment.Confirmed = true
+	enrollment.LastUsedStep = step
+	if err := ms.store.Save(ctx, enrollment); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// IsEnabled checks if a user has confirmed MFA
+func (ms *MFAService) IsEnabled(ctx context.Context, userID string) bool {
+	enrollment, err := ms.store.Get(ctx, userID)
+	return err == nil && enrollment.Confirmed
+}
+
+// Disable removes the MFA enrollment of a user
+func (ms *MFAService) Disable(ctx context.Context, userID string) error {
+	return ms.store.Delete(ctx, userID)
+}
+
+// Verify checks a TOTP code or a single-use recovery code and returns the
+// authentication methods it proves. Each code is claimed in the attempt
+// store, so it cannot be used twice even by concurrent requests.
+func (ms *MFAService) Verify(ctx context.Context, userID, code string) ([]string, error) {
+	enrollment, err := ms.store.Get(ctx, userID)
+	if err != nil || !enrollment.Confirmed {
+		return nil, ErrMFANotEnrolled
+	}
+
+	if step, ok := ms.validateTOTP(enrollment, code, time.Now()); ok {
+		if err := ms.claimStep(ctx, userID, step); err != nil {
+			return nil, err
+		}
+		enrollment.LastUsedStep = step
+		if err := ms.store.Save(ctx, enrollment); err != nil {
+			return nil, err
+		}
+		return []string{AMROTP, AMRMFA}, nil
+	}
+
+	hashed := hashRecoveryCode(code)
+	for _, stored := range enrollment.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(hashed), []byte(stored)) == 1 {
+			if err := ms.claim(ctx, ms.recoveryClaimKey(userID, stored), mfaRecoveryClaimTTL); err != nil {
+				return nil, err
+			}
+			ms.dropClaimedRecoveryCodes(ctx, enrollment)
+			if err := ms.store.Save(ctx, enrollment); err != nil {
+				return nil, err
+			}
+			if ms.logger != nil {
+				ms.logger.WithField("user_id", userID).Info("Recovery code used")
+			}
+			return []string{AMRMFA}, nil
+		}
+	}
+
+	return nil, ErrMFAInvalidCode
+}
+
+// mfaRecoveryClaimTTL is how long a used recovery code stays claimed. A save
+// racing with its use can restore the code; the claim keeps rejecting it and
+// the next recovery code use drops it.
+const mfaRecoveryClaimTTL = 30 * 24 * time.Hour
+
+// claim marks a code as used in the attempt store, failing if it already was
+func (ms *MFAService) claim(ctx context.Context, key string, ttl time.Duration) error {
+	entry, err := ms.attempts.Increment(ctx, key, ttl)
+	if err != nil {
+		return err
+	}
+	if entry.Count > 1 {
+		return ErrMFAInvalidCode
+	}
+	return nil
+}
+
+// claimStep marks a TOTP time step of a user as used. The claim outlives the
+// skew window in which the step is accepted.
+func (ms *MFAService) claimStep(ctx context.Context, userID string, step int64) error {
+	ttl := time.Duration(2*ms.config.Skew+2) * ms.config.Period
+	return ms.claim(ctx, fmt.Sprintf("mfa:step:%s:%d", userID, step), ttl)
+}
+
+// recoveryClaimKey returns the claim key of a hashed recovery code
+func (ms *MFAService) recoveryClaimKey(userID, hashed string) string {
+	return "mfa:recovery:" + userID + ":" + hashed
+}
+
+// dropClaimedRecoveryCodes removes recovery codes that were used, including
+// ones restored by a concurrent save of an older copy of the enrollment
+func (ms *MFAService) dropClaimedRecoveryCodes(ctx context.Context, enrollment *MFAEnrollment) {
+	remaining := enrollment.RecoveryCodes[:0]
+	for _, stored := range enrollment.RecoveryCodes {
+		entry, err := ms.attempts.Get(ctx, ms.recoveryClaimKey(enrollment.UserID, stored))
+		if err == nil && entry != nil && entry.Count > 0 {
+			continue
+		}
+		remaining = append(remaining, stored)
+	}
+	enrollment.RecoveryCodes = remaining
+}
+
+// validateTOTP checks a code within the skew window, rejecting steps that were already used
+func (ms *MFAService) validateTOTP(enrollment *MFAEnrollment, code string, at time.Time) (int64, bool) {
+	if len(code) != ms.config.Digits {
+		return 0, false
+	}
+
+	key, err := decodeTOTPSecret(enrollment.Secret)
+	if err != nil {
+		return 0, false
+	}
+
+	current := at.Unix() / int64(ms.config.Period.Seconds())
+	for offset := -ms.config.Skew; offset <= ms.config.Skew; offset++ {
+		step := current + int64(offset)
+		if step <= enrollment.LastUsedStep || step < 0 {
+			continue
+		}
+		expected := hotpCode(key, uint64(step), ms.config.Digits)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// IssueChallenge creates a short-lived token proving the first login step succeeded
+func (ms *MFAService) IssueChallenge(user *AuthUser) (string, error) {
+	now := time.Now()
+	claims := &JWTClaims{
+		UserID:   user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+		Roles:    user.Roles,
+		Metadata: user.Metadata,
+		AMR:      user.AMR,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        generateTokenID(),
+			ExpiresAt: jwt.NewNumericDate(now.Add(ms.config.ChallengeExpiry)),
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Issuer:    mfaChallengeIssuer,
+			Subject:   user.ID,
+		},
+	}
+	return ms.authService.signClaims(claims)
+}
+
+// CompleteChallenge verifies a challenge token and code, consumes the challenge
+// and returns the user with the proven authentication methods. Wrong codes
+// are counted per challenge and per user; a challenge is burned after
+// MaxChallengeAttempts misses and a user is blocked after MaxFailures.
+func (ms *MFAService) CompleteChallenge(ctx context.Context, challengeToken, code string) (*AuthUser, error) {
+	claims, err := ms.authService.ValidateTokenContext(ctx, challengeToken)
+	if err != nil || claims.RegisteredClaims.Issuer != mfaChallengeIssuer {
+		return nil, ErrMFAChallengeFailed
+	}
+
+	jti := claims.RegisteredClaims.ID
+	expiresAt := claims.RegisteredClaims.ExpiresAt.Time
+	store := ms.authService.config.TokenStore
+	if denied, err := store.IsAccessTokenDenied(ctx, jti); err != nil || denied {
+		return nil, ErrMFAChallengeFailed
+	}
+
+	failuresKey := "mfa:failures:" + claims.UserID
+	if ms.config.MaxFailures > 0 {
+		if entry, err := ms.attempts.Get(ctx, failuresKey); err == nil && entry != nil &&
+			time.Now().Before(entry.ExpiresAt) && entry.Count >= int64(ms.config.MaxFailures) {
+			return nil, ErrMFATooManyAttempts
+		}
+	}
+
+	methods, err := ms.Verify(ctx, claims.UserID, code)
+	if err != nil {
+		ms.recordChallengeFailure(ctx, claims.UserID, jti, expiresAt)
+		return nil, err
+	}
+
+	// Consuming the challenge is a claim too, so concurrent requests with
+	// different valid codes cannot both complete it
+	if err := ms.claim(ctx, "mfa:challenge:used:"+jti, time.Until(expiresAt)); err != nil {
+		return nil, ErrMFAChallengeFailed
+	}
+	if err := store.DenyAccessToken(ctx, jti, expiresAt); err != nil {
+		return nil, err
+	}
+	ms.attempts.Delete(ctx, failuresKey)
+
+	user := claims.ToAuthUser()
+	user.AMR = appendUnique(user.AMR, methods...)
+	user.MFAAt = time.Now()
+	return user, nil
+}
+
+// recordChallengeFailure counts a wrong code and burns the challenge once it
+// ran out of attempts
+func (ms *MFAService) recordChallengeFailure(ctx context.Context, userID, jti string, expiresAt time.Time) {
+	if ms.config.MaxFailures > 0 {
+		if _, err := ms.attempts.Increment(ctx, "mfa:failures:"+userID, ms.config.FailureWindow); err != nil && ms.logger != nil {
+			ms.logger.WithError(err).Warn("Failed to record MFA failure")
+		}
+	}
+
+	if ms.config.MaxChallengeAttempts <= 0 {
+		return
+	}
+
+	entry, err := ms.attempts.Increment(ctx, "mfa:challenge:failures:"+jti, time.Until(expiresAt))
+	if err != nil {
+		if ms.logger != nil {
+			ms.logger.WithError(err).Warn("Failed to record MFA challenge failure")
+		}
+		return
+	}
+
+	if entry.Count >= int64(ms.config.MaxChallengeAttempts) {
+		if err := ms.authService.config.TokenStore.DenyAccessToken(ctx, jti, expiresAt); err != nil && ms.logger != nil {
+			ms.logger.WithError(err).Warn("Failed to revoke MFA challenge")
+		}
+	}
+}
+
+// appendUnique appends values that are not yet in the slice
+func appendUnique(values []string, additions ...string) []string {
+	for _, addition := range additions {
+		found := false
+		for _, value := range values {
+			if value == addition {
+				found = true
+				break
+			}
+		}
+		if !found {
+			values = append(values, addition)
+		}
+	}
+	return values
+}
+
+// generateRecoveryCode generates a random recovery code. Bytes that would
+// bias the modulo towards the start of the alphabet are rejected.
+func generateRecoveryCode(length int) string {
+	const alphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+	const limit = 256 - 256%len(alphabet)
+
+	code := make([]byte, 0, length)
+	buf := make([]byte, length)
+	for len(code) < length {
+		if _, err := rand.Read(buf); err != nil {
+			panic(fmt.Sprintf("failed to generate recovery code: %v", err))
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(code) < length {
+				code = append(code, alphabet[int(b)%len(alphabet)])
+			}
+		}
+	}
+	return string(code)
+}
+
+// hashRecoveryCode hashes a recovery code for storage
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequireMFA marks a route as requiring multi-factor authentication for MFAGuard
+func RequireMFA() MetadataEntry {
+	return SetMetadata(MetadataKeyRequireMFA, true)
+}
+
+// DefaultMFAMaxAge is how long completed MFA satisfies MFAGuard by default
+const DefaultMFAMaxAge = time.Hour
+
+// MFAGuard requires the current user to have completed multi-factor authentication
+// within MaxAge, or DefaultMFAMaxAge when not set. With OnlyMarkedRoutes it only
+// applies to routes marked with RequireMFA, so it can be installed globally.
+type MFAGuard struct {
+	OnlyMarkedRoutes bool
+	MaxAge           time.Duration
+}
+
+// NewMFAGuard creates a guard requiring MFA on every route it is applied to
+func NewMFAGuard() *MFAGuard {
+	return &MFAGuard{MaxAge: DefaultMFAMaxAge}
+}
+
+// WithMaxAge sets how long completed MFA satisfies the guard
+func (mg *MFAGuard) WithMaxAge(maxAge time.Duration) *MFAGuard {
+	mg.MaxAge = maxAge
+	return mg
+}
+
+// CanActivate checks the authentication methods of the current user
+func (mg *MFAGuard) CanActivate(ctx echo.Context) (bool, error) {
+	if mg.OnlyMarkedRoutes {
+		if required, ok := GetMetadata(ctx, MetadataKeyRequireMFA); !ok || required != true {
+			return true, nil
+		}
+	}
+
+	user, err := GetCurrentUser(ctx)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusUnauthorized, "User not authenticated")
+	}
+
+	maxAge := mg.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultMFAMaxAge
+	}
+	if user.HasMFA() && !user.MFAAt.IsZero() && time.Since(user.MFAAt) <= maxAge {
+		return true, nil
+	}
+
+	return false, echo.NewHTTPError(http.StatusForbidden, "Multi-factor authentication required")
+}
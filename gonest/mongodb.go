@@ -110,6 +110,8 @@ type Schema struct {
 	Indexes        []*Index
 	HasTimestamps  bool
 	CollectionName string
+	// TenantField is the field holding the tenant ID of tenant-scoped documents
+	TenantField string
 }
 
 // NewSchema creates a new schema
@@ -196,6 +198,13 @@ func (s *Schema) Timestamps() *Schema {
 	return s
 }
 
+// TenantScoped scopes documents to the tenant stored in the given field
+func (s *Schema) TenantScoped(field string) *Schema {
+	s.TenantField = field
+	s.AddIndex(NewIndex(map[string]interface{}{field: 1}))
+	return s
+}
+
 // Collection sets the collection name
 func (s *Schema) Collection(name string) *Schema {
 	s.CollectionName = name
@@ -259,6 +268,27 @@ type MongoDBBaseModel struct {
 	UpdatedAt time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
 }
 
+// TenantAware is implemented by documents that carry a tenant ID
+type TenantAware interface {
+	GetTenantID() string
+	SetTenantID(tenantID string)
+}
+
+// MongoDBTenantModel can be embedded in tenant-scoped documents
+type MongoDBTenantModel struct {
+	TenantID string `bson:"tenantId,omitempty" json:"tenantId,omitempty"`
+}
+
+// GetTenantID returns the tenant ID
+func (tm *MongoDBTenantModel) GetTenantID() string {
+	return tm.TenantID
+}
+
+// SetTenantID sets the tenant ID
+func (tm *MongoDBTenantModel) SetTenantID(tenantID string) {
+	tm.TenantID = tenantID
+}
+
 // BeforeSave default implementation
 func (bm *MongoDBBaseModel) BeforeSave() error {
 	if bm.CreatedAt.IsZero() {
@@ -302,6 +332,9 @@ type MongoDBQuery struct {
 	limit    int64
 	selects  map[string]interface{}
 	populate []string
+	// tenantField is filtered by the tenant of the context when set
+	tenantField string
+	unscoped    bool
 }
 
 // NewMongoDBQuery creates a new query
@@ -387,8 +420,33 @@ func (q *MongoDBQuery) Populate(fields ...string) *MongoDBQuery {
 	return q
 }
 
+// TenantScoped filters the query by the tenant of the context in the given field
+func (q *MongoDBQuery) TenantScoped(field string) *MongoDBQuery {
+	q.tenantField = field
+	return q
+}
+
+// Unscoped disables tenant filtering, e.g. for cross-tenant admin queries
+func (q *MongoDBQuery) Unscoped() *MongoDBQuery {
+	q.unscoped = true
+	return q
+}
+
+// Filter returns the filter the query executes with, including the tenant
+// filter. Tenant-scoped queries fail without a tenant in the context.
+func (q *MongoDBQuery) Filter(ctx context.Context) (map[string]interface{}, error) {
+	if q.tenantField == "" || q.unscoped {
+		return q.filter, nil
+	}
+	return tenantFilter(ctx, q.tenantField, q.filter)
+}
+
 // Find executes the query and returns results
 func (q *MongoDBQuery) Find(ctx context.Context, result interface{}) error {
+	if _, err := q.Filter(ctx); err != nil {
+		return err
+	}
+
 	// In a real implementation, this would execute the MongoDB query
 	// For now, we'll simulate the query execution
 	return nil
@@ -396,6 +454,10 @@ func (q *MongoDBQuery) Find(ctx context.Context, result interface{}) error {
 
 // FindOne executes the query and returns a single result
 func (q *MongoDBQuery) FindOne(ctx context.Context, result interface{}) error {
+	if _, err := q.Filter(ctx); err != nil {
+		return err
+	}
+
 	// In a real implementation, this would execute the MongoDB query
 	// For now, we'll simulate the query execution
 	return nil
@@ -403,11 +465,30 @@ func (q *MongoDBQuery) FindOne(ctx context.Context, result interface{}) error {
 
 // Count returns the count of documents matching the query
 func (q *MongoDBQuery) Count(ctx context.Context) (int64, error) {
+	if _, err := q.Filter(ctx); err != nil {
+		return 0, err
+	}
+
 	// In a real implementation, this would execute the MongoDB count query
 	// For now, we'll simulate the count
 	return 0, nil
 }
 
+// tenantFilter returns a copy of a filter restricted to the context's tenant
+func tenantFilter(ctx context.Context, field string, filter map[string]interface{}) (map[string]interface{}, error) {
+	tenantID, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+
+	scoped := make(map[string]interface{}, len(filter)+1)
+	for k, v := range filter {
+		scoped[k] = v
+	}
+	scoped[field] = tenantID
+	return scoped, nil
+}
+
 // MongoDBModel represents a MongoDB model manager
 type MongoDBModel struct {
 	name       string
@@ -426,15 +507,38 @@ func NewMongoDBModel(name string, schema *Schema, connection *MongoDBConnection,
 	}
 }
 
-// Query creates a new query builder
+// Query creates a new query builder, scoped to the tenant for tenant-scoped schemas
 func (mm *MongoDBModel) Query() *MongoDBQuery {
-	return NewMongoDBQuery()
+	query := NewMongoDBQuery()
+	if mm.schema != nil && mm.schema.TenantField != "" {
+		query.TenantScoped(mm.schema.TenantField)
+	}
+	return query
+}
+
+// scopeFilter restricts a filter to the context's tenant for tenant-scoped schemas
+func (mm *MongoDBModel) scopeFilter(ctx context.Context, filter map[string]interface{}) (map[string]interface{}, error) {
+	if mm.schema == nil || mm.schema.TenantField == "" {
+		return filter, nil
+	}
+	return tenantFilter(ctx, mm.schema.TenantField, filter)
 }
 
 // Create creates a new document
 func (mm *MongoDBModel) Create(ctx context.Context, document MongoDBDocument) error {
 	mm.logger.Infof("Creating %s document", mm.name)
 
+	// Stamp tenant-scoped documents with the context's tenant
+	if mm.schema != nil && mm.schema.TenantField != "" {
+		tenantID, ok := TenantFromContext(ctx)
+		if !ok {
+			return ErrNoTenant
+		}
+		if doc, ok := document.(TenantAware); ok {
+			doc.SetTenantID(tenantID)
+		}
+	}
+
 	// Execute lifecycle hooks
 	if err := document.BeforeSave(); err != nil {
 		return err
@@ -456,6 +560,10 @@ func (mm *MongoDBModel) Create(ctx context.Context, document MongoDBDocument) er
 func (mm *MongoDBModel) FindById(ctx context.Context, id string, result MongoDBDocument) error {
 	mm.logger.Infof("Finding %s document by ID: %s", mm.name, id)
 
+	if _, err := mm.scopeFilter(ctx, map[string]interface{}{"_id": id}); err != nil {
+		return err
+	}
+
 	// In a real implementation, this would find the document in MongoDB
 	// For now, we'll simulate the find operation
 
@@ -467,6 +575,10 @@ func (mm *MongoDBModel) FindById(ctx context.Context, id string, result MongoDBD
 func (mm *MongoDBModel) Find(ctx context.Context, filter map[string]interface{}, result interface{}) error {
 	mm.logger.Infof("Finding %s documents with filter", mm.name)
 
+	if _, err := mm.scopeFilter(ctx, filter); err != nil {
+		return err
+	}
+
 	// In a real implementation, this would find documents in MongoDB
 	// For now, we'll simulate the find operation
 
@@ -478,6 +590,10 @@ func (mm *MongoDBModel) Find(ctx context.Context, filter map[string]interface{},
 func (mm *MongoDBModel) UpdateById(ctx context.Context, id string, update map[string]interface{}) error {
 	mm.logger.Infof("Updating %s document by ID: %s", mm.name, id)
 
+	if _, err := mm.scopeFilter(ctx, map[string]interface{}{"_id": id}); err != nil {
+		return err
+	}
+
 	// In a real implementation, this would update the document in MongoDB
 	// For now, we'll simulate the update operation
 
@@ -489,6 +605,10 @@ func (mm *MongoDBModel) UpdateById(ctx context.Context, id string, update map[st
 func (mm *MongoDBModel) DeleteById(ctx context.Context, id string) error {
 	mm.logger.Infof("Deleting %s document by ID: %s", mm.name, id)
 
+	if _, err := mm.scopeFilter(ctx, map[string]interface{}{"_id": id}); err != nil {
+		return err
+	}
+
 	// In a real implementation, this would delete the document from MongoDB
 	// For now, we'll simulate the delete operation
 
@@ -500,6 +620,10 @@ func (mm *MongoDBModel) DeleteById(ctx context.Context, id string) error {
 func (mm *MongoDBModel) Count(ctx context.Context, filter map[string]interface{}) (int64, error) {
 	mm.logger.Infof("Counting %s documents", mm.name)
 
+	if _, err := mm.scopeFilter(ctx, filter); err != nil {
+		return 0, err
+	}
+
 	// In a real implementation, this would count documents in MongoDB
 	// For now, we'll simulate the count operation
 
@@ -510,6 +634,10 @@ func (mm *MongoDBModel) Count(ctx context.Context, filter map[string]interface{}
 func (mm *MongoDBModel) Exists(ctx context.Context, filter map[string]interface{}) (bool, error) {
 	mm.logger.Infof("Checking if %s documents exist", mm.name)
 
+	if _, err := mm.scopeFilter(ctx, filter); err != nil {
+		return false, err
+	}
+
 	// In a real implementation, this would check existence in MongoDB
 	// For now, we'll simulate the existence check
 
@@ -520,6 +648,15 @@ func (mm *MongoDBModel) Exists(ctx context.Context, filter map[string]interface{
 func (mm *MongoDBModel) Aggregate(ctx context.Context, pipeline []map[string]interface{}, result interface{}) error {
 	mm.logger.Infof("Executing aggregation pipeline on %s", mm.name)
 
+	// Tenant-scoped pipelines start by matching the context's tenant
+	if mm.schema != nil && mm.schema.TenantField != "" {
+		match, err := mm.scopeFilter(ctx, map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		pipeline = append([]map[string]interface{}{{"$match": match}}, pipeline...)
+	}
+
 	// In a real implementation, this would execute the aggregation pipeline
 	// For now, we'll simulate the aggregation
 
@@ -0,0 +1,560 @@
+package gonest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jwt "github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// OIDC errors
+var (
+	ErrOIDCStateInvalid = errors.New("invalid or expired OIDC state")
+	ErrOIDCNonceInvalid = errors.New("ID token nonce does not match")
+)
+
+// OIDCConfig holds the configuration of an OpenID Connect provider
+type OIDCConfig struct {
+	// Name identifies the provider and is used as the strategy name
+	Name         string
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	// DiscoveryURL defaults to the issuer's /.well-known/openid-configuration
+	DiscoveryURL string
+	// DiscoveryTTL is how long the discovery document is cached, 24 hours by default
+	DiscoveryTTL time.Duration
+	// RoleClaim is the claim mapped to AuthUser.Roles
+	RoleClaim string
+	// UserMapper maps ID token and userinfo claims to a user. ID token
+	// claims take precedence over userinfo claims of the same name.
+	UserMapper func(claims map[string]interface{}) (*AuthUser, error)
+	StateTTL   time.Duration
+	HTTPClient *http.Client
+}
+
+// OIDCDiscovery holds the provider metadata published by discovery
+type OIDCDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserinfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCAuthState is the state kept between the authorization redirect and the callback
+type OIDCAuthState struct {
+	Provider     string
+	CodeVerifier string
+	Nonce        string
+	ReturnTo     string
+	ExpiresAt    time.Time
+}
+
+// OIDCStateStore persists authorization state until the callback consumes it
+type OIDCStateStore interface {
+	Save(ctx context.Context, state string, data *OIDCAuthState) error
+	// Consume returns and deletes the state so it can only be used once
+	Consume(ctx context.Context, state string) (*OIDCAuthState, error)
+}
+
+// MemoryOIDCStateStore implements an in-memory OIDC state store.
+// Expired states are swept on writes, at most once per sweep interval.
+type MemoryOIDCStateStore struct {
+	states    map[string]*OIDCAuthState
+	lastSweep time.Time
+	mutex     sync.Mutex
+}
+
+// NewMemoryOIDCStateStore creates a new memory OIDC state store
+func NewMemoryOIDCStateStore() *MemoryOIDCStateStore {
+	return &MemoryOIDCStateStore{
+		states:    make(map[string]*OIDCAuthState),
+		lastSweep: time.Now(),
+	}
+}
+
+// Save stores authorization state
+func (mss *MemoryOIDCStateStore) Save(ctx context.Context, state string, data *OIDCAuthState) error {
+	mss.mutex.Lock()
+	defer mss.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(mss.lastSweep) >= memoryStoreSweepInterval {
+		mss.lastSweep = now
+		for key, existing := range mss.states {
+			if now.After(existing.ExpiresAt) {
+				delete(mss.states, key)
+			}
+		}
+	}
+
+	mss.states[state] = data
+	return nil
+}
+
+// Consume retrieves and deletes authorization state
+func (mss *MemoryOIDCStateStore) Consume(ctx context.Context, state string) (*OIDCAuthState, error) {
+	mss.mutex.Lock()
+	defer mss.mutex.Unlock()
+
+	data, exists := mss.states[state]
+	if !exists {
+		return nil, ErrOIDCStateInvalid
+	}
+	delete(mss.states, state)
+
+	if time.Now().After(data.ExpiresAt) {
+		return nil, ErrOIDCStateInvalid
+	}
+	return data, nil
+}
+
+// OIDCCallback holds the parameters the provider sends to the redirect URL
+type OIDCCallback struct {
+	Code  string
+	State string
+}
+
+// OIDCStrategy authenticates users with an OpenID Connect provider using the
+// authorization code flow with PKCE
+type OIDCStrategy struct {
+	config       *OIDCConfig
+	stateStore   OIDCStateStore
+	discovery    *OIDCDiscovery
+	discoveredAt time.Time
+	refresh      *oidcDiscoveryRefresh
+	lastFailure  *oidcDiscoveryFailure
+	keys         *RemoteJWKS
+	mutex        sync.Mutex
+}
+
+// oidcDiscoveryRetryInterval is how long a failed discovery fetch is not retried
+const oidcDiscoveryRetryInterval = time.Minute
+
+// oidcDiscoveryRefresh is a discovery fetch shared by all callers waiting for it
+type oidcDiscoveryRefresh struct {
+	done      chan struct{}
+	discovery *OIDCDiscovery
+	err       error
+}
+
+// oidcDiscoveryFailure records the last failed discovery fetch
+type oidcDiscoveryFailure struct {
+	at  time.Time
+	err error
+}
+
+// NewOIDCStrategy creates a new OIDC strategy
+func NewOIDCStrategy(config *OIDCConfig, stateStore OIDCStateStore) *OIDCStrategy {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	if config.DiscoveryURL == "" {
+		config.DiscoveryURL = strings.TrimSuffix(config.Issuer, "/") + "/.well-known/openid-configuration"
+	}
+	if config.DiscoveryTTL == 0 {
+		config.DiscoveryTTL = 24 * time.Hour
+	}
+	if config.StateTTL == 0 {
+		config.StateTTL = 10 * time.Minute
+	}
+	if config.HTTPClient == nil {
+		config.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	if stateStore == nil {
+		stateStore = NewMemoryOIDCStateStore()
+	}
+
+	return &OIDCStrategy{
+		config:     config,
+		stateStore: stateStore,
+	}
+}
+
+// GetName returns strategy name
+func (oidc *OIDCStrategy) GetName() string {
+	return oidc.config.Name
+}
+
+// Discover fetches the provider metadata and caches it for DiscoveryTTL.
+// Concurrent callers share a single fetch, which runs outside the lock. A
+// cached document keeps being served when a refresh fails, and fetches are
+// retried at most once per oidcDiscoveryRetryInterval after a failure.
+func (oidc *OIDCStrategy) Discover(ctx context.Context) (*OIDCDiscovery, error) {
+	oidc.mutex.Lock()
+	now := time.Now()
+	cached := oidc.discovery
+	if cached != nil && now.Sub(oidc.discoveredAt) < oidc.config.DiscoveryTTL {
+		oidc.mutex.Unlock()
+		return cached, nil
+	}
+
+	refresh := oidc.refresh
+	if refresh == nil {
+		if oidc.lastFailure != nil && now.Sub(oidc.lastFailure.at) < oidcDiscoveryRetryInterval {
+			err := oidc.lastFailure.err
+			oidc.mutex.Unlock()
+			if cached != nil {
+				return cached, nil
+			}
+			return nil, err
+		}
+
+		refresh = &oidcDiscoveryRefresh{done: make(chan struct{})}
+		oidc.refresh = refresh
+		go oidc.runDiscovery(ctx, refresh)
+	}
+	oidc.mutex.Unlock()
+
+	select {
+	case <-refresh.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	if refresh.err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, refresh.err
+	}
+	return refresh.discovery, nil
+}
+
+// runDiscovery performs a shared discovery fetch. It is detached from the
+// cancellation of the caller that started it, since other callers may be
+// waiting on it.
+func (oidc *OIDCStrategy) runDiscovery(ctx context.Context, refresh *oidcDiscoveryRefresh) {
+	discovery, err := oidc.fetchDiscovery(context.WithoutCancel(ctx))
+
+	oidc.mutex.Lock()
+	if err != nil {
+		oidc.lastFailure = &oidcDiscoveryFailure{at: time.Now(), err: err}
+	} else {
+		if oidc.keys == nil || oidc.discovery.JWKSURI != discovery.JWKSURI {
+			oidc.keys = NewRemoteJWKS(discovery.JWKSURI, time.Hour).WithHTTPClient(oidc.config.HTTPClient)
+		}
+		oidc.discovery = discovery
+		oidc.discoveredAt = time.Now()
+		oidc.lastFailure = nil
+	}
+	refresh.discovery = discovery
+	refresh.err = err
+	oidc.refresh = nil
+	oidc.mutex.Unlock()
+
+	close(refresh.done)
+}
+
+// fetchDiscovery downloads and checks the discovery document
+func (oidc *OIDCStrategy) fetchDiscovery(ctx context.Context) (*OIDCDiscovery, error) {
+	var discovery OIDCDiscovery
+	if err := oidc.getJSON(ctx, oidc.config.DiscoveryURL, "", &discovery); err != nil {
+		return nil, fmt.Errorf("OIDC discovery failed: %w", err)
+	}
+
+	if strings.TrimSuffix(discovery.Issuer, "/") != strings.TrimSuffix(oidc.config.Issuer, "/") {
+		return nil, fmt.Errorf("OIDC discovery issuer '%s' does not match '%s'", discovery.Issuer, oidc.config.Issuer)
+	}
+
+	return &discovery, nil
+}
+
+// AuthorizationURL creates the URL the user is redirected to for login.
+// returnTo is kept with the state and returned after the callback.
+func (oidc *OIDCStrategy) AuthorizationURL(ctx context.Context, returnTo string) (string, error) {
+	discovery, err := oidc.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	state := randomURLString(32)
+	verifier := randomURLString(32)
+	nonce := randomURLString(32)
+
+	err = oidc.stateStore.Save(ctx, state, &OIDCAuthState{
+		Provider:     oidc.config.Name,
+		CodeVerifier: verifier,
+		Nonce:        nonce,
+		ReturnTo:     returnTo,
+		ExpiresAt:    time.Now().Add(oidc.config.StateTTL),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	challenge := sha256.Sum256([]byte(verifier))
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", oidc.config.ClientID)
+	params.Set("redirect_uri", oidc.config.RedirectURL)
+	params.Set("scope", strings.Join(oidc.config.Scopes, " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	params.Set("code_challenge_method", "S256")
+
+	separator := "?"
+	if strings.Contains(discovery.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return discovery.AuthorizationEndpoint + separator + params.Encode(), nil
+}
+
+// Authenticate completes the login from an OIDCCallback or the callback request context
+func (oidc *OIDCStrategy) Authenticate(ctx context.Context, credentials interface{}) (*AuthUser, error) {
+	user, _, err := oidc.HandleCallback(ctx, credentials)
+	return user, err
+}
+
+// HandleCallback completes the login and also returns the state saved with AuthorizationURL
+func (oidc *OIDCStrategy) HandleCallback(ctx context.Context, credentials interface{}) (*AuthUser, *OIDCAuthState, error) {
+	var callback OIDCCallback
+
+	switch creds := credentials.(type) {
+	case OIDCCallback:
+		callback = creds
+	case *OIDCCallback:
+		callback = *creds
+	case echo.Context:
+		if providerError := creds.QueryParam("error"); providerError != "" {
+			return nil, nil, fmt.Errorf("OIDC provider returned error: %s", providerError)
+		}
+		callback = OIDCCallback{
+			Code:  creds.QueryParam("code"),
+			State: creds.QueryParam("state"),
+		}
+	default:
+		return nil, nil, errors.New("invalid credentials format")
+	}
+
+	if callback.Code == "" || callback.State == "" {
+		return nil, nil, ErrNoCredentials
+	}
+
+	state, err := oidc.stateStore.Consume(ctx, callback.State)
+	if err != nil {
+		return nil, nil, err
+	}
+	if state.Provider != oidc.config.Name {
+		return nil, nil, ErrOIDCStateInvalid
+	}
+
+	discovery, err := oidc.Discover(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tokens, err := oidc.exchangeCode(ctx, discovery, callback.Code, state.CodeVerifier)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	claims, err := oidc.validateIDToken(ctx, discovery, tokens.IDToken, state.Nonce)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if discovery.UserinfoEndpoint != "" && tokens.AccessToken != "" {
+		var userinfo map[string]interface{}
+		if err := oidc.getJSON(ctx, discovery.UserinfoEndpoint, tokens.AccessToken, &userinfo); err != nil {
+			return nil, nil, fmt.Errorf("OIDC userinfo request failed: %w", err)
+		}
+		if userinfo["sub"] != claims["sub"] {
+			return nil, nil, errors.New("OIDC userinfo subject does not match ID token")
+		}
+		// Userinfo only fills in claims the signed ID token does not carry
+		for key, value := range userinfo {
+			if _, exists := claims[key]; !exists {
+				claims[key] = value
+			}
+		}
+	}
+
+	user, err := oidc.mapUser(claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	return user, state, nil
+}
+
+// oidcTokenResponse is the token endpoint response
+type oidcTokenResponse struct {
+	AccessToken string `json:"access_token"`
+	IDToken     string `json:"id_token"`
+	TokenType   string `json:"token_type"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// exchangeCode exchanges the authorization code at the token endpoint
+func (oidc *OIDCStrategy) exchangeCode(ctx context.Context, discovery *OIDCDiscovery, code, verifier string) (*oidcTokenResponse, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", oidc.config.RedirectURL)
+	form.Set("client_id", oidc.config.ClientID)
+	form.Set("code_verifier", verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, discovery.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if oidc.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(oidc.config.ClientID), url.QueryEscape(oidc.config.ClientSecret))
+	}
+
+	resp, err := oidc.config.HTTPClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("OIDC token request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC token request failed: unexpected status %d", resp.StatusCode)
+	}
+
+	var tokens oidcTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, fmt.Errorf("failed to decode OIDC token response: %w", err)
+	}
+	if tokens.IDToken == "" {
+		return nil, errors.New("OIDC token response has no ID token")
+	}
+	return &tokens, nil
+}
+
+// validateIDToken verifies the ID token signature and claims
+func (oidc *OIDCStrategy) validateIDToken(ctx context.Context, discovery *OIDCDiscovery, idToken, nonce string) (map[string]interface{}, error) {
+	oidc.mutex.Lock()
+	keys := oidc.keys
+	oidc.mutex.Unlock()
+
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(idToken, claims, func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		publicKey, algorithm, err := keys.PublicKey(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if algorithm != "" && algorithm != token.Method.Alg() {
+			return nil, fmt.Errorf("token algorithm %s does not match key algorithm %s", token.Method.Alg(), algorithm)
+		}
+		return publicKey, nil
+	},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(discovery.Issuer),
+		jwt.WithAudience(oidc.config.ClientID),
+		jwt.WithExpirationRequired(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ID token: %w", err)
+	}
+
+	if claimNonce, _ := claims["nonce"].(string); claimNonce != nonce {
+		return nil, ErrOIDCNonceInvalid
+	}
+
+	if audiences, _ := claims.GetAudience(); len(audiences) > 1 {
+		if azp, _ := claims["azp"].(string); azp != oidc.config.ClientID {
+			return nil, errors.New("ID token authorized party does not match client")
+		}
+	}
+
+	return claims, nil
+}
+
+// mapUser maps claims to an AuthUser
+func (oidc *OIDCStrategy) mapUser(claims map[string]interface{}) (*AuthUser, error) {
+	if oidc.config.UserMapper != nil {
+		return oidc.config.UserMapper(claims)
+	}
+
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+
+	email, _ := claims["email"].(string)
+	username, _ := claims["preferred_username"].(string)
+	if username == "" {
+		username = email
+	}
+
+	var roles []string
+	if oidc.config.RoleClaim != "" {
+		switch value := claims[oidc.config.RoleClaim].(type) {
+		case []interface{}:
+			for _, role := range value {
+				if name, ok := role.(string); ok {
+					roles = append(roles, name)
+				}
+			}
+		case string:
+			roles = strings.Fields(value)
+		}
+	}
+
+	metadata := map[string]interface{}{
+		"provider": oidc.config.Name,
+	}
+	if name, ok := claims["name"].(string); ok {
+		metadata["name"] = name
+	}
+
+	return &AuthUser{
+		ID:       oidc.config.Name + ":" + subject,
+		Username: username,
+		Email:    email,
+		Roles:    roles,
+		Metadata: metadata,
+	}, nil
+}
+
+// getJSON performs a GET request and decodes the JSON response
+func (oidc *OIDCStrategy) getJSON(ctx context.Context, endpoint, bearerToken string, dest interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+bearerToken)
+	}
+
+	resp, err := oidc.config.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(dest)
+}
+
+// randomURLString generates a random URL-safe string from n random bytes
+func randomURLString(n int) string {
+	buf := make([]byte, n)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("failed to generate random string: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
@@ -0,0 +1,216 @@
+package gonest
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// loginWithMockOIDC runs the authorization code flow against the mock provider
+func loginWithMockOIDC(t *testing.T, strategy *OIDCStrategy, provider *MockOIDCProvider, returnTo string) OIDCCallback {
+	t.Helper()
+
+	authURL, err := strategy.AuthorizationURL(context.Background(), returnTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	location, err := provider.Authorize(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	callbackURL, err := url.Parse(location)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return OIDCCallback{
+		Code:  callbackURL.Query().Get("code"),
+		State: callbackURL.Query().Get("state"),
+	}
+}
+
+func TestOIDCStrategyLogin(t *testing.T) {
+	provider := NewMockOIDCProvider(t)
+	provider.Claims["roles"] = []interface{}{"admin", "user"}
+	strategy := NewOIDCStrategy(provider.Config("mock", "http://app.test/callback"), nil)
+
+	callback := loginWithMockOIDC(t, strategy, provider, "/dashboard")
+	user, state, err := strategy.HandleCallback(context.Background(), callback)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.ID != "mock:mock-user" {
+		t.Fatalf("unexpected user ID %q", user.ID)
+	}
+	if user.Email != "mock.user@example.com" || user.Username != "mock.user" {
+		t.Fatalf("unexpected user %+v", user)
+	}
+	if len(user.Roles) != 2 || user.Roles[0] != "admin" {
+		t.Fatalf("unexpected roles %v", user.Roles)
+	}
+	if state.ReturnTo != "/dashboard" {
+		t.Fatalf("unexpected return path %q", state.ReturnTo)
+	}
+
+	if _, err := strategy.Authenticate(context.Background(), callback); !errors.Is(err, ErrOIDCStateInvalid) {
+		t.Fatalf("expected a consumed state to be rejected, got %v", err)
+	}
+}
+
+func TestOIDCStrategyPrefersIDTokenClaims(t *testing.T) {
+	provider := NewMockOIDCProvider(t)
+	delete(provider.Claims, "name")
+	provider.UserinfoClaims = map[string]interface{}{
+		"email": "attacker@example.com",
+		"name":  "From Userinfo",
+	}
+	strategy := NewOIDCStrategy(provider.Config("mock", "http://app.test/callback"), nil)
+
+	user, err := strategy.Authenticate(context.Background(), loginWithMockOIDC(t, strategy, provider, ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if user.Email != "mock.user@example.com" {
+		t.Fatalf("userinfo must not override ID token claims, got email %q", user.Email)
+	}
+	if user.Metadata["name"] != "From Userinfo" {
+		t.Fatalf("expected userinfo to fill in missing claims, got %v", user.Metadata["name"])
+	}
+}
+
+func TestOIDCStrategyRejectsUserinfoSubjectMismatch(t *testing.T) {
+	provider := NewMockOIDCProvider(t)
+	provider.UserinfoClaims = map[string]interface{}{"sub": "someone-else"}
+	strategy := NewOIDCStrategy(provider.Config("mock", "http://app.test/callback"), nil)
+
+	if _, err := strategy.Authenticate(context.Background(), loginWithMockOIDC(t, strategy, provider, "")); err == nil {
+		t.Fatal("expected a userinfo subject mismatch to fail the login")
+	}
+}
+
+func TestOIDCStrategyRejectsWrongClient(t *testing.T) {
+	provider := NewMockOIDCProvider(t)
+	config := provider.Config("mock", "http://app.test/callback")
+	config.ClientSecret = "wrong"
+	strategy := NewOIDCStrategy(config, nil)
+
+	if _, err := strategy.Authenticate(context.Background(), loginWithMockOIDC(t, strategy, provider, "")); err == nil {
+		t.Fatal("expected the token exchange to fail with a wrong client secret")
+	}
+}
+
+func TestOIDCStrategyDiscoveryTTL(t *testing.T) {
+	provider := NewMockOIDCProvider(t)
+	strategy := NewOIDCStrategy(provider.Config("mock", "http://app.test/callback"), nil)
+
+	first, err := strategy.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cached, err := strategy.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached != first {
+		t.Fatal("expected the discovery document to be cached")
+	}
+
+	strategy.config.DiscoveryTTL = time.Nanosecond
+	refreshed, err := strategy.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if refreshed == first {
+		t.Fatal("expected an expired discovery document to be refetched")
+	}
+
+	provider.Server.Close()
+	stale, err := strategy.Discover(context.Background())
+	if err != nil {
+		t.Fatalf("expected the cached document while the provider is down, got %v", err)
+	}
+	if stale != refreshed {
+		t.Fatal("expected the last discovery document to be served")
+	}
+}
+
+func TestOIDCStrategyDiscoveryBacksOffAfterFailure(t *testing.T) {
+	var fetches atomic.Int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	strategy := NewOIDCStrategy(&OIDCConfig{
+		Name:         "down",
+		Issuer:       server.URL,
+		ClientID:     "client",
+		RedirectURL:  "http://app.test/callback",
+		DiscoveryURL: server.URL,
+	}, nil)
+
+	// Concurrent callers share a single fetch
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := strategy.Discover(context.Background())
+			errs <- err
+		}()
+	}
+	for fetches.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err == nil {
+			t.Fatal("expected discovery to fail")
+		}
+	}
+
+	// A failed fetch is not retried right away
+	if _, err := strategy.Discover(context.Background()); err == nil {
+		t.Fatal("expected the last failure to be returned")
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("expected a single discovery fetch, got %d", got)
+	}
+}
+
+func TestLocalReturnPath(t *testing.T) {
+	tests := map[string]string{
+		"/dashboard?tab=1":   "/dashboard?tab=1",
+		"":                   "",
+		"dashboard":          "",
+		"//evil.com":         "",
+		"/\\evil.com":        "",
+		"/\t/evil.com":       "",
+		"/\n/evil.com":       "",
+		"https://evil.com":   "",
+		"/%zz":               "",
+		"/ok/../still-local": "/ok/../still-local",
+	}
+
+	for input, want := range tests {
+		if got := localReturnPath(input); got != want {
+			t.Errorf("localReturnPath(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
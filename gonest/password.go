@@ -0,0 +1,552 @@
+package gonest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Password hashing algorithms
+const (
+	PasswordAlgorithmArgon2id = "argon2id"
+	PasswordAlgorithmBcrypt   = "bcrypt"
+)
+
+// Password errors
+var (
+	ErrInvalidCredentials   = errors.New("invalid credentials")
+	ErrAccountLocked        = errors.New("account is temporarily locked")
+	ErrResetTokenInvalid    = errors.New("invalid or expired password reset token")
+	ErrUnsupportedHash      = errors.New("unsupported password hash format")
+	ErrPasswordPolicyFailed = errors.New("password does not meet policy")
+)
+
+// Argon2Params holds argon2id parameters
+type Argon2Params struct {
+	Memory      uint32 // in KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// PasswordPolicy describes the rules passwords must follow
+type PasswordPolicy struct {
+	MinLength     int
+	MaxLength     int
+	RequireUpper  bool
+	RequireLower  bool
+	RequireDigit  bool
+	RequireSymbol bool
+	// Forbidden passwords are rejected case-insensitively, e.g. common passwords
+	Forbidden []string
+}
+
+// DefaultPasswordPolicy returns the default password policy
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{
+		MinLength: 12,
+		MaxLength: 128,
+		Forbidden: []string{"password", "password123", "123456789012", "qwertyuiopas"},
+	}
+}
+
+// PasswordPolicyError lists the rules a password violates
+type PasswordPolicyError struct {
+	Violations []string
+}
+
+// Error implements error interface
+func (ppe *PasswordPolicyError) Error() string {
+	return "password does not meet policy: " + strings.Join(ppe.Violations, ", ")
+}
+
+// Is matches ErrPasswordPolicyFailed
+func (ppe *PasswordPolicyError) Is(target error) bool {
+	return target == ErrPasswordPolicyFailed
+}
+
+// Validate checks a password against the policy
+func (pp *PasswordPolicy) Validate(password string) error {
+	var violations []string
+
+	length := len([]rune(password))
+	if pp.MinLength > 0 && length < pp.MinLength {
+		violations = append(violations, fmt.Sprintf("must be at least %d characters", pp.MinLength))
+	}
+	if pp.MaxLength > 0 && length > pp.MaxLength {
+		violations = append(violations, fmt.Sprintf("must be at most %d characters", pp.MaxLength))
+	}
+
+	var hasUpper, hasLower, hasDigit, hasSymbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			hasUpper = true
+		case unicode.IsLower(r):
+			hasLower = true
+		case unicode.IsDigit(r):
+			hasDigit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			hasSymbol = true
+		}
+	}
+
+	if pp.RequireUpper && !hasUpper {
+		violations = append(violations, "must contain an uppercase letter")
+	}
+	if pp.RequireLower && !hasLower {
+		violations = append(violations, "must contain a lowercase letter")
+	}
+	if pp.RequireDigit && !hasDigit {
+		violations = append(violations, "must contain a digit")
+	}
+	if pp.RequireSymbol && !hasSymbol {
+		violations = append(violations, "must contain a symbol")
+	}
+
+	for _, forbidden := range pp.Forbidden {
+		if strings.EqualFold(password, forbidden) {
+			violations = append(violations, "is too common")
+			break
+		}
+	}
+
+	if len(violations) > 0 {
+		return &PasswordPolicyError{Violations: violations}
+	}
+	return nil
+}
+
+// ValidationFunc returns a validator rule for the policy, for use with
+// DTOValidator.RegisterValidation, e.g. `validate:"required,password"`
+func (pp *PasswordPolicy) ValidationFunc() validator.Func {
+	return func(fl validator.FieldLevel) bool {
+		return pp.Validate(fl.Field().String()) == nil
+	}
+}
+
+// LockoutConfig holds account lockout configuration.
+// Failures are counted per account and client IP (see WithClientIP), so an
+// attacker cannot lock a victim out from their own address. The trade-off is
+// that an attacker spreading guesses over many addresses gets MaxAttempts
+// guesses per address; combine lockout with per-IP rate limiting. When the
+// context carries no client IP, failures are counted per account only.
+type LockoutConfig struct {
+	// MaxAttempts failed attempts within Window lock the account
+	MaxAttempts int
+	Window      time.Duration
+	Duration    time.Duration
+}
+
+// PasswordConfig holds password service configuration
+type PasswordConfig struct {
+	Algorithm     string
+	Argon2        Argon2Params
+	BcryptCost    int
+	Policy        *PasswordPolicy
+	ResetTokenTTL time.Duration
+	Lockout       *LockoutConfig
+}
+
+// DefaultPasswordConfig returns default password configuration
+func DefaultPasswordConfig() *PasswordConfig {
+	return &PasswordConfig{
+		Algorithm: PasswordAlgorithmArgon2id,
+		Argon2: Argon2Params{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 2,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+		BcryptCost:    12,
+		Policy:        DefaultPasswordPolicy(),
+		ResetTokenTTL: time.Hour,
+		Lockout: &LockoutConfig{
+			MaxAttempts: 5,
+			Window:      15 * time.Minute,
+			Duration:    15 * time.Minute,
+		},
+	}
+}
+
+// PasswordService hashes and verifies passwords, issues reset tokens and locks out accounts
+type PasswordService struct {
+	config       *PasswordConfig
+	resetStore   CacheProvider
+	lockoutStore RateLimitStore
+	dummyHash    string
+	logger       *logrus.Logger
+}
+
+// NewPasswordService creates a new password service. Reset tokens are kept in
+// resetStore, failed attempts and used reset tokens in lockoutStore; memory
+// stores are used when nil.
+func NewPasswordService(config *PasswordConfig, resetStore CacheProvider, lockoutStore RateLimitStore, logger *logrus.Logger) *PasswordService {
+	if config == nil {
+		config = DefaultPasswordConfig()
+	}
+	if resetStore == nil {
+		resetStore = NewMemoryCache(logger)
+	}
+	if lockoutStore == nil {
+		lockoutStore = NewMemoryRateLimitStore()
+	}
+
+	ps := &PasswordService{
+		config:       config,
+		resetStore:   resetStore,
+		lockoutStore: lockoutStore,
+		logger:       logger,
+	}
+
+	// Verified against unknown users so that lookups take the same time
+	ps.dummyHash, _ = ps.Hash(randomURLString(16))
+	return ps
+}
+
+// Policy returns the password policy
+func (ps *PasswordService) Policy() *PasswordPolicy {
+	return ps.config.Policy
+}
+
+// PasswordRuleRegistrar is a validator whose password tag can enforce a policy,
+// e.g. DTOValidator and ValidationPipe
+type PasswordRuleRegistrar interface {
+	RegisterPasswordRule(policy *PasswordPolicy) error
+}
+
+// RegisterPasswordRule makes the password tag of validators enforce the configured
+// policy. Call it at startup, before the validators are first used.
+func (ps *PasswordService) RegisterPasswordRule(validators ...PasswordRuleRegistrar) error {
+	for _, validator := range validators {
+		if err := validator.RegisterPasswordRule(ps.config.Policy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hash hashes a password with the configured algorithm
+func (ps *PasswordService) Hash(password string) (string, error) {
+	switch ps.config.Algorithm {
+	case PasswordAlgorithmBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), ps.config.BcryptCost)
+		if err != nil {
+			return "", err
+		}
+		return string(hash), nil
+	case PasswordAlgorithmArgon2id, "":
+		params := ps.config.Argon2
+		salt := make([]byte, params.SaltLength)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+			argon2.Version, params.Memory, params.Iterations, params.Parallelism,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key),
+		), nil
+	}
+
+	return "", fmt.Errorf("%w: %s", ErrUnsupportedAlgorithm, ps.config.Algorithm)
+}
+
+// Verify checks a password against an argon2id or bcrypt hash in constant time
+func (ps *PasswordService) Verify(password, encodedHash string) (bool, error) {
+	if strings.HasPrefix(encodedHash, "$argon2id$") {
+		params, salt, key, err := decodeArgon2Hash(encodedHash)
+		if err != nil {
+			return false, err
+		}
+		computed := argon2.IDKey([]byte(password), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+		return subtle.ConstantTimeCompare(computed, key) == 1, nil
+	}
+
+	if strings.HasPrefix(encodedHash, "$2") {
+		err := bcrypt.CompareHashAndPassword([]byte(encodedHash), []byte(password))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+
+	return false, ErrUnsupportedHash
+}
+
+// NeedsRehash reports whether a hash uses another algorithm or weaker parameters than configured
+func (ps *PasswordService) NeedsRehash(encodedHash string) bool {
+	switch ps.config.Algorithm {
+	case PasswordAlgorithmBcrypt:
+		cost, err := bcrypt.Cost([]byte(encodedHash))
+		return err != nil || cost != ps.config.BcryptCost
+	default:
+		params, _, _, err := decodeArgon2Hash(encodedHash)
+		if err != nil {
+			return true
+		}
+		configured := ps.config.Argon2
+		return params.Memory != configured.Memory ||
+			params.Iterations != configured.Iterations ||
+			params.Parallelism != configured.Parallelism ||
+			params.KeyLength != configured.KeyLength
+	}
+}
+
+// VerifyAndUpgrade verifies a password and returns a new hash when the stored
+// one should be upgraded; newHash is empty when no upgrade is needed
+func (ps *PasswordService) VerifyAndUpgrade(password, encodedHash string) (bool, string, error) {
+	ok, err := ps.Verify(password, encodedHash)
+	if err != nil || !ok {
+		return false, "", err
+	}
+
+	if !ps.NeedsRehash(encodedHash) {
+		return true, "", nil
+	}
+
+	newHash, err := ps.Hash(password)
+	if err != nil {
+		return true, "", err
+	}
+	return true, newHash, nil
+}
+
+// decodeArgon2Hash parses a PHC formatted argon2id hash
+func decodeArgon2Hash(encodedHash string) (*Argon2Params, []byte, []byte, error) {
+	parts := strings.Split(encodedHash, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+
+	params := &Argon2Params{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism); err != nil {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, nil, nil, ErrUnsupportedHash
+	}
+
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
+
+// IssueResetToken creates a single-use password reset token for a user
+func (ps *PasswordService) IssueResetToken(ctx context.Context, userID string) (string, error) {
+	token := randomURLString(32)
+	if err := ps.resetStore.Set(ctx, ps.resetKey(token), []byte(userID), ps.config.ResetTokenTTL); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// ConsumeResetToken verifies a reset token and returns its user. The token cannot be used again.
+func (ps *PasswordService) ConsumeResetToken(ctx context.Context, token string) (string, error) {
+	key := ps.resetKey(token)
+
+	userID, err := ps.resetStore.Get(ctx, key)
+	if err != nil || len(userID) == 0 {
+		return "", ErrResetTokenInvalid
+	}
+
+	// Claiming the token in the lockout store is atomic, so concurrent
+	// requests with the same token cannot both pass the lookup above
+	entry, err := ps.lockoutStore.Increment(ctx, key+":used", ps.config.ResetTokenTTL)
+	if err != nil {
+		return "", err
+	}
+	if entry.Count > 1 {
+		return "", ErrResetTokenInvalid
+	}
+
+	if err := ps.resetStore.Delete(ctx, key); err != nil {
+		return "", err
+	}
+	return string(userID), nil
+}
+
+// resetKey returns the store key of a reset token; only the token hash is stored
+func (ps *PasswordService) resetKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "password_reset:" + hex.EncodeToString(sum[:])
+}
+
+// IsLocked checks if an account is locked out for the client of the context
+func (ps *PasswordService) IsLocked(ctx context.Context, accountID string) bool {
+	if ps.config.Lockout == nil {
+		return false
+	}
+
+	entry, err := ps.lockoutStore.Get(ctx, lockoutKey(ctx, "locked", accountID))
+	return err == nil && entry != nil && time.Now().Before(entry.ExpiresAt) &&
+		entry.FirstSeen.After(ps.unlockedAt(ctx, accountID))
+}
+
+// RecordFailure records a failed login and locks the account for the client
+// of the context once the limit is reached
+func (ps *PasswordService) RecordFailure(ctx context.Context, accountID string) (bool, error) {
+	lockout := ps.config.Lockout
+	if lockout == nil {
+		return false, nil
+	}
+
+	failuresKey := lockoutKey(ctx, "failures", accountID)
+	entry, err := ps.lockoutStore.Increment(ctx, failuresKey, lockout.Window)
+	if err != nil {
+		return false, err
+	}
+
+	// Failures counted before an Unlock start over
+	if !entry.FirstSeen.After(ps.unlockedAt(ctx, accountID)) {
+		if err := ps.lockoutStore.Delete(ctx, failuresKey); err != nil {
+			return false, err
+		}
+		if entry, err = ps.lockoutStore.Increment(ctx, failuresKey, lockout.Window); err != nil {
+			return false, err
+		}
+	}
+
+	if entry.Count < int64(lockout.MaxAttempts) {
+		return false, nil
+	}
+
+	now := time.Now()
+	locked := &RateLimitEntry{
+		Count:     entry.Count,
+		FirstSeen: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(lockout.Duration),
+	}
+	if err := ps.lockoutStore.Set(ctx, lockoutKey(ctx, "locked", accountID), locked, lockout.Duration); err != nil {
+		return false, err
+	}
+	if err := ps.lockoutStore.Delete(ctx, failuresKey); err != nil {
+		return true, err
+	}
+
+	if ps.logger != nil {
+		ps.logger.WithFields(logrus.Fields{
+			"account":   accountID,
+			"client_ip": clientIPFromContext(ctx),
+		}).Warn("Account locked after repeated login failures")
+	}
+	return true, nil
+}
+
+// RecordSuccess clears the failed attempts of an account for the client of the context
+func (ps *PasswordService) RecordSuccess(ctx context.Context, accountID string) error {
+	if ps.config.Lockout == nil {
+		return nil
+	}
+	return ps.lockoutStore.Delete(ctx, lockoutKey(ctx, "failures", accountID))
+}
+
+// Unlock removes the lockouts of an account for all clients
+func (ps *PasswordService) Unlock(ctx context.Context, accountID string) error {
+	lockout := ps.config.Lockout
+	if lockout == nil {
+		return nil
+	}
+
+	// Entries are keyed by client and cannot be listed, so the time of the
+	// unlock is recorded instead; older entries expire before the marker does
+	ttl := lockout.Window
+	if lockout.Duration > ttl {
+		ttl = lockout.Duration
+	}
+
+	now := time.Now()
+	unlocked := &RateLimitEntry{
+		FirstSeen: now,
+		LastSeen:  now,
+		ExpiresAt: now.Add(ttl),
+	}
+	return ps.lockoutStore.Set(ctx, "lockout:unlocked:"+accountID, unlocked, ttl)
+}
+
+// unlockedAt returns when the account was last unlocked
+func (ps *PasswordService) unlockedAt(ctx context.Context, accountID string) time.Time {
+	entry, err := ps.lockoutStore.Get(ctx, "lockout:unlocked:"+accountID)
+	if err != nil || entry == nil {
+		return time.Time{}
+	}
+	return entry.FirstSeen
+}
+
+// lockoutKey returns the store key of a lockout entry for the account and
+// the client of the context. The client is length-prefixed so that account
+// IDs cannot be crafted to collide with another client's key.
+func lockoutKey(ctx context.Context, kind, accountID string) string {
+	client := clientIPFromContext(ctx)
+	return fmt.Sprintf("lockout:%s:%d:%s:%s", kind, len(client), client, accountID)
+}
+
+// CredentialLookup finds a user and their password hash by username.
+// It returns a nil user when the username does not exist.
+type CredentialLookup func(ctx context.Context, username string) (*AuthUser, string, error)
+
+// LocalValidator builds a validator for NewLocalStrategyWithContext that verifies hashes,
+// applies lockout and upgrades outdated hashes through updateHash
+func (ps *PasswordService) LocalValidator(lookup CredentialLookup, updateHash func(user *AuthUser, hash string) error) func(ctx context.Context, username, password string) (*AuthUser, error) {
+	return func(ctx context.Context, username, password string) (*AuthUser, error) {
+		if ps.IsLocked(ctx, username) {
+			return nil, ErrAccountLocked
+		}
+
+		user, hash, err := lookup(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+
+		if user == nil {
+			ps.Verify(password, ps.dummyHash)
+			ps.RecordFailure(ctx, username)
+			return nil, ErrInvalidCredentials
+		}
+
+		ok, newHash, err := ps.VerifyAndUpgrade(password, hash)
+		if err != nil || !ok {
+			if locked, _ := ps.RecordFailure(ctx, username); locked {
+				return nil, ErrAccountLocked
+			}
+			return nil, ErrInvalidCredentials
+		}
+
+		ps.RecordSuccess(ctx, username)
+
+		if newHash != "" && updateHash != nil {
+			if err := updateHash(user, newHash); err != nil && ps.logger != nil {
+				ps.logger.WithError(err).Warn("Failed to upgrade password hash")
+			}
+		}
+
+		return user, nil
+	}
+}
@@ -0,0 +1,41 @@
+package gonest
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConsumeResetTokenOnce(t *testing.T) {
+	ps := NewPasswordService(nil, nil, nil, nil)
+	ctx := context.Background()
+
+	token, err := ps.IssueResetToken(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var successes atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if userID, err := ps.ConsumeResetToken(ctx, token); err == nil {
+				if userID != "u1" {
+					t.Errorf("unexpected user %q", userID)
+				}
+				successes.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := successes.Load(); got != 1 {
+		t.Fatalf("expected the reset token to be consumed once, got %d", got)
+	}
+	if _, err := ps.ConsumeResetToken(ctx, token); err != ErrResetTokenInvalid {
+		t.Fatalf("expected ErrResetTokenInvalid on reuse, got %v", err)
+	}
+}
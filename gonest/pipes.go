@@ -80,13 +80,28 @@ type ValidationPipe struct {
 	validator *validator.Validate
 }
 
-// NewValidationPipe creates a new validation pipe
+// NewValidationPipe creates a new validation pipe.
+// The password tag enforces DefaultPasswordPolicy until RegisterPasswordRule is called.
 func NewValidationPipe() *ValidationPipe {
+	v := validator.New()
+	v.RegisterValidation("password", DefaultPasswordPolicy().ValidationFunc())
+
 	return &ValidationPipe{
-		validator: validator.New(),
+		validator: v,
 	}
 }
 
+// RegisterValidation registers a custom validation rule
+func (vp *ValidationPipe) RegisterValidation(tag string, fn validator.Func) error {
+	return vp.validator.RegisterValidation(tag, fn)
+}
+
+// RegisterPasswordRule makes the password tag enforce a policy.
+// Like RegisterValidation, it must be called before the first validation.
+func (vp *ValidationPipe) RegisterPasswordRule(policy *PasswordPolicy) error {
+	return vp.validator.RegisterValidation("password", policy.ValidationFunc())
+}
+
 // Transform validates the input data
 func (vp *ValidationPipe) Transform(value interface{}) (interface{}, error) {
 	if err := vp.validator.Struct(value); err != nil {
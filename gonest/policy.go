@@ -0,0 +1,427 @@
+package gonest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Permissions have the form "<resource>:<action>", e.g. "users:read".
+// Either part may be "*", and "*" alone grants everything.
+
+// MetadataKeyPermissions is the metadata key of the permissions required by a route
+const MetadataKeyPermissions = "permissions"
+
+// RequirePermissions creates a metadata entry with the permissions required by a route
+func RequirePermissions(permissions ...string) MetadataEntry {
+	return SetMetadata(MetadataKeyPermissions, permissions)
+}
+
+// PolicyCondition decides whether a grant applies to a subject and resource
+type PolicyCondition func(subject *AuthUser, resource interface{}) bool
+
+// ConditionFactory builds a condition from its argument in a policy file
+type ConditionFactory func(arg interface{}) (PolicyCondition, error)
+
+// PolicyResource is implemented by resources that know their type
+type PolicyResource interface {
+	ResourceType() string
+}
+
+// policyGrant is a permission granted to a role
+type policyGrant struct {
+	permission string
+	conditions []PolicyCondition
+}
+
+// rolePolicy holds the grants of a role
+type rolePolicy struct {
+	inherits []string
+	grants   []policyGrant
+}
+
+// PolicyEngine maps roles to permissions and evaluates ability checks
+type PolicyEngine struct {
+	roles      map[string]*rolePolicy
+	conditions map[string]ConditionFactory
+	mutex      sync.RWMutex
+}
+
+// NewPolicyEngine creates a new policy engine with the built-in "owner" condition
+func NewPolicyEngine() *PolicyEngine {
+	pe := &PolicyEngine{
+		roles:      make(map[string]*rolePolicy),
+		conditions: make(map[string]ConditionFactory),
+	}
+
+	pe.RegisterCondition("owner", func(arg interface{}) (PolicyCondition, error) {
+		field, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("owner condition expects a field name, got %T", arg)
+		}
+		return OwnerCondition(field), nil
+	})
+
+	return pe
+}
+
+// DefaultPolicyEngine is used by Can when the context carries no engine
+var DefaultPolicyEngine = NewPolicyEngine()
+
+// role returns the policy of a role, creating it if needed
+func (pe *PolicyEngine) role(name string) *rolePolicy {
+	policy, exists := pe.roles[name]
+	if !exists {
+		policy = &rolePolicy{}
+		pe.roles[name] = policy
+	}
+	return policy
+}
+
+// Inherit makes a role inherit the permissions of other roles
+func (pe *PolicyEngine) Inherit(role string, parents ...string) *PolicyEngine {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	policy := pe.role(role)
+	policy.inherits = append(policy.inherits, parents...)
+	return pe
+}
+
+// Allow grants a permission to a role. All conditions must hold for the grant to apply.
+func (pe *PolicyEngine) Allow(role, permission string, conditions ...PolicyCondition) *PolicyEngine {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	policy := pe.role(role)
+	policy.grants = append(policy.grants, policyGrant{
+		permission: permission,
+		conditions: conditions,
+	})
+	return pe
+}
+
+// RegisterCondition registers a named condition usable in policy files
+func (pe *PolicyEngine) RegisterCondition(name string, factory ConditionFactory) {
+	pe.mutex.Lock()
+	defer pe.mutex.Unlock()
+
+	pe.conditions[name] = factory
+}
+
+// Can checks if a subject may perform an action on a resource.
+// The action is either a full permission ("posts:update") or an action
+// ("update") combined with the type of the resource. The resource may be a
+// type name or a value; conditions are only evaluated against values, so
+// conditional grants never apply to a type name or a nil resource.
+func (pe *PolicyEngine) Can(subject *AuthUser, action string, resource interface{}) bool {
+	return pe.can(subject, action, resource, false)
+}
+
+// CanAny checks if a subject may perform an action on some resource of a
+// type, counting conditional grants as applying. It suits deciding what to
+// show, e.g. an edit button, but must not be used to authorize access to a
+// specific resource.
+func (pe *PolicyEngine) CanAny(subject *AuthUser, action, resourceType string) bool {
+	return pe.can(subject, action, resourceType, true)
+}
+
+// can checks a permission. anyResource makes conditional grants apply
+// without evaluating them.
+func (pe *PolicyEngine) can(subject *AuthUser, action string, resource interface{}, anyResource bool) bool {
+	if subject == nil {
+		return false
+	}
+
+	permission := action
+	if !strings.Contains(action, ":") {
+		resourceType := policyResourceType(resource)
+		if resourceType == "" {
+			return false
+		}
+		permission = resourceType + ":" + action
+	}
+
+	// A type name is not a resource conditions can be evaluated against
+	if _, isTypeName := resource.(string); isTypeName {
+		resource = nil
+	}
+
+	pe.mutex.RLock()
+	defer pe.mutex.RUnlock()
+
+	visited := make(map[string]bool)
+	for _, role := range subject.Roles {
+		if pe.roleCan(role, permission, subject, resource, anyResource, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// roleCan checks the grants of a role and the roles it inherits
+func (pe *PolicyEngine) roleCan(role, permission string, subject *AuthUser, resource interface{}, anyResource bool, visited map[string]bool) bool {
+	if visited[role] {
+		return false
+	}
+	visited[role] = true
+
+	policy, exists := pe.roles[role]
+	if !exists {
+		return false
+	}
+
+	for _, grant := range policy.grants {
+		if !matchPermission(grant.permission, permission) {
+			continue
+		}
+		if len(grant.conditions) == 0 || anyResource {
+			return true
+		}
+		// Conditional grants never apply when there is no resource to check
+		if resource != nil && conditionsHold(grant.conditions, subject, resource) {
+			return true
+		}
+	}
+
+	for _, parent := range policy.inherits {
+		if pe.roleCan(parent, permission, subject, resource, anyResource, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+// conditionsHold checks that all conditions hold
+func conditionsHold(conditions []PolicyCondition, subject *AuthUser, resource interface{}) bool {
+	for _, condition := range conditions {
+		if !condition(subject, resource) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchPermission matches a permission against a granted pattern
+func matchPermission(pattern, permission string) bool {
+	if pattern == "*" || pattern == permission {
+		return true
+	}
+
+	patternResource, patternAction, _ := strings.Cut(pattern, ":")
+	resource, action, _ := strings.Cut(permission, ":")
+
+	return (patternResource == "*" || patternResource == resource) &&
+		(patternAction == "*" || patternAction == action)
+}
+
+// policyResourceType determines the type name of a resource
+func policyResourceType(resource interface{}) string {
+	switch r := resource.(type) {
+	case string:
+		return r
+	case PolicyResource:
+		return r.ResourceType()
+	}
+	return ""
+}
+
+// OwnerCondition holds when the resource field equals the subject ID
+func OwnerCondition(field string) PolicyCondition {
+	return func(subject *AuthUser, resource interface{}) bool {
+		value, ok := resourceAttribute(resource, field)
+		return ok && fmt.Sprint(value) == subject.ID
+	}
+}
+
+// resourceAttribute reads a field of a map or struct resource by key, field name or json tag
+func resourceAttribute(resource interface{}, field string) (interface{}, bool) {
+	if values, ok := resource.(map[string]interface{}); ok {
+		value, exists := values[field]
+		return value, exists
+	}
+
+	v := reflect.ValueOf(resource)
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return nil, false
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, false
+	}
+
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		structField := t.Field(i)
+		if !structField.IsExported() {
+			continue
+		}
+		tagName, _, _ := strings.Cut(structField.Tag.Get("json"), ",")
+		if structField.Name == field || tagName == field {
+			return v.Field(i).Interface(), true
+		}
+	}
+	return nil, false
+}
+
+// PolicyDefinition describes role permissions, e.g. loaded from YAML:
+//
+//	roles:
+//	  viewer:
+//	    permissions: ["posts:read"]
+//	  author:
+//	    inherits: [viewer]
+//	    permissions:
+//	      - permission: posts:update
+//	        when: {owner: author_id}
+type PolicyDefinition struct {
+	Roles map[string]RoleDefinition `json:"roles"`
+}
+
+// RoleDefinition describes the permissions of a role
+type RoleDefinition struct {
+	Inherits    []string               `json:"inherits"`
+	Permissions []PermissionDefinition `json:"permissions"`
+}
+
+// PermissionDefinition is a permission with optional named conditions
+type PermissionDefinition struct {
+	Permission string                 `json:"permission"`
+	When       map[string]interface{} `json:"when"`
+}
+
+// UnmarshalJSON accepts either a permission string or an object
+func (pd *PermissionDefinition) UnmarshalJSON(data []byte) error {
+	var permission string
+	if err := json.Unmarshal(data, &permission); err == nil {
+		pd.Permission = permission
+		return nil
+	}
+
+	type plain PermissionDefinition
+	return json.Unmarshal(data, (*plain)(pd))
+}
+
+// Load adds the roles of a policy definition to the engine
+func (pe *PolicyEngine) Load(definition *PolicyDefinition) error {
+	for roleName, role := range definition.Roles {
+		if len(role.Inherits) > 0 {
+			pe.Inherit(roleName, role.Inherits...)
+		}
+
+		for _, permission := range role.Permissions {
+			conditions, err := pe.buildConditions(permission.When)
+			if err != nil {
+				return fmt.Errorf("role '%s' permission '%s': %w", roleName, permission.Permission, err)
+			}
+			pe.Allow(roleName, permission.Permission, conditions...)
+		}
+	}
+	return nil
+}
+
+// LoadFromConfig loads a policy definition from a configuration section
+func (pe *PolicyEngine) LoadFromConfig(configService *ConfigService, key string) error {
+	var definition PolicyDefinition
+	if err := configService.GetStruct(key, &definition); err != nil {
+		return fmt.Errorf("failed to load policies from '%s': %w", key, err)
+	}
+	return pe.Load(&definition)
+}
+
+// buildConditions creates conditions from named condition arguments
+func (pe *PolicyEngine) buildConditions(when map[string]interface{}) ([]PolicyCondition, error) {
+	pe.mutex.RLock()
+	defer pe.mutex.RUnlock()
+
+	conditions := make([]PolicyCondition, 0, len(when))
+	for name, arg := range when {
+		factory, exists := pe.conditions[name]
+		if !exists {
+			return nil, fmt.Errorf("unknown condition '%s'", name)
+		}
+		condition, err := factory(arg)
+		if err != nil {
+			return nil, err
+		}
+		conditions = append(conditions, condition)
+	}
+	return conditions, nil
+}
+
+// policyEngineContextKey is the context key of the policy engine
+type policyEngineContextKey struct{}
+
+// WithPolicyEngine returns a context carrying a policy engine for Can
+func WithPolicyEngine(ctx context.Context, engine *PolicyEngine) context.Context {
+	return context.WithValue(ctx, policyEngineContextKey{}, engine)
+}
+
+// Can checks if the user of the context may perform an action on a resource,
+// using the context's policy engine or DefaultPolicyEngine
+func Can(ctx context.Context, action string, resource interface{}) bool {
+	user, ok := UserFromContext(ctx)
+	if !ok {
+		return false
+	}
+
+	engine, ok := ctx.Value(policyEngineContextKey{}).(*PolicyEngine)
+	if !ok {
+		engine = DefaultPolicyEngine
+	}
+	return engine.Can(user, action, resource)
+}
+
+// PoliciesGuard requires permissions granted by a policy engine. Permissions
+// come from the guard and from the route's RequirePermissions metadata.
+type PoliciesGuard struct {
+	Engine      *PolicyEngine
+	Permissions []string
+}
+
+// NewPoliciesGuard creates a new policies guard
+func NewPoliciesGuard(engine *PolicyEngine, permissions ...string) *PoliciesGuard {
+	if engine == nil {
+		engine = DefaultPolicyEngine
+	}
+	return &PoliciesGuard{
+		Engine:      engine,
+		Permissions: permissions,
+	}
+}
+
+// CanActivate checks that the current user has every required permission
+func (pg *PoliciesGuard) CanActivate(ctx echo.Context) (bool, error) {
+	ctx.SetRequest(ctx.Request().WithContext(WithPolicyEngine(ctx.Request().Context(), pg.Engine)))
+
+	permissions := pg.Permissions
+	if value, ok := GetMetadata(ctx, MetadataKeyPermissions); ok {
+		if required, ok := value.([]string); ok {
+			permissions = append(append([]string{}, permissions...), required...)
+		}
+	}
+
+	if len(permissions) == 0 {
+		return true, nil
+	}
+
+	user, err := GetCurrentUser(ctx)
+	if err != nil {
+		return false, echo.NewHTTPError(http.StatusUnauthorized, "User not authenticated")
+	}
+
+	for _, permission := range permissions {
+		if !pg.Engine.Can(user, permission, nil) {
+			return false, echo.NewHTTPError(http.StatusForbidden, "Insufficient permissions")
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,28 @@
+package gonest
+
+import "testing"
+
+func TestPolicyEngineConditionalGrantsOnTypeNames(t *testing.T) {
+	engine := NewPolicyEngine().
+		Allow("author", "posts:update", OwnerCondition("author_id"))
+	author := &AuthUser{ID: "u1", Roles: []string{"author"}}
+
+	if engine.Can(author, "update", "posts") {
+		t.Fatal("a conditional grant must not apply to a type name")
+	}
+	if engine.Can(author, "posts:update", nil) {
+		t.Fatal("a conditional grant must not apply without a resource")
+	}
+	if !engine.CanAny(author, "update", "posts") {
+		t.Fatal("CanAny should count conditional grants")
+	}
+
+	own := map[string]interface{}{"author_id": "u1"}
+	other := map[string]interface{}{"author_id": "u2"}
+	if !engine.Can(author, "posts:update", own) {
+		t.Fatal("the owner condition should hold for the author's post")
+	}
+	if engine.Can(author, "posts:update", other) {
+		t.Fatal("the owner condition should not hold for another user's post")
+	}
+}
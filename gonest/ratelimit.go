@@ -2,11 +2,14 @@ package gonest
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/labstack/echo/v4"
@@ -21,6 +24,8 @@ const (
 	SlidingWindowStrategy RateLimitStrategy = "sliding_window"
 	TokenBucketStrategy   RateLimitStrategy = "token_bucket"
 	LeakyBucketStrategy   RateLimitStrategy = "leaky_bucket"
+	// ConcurrencyStrategy limits in-flight requests instead of request rates
+	ConcurrencyStrategy RateLimitStrategy = "concurrency"
 )
 
 // RateLimitConfig holds rate limiting configuration
@@ -34,6 +39,24 @@ type RateLimitConfig struct {
 	SkipFunc       func(echo.Context) bool
 	OnLimitReached func(echo.Context) error
 	Store          RateLimitStore
+	// FallbackStore limits requests locally while Store is unavailable.
+	// It defaults to a memory store unless Store is one.
+	FallbackStore RateLimitStore
+	// Cost is how much of the limit a request uses, 1 if not positive.
+	// CostFunc computes it per request; RateLimitCost metadata of the route
+	// takes precedence over both.
+	Cost     int64
+	CostFunc func(echo.Context) int64
+	// With ConcurrencyStrategy, MaxRequests caps the in-flight requests of
+	// each key on a route and MaxConcurrentPerRoute those of a route across
+	// keys. Requests over a limit wait in a queue of up to QueueSize
+	// requests for at most QueueTimeout, or while the request is not
+	// cancelled if zero. A request costing more than a limit is always
+	// rejected. Concurrency is limited per process; the strategy is not
+	// supported by Throttler profiles or stores.
+	MaxConcurrentPerRoute int64
+	QueueSize             int
+	QueueTimeout          time.Duration
 }
 
 // DefaultRateLimitConfig returns default rate limiting configuration
@@ -51,6 +74,13 @@ func DefaultRateLimitConfig() *RateLimitConfig {
 	}
 }
 
+// ErrRateLimitStrategyUnsupported is returned when evaluating a rule whose
+// strategy is not a rate, i.e. ConcurrencyStrategy, which only RateLimiter supports
+var ErrRateLimitStrategyUnsupported = errors.New("rate limit strategy cannot be evaluated by a store")
+
+// ErrRateLimitEntryNotFound is returned by RateLimitStore.Get for keys without an entry
+var ErrRateLimitEntryNotFound = errors.New("rate limit entry not found")
+
 // RateLimitStore interface for storing rate limit data
 type RateLimitStore interface {
 	Get(ctx context.Context, key string) (*RateLimitEntry, error)
@@ -60,14 +90,56 @@ type RateLimitStore interface {
 	Clear(ctx context.Context) error
 }
 
+// AtomicRateLimitStore is implemented by stores that evaluate a rule in one
+// atomic step, which shared stores need so that replicas cannot race
+type AtomicRateLimitStore interface {
+	RateLimitStore
+	Allow(ctx context.Context, key string, rule RateLimitRule) (*RateLimitResult, error)
+}
+
+// rateLimitPeeker is implemented by atomic stores that can evaluate a rule
+// without recording the request
+type rateLimitPeeker interface {
+	Peek(ctx context.Context, key string, rule RateLimitRule) (*RateLimitResult, error)
+}
+
+// RateLimitRule is a limit evaluated for a key
+type RateLimitRule struct {
+	Strategy RateLimitStrategy
+	Limit    int64
+	Window   time.Duration
+	// Cost is the part of the limit a request uses, 1 if not positive
+	Cost int64
+}
+
+// validate checks that stores can evaluate the rule
+func (r RateLimitRule) validate() error {
+	if r.Strategy == ConcurrencyStrategy {
+		return ErrRateLimitStrategyUnsupported
+	}
+	return nil
+}
+
+// RateLimitResult is the outcome of a rate limit check
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	// ResetAt is when the limit is fully available again
+	ResetAt time.Time
+	// RetryAfter is how long a rejected client should wait
+	RetryAfter time.Duration
+}
+
 // RateLimitEntry represents a rate limit entry
 type RateLimitEntry struct {
-	Count      int64     `json:"count"`
-	FirstSeen  time.Time `json:"first_seen"`
-	LastSeen   time.Time `json:"last_seen"`
-	ExpiresAt  time.Time `json:"expires_at"`
-	Tokens     float64   `json:"tokens,omitempty"`      // For token bucket
-	LastRefill time.Time `json:"last_refill,omitempty"` // For token bucket
+	Count         int64     `json:"count"`
+	PreviousCount int64     `json:"previous_count,omitempty"` // For sliding window
+	FirstSeen     time.Time `json:"first_seen"`
+	LastSeen      time.Time `json:"last_seen"`
+	ExpiresAt     time.Time `json:"expires_at"`
+	Tokens        float64   `json:"tokens,omitempty"`      // Tokens for token bucket, level for leaky bucket
+	LastRefill    time.Time `json:"last_refill,omitempty"` // For token and leaky bucket
 }
 
 // MemoryRateLimitStore implements in-memory rate limiting
@@ -95,7 +167,7 @@ func (mrs *MemoryRateLimitStore) Get(ctx context.Context, key string) (*RateLimi
 
 	entry, exists := mrs.entries[key]
 	if !exists {
-		return nil, fmt.Errorf("entry not found")
+		return nil, ErrRateLimitEntryNotFound
 	}
 
 	if time.Now().After(entry.ExpiresAt) {
@@ -143,6 +215,45 @@ func (mrs *MemoryRateLimitStore) Increment(ctx context.Context, key string, expi
 	return entry, nil
 }
 
+// Allow evaluates a rule for a key atomically
+func (mrs *MemoryRateLimitStore) Allow(ctx context.Context, key string, rule RateLimitRule) (*RateLimitResult, error) {
+	if err := rule.validate(); err != nil {
+		return nil, err
+	}
+
+	mrs.mutex.Lock()
+	defer mrs.mutex.Unlock()
+
+	now := time.Now()
+	entry := mrs.entries[key]
+	if entry != nil && entry.ExpiresAt.UnixMilli() <= now.UnixMilli() {
+		entry = nil
+	}
+
+	result, next := evaluateRateLimit(entry, rule, now)
+	mrs.entries[key] = next
+	return result, nil
+}
+
+// Peek evaluates a rule for a key without recording the request
+func (mrs *MemoryRateLimitStore) Peek(ctx context.Context, key string, rule RateLimitRule) (*RateLimitResult, error) {
+	if err := rule.validate(); err != nil {
+		return nil, err
+	}
+
+	mrs.mutex.RLock()
+	defer mrs.mutex.RUnlock()
+
+	now := time.Now()
+	entry := mrs.entries[key]
+	if entry != nil && entry.ExpiresAt.UnixMilli() <= now.UnixMilli() {
+		entry = nil
+	}
+
+	result, _ := evaluateRateLimit(entry, rule, now)
+	return result, nil
+}
+
 // Delete removes a rate limit entry
 func (mrs *MemoryRateLimitStore) Delete(ctx context.Context, key string) error {
 	mrs.mutex.Lock()
@@ -178,10 +289,50 @@ func (mrs *MemoryRateLimitStore) cleanup() {
 	}
 }
 
+// MetadataKeyRateLimitCost is the metadata key for the request cost of a controller or route
+const MetadataKeyRateLimitCost = "rate_limit_cost"
+
+// RateLimitCost sets the cost of the requests to a controller or route
+func RateLimitCost(cost int64) MetadataEntry {
+	return SetMetadata(MetadataKeyRateLimitCost, cost)
+}
+
+// RateLimitCostFunc computes the cost of the requests to a controller or route
+func RateLimitCostFunc(costFunc func(echo.Context) int64) MetadataEntry {
+	return SetMetadata(MetadataKeyRateLimitCost, costFunc)
+}
+
+// requestCost resolves the cost of a request from route metadata, then the cost function, then the static cost
+func requestCost(c echo.Context, cost int64, costFunc func(echo.Context) int64) int64 {
+	if value, ok := GetMetadata(c, MetadataKeyRateLimitCost); ok {
+		switch v := value.(type) {
+		case int64:
+			return max(1, v)
+		case func(echo.Context) int64:
+			return max(1, v(c))
+		}
+	}
+	if costFunc != nil {
+		return max(1, costFunc(c))
+	}
+	return max(1, cost)
+}
+
+// rateLimitRoute identifies the route of a request for per-route limits
+func rateLimitRoute(c echo.Context) string {
+	route := c.Path()
+	if route == "" {
+		route = c.Request().URL.Path
+	}
+	return c.Request().Method + " " + route
+}
+
 // RateLimiter provides rate limiting functionality
 type RateLimiter struct {
-	config *RateLimitConfig
-	logger *logrus.Logger
+	config      *RateLimitConfig
+	logger      *logrus.Logger
+	backend     *rateLimitBackend
+	concurrency *concurrencyLimiter
 }
 
 // NewRateLimiter creates a new rate limiter
@@ -189,10 +340,15 @@ func NewRateLimiter(config *RateLimitConfig, logger *logrus.Logger) *RateLimiter
 	if config == nil {
 		config = DefaultRateLimitConfig()
 	}
+	if config.Store == nil {
+		config.Store = NewMemoryRateLimitStore()
+	}
 
 	return &RateLimiter{
-		config: config,
-		logger: logger,
+		config:      config,
+		logger:      logger,
+		backend:     newRateLimitBackend(config.Store, config.FallbackStore, logger),
+		concurrency: newConcurrencyLimiter(config.QueueSize),
 	}
 }
 
@@ -203,11 +359,15 @@ func (rl *RateLimiter) Middleware() echo.MiddlewareFunc {
 			if rl.config.SkipFunc != nil && rl.config.SkipFunc(c) {
 				return next(c)
 			}
+			if rl.config.Strategy == ConcurrencyStrategy {
+				return rl.limitConcurrency(c, next)
+			}
 
 			key := rl.config.KeyGenerator(c)
 			ctx := c.Request().Context()
+			cost := requestCost(c, rl.config.Cost, rl.config.CostFunc)
 
-			allowed, info, err := rl.checkLimit(ctx, key)
+			result, err := rl.checkLimit(ctx, key, cost)
 			if err != nil {
 				rl.logger.WithError(err).Error("Rate limit check failed")
 				return next(c) // Continue on error
@@ -215,22 +375,12 @@ func (rl *RateLimiter) Middleware() echo.MiddlewareFunc {
 
 			// Set rate limit headers
 			if rl.config.Headers {
-				c.Response().Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", rl.config.MaxRequests))
-				c.Response().Header().Set("X-RateLimit-Remaining", fmt.Sprintf("%d", max(0, rl.config.MaxRequests-info.Count)))
-				c.Response().Header().Set("X-RateLimit-Reset", fmt.Sprintf("%d", info.ExpiresAt.Unix()))
-
-				if !allowed {
-					retryAfter := time.Until(info.ExpiresAt).Seconds()
-					c.Response().Header().Set("Retry-After", fmt.Sprintf("%.0f", retryAfter))
-				}
+				setRateLimitHeaders(c, result, "")
+				setStandardRateLimitHeaders(c, result, rateLimitPolicy(rl.config.MaxRequests, rl.config.WindowDuration))
 			}
 
-			if !allowed {
-				if rl.config.OnLimitReached != nil {
-					return rl.config.OnLimitReached(c)
-				}
-
-				return echo.NewHTTPError(http.StatusTooManyRequests, rl.config.ErrorMessage)
+			if !result.Allowed {
+				return rl.reject(c)
 			}
 
 			return next(c)
@@ -238,154 +388,330 @@ func (rl *RateLimiter) Middleware() echo.MiddlewareFunc {
 	}
 }
 
-// checkLimit checks if a request is within the rate limit
-func (rl *RateLimiter) checkLimit(ctx context.Context, key string) (bool, *RateLimitEntry, error) {
-	switch rl.config.Strategy {
-	case FixedWindowStrategy:
-		return rl.checkFixedWindow(ctx, key)
-	case SlidingWindowStrategy:
-		return rl.checkSlidingWindow(ctx, key)
-	case TokenBucketStrategy:
-		return rl.checkTokenBucket(ctx, key)
-	case LeakyBucketStrategy:
-		return rl.checkLeakyBucket(ctx, key)
-	default:
-		return rl.checkFixedWindow(ctx, key)
+// reject responds to a request over the limit
+func (rl *RateLimiter) reject(c echo.Context) error {
+	if rl.config.OnLimitReached != nil {
+		return rl.config.OnLimitReached(c)
 	}
+	return echo.NewHTTPError(http.StatusTooManyRequests, rl.config.ErrorMessage)
 }
 
-// checkFixedWindow implements fixed window rate limiting
-func (rl *RateLimiter) checkFixedWindow(ctx context.Context, key string) (bool, *RateLimitEntry, error) {
-	entry, err := rl.config.Store.Increment(ctx, key, rl.config.WindowDuration)
-	if err != nil {
-		return false, nil, err
+// limitConcurrency runs a request once it holds slots of its key and route
+func (rl *RateLimiter) limitConcurrency(c echo.Context, next echo.HandlerFunc) error {
+	ctx := c.Request().Context()
+	if rl.config.QueueTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, rl.config.QueueTimeout)
+		defer cancel()
 	}
 
-	allowed := entry.Count <= rl.config.MaxRequests
-	return allowed, entry, nil
-}
+	route := rateLimitRoute(c)
+	cost := requestCost(c, rl.config.Cost, rl.config.CostFunc)
 
-// checkSlidingWindow implements sliding window rate limiting
-func (rl *RateLimiter) checkSlidingWindow(ctx context.Context, key string) (bool, *RateLimitEntry, error) {
-	// This is a simplified sliding window implementation
-	// A full implementation would track individual request timestamps
+	release, remaining, acquired := rl.concurrency.acquire(ctx, "key:"+route+":"+rl.config.KeyGenerator(c), rl.config.MaxRequests, cost)
+	if acquired {
+		defer release()
 
-	now := time.Now()
-	entry, err := rl.config.Store.Get(ctx, key)
-	if err != nil || now.After(entry.ExpiresAt) {
-		// Create new entry
-		entry = &RateLimitEntry{
-			Count:     1,
-			FirstSeen: now,
-			LastSeen:  now,
-			ExpiresAt: now.Add(rl.config.WindowDuration),
-		}
-		rl.config.Store.Set(ctx, key, entry, rl.config.WindowDuration)
-		return true, entry, nil
-	}
-
-	// Calculate rate based on sliding window
-	windowStart := now.Add(-rl.config.WindowDuration)
-	if entry.FirstSeen.Before(windowStart) {
-		// Adjust count based on sliding window
-		elapsed := now.Sub(entry.FirstSeen)
-		if elapsed >= rl.config.WindowDuration {
-			entry.Count = 1
-			entry.FirstSeen = now
-		} else {
-			// Linear approximation for sliding window
-			ratio := float64(elapsed) / float64(rl.config.WindowDuration)
-			entry.Count = int64(float64(entry.Count)*(1-ratio)) + 1
+		if rl.config.MaxConcurrentPerRoute > 0 {
+			var releaseRoute func()
+			if releaseRoute, _, acquired = rl.concurrency.acquire(ctx, "route:"+route, rl.config.MaxConcurrentPerRoute, cost); acquired {
+				defer releaseRoute()
+			}
 		}
-	} else {
-		entry.Count++
 	}
 
-	entry.LastSeen = now
-	rl.config.Store.Set(ctx, key, entry, rl.config.WindowDuration)
+	// In-flight limits have no reset time, so only the limit and the
+	// remaining slots are reported
+	if rl.config.Headers {
+		header := c.Response().Header()
+		header.Set("X-RateLimit-Limit", fmt.Sprintf("%d", rl.config.MaxRequests))
+		header.Set("X-RateLimit-Remaining", fmt.Sprintf("%d", remaining))
+		header.Set("RateLimit-Limit", fmt.Sprintf("%d", rl.config.MaxRequests))
+		header.Set("RateLimit-Remaining", fmt.Sprintf("%d", remaining))
+	}
 
-	allowed := entry.Count <= rl.config.MaxRequests
-	return allowed, entry, nil
+	if !acquired {
+		return rl.reject(c)
+	}
+	return next(c)
 }
 
-// checkTokenBucket implements token bucket rate limiting
-func (rl *RateLimiter) checkTokenBucket(ctx context.Context, key string) (bool, *RateLimitEntry, error) {
-	now := time.Now()
-	entry, err := rl.config.Store.Get(ctx, key)
+// setRateLimitHeaders sets the rate limit headers of a result, with a
+// suffix appended to the X-RateLimit headers
+func setRateLimitHeaders(c echo.Context, result *RateLimitResult, suffix string) {
+	header := c.Response().Header()
+	header.Set("X-RateLimit-Limit"+suffix, fmt.Sprintf("%d", result.Limit))
+	header.Set("X-RateLimit-Remaining"+suffix, fmt.Sprintf("%d", result.Remaining))
+	header.Set("X-RateLimit-Reset"+suffix, fmt.Sprintf("%d", result.ResetAt.Unix()))
 
-	if err != nil || now.After(entry.ExpiresAt) {
-		// Create new entry with full bucket
-		entry = &RateLimitEntry{
-			Count:      1,
-			FirstSeen:  now,
-			LastSeen:   now,
-			ExpiresAt:  now.Add(rl.config.WindowDuration),
-			Tokens:     float64(rl.config.MaxRequests - 1),
-			LastRefill: now,
+	if !result.Allowed {
+		header.Set("Retry-After", fmt.Sprintf("%.0f", math.Ceil(result.RetryAfter.Seconds())))
+	}
+}
+
+// setStandardRateLimitHeaders sets the RateLimit headers of the IETF draft
+// (draft-ietf-httpapi-ratelimit-headers) for a result, listing the policies
+// applied to the request
+func setStandardRateLimitHeaders(c echo.Context, result *RateLimitResult, policies ...string) {
+	header := c.Response().Header()
+	header.Set("RateLimit-Limit", fmt.Sprintf("%d", result.Limit))
+	header.Set("RateLimit-Remaining", fmt.Sprintf("%d", result.Remaining))
+	header.Set("RateLimit-Reset", fmt.Sprintf("%.0f", math.Max(0, math.Ceil(time.Until(result.ResetAt).Seconds()))))
+
+	if len(policies) > 0 {
+		header.Set("RateLimit-Policy", strings.Join(policies, ", "))
+	}
+}
+
+// rateLimitPolicy formats a limit as a RateLimit-Policy item, e.g. 100;w=3600
+func rateLimitPolicy(limit int64, window time.Duration) string {
+	return fmt.Sprintf("%d;w=%.0f", limit, math.Ceil(window.Seconds()))
+}
+
+// checkLimit checks if a request of a cost is within the rate limit
+func (rl *RateLimiter) checkLimit(ctx context.Context, key string, cost int64) (*RateLimitResult, error) {
+	return rl.backend.check(ctx, key, RateLimitRule{
+		Strategy: rl.config.Strategy,
+		Limit:    rl.config.MaxRequests,
+		Window:   rl.config.WindowDuration,
+		Cost:     cost,
+	})
+}
+
+// rateLimitStoreRetryInterval is how long the fallback store is used after a store failure
+const rateLimitStoreRetryInterval = time.Second
+
+// rateLimitBackend checks rules against a store, limiting locally with a
+// fallback store while the store is unavailable
+type rateLimitBackend struct {
+	store    RateLimitStore
+	fallback RateLimitStore
+	logger   *logrus.Logger
+	// retryAt is when the store is tried again after a failure, in Unix nanoseconds
+	retryAt  atomic.Int64
+	degraded atomic.Bool
+}
+
+// newRateLimitBackend creates a backend; the fallback defaults to a memory
+// store unless the store is one
+func newRateLimitBackend(store, fallback RateLimitStore, logger *logrus.Logger) *rateLimitBackend {
+	if _, local := store.(*MemoryRateLimitStore); fallback == nil && !local {
+		fallback = NewMemoryRateLimitStore()
+	}
+
+	return &rateLimitBackend{
+		store:    store,
+		fallback: fallback,
+		logger:   logger,
+	}
+}
+
+// check evaluates a rule, using the fallback store while the store is unavailable
+func (rb *rateLimitBackend) check(ctx context.Context, key string, rule RateLimitRule) (*RateLimitResult, error) {
+	if err := rule.validate(); err != nil {
+		return nil, err
+	}
+
+	if rb.fallback == nil || time.Now().UnixNano() >= rb.retryAt.Load() {
+		result, err := checkRateLimit(ctx, rb.store, key, rule)
+		if err == nil {
+			if rb.degraded.CompareAndSwap(true, false) && rb.logger != nil {
+				rb.logger.Info("Rate limit store recovered")
+			}
+			return result, nil
+		}
+		if rb.fallback == nil || !rateLimitStoreUnavailable(ctx, err) {
+			return nil, err
+		}
+
+		rb.retryAt.Store(time.Now().Add(rateLimitStoreRetryInterval).UnixNano())
+		if rb.degraded.CompareAndSwap(false, true) && rb.logger != nil {
+			rb.logger.WithError(err).Warn("Rate limit store unavailable, limiting locally")
 		}
-		rl.config.Store.Set(ctx, key, entry, rl.config.WindowDuration)
-		return true, entry, nil
 	}
 
-	// Refill tokens based on elapsed time
-	elapsed := now.Sub(entry.LastRefill)
-	refillRate := float64(rl.config.MaxRequests) / float64(rl.config.WindowDuration)
-	tokensToAdd := refillRate * float64(elapsed)
+	return checkRateLimit(ctx, rb.fallback, key, rule)
+}
 
-	entry.Tokens = min(float64(rl.config.MaxRequests), entry.Tokens+tokensToAdd)
-	entry.LastRefill = now
+// peek evaluates a rule on the store check would use without recording the
+// request. It returns nil if the store cannot evaluate rules without recording.
+func (rb *rateLimitBackend) peek(ctx context.Context, key string, rule RateLimitRule) (*RateLimitResult, error) {
+	if err := rule.validate(); err != nil {
+		return nil, err
+	}
 
-	// Check if token is available
-	if entry.Tokens >= 1.0 {
-		entry.Tokens--
-		entry.Count++
-		entry.LastSeen = now
-		rl.config.Store.Set(ctx, key, entry, rl.config.WindowDuration)
-		return true, entry, nil
+	store := rb.store
+	if rb.fallback != nil && time.Now().UnixNano() < rb.retryAt.Load() {
+		store = rb.fallback
 	}
 
-	// No tokens available
-	rl.config.Store.Set(ctx, key, entry, rl.config.WindowDuration)
-	return false, entry, nil
+	if _, ok := store.(AtomicRateLimitStore); ok {
+		if peeker, ok := store.(rateLimitPeeker); ok {
+			return peeker.Peek(ctx, key, rule)
+		}
+		return nil, nil
+	}
+
+	now := time.Now()
+	entry, err := store.Get(ctx, key)
+	if err != nil || !now.Before(entry.ExpiresAt) {
+		entry = nil
+	}
+	result, _ := evaluateRateLimit(entry, rule, now)
+	return result, nil
 }
 
-// checkLeakyBucket implements leaky bucket rate limiting
-func (rl *RateLimiter) checkLeakyBucket(ctx context.Context, key string) (bool, *RateLimitEntry, error) {
+// rateLimitStoreUnavailable reports whether an error means the store cannot
+// be reached, as opposed to a cancelled request or an error reply
+func rateLimitStoreUnavailable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var replyErr RedisError
+	return !errors.As(err, &replyErr)
+}
+
+// checkRateLimit evaluates a rule on a store, atomically if the store supports it
+func checkRateLimit(ctx context.Context, store RateLimitStore, key string, rule RateLimitRule) (*RateLimitResult, error) {
+	if atomicStore, ok := store.(AtomicRateLimitStore); ok {
+		return atomicStore.Allow(ctx, key, rule)
+	}
+
 	now := time.Now()
-	entry, err := rl.config.Store.Get(ctx, key)
+	entry, err := store.Get(ctx, key)
+	if err != nil || !now.Before(entry.ExpiresAt) {
+		entry = nil
+	}
 
-	if err != nil || now.After(entry.ExpiresAt) {
-		// Create new entry
-		entry = &RateLimitEntry{
-			Count:      1,
-			FirstSeen:  now,
-			LastSeen:   now,
-			ExpiresAt:  now.Add(rl.config.WindowDuration),
-			LastRefill: now,
-		}
-		rl.config.Store.Set(ctx, key, entry, rl.config.WindowDuration)
-		return true, entry, nil
+	result, next := evaluateRateLimit(entry, rule, now)
+	if err := store.Set(ctx, key, next, next.ExpiresAt.Sub(now)); err != nil {
+		return nil, err
 	}
+	return result, nil
+}
 
-	// Leak tokens based on elapsed time
-	elapsed := now.Sub(entry.LastRefill)
-	leakRate := float64(rl.config.MaxRequests) / float64(rl.config.WindowDuration)
-	tokensToLeak := leakRate * float64(elapsed)
+// evaluateRateLimit applies a rule to the current entry of a key, nil if it
+// has none, and returns the result with the entry to store until its
+// ExpiresAt. Times are in milliseconds so the Redis scripts, which mirror
+// this function, give the same results.
+func evaluateRateLimit(entry *RateLimitEntry, rule RateLimitRule, now time.Time) (*RateLimitResult, *RateLimitEntry) {
+	nowMs := now.UnixMilli()
+	windowMs := max(1, rule.Window.Milliseconds())
+	limit := float64(rule.Limit)
+	cost := max(1, rule.Cost)
+
+	var next RateLimitEntry
+	if entry != nil {
+		next = *entry
+	}
 
-	entry.Count = max(0, int64(float64(entry.Count)-tokensToLeak))
-	entry.LastRefill = now
+	var allowed bool
+	var remaining, resetMs, retryMs, expiresMs int64
 
-	// Check if bucket has space
-	if entry.Count < rl.config.MaxRequests {
-		entry.Count++
-		entry.LastSeen = now
-		rl.config.Store.Set(ctx, key, entry, rl.config.WindowDuration)
-		return true, entry, nil
+	switch rule.Strategy {
+	case SlidingWindowStrategy:
+		// Weighted sum of the previous and current fixed windows
+		start := nowMs - nowMs%windowMs
+		var previous, current int64
+		if entry != nil {
+			switch entry.FirstSeen.UnixMilli() {
+			case start:
+				previous, current = entry.PreviousCount, entry.Count
+			case start - windowMs:
+				previous = entry.Count
+			}
+		}
+
+		estimate := float64(previous)*(float64(windowMs-(nowMs-start))/float64(windowMs)) + float64(current)
+		if estimate+float64(cost) <= limit {
+			allowed = true
+			current += cost
+			estimate += float64(cost)
+		}
+
+		next = RateLimitEntry{Count: current, PreviousCount: previous, FirstSeen: time.UnixMilli(start)}
+		remaining = max(0, int64(math.Floor(limit-estimate)))
+		resetMs = start + windowMs
+		expiresMs = start + 2*windowMs
+
+	case TokenBucketStrategy:
+		// Tokens refill continuously up to the limit over one window
+		rate := limit / float64(windowMs)
+		tokens, last := limit, nowMs
+		if entry != nil {
+			tokens, last = entry.Tokens, entry.LastRefill.UnixMilli()
+		} else {
+			next.FirstSeen = now
+		}
+
+		tokens = math.Min(limit, tokens+float64(nowMs-last)*rate)
+		if tokens >= float64(cost) {
+			allowed = true
+			tokens -= float64(cost)
+			next.Count += cost
+		} else {
+			retryMs = int64(math.Ceil((float64(cost) - tokens) / rate))
+		}
+
+		next.Tokens = tokens
+		next.LastRefill = now
+		remaining = int64(math.Floor(tokens))
+		resetMs = nowMs + int64(math.Ceil((limit-tokens)/rate))
+		expiresMs = max(resetMs, nowMs+1)
+
+	case LeakyBucketStrategy:
+		// The bucket level drains continuously, emptying a full bucket over one window
+		rate := limit / float64(windowMs)
+		level, last := 0.0, nowMs
+		if entry != nil {
+			level, last = entry.Tokens, entry.LastRefill.UnixMilli()
+		} else {
+			next.FirstSeen = now
+		}
+
+		level = math.Max(0, level-float64(nowMs-last)*rate)
+		if level+float64(cost) <= limit {
+			allowed = true
+			level += float64(cost)
+			next.Count += cost
+		} else {
+			retryMs = int64(math.Ceil((level + float64(cost) - limit) / rate))
+		}
+
+		next.Tokens = level
+		next.LastRefill = now
+		remaining = max(0, int64(math.Floor(limit-level)))
+		resetMs = nowMs + int64(math.Ceil(level/rate))
+		expiresMs = max(resetMs, nowMs+1)
+
+	default:
+		// Fixed window
+		if entry == nil {
+			next = RateLimitEntry{FirstSeen: now, ExpiresAt: time.UnixMilli(nowMs + windowMs)}
+		}
+
+		if next.Count+cost <= rule.Limit {
+			allowed = true
+			next.Count += cost
+		}
+		remaining = max(0, rule.Limit-next.Count)
+		resetMs = next.ExpiresAt.UnixMilli()
+		expiresMs = resetMs
 	}
 
-	// Bucket is full
-	rl.config.Store.Set(ctx, key, entry, rl.config.WindowDuration)
-	return false, entry, nil
+	if !allowed && retryMs == 0 {
+		retryMs = resetMs - nowMs
+	}
+	next.LastSeen = now
+	next.ExpiresAt = time.UnixMilli(expiresMs)
+
+	return &RateLimitResult{
+		Allowed:    allowed,
+		Limit:      rule.Limit,
+		Remaining:  remaining,
+		ResetAt:    time.UnixMilli(resetMs),
+		RetryAfter: time.Duration(retryMs) * time.Millisecond,
+	}, &next
 }
 
 // Rate limiting decorators and utilities
@@ -396,6 +722,8 @@ type RateLimitDecorator struct {
 	WindowDuration time.Duration
 	Strategy       RateLimitStrategy
 	KeyGenerator   func(echo.Context) string
+	Cost           int64
+	CostFunc       func(echo.Context) int64
 }
 
 // NewRateLimit creates a rate limit decorator
@@ -422,6 +750,18 @@ func (rld *RateLimitDecorator) WithKeyGenerator(generator func(echo.Context) str
 	return rld
 }
 
+// WithCost sets the cost of each request
+func (rld *RateLimitDecorator) WithCost(cost int64) *RateLimitDecorator {
+	rld.Cost = cost
+	return rld
+}
+
+// WithCostFunc sets a function computing the cost of a request
+func (rld *RateLimitDecorator) WithCostFunc(costFunc func(echo.Context) int64) *RateLimitDecorator {
+	rld.CostFunc = costFunc
+	return rld
+}
+
 // Middleware returns the rate limiting middleware
 func (rld *RateLimitDecorator) Middleware(logger *logrus.Logger) echo.MiddlewareFunc {
 	config := &RateLimitConfig{
@@ -432,6 +772,8 @@ func (rld *RateLimitDecorator) Middleware(logger *logrus.Logger) echo.Middleware
 		ErrorMessage:   "Rate limit exceeded",
 		Headers:        true,
 		Store:          NewMemoryRateLimitStore(),
+		Cost:           rld.Cost,
+		CostFunc:       rld.CostFunc,
 	}
 
 	rateLimiter := NewRateLimiter(config, logger)
@@ -467,13 +809,26 @@ func IPKeyGenerator(c echo.Context) string {
 	return "ip:" + getClientIP(c)
 }
 
-// UserKeyGenerator generates keys based on authenticated user
+// UserKeyGenerator generates keys based on authenticated user.
+// Requests authenticated with an API key are limited per key, and users
+// are limited per tenant when the request has one.
 func UserKeyGenerator(c echo.Context) string {
 	user, err := GetCurrentUser(c)
 	if err != nil {
 		return IPKeyGenerator(c) // Fallback to IP
 	}
-	return "user:" + user.ID
+	if keyID, ok := user.Metadata["api_key_id"].(string); ok {
+		return "apikey:" + keyID
+	}
+	return tenantKey(c.Request().Context(), "user:"+user.ID)
+}
+
+// TenantKeyGenerator generates rate limit keys shared by all clients of a tenant
+func TenantKeyGenerator(c echo.Context) string {
+	if tenantID, ok := GetTenant(c); ok {
+		return tenantPrefix(tenantID)
+	}
+	return IPKeyGenerator(c)
 }
 
 // RouteKeyGenerator generates keys based on route
@@ -536,13 +891,15 @@ func (brl *BurstRateLimiter) Middleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			// Check burst limit first
-			burstAllowed, _, err := brl.burstLimiter.checkLimit(c.Request().Context(), brl.burstLimiter.config.KeyGenerator(c))
+			burstConfig := brl.burstLimiter.config
+			cost := requestCost(c, burstConfig.Cost, burstConfig.CostFunc)
+			burst, err := brl.burstLimiter.checkLimit(c.Request().Context(), burstConfig.KeyGenerator(c), cost)
 			if err != nil {
 				brl.logger.WithError(err).Error("Burst rate limit check failed")
 				return next(c) // Continue on error
 			}
 
-			if !burstAllowed {
+			if !burst.Allowed {
 				return echo.NewHTTPError(http.StatusTooManyRequests, "Burst rate limit exceeded")
 			}
 
@@ -552,17 +909,387 @@ func (brl *BurstRateLimiter) Middleware() echo.MiddlewareFunc {
 	}
 }
 
-// Utility functions
-func min(a, b float64) float64 {
-	if a < b {
-		return a
+// concurrencyLimiter holds weighted semaphores with FIFO queues, created on
+// first use and removed when idle
+type concurrencyLimiter struct {
+	semaphores map[string]*concurrencySemaphore
+	queueSize  int
+	mutex      sync.Mutex
+}
+
+// concurrencySemaphore limits the total weight of holders of a key
+type concurrencySemaphore struct {
+	used    int64
+	limit   int64
+	waiters []*concurrencyWaiter
+	refs    int
+}
+
+// concurrencyWaiter is a request queued for a semaphore
+type concurrencyWaiter struct {
+	weight  int64
+	ready   chan struct{}
+	granted bool
+}
+
+// newConcurrencyLimiter creates a concurrency limiter with a queue size per semaphore
+func newConcurrencyLimiter(queueSize int) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		semaphores: make(map[string]*concurrencySemaphore),
+		queueSize:  queueSize,
+	}
+}
+
+// acquire takes weight from the semaphore of a key, queueing until the
+// context is done if it is full. It returns the release function and the
+// weight still available.
+func (cl *concurrencyLimiter) acquire(ctx context.Context, key string, limit, weight int64) (func(), int64, bool) {
+	cl.mutex.Lock()
+	semaphore, exists := cl.semaphores[key]
+	if !exists {
+		semaphore = &concurrencySemaphore{}
+		cl.semaphores[key] = semaphore
+	}
+	semaphore.limit = limit
+
+	release := func() {
+		cl.mutex.Lock()
+		defer cl.mutex.Unlock()
+
+		semaphore.used -= weight
+		cl.unref(key, semaphore)
+	}
+
+	if len(semaphore.waiters) == 0 && semaphore.used+weight <= limit {
+		semaphore.used += weight
+		semaphore.refs++
+		available := limit - semaphore.used
+		cl.mutex.Unlock()
+		return release, available, true
+	}
+	if weight > limit || len(semaphore.waiters) >= cl.queueSize {
+		if !exists {
+			delete(cl.semaphores, key)
+		}
+		cl.mutex.Unlock()
+		return nil, 0, false
+	}
+
+	waiter := &concurrencyWaiter{weight: weight, ready: make(chan struct{})}
+	semaphore.waiters = append(semaphore.waiters, waiter)
+	semaphore.refs++
+	cl.mutex.Unlock()
+
+	select {
+	case <-waiter.ready:
+	case <-ctx.Done():
+	}
+
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+
+	if waiter.granted {
+		return release, max(0, limit-semaphore.used), true
+	}
+	for i, queued := range semaphore.waiters {
+		if queued == waiter {
+			semaphore.waiters = append(semaphore.waiters[:i], semaphore.waiters[i+1:]...)
+			break
+		}
+	}
+	cl.unref(key, semaphore)
+	return nil, 0, false
+}
+
+// unref drops a reference to a semaphore, granting queued waiters that fit
+// and removing it once unused. The mutex must be held.
+func (cl *concurrencyLimiter) unref(key string, semaphore *concurrencySemaphore) {
+	semaphore.refs--
+	for len(semaphore.waiters) > 0 && semaphore.used+semaphore.waiters[0].weight <= semaphore.limit {
+		waiter := semaphore.waiters[0]
+		semaphore.waiters = semaphore.waiters[1:]
+		semaphore.used += waiter.weight
+		waiter.granted = true
+		close(waiter.ready)
+	}
+
+	if semaphore.refs == 0 {
+		delete(cl.semaphores, key)
+	}
+}
+
+// RequestPriority ranks requests for load shedding; lower priorities are shed first
+type RequestPriority int
+
+const (
+	RequestPriorityLow RequestPriority = iota + 1
+	RequestPriorityNormal
+	RequestPriorityHigh
+	// RequestPriorityCritical requests are never shed
+	RequestPriorityCritical
+)
+
+// LoadShedAlgorithm selects how the concurrency limit adapts
+type LoadShedAlgorithm string
+
+const (
+	// GradientLimitAlgorithm moves the limit with the ratio of the long-term
+	// to the recent latency, growing it while latency is stable
+	GradientLimitAlgorithm LoadShedAlgorithm = "gradient"
+	// AIMDLimitAlgorithm increases the limit additively and decreases it
+	// multiplicatively when latency exceeds LatencyThreshold
+	AIMDLimitAlgorithm LoadShedAlgorithm = "aimd"
+)
+
+// MetadataKeyPriority is the metadata key for the request priority of a controller or route
+const MetadataKeyPriority = "request_priority"
+
+// RoutePriority sets the load shedding priority of a controller or route
+func RoutePriority(priority RequestPriority) MetadataEntry {
+	return SetMetadata(MetadataKeyPriority, priority)
+}
+
+// LoadShedderConfig configures a LoadShedder
+type LoadShedderConfig struct {
+	Algorithm    LoadShedAlgorithm
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// LatencyThreshold is the latency above which AIMD decreases the limit
+	LatencyThreshold time.Duration
+	// BackoffRatio multiplies the limit on an AIMD decrease
+	BackoffRatio float64
+	// Tolerance is how much the recent latency may exceed the long-term
+	// latency before the gradient decreases the limit
+	Tolerance float64
+	// Smoothing weights new gradient limits against the current one
+	Smoothing float64
+	// PriorityShares is the fraction of the limit requests of a priority
+	// may fill, so lower priorities are rejected first as load grows
+	PriorityShares map[RequestPriority]float64
+	// RolePriorities maps roles of the current user to priorities
+	RolePriorities  map[string]RequestPriority
+	DefaultPriority RequestPriority
+	// PriorityFunc overrides route metadata and roles when set
+	PriorityFunc func(echo.Context) RequestPriority
+	RetryAfter   time.Duration
+	ErrorMessage string
+	SkipFunc     func(echo.Context) bool
+}
+
+// DefaultLoadShedderConfig returns default load shedding configuration
+func DefaultLoadShedderConfig() *LoadShedderConfig {
+	return &LoadShedderConfig{
+		Algorithm:        GradientLimitAlgorithm,
+		InitialLimit:     20,
+		MinLimit:         5,
+		MaxLimit:         1000,
+		LatencyThreshold: 500 * time.Millisecond,
+		BackoffRatio:     0.9,
+		Tolerance:        1.5,
+		Smoothing:        0.2,
+		PriorityShares: map[RequestPriority]float64{
+			RequestPriorityLow:    0.5,
+			RequestPriorityNormal: 0.8,
+			RequestPriorityHigh:   1.0,
+		},
+		DefaultPriority: RequestPriorityNormal,
+		RetryAfter:      time.Second,
+		ErrorMessage:    "Service overloaded",
+	}
+}
+
+// LoadShedder rejects requests with 503 when the server is overloaded. It
+// measures latency and in-flight requests to adapt a concurrency limit and
+// admits requests of a priority while in-flight requests are below that
+// priority's share of the limit. Use it after authentication so roles are
+// known.
+type LoadShedder struct {
+	config   *LoadShedderConfig
+	logger   *logrus.Logger
+	limit    float64
+	inFlight int
+	// longRTT and shortRTT are moving averages of latency in nanoseconds
+	longRTT  float64
+	shortRTT float64
+	mutex    sync.Mutex
+}
+
+// NewLoadShedder creates a load shedder
+func NewLoadShedder(config *LoadShedderConfig, logger *logrus.Logger) *LoadShedder {
+	if config == nil {
+		config = DefaultLoadShedderConfig()
+	}
+	if config.MinLimit <= 0 {
+		config.MinLimit = 1
+	}
+	if config.MaxLimit < config.MinLimit {
+		config.MaxLimit = config.MinLimit
+	}
+	defaults := DefaultLoadShedderConfig()
+	if config.LatencyThreshold <= 0 {
+		config.LatencyThreshold = defaults.LatencyThreshold
+	}
+	if config.BackoffRatio <= 0 || config.BackoffRatio >= 1 {
+		config.BackoffRatio = defaults.BackoffRatio
+	}
+	if config.Tolerance <= 0 {
+		config.Tolerance = defaults.Tolerance
+	}
+	if config.Smoothing <= 0 || config.Smoothing > 1 {
+		config.Smoothing = defaults.Smoothing
+	}
+	if config.PriorityShares == nil {
+		config.PriorityShares = defaults.PriorityShares
+	}
+	if config.DefaultPriority == 0 {
+		config.DefaultPriority = defaults.DefaultPriority
+	}
+	if config.ErrorMessage == "" {
+		config.ErrorMessage = defaults.ErrorMessage
+	}
+
+	return &LoadShedder{
+		config: config,
+		logger: logger,
+		limit:  float64(min(max(int64(config.InitialLimit), int64(config.MinLimit)), int64(config.MaxLimit))),
+	}
+}
+
+// Middleware returns load shedding middleware
+func (ls *LoadShedder) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if ls.config.SkipFunc != nil && ls.config.SkipFunc(c) {
+				return next(c)
+			}
+
+			priority := ls.priority(c)
+			inFlight, admitted := ls.acquire(priority)
+			if !admitted {
+				if ls.logger != nil {
+					ls.logger.WithFields(logrus.Fields{
+						"priority":  priority,
+						"in_flight": inFlight,
+						"path":      c.Request().URL.Path,
+					}).Debug("Request shed")
+				}
+
+				c.Response().Header().Set("Retry-After", fmt.Sprintf("%.0f", math.Max(1, math.Ceil(ls.config.RetryAfter.Seconds()))))
+				return echo.NewHTTPError(http.StatusServiceUnavailable, ls.config.ErrorMessage)
+			}
+
+			start := time.Now()
+			defer func() {
+				ls.release(inFlight, time.Since(start))
+			}()
+
+			return next(c)
+		}
+	}
+}
+
+// Limit returns the current concurrency limit
+func (ls *LoadShedder) Limit() int {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	return int(ls.limit)
+}
+
+// InFlight returns the number of requests being processed
+func (ls *LoadShedder) InFlight() int {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	return ls.inFlight
+}
+
+// priority resolves the priority of a request: the higher of the route
+// metadata and the roles of the current user, or the default if neither is set
+func (ls *LoadShedder) priority(c echo.Context) RequestPriority {
+	if ls.config.PriorityFunc != nil {
+		if priority := ls.config.PriorityFunc(c); priority > 0 {
+			return priority
+		}
+	}
+
+	var priority RequestPriority
+	if value, ok := GetMetadata(c, MetadataKeyPriority); ok {
+		priority, _ = value.(RequestPriority)
+	}
+	if user, err := GetCurrentUser(c); err == nil {
+		for _, role := range user.Roles {
+			if rolePriority := ls.config.RolePriorities[role]; rolePriority > priority {
+				priority = rolePriority
+			}
+		}
+	}
+
+	if priority == 0 {
+		return ls.config.DefaultPriority
+	}
+	return priority
+}
+
+// acquire admits a request if in-flight requests are below its priority's
+// share of the limit, returning the in-flight count including it
+func (ls *LoadShedder) acquire(priority RequestPriority) (int, bool) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if priority < RequestPriorityCritical {
+		share, exists := ls.config.PriorityShares[priority]
+		if !exists {
+			share = 1
+		}
+		if float64(ls.inFlight) >= math.Max(1, math.Floor(ls.limit*share)) {
+			return ls.inFlight, false
+		}
 	}
-	return b
+
+	ls.inFlight++
+	return ls.inFlight, true
 }
 
-func max(a, b int64) int64 {
-	if a > b {
-		return a
+// release records the latency of a request admitted at an in-flight count and adapts the limit
+func (ls *LoadShedder) release(inFlight int, latency time.Duration) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	ls.inFlight--
+
+	limit := ls.limit
+	switch ls.config.Algorithm {
+	case AIMDLimitAlgorithm:
+		if latency > ls.config.LatencyThreshold {
+			limit *= ls.config.BackoffRatio
+		} else if float64(inFlight)*2 >= limit {
+			// Only grow while the limit is actually being used
+			limit++
+		}
+
+	default:
+		rtt := float64(latency)
+		if ls.longRTT == 0 {
+			ls.longRTT, ls.shortRTT = rtt, rtt
+		}
+		ls.shortRTT += (rtt - ls.shortRTT) / 10
+		ls.longRTT += (rtt - ls.longRTT) / 600
+
+		// Recover quickly from a period of high latency once it has passed
+		if ls.longRTT/ls.shortRTT > 2 {
+			ls.longRTT *= 0.95
+		}
+
+		if float64(inFlight) < limit/2 {
+			break
+		}
+
+		gradient := math.Max(0.5, math.Min(1, ls.config.Tolerance*ls.longRTT/ls.shortRTT))
+		target := limit*gradient + math.Sqrt(limit)
+		limit = limit*(1-ls.config.Smoothing) + target*ls.config.Smoothing
 	}
-	return b
+
+	ls.limit = math.Max(float64(ls.config.MinLimit), math.Min(float64(ls.config.MaxLimit), limit))
 }
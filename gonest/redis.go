@@ -0,0 +1,1211 @@
+package gonest
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrRedisNil is returned for nil replies, e.g. GET on a missing key
+var ErrRedisNil = errors.New("redis: nil reply")
+
+// ErrRedisClosed is returned when using a closed client
+var ErrRedisClosed = errors.New("redis: client is closed")
+
+// ErrRedisCacheNoPrefix is returned by RedisCache.Clear when the cache has no prefix
+var ErrRedisCacheNoPrefix = errors.New("redis: refusing to clear a cache without a key prefix")
+
+// RedisError is an error reply sent by the server
+type RedisError string
+
+// Error implements the error interface
+func (re RedisError) Error() string {
+	return string(re)
+}
+
+// RedisConfig configures a Redis client
+type RedisConfig struct {
+	Addr         string
+	Password     string
+	DB           int
+	PoolSize     int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+}
+
+// DefaultRedisConfig returns default Redis configuration
+func DefaultRedisConfig() *RedisConfig {
+	return &RedisConfig{
+		Addr:         "localhost:6379",
+		PoolSize:     10,
+		DialTimeout:  5 * time.Second,
+		ReadTimeout:  3 * time.Second,
+		WriteTimeout: 3 * time.Second,
+	}
+}
+
+// redisConn is a pooled connection speaking RESP
+type redisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	writer *bufio.Writer
+}
+
+// RedisClient is a pooled client for servers speaking the Redis protocol (RESP)
+type RedisClient struct {
+	config *RedisConfig
+	slots  chan struct{}
+	idle   chan *redisConn
+	closed bool
+	mutex  sync.Mutex
+}
+
+// NewRedisClient creates a new Redis client. Connections are opened lazily.
+func NewRedisClient(config *RedisConfig) *RedisClient {
+	if config == nil {
+		config = DefaultRedisConfig()
+	}
+	if config.PoolSize <= 0 {
+		config.PoolSize = 10
+	}
+
+	return &RedisClient{
+		config: config,
+		slots:  make(chan struct{}, config.PoolSize),
+		idle:   make(chan *redisConn, config.PoolSize),
+	}
+}
+
+// Do sends a command and returns its reply. Error replies are returned as RedisError.
+func (rc *RedisClient) Do(ctx context.Context, args ...interface{}) (interface{}, error) {
+	replies, err := rc.pipeline(ctx, [][]interface{}{args})
+	if err != nil {
+		return nil, err
+	}
+	if replyErr, ok := replies[0].(RedisError); ok {
+		return nil, replyErr
+	}
+	return replies[0], nil
+}
+
+// Pipeline creates a pipeline that sends several commands in one round trip
+func (rc *RedisClient) Pipeline() *RedisPipeline {
+	return &RedisPipeline{client: rc}
+}
+
+// Ping checks the connection to the server
+func (rc *RedisClient) Ping(ctx context.Context) error {
+	_, err := rc.Do(ctx, "PING")
+	return err
+}
+
+// Close closes all idle connections; connections in use are closed when released
+func (rc *RedisClient) Close() error {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	if rc.closed {
+		return nil
+	}
+	rc.closed = true
+
+	for {
+		select {
+		case conn := <-rc.idle:
+			conn.conn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// redisStaleConnError marks a failure showing that the server closed a
+// connection before it could have run the commands sent on it
+type redisStaleConnError struct {
+	err error
+}
+
+func (e redisStaleConnError) Error() string { return e.err.Error() }
+
+func (e redisStaleConnError) Unwrap() error { return e.err }
+
+// pipeline writes all commands, then reads one reply per command. A pooled
+// connection is retried once on a new connection when the server had closed
+// it while idle: writing failed, or the connection was closed before any
+// reply byte was read. Other failures, e.g. read timeouts, are not retried
+// since the commands may have run.
+func (rc *RedisClient) pipeline(ctx context.Context, commands [][]interface{}) ([]interface{}, error) {
+	for attempt := 0; ; attempt++ {
+		conn, reused, err := rc.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		replies, err := rc.roundTrip(ctx, conn, commands)
+		rc.release(conn, err)
+		if err == nil {
+			return replies, nil
+		}
+
+		var stale redisStaleConnError
+		if !errors.As(err, &stale) {
+			return nil, err
+		}
+		if !reused || attempt > 0 || ctx.Err() != nil {
+			return nil, stale.err
+		}
+	}
+}
+
+// roundTrip sends commands on a connection and reads their replies
+func (rc *RedisClient) roundTrip(ctx context.Context, conn *redisConn, commands [][]interface{}) ([]interface{}, error) {
+	deadline := time.Now().Add(rc.config.WriteTimeout + rc.config.ReadTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.conn.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	for _, args := range commands {
+		if err := writeRESPCommand(conn.writer, args); err != nil {
+			return nil, redisStaleConnError{err}
+		}
+	}
+	if err := conn.writer.Flush(); err != nil {
+		return nil, redisStaleConnError{err}
+	}
+
+	// A server that closed the connection while idle replies with EOF or a
+	// reset before sending anything
+	if _, err := conn.reader.Peek(1); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, syscall.ECONNRESET) {
+			return nil, redisStaleConnError{err}
+		}
+		return nil, err
+	}
+
+	replies := make([]interface{}, len(commands))
+	for i := range commands {
+		reply, err := readRESP(conn.reader)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = reply
+	}
+	return replies, nil
+}
+
+// acquire takes a pool slot and returns an idle or new connection
+func (rc *RedisClient) acquire(ctx context.Context) (*redisConn, bool, error) {
+	select {
+	case rc.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+
+	rc.mutex.Lock()
+	closed := rc.closed
+	rc.mutex.Unlock()
+	if closed {
+		<-rc.slots
+		return nil, false, ErrRedisClosed
+	}
+
+	select {
+	case conn := <-rc.idle:
+		return conn, true, nil
+	default:
+	}
+
+	conn, err := rc.dial(ctx)
+	if err != nil {
+		<-rc.slots
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+// release returns a connection to the pool, closing it after network errors
+func (rc *RedisClient) release(conn *redisConn, err error) {
+	defer func() { <-rc.slots }()
+
+	rc.mutex.Lock()
+	closed := rc.closed
+	rc.mutex.Unlock()
+
+	if err != nil || closed {
+		conn.conn.Close()
+		return
+	}
+
+	select {
+	case rc.idle <- conn:
+	default:
+		conn.conn.Close()
+	}
+}
+
+// dial opens a connection and authenticates it
+func (rc *RedisClient) dial(ctx context.Context) (*redisConn, error) {
+	dialer := net.Dialer{Timeout: rc.config.DialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", rc.config.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("redis: failed to connect to %s: %w", rc.config.Addr, err)
+	}
+
+	conn := &redisConn{
+		conn:   netConn,
+		reader: bufio.NewReader(netConn),
+		writer: bufio.NewWriter(netConn),
+	}
+
+	var setup [][]interface{}
+	if rc.config.Password != "" {
+		setup = append(setup, []interface{}{"AUTH", rc.config.Password})
+	}
+	if rc.config.DB != 0 {
+		setup = append(setup, []interface{}{"SELECT", rc.config.DB})
+	}
+	if len(setup) == 0 {
+		return conn, nil
+	}
+
+	replies, err := rc.roundTrip(ctx, conn, setup)
+	if err == nil {
+		for _, reply := range replies {
+			if replyErr, ok := reply.(RedisError); ok {
+				err = replyErr
+				break
+			}
+		}
+	}
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// RedisPipeline queues commands and sends them in one round trip
+type RedisPipeline struct {
+	client   *RedisClient
+	commands [][]interface{}
+}
+
+// Queue adds a command to the pipeline
+func (rp *RedisPipeline) Queue(args ...interface{}) *RedisPipeline {
+	rp.commands = append(rp.commands, args)
+	return rp
+}
+
+// Len returns the number of queued commands
+func (rp *RedisPipeline) Len() int {
+	return len(rp.commands)
+}
+
+// Exec sends the queued commands. Error replies are returned in place as RedisError.
+func (rp *RedisPipeline) Exec(ctx context.Context) ([]interface{}, error) {
+	if len(rp.commands) == 0 {
+		return nil, nil
+	}
+
+	replies, err := rp.client.pipeline(ctx, rp.commands)
+	rp.commands = nil
+	return replies, err
+}
+
+// writeRESPCommand encodes a command as an array of bulk strings
+func writeRESPCommand(w *bufio.Writer, args []interface{}) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		var data []byte
+		switch v := arg.(type) {
+		case []byte:
+			data = v
+		case string:
+			data = []byte(v)
+		case int:
+			data = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			data = strconv.AppendInt(nil, v, 10)
+		case float64:
+			data = strconv.AppendFloat(nil, v, 'f', -1, 64)
+		default:
+			data = []byte(fmt.Sprint(v))
+		}
+
+		fmt.Fprintf(w, "$%d\r\n", len(data))
+		w.Write(data)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRESP decodes a reply: simple strings as string, errors as RedisError,
+// integers as int64, bulk strings as []byte and arrays as []interface{}.
+// Nil bulk strings and arrays decode as nil.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return RedisError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return data[:size], nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil || count < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, count)
+		for i := range values {
+			if values[i], err = readRESP(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// redisInt converts an integer reply
+func redisInt(reply interface{}) (int64, error) {
+	switch v := reply.(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		return strconv.ParseInt(string(v), 10, 64)
+	case string:
+		return strconv.ParseInt(v, 10, 64)
+	case nil:
+		return 0, ErrRedisNil
+	}
+	return 0, fmt.Errorf("redis: unexpected integer reply %T", reply)
+}
+
+// redisBytes converts a bulk string reply
+func redisBytes(reply interface{}) ([]byte, error) {
+	switch v := reply.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		return []byte(v), nil
+	case nil:
+		return nil, ErrRedisNil
+	}
+	return nil, fmt.Errorf("redis: unexpected bulk reply %T", reply)
+}
+
+// RedisCache implements CacheProvider on a Redis-protocol server, so all
+// replicas share one cache
+type RedisCache struct {
+	client    *RedisClient
+	prefix    string
+	scanCount int
+	logger    *logrus.Logger
+}
+
+// NewRedisCache creates a Redis cache storing keys under a prefix
+func NewRedisCache(client *RedisClient, prefix string, logger *logrus.Logger) *RedisCache {
+	return &RedisCache{
+		client:    client,
+		prefix:    prefix,
+		scanCount: 500,
+		logger:    logger,
+	}
+}
+
+// Client returns the underlying client
+func (rc *RedisCache) Client() *RedisClient {
+	return rc.client
+}
+
+// Get retrieves a value from cache
+func (rc *RedisCache) Get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := rc.client.Do(ctx, "GET", rc.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrCacheMiss
+	}
+	return redisBytes(reply)
+}
+
+// Set stores a value in cache
+func (rc *RedisCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	_, err := rc.client.Do(ctx, setArgs(rc.prefix+key, value, expiration)...)
+	return err
+}
+
+// setArgs builds a SET command with millisecond expiration
+func setArgs(key string, value []byte, expiration time.Duration) []interface{} {
+	args := []interface{}{"SET", key, value}
+	if expiration > 0 {
+		ms := expiration.Milliseconds()
+		if ms == 0 {
+			ms = 1
+		}
+		args = append(args, "PX", ms)
+	}
+	return args
+}
+
+// Delete removes a value from cache
+func (rc *RedisCache) Delete(ctx context.Context, key string) error {
+	_, err := rc.client.Do(ctx, "DEL", rc.prefix+key)
+	return err
+}
+
+// Clear removes all keys under the cache prefix. A cache without a prefix
+// refuses, since it would delete every key of the database.
+func (rc *RedisCache) Clear(ctx context.Context) error {
+	if rc.prefix == "" {
+		return ErrRedisCacheNoPrefix
+	}
+
+	return rc.scan(ctx, escapeRedisGlob(rc.prefix)+"*", func(keys []string) error {
+		args := make([]interface{}, 0, len(keys)+1)
+		args = append(args, "DEL")
+		for _, key := range keys {
+			args = append(args, key)
+		}
+		_, err := rc.client.Do(ctx, args...)
+		return err
+	})
+}
+
+// Exists checks if a key exists in cache
+func (rc *RedisCache) Exists(ctx context.Context, key string) (bool, error) {
+	reply, err := rc.client.Do(ctx, "EXISTS", rc.prefix+key)
+	if err != nil {
+		return false, err
+	}
+	count, err := redisInt(reply)
+	return count > 0, err
+}
+
+// TTL returns the time-to-live for a key, -1 if it does not expire
+func (rc *RedisCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	reply, err := rc.client.Do(ctx, "PTTL", rc.prefix+key)
+	if err != nil {
+		return 0, err
+	}
+
+	return redisTTL(reply)
+}
+
+// redisTTL converts a PTTL reply, -1 if the key does not expire
+func redisTTL(reply interface{}) (time.Duration, error) {
+	ms, err := redisInt(reply)
+	if err != nil {
+		return 0, err
+	}
+
+	switch ms {
+	case -2:
+		return 0, ErrCacheMiss
+	case -1:
+		return -1, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// GetWithTTL retrieves a value and its time-to-live in one round trip
+func (rc *RedisCache) GetWithTTL(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	replies, err := rc.client.Pipeline().
+		Queue("GET", rc.prefix+key).
+		Queue("PTTL", rc.prefix+key).
+		Exec(ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, reply := range replies {
+		if replyErr, ok := reply.(RedisError); ok {
+			return nil, 0, replyErr
+		}
+	}
+	if replies[0] == nil {
+		return nil, 0, ErrCacheMiss
+	}
+
+	value, err := redisBytes(replies[0])
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl, err := redisTTL(replies[1])
+	if err != nil {
+		return nil, 0, err
+	}
+	return value, ttl, nil
+}
+
+// Keys returns the keys matching a glob pattern, using SCAN instead of KEYS
+func (rc *RedisCache) Keys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	err := rc.scan(ctx, escapeRedisGlob(rc.prefix)+pattern, func(batch []string) error {
+		for _, key := range batch {
+			keys = append(keys, strings.TrimPrefix(key, rc.prefix))
+		}
+		return nil
+	})
+	return keys, err
+}
+
+// escapeRedisGlob escapes the glob characters of a literal MATCH pattern part
+func escapeRedisGlob(s string) string {
+	var escaped strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			escaped.WriteByte('\\')
+		}
+		escaped.WriteRune(r)
+	}
+	return escaped.String()
+}
+
+// GetMulti retrieves several values in one round trip; missing keys are omitted
+func (rc *RedisCache) GetMulti(ctx context.Context, keys []string) (map[string][]byte, error) {
+	pipeline := rc.client.Pipeline()
+	for _, key := range keys {
+		pipeline.Queue("GET", rc.prefix+key)
+	}
+
+	replies, err := pipeline.Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string][]byte, len(keys))
+	for i, reply := range replies {
+		if replyErr, ok := reply.(RedisError); ok {
+			return nil, replyErr
+		}
+		if value, err := redisBytes(reply); err == nil {
+			values[keys[i]] = value
+		}
+	}
+	return values, nil
+}
+
+// SetMulti stores several values in one round trip
+func (rc *RedisCache) SetMulti(ctx context.Context, values map[string][]byte, expiration time.Duration) error {
+	pipeline := rc.client.Pipeline()
+	for key, value := range values {
+		pipeline.Queue(setArgs(rc.prefix+key, value, expiration)...)
+	}
+
+	replies, err := pipeline.Exec(ctx)
+	if err != nil {
+		return err
+	}
+	for _, reply := range replies {
+		if replyErr, ok := reply.(RedisError); ok {
+			return replyErr
+		}
+	}
+	return nil
+}
+
+// Close closes the underlying client
+func (rc *RedisCache) Close() error {
+	return rc.client.Close()
+}
+
+// scan iterates the keys matching a pattern in batches
+func (rc *RedisCache) scan(ctx context.Context, match string, fn func(keys []string) error) error {
+	cursor := "0"
+	for {
+		reply, err := rc.client.Do(ctx, "SCAN", cursor, "MATCH", match, "COUNT", rc.scanCount)
+		if err != nil {
+			return err
+		}
+
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 2 {
+			return fmt.Errorf("redis: unexpected SCAN reply %T", reply)
+		}
+
+		next, err := redisBytes(parts[0])
+		if err != nil {
+			return err
+		}
+		items, _ := parts[1].([]interface{})
+
+		if len(items) > 0 {
+			keys := make([]string, 0, len(items))
+			for _, item := range items {
+				key, err := redisBytes(item)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, string(key))
+			}
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
+
+// redisSubscriptionPingInterval is how often an idle subscription checks its connection
+const redisSubscriptionPingInterval = 30 * time.Second
+
+// RedisSubscription receives the messages published to a channel on a
+// dedicated connection. The connection is pinged while idle and replaced
+// with backoff once it fails or a reply is overdue.
+type RedisSubscription struct {
+	client       *RedisClient
+	channel      string
+	handler      func(payload []byte)
+	pingInterval time.Duration
+	conn         *redisConn
+	closed       bool
+	mutex        sync.Mutex
+	done         chan struct{}
+}
+
+// Subscribe subscribes to a channel. The handler is called from a single
+// goroutine for each message, and with a nil payload after a reconnect,
+// since messages published while disconnected are lost.
+func (rc *RedisClient) Subscribe(ctx context.Context, channel string, handler func(payload []byte)) (*RedisSubscription, error) {
+	subscription := &RedisSubscription{
+		client:       rc,
+		channel:      channel,
+		handler:      handler,
+		pingInterval: redisSubscriptionPingInterval,
+		done:         make(chan struct{}),
+	}
+
+	conn, err := subscription.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	subscription.conn = conn
+
+	go subscription.run()
+	return subscription, nil
+}
+
+// connect opens a connection and subscribes it to the channel
+func (rs *RedisSubscription) connect(ctx context.Context) (*redisConn, error) {
+	conn, err := rs.client.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := rs.client.roundTrip(ctx, conn, [][]interface{}{{"SUBSCRIBE", rs.channel}})
+	if err == nil {
+		if replyErr, ok := replies[0].(RedisError); ok {
+			err = replyErr
+		}
+	}
+	if err == nil {
+		err = conn.conn.SetDeadline(time.Time{})
+	}
+	if err != nil {
+		conn.conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// run reads messages until the subscription is closed
+func (rs *RedisSubscription) run() {
+	defer close(rs.done)
+
+	backoff := 100 * time.Millisecond
+	rs.mutex.Lock()
+	conn := rs.conn
+	rs.mutex.Unlock()
+	stopPing := rs.startPing(conn)
+
+	for {
+		// Pings keep a healthy connection busy, so a silent one is dead
+		err := conn.conn.SetReadDeadline(time.Now().Add(rs.pingInterval + rs.client.config.ReadTimeout))
+		var reply interface{}
+		if err == nil {
+			reply, err = readRESP(conn.reader)
+		}
+		if err == nil {
+			backoff = 100 * time.Millisecond
+			if parts, ok := reply.([]interface{}); ok && len(parts) == 3 {
+				if kind, _ := redisBytes(parts[0]); string(kind) == "message" {
+					payload, _ := redisBytes(parts[2])
+					rs.handler(payload)
+				}
+			}
+			continue
+		}
+
+		close(stopPing)
+		conn.conn.Close()
+		for {
+			rs.mutex.Lock()
+			closed := rs.closed
+			rs.mutex.Unlock()
+			if closed {
+				return
+			}
+
+			time.Sleep(backoff)
+			if backoff < 5*time.Second {
+				backoff *= 2
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), rs.client.config.DialTimeout+rs.client.config.ReadTimeout)
+			conn, err = rs.connect(ctx)
+			cancel()
+			if err != nil {
+				continue
+			}
+
+			rs.mutex.Lock()
+			if rs.closed {
+				rs.mutex.Unlock()
+				conn.conn.Close()
+				return
+			}
+			rs.conn = conn
+			rs.mutex.Unlock()
+
+			stopPing = rs.startPing(conn)
+			rs.handler(nil)
+			break
+		}
+	}
+}
+
+// startPing pings a connection periodically until the returned channel is closed.
+// A failed write closes the connection so the reader reconnects.
+func (rs *RedisSubscription) startPing(conn *redisConn) chan struct{} {
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(rs.pingInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+
+			err := conn.conn.SetWriteDeadline(time.Now().Add(rs.client.config.WriteTimeout))
+			if err == nil {
+				err = writeRESPCommand(conn.writer, []interface{}{"PING"})
+			}
+			if err == nil {
+				err = conn.writer.Flush()
+			}
+			if err != nil {
+				conn.conn.Close()
+				return
+			}
+		}
+	}()
+	return stop
+}
+
+// Close unsubscribes and waits for the handler goroutine to stop
+func (rs *RedisSubscription) Close() error {
+	rs.mutex.Lock()
+	if rs.closed {
+		rs.mutex.Unlock()
+		return nil
+	}
+	rs.closed = true
+	rs.conn.conn.Close()
+	rs.mutex.Unlock()
+
+	<-rs.done
+	return nil
+}
+
+// Publish publishes a message to a channel and returns the number of receivers
+func (rc *RedisClient) Publish(ctx context.Context, channel string, payload []byte) (int64, error) {
+	reply, err := rc.Do(ctx, "PUBLISH", channel, payload)
+	if err != nil {
+		return 0, err
+	}
+	return redisInt(reply)
+}
+
+// RedisScript is a Lua script run with EVALSHA, falling back to EVAL when
+// the server does not have it cached yet
+type RedisScript struct {
+	source string
+	hash   string
+}
+
+// NewRedisScript creates a script from its Lua source
+func NewRedisScript(source string) *RedisScript {
+	sum := sha1.Sum([]byte(source))
+	return &RedisScript{
+		source: source,
+		hash:   hex.EncodeToString(sum[:]),
+	}
+}
+
+// Hash returns the SHA1 digest identifying the script on the server
+func (rs *RedisScript) Hash() string {
+	return rs.hash
+}
+
+// Load caches the script on the server
+func (rs *RedisScript) Load(ctx context.Context, client *RedisClient) error {
+	_, err := client.Do(ctx, "SCRIPT", "LOAD", rs.source)
+	return err
+}
+
+// Run runs the script with keys and arguments
+func (rs *RedisScript) Run(ctx context.Context, client *RedisClient, keys []string, args ...interface{}) (interface{}, error) {
+	reply, err := client.Do(ctx, rs.command("EVALSHA", rs.hash, keys, args)...)
+	var replyErr RedisError
+	if errors.As(err, &replyErr) && strings.HasPrefix(string(replyErr), "NOSCRIPT") {
+		reply, err = client.Do(ctx, rs.command("EVAL", rs.source, keys, args)...)
+	}
+	return reply, err
+}
+
+// command builds an EVAL or EVALSHA command
+func (rs *RedisScript) command(name, script string, keys []string, args []interface{}) []interface{} {
+	command := make([]interface{}, 0, len(keys)+len(args)+3)
+	command = append(command, name, script, len(keys))
+	for _, key := range keys {
+		command = append(command, key)
+	}
+	return append(command, args...)
+}
+
+// redisRateLimitScript evaluates a rate limit rule atomically, mirroring
+// evaluateRateLimit. The server clock is used so replicas agree on time;
+// writing after reading it needs Redis 5 or later, which replicates script
+// effects instead of the script.
+// It returns allowed, remaining, reset and retry-after in milliseconds and
+// the new state, which is not stored when ARGV[5] is 1.
+var redisRateLimitScript = NewRedisScript(`
+local strategy = ARGV[1]
+local limit = tonumber(ARGV[2])
+local window = math.max(1, tonumber(ARGV[3]))
+local cost = math.max(1, tonumber(ARGV[4]))
+local clock = redis.call('TIME')
+local now = tonumber(clock[1]) * 1000 + math.floor(tonumber(clock[2]) / 1000)
+
+local state
+local raw = redis.call('GET', KEYS[1])
+if raw then
+  state = cjson.decode(raw)
+  if state.x <= now then
+    state = nil
+  end
+end
+
+local allowed, remaining, reset, retry, expires = 0, 0, 0, 0, 0
+local nextState = {c = 0, p = 0, t = 0, f = now, l = now}
+if state then
+  nextState = {c = state.c or 0, p = state.p or 0, t = state.t or 0, f = state.f or now, l = state.l or now}
+end
+
+if strategy == 'sliding_window' then
+  local start = now - now % window
+  local previous, current = 0, 0
+  if state then
+    if state.f == start then
+      previous, current = state.p or 0, state.c or 0
+    elseif state.f == start - window then
+      previous = state.c or 0
+    end
+  end
+  local estimate = previous * ((window - (now - start)) / window) + current
+  if estimate + cost <= limit then
+    allowed = 1
+    current = current + cost
+    estimate = estimate + cost
+  end
+  nextState = {c = current, p = previous, t = 0, f = start, l = 0}
+  remaining = math.max(0, math.floor(limit - estimate))
+  reset = start + window
+  expires = start + 2 * window
+elseif strategy == 'token_bucket' then
+  local rate = limit / window
+  local tokens, last = limit, now
+  if state then
+    tokens, last = nextState.t, nextState.l
+  end
+  tokens = math.min(limit, tokens + (now - last) * rate)
+  if tokens >= cost then
+    allowed = 1
+    tokens = tokens - cost
+    nextState.c = nextState.c + cost
+  else
+    retry = math.ceil((cost - tokens) / rate)
+  end
+  nextState.t = tokens
+  nextState.l = now
+  remaining = math.floor(tokens)
+  reset = now + math.ceil((limit - tokens) / rate)
+  expires = math.max(reset, now + 1)
+elseif strategy == 'leaky_bucket' then
+  local rate = limit / window
+  local level, last = 0, now
+  if state then
+    level, last = nextState.t, nextState.l
+  end
+  level = math.max(0, level - (now - last) * rate)
+  if level + cost <= limit then
+    allowed = 1
+    level = level + cost
+    nextState.c = nextState.c + cost
+  else
+    retry = math.ceil((level + cost - limit) / rate)
+  end
+  nextState.t = level
+  nextState.l = now
+  remaining = math.max(0, math.floor(limit - level))
+  reset = now + math.ceil(level / rate)
+  expires = math.max(reset, now + 1)
+else
+  if not state then
+    nextState = {c = 0, p = 0, t = 0, f = now, l = 0, x = now + window}
+  else
+    nextState.x = state.x
+  end
+  if nextState.c + cost <= limit then
+    allowed = 1
+    nextState.c = nextState.c + cost
+  end
+  remaining = math.max(0, limit - nextState.c)
+  reset = nextState.x
+  expires = reset
+end
+
+if allowed == 0 and retry == 0 then
+  retry = reset - now
+end
+nextState.s = now
+nextState.x = expires
+
+local encoded = cjson.encode(nextState)
+if ARGV[5] ~= '1' then
+  redis.call('SET', KEYS[1], encoded, 'PX', math.max(1, expires - now))
+end
+return {allowed, remaining, reset, retry, encoded}
+`)
+
+// redisRateLimitState is the compact JSON form of a RateLimitEntry stored in
+// Redis, with times in Unix milliseconds
+type redisRateLimitState struct {
+	Count         int64   `json:"c"`
+	PreviousCount int64   `json:"p"`
+	Tokens        float64 `json:"t"`
+	FirstSeen     int64   `json:"f"`
+	LastRefill    int64   `json:"l"`
+	LastSeen      int64   `json:"s"`
+	ExpiresAt     int64   `json:"x"`
+}
+
+// newRedisRateLimitState converts an entry to its stored form
+func newRedisRateLimitState(entry *RateLimitEntry) *redisRateLimitState {
+	state := &redisRateLimitState{
+		Count:         entry.Count,
+		PreviousCount: entry.PreviousCount,
+		Tokens:        entry.Tokens,
+		FirstSeen:     entry.FirstSeen.UnixMilli(),
+		LastSeen:      entry.LastSeen.UnixMilli(),
+		ExpiresAt:     entry.ExpiresAt.UnixMilli(),
+	}
+	if !entry.LastRefill.IsZero() {
+		state.LastRefill = entry.LastRefill.UnixMilli()
+	}
+	return state
+}
+
+// entry converts the stored form to an entry
+func (rs *redisRateLimitState) entry() *RateLimitEntry {
+	entry := &RateLimitEntry{
+		Count:         rs.Count,
+		PreviousCount: rs.PreviousCount,
+		Tokens:        rs.Tokens,
+		FirstSeen:     time.UnixMilli(rs.FirstSeen),
+		LastSeen:      time.UnixMilli(rs.LastSeen),
+		ExpiresAt:     time.UnixMilli(rs.ExpiresAt),
+	}
+	if rs.LastRefill != 0 {
+		entry.LastRefill = time.UnixMilli(rs.LastRefill)
+	}
+	return entry
+}
+
+// RedisRateLimitStore is a RateLimitStore shared by all replicas through
+// Redis. Rules are evaluated by a server-side script, so concurrent requests
+// on different replicas cannot exceed a limit.
+type RedisRateLimitStore struct {
+	client *RedisClient
+	cache  *RedisCache
+	prefix string
+}
+
+// NewRedisRateLimitStore creates a Redis rate limit store; the prefix defaults to ratelimit:
+func NewRedisRateLimitStore(client *RedisClient, prefix string) *RedisRateLimitStore {
+	if prefix == "" {
+		prefix = "ratelimit:"
+	}
+	return &RedisRateLimitStore{
+		client: client,
+		cache:  NewRedisCache(client, prefix, nil),
+		prefix: prefix,
+	}
+}
+
+// Allow evaluates a rule for a key atomically on the server
+func (rs *RedisRateLimitStore) Allow(ctx context.Context, key string, rule RateLimitRule) (*RateLimitResult, error) {
+	result, _, err := rs.run(ctx, key, rule, false)
+	return result, err
+}
+
+// Peek evaluates a rule for a key on the server without recording the request
+func (rs *RedisRateLimitStore) Peek(ctx context.Context, key string, rule RateLimitRule) (*RateLimitResult, error) {
+	result, _, err := rs.run(ctx, key, rule, true)
+	return result, err
+}
+
+// run runs the rate limit script and decodes its reply
+func (rs *RedisRateLimitStore) run(ctx context.Context, key string, rule RateLimitRule, peek bool) (*RateLimitResult, *RateLimitEntry, error) {
+	if err := rule.validate(); err != nil {
+		return nil, nil, err
+	}
+
+	peekArg := 0
+	if peek {
+		peekArg = 1
+	}
+	reply, err := redisRateLimitScript.Run(ctx, rs.client, []string{rs.prefix + key},
+		string(rule.Strategy), rule.Limit, rule.Window.Milliseconds(), max(1, rule.Cost), peekArg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 5 {
+		return nil, nil, fmt.Errorf("redis: unexpected rate limit reply %T", reply)
+	}
+
+	numbers := make([]int64, 4)
+	for i := range numbers {
+		if numbers[i], err = redisInt(values[i]); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	encoded, err := redisBytes(values[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	var state redisRateLimitState
+	if err := json.Unmarshal(encoded, &state); err != nil {
+		return nil, nil, err
+	}
+
+	return &RateLimitResult{
+		Allowed:    numbers[0] == 1,
+		Limit:      rule.Limit,
+		Remaining:  numbers[1],
+		ResetAt:    time.UnixMilli(numbers[2]),
+		RetryAfter: time.Duration(numbers[3]) * time.Millisecond,
+	}, state.entry(), nil
+}
+
+// Get retrieves a rate limit entry
+func (rs *RedisRateLimitStore) Get(ctx context.Context, key string) (*RateLimitEntry, error) {
+	value, err := rs.cache.Get(ctx, key)
+	if errors.Is(err, ErrCacheMiss) {
+		return nil, ErrRateLimitEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var state redisRateLimitState
+	if err := json.Unmarshal(value, &state); err != nil {
+		return nil, err
+	}
+	return state.entry(), nil
+}
+
+// Set stores a rate limit entry, expiring at its ExpiresAt if no expiration is given
+func (rs *RedisRateLimitStore) Set(ctx context.Context, key string, entry *RateLimitEntry, expiration time.Duration) error {
+	if expiration <= 0 && !entry.ExpiresAt.IsZero() {
+		if expiration = time.Until(entry.ExpiresAt); expiration <= 0 {
+			return rs.cache.Delete(ctx, key)
+		}
+	}
+
+	value, err := json.Marshal(newRedisRateLimitState(entry))
+	if err != nil {
+		return err
+	}
+	return rs.cache.Set(ctx, key, value, expiration)
+}
+
+// Increment increments the count of a fixed window starting with the first increment
+func (rs *RedisRateLimitStore) Increment(ctx context.Context, key string, expiration time.Duration) (*RateLimitEntry, error) {
+	_, entry, err := rs.run(ctx, key, RateLimitRule{
+		Strategy: FixedWindowStrategy,
+		Limit:    1 << 53,
+		Window:   expiration,
+	}, false)
+	return entry, err
+}
+
+// Delete removes a rate limit entry
+func (rs *RedisRateLimitStore) Delete(ctx context.Context, key string) error {
+	return rs.cache.Delete(ctx, key)
+}
+
+// Clear removes all rate limit entries under the prefix
+func (rs *RedisRateLimitStore) Clear(ctx context.Context) error {
+	return rs.cache.Clear(ctx)
+}
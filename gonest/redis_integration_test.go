@@ -0,0 +1,99 @@
+//go:build redis
+
+package gonest
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+// newRedisIntegrationClient connects to the server at REDIS_ADDR
+func newRedisIntegrationClient(t *testing.T) *RedisClient {
+	t.Helper()
+
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR is not set")
+	}
+
+	config := DefaultRedisConfig()
+	config.Addr = addr
+	config.Password = os.Getenv("REDIS_PASSWORD")
+	client := NewRedisClient(config)
+	t.Cleanup(func() { client.Close() })
+
+	if err := client.Ping(context.Background()); err != nil {
+		t.Fatalf("Failed to connect to Redis at %s: %v", addr, err)
+	}
+	return client
+}
+
+func TestRedisRateLimitScriptStrategies(t *testing.T) {
+	client := newRedisIntegrationClient(t)
+	store := NewRedisRateLimitStore(client, "gonest:test:"+generateTokenID()+":")
+	t.Cleanup(func() { store.Clear(context.Background()) })
+	ctx := context.Background()
+
+	strategies := []RateLimitStrategy{
+		FixedWindowStrategy,
+		SlidingWindowStrategy,
+		TokenBucketStrategy,
+		LeakyBucketStrategy,
+	}
+	for _, strategy := range strategies {
+		t.Run(string(strategy), func(t *testing.T) {
+			rule := RateLimitRule{Strategy: strategy, Limit: 3, Window: time.Minute}
+
+			for i := 0; i < 3; i++ {
+				result, err := store.Allow(ctx, string(strategy), rule)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !result.Allowed {
+					t.Fatalf("request %d was rejected: %+v", i, result)
+				}
+			}
+
+			result, err := store.Allow(ctx, string(strategy), rule)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed || result.RetryAfter <= 0 {
+				t.Fatalf("expected a rejection with a retry delay, got %+v", result)
+			}
+
+			entry, err := store.Get(ctx, string(strategy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !entry.ExpiresAt.After(time.Now()) {
+				t.Fatalf("stored entry already expired: %+v", entry)
+			}
+		})
+	}
+}
+
+func TestRedisRateLimitScriptCost(t *testing.T) {
+	client := newRedisIntegrationClient(t)
+	store := NewRedisRateLimitStore(client, "gonest:test:"+generateTokenID()+":")
+	t.Cleanup(func() { store.Clear(context.Background()) })
+	ctx := context.Background()
+
+	rule := RateLimitRule{Strategy: FixedWindowStrategy, Limit: 5, Window: time.Minute, Cost: 3}
+	result, err := store.Allow(ctx, "client", rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Allowed || result.Remaining != 2 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+
+	if result, err = store.Allow(ctx, "client", rule); err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed {
+		t.Fatalf("expected a request over the remaining limit to be rejected, got %+v", result)
+	}
+}
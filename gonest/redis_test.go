@@ -0,0 +1,452 @@
+package gonest
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newMockRedisCache(t *testing.T, server *MockRedisServer, prefix string) *RedisCache {
+	t.Helper()
+
+	client := server.Client()
+	t.Cleanup(func() { client.Close() })
+	return NewRedisCache(client, prefix, nil)
+}
+
+func TestRedisCacheGetSet(t *testing.T) {
+	cache := newMockRedisCache(t, NewMockRedisServer(t), "app:")
+	ctx := context.Background()
+
+	if _, err := cache.Get(ctx, "missing"); !errors.Is(err, ErrCacheMiss) {
+		t.Fatalf("expected ErrCacheMiss, got %v", err)
+	}
+
+	if err := cache.Set(ctx, "greeting", []byte("hello"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	value, err := cache.Get(ctx, "greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(value) != "hello" {
+		t.Fatalf("unexpected value %q", value)
+	}
+
+	ttl, err := cache.TTL(ctx, "greeting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("unexpected TTL %s", ttl)
+	}
+}
+
+func TestRedisCacheClearOnlyRemovesPrefixedKeys(t *testing.T) {
+	server := NewMockRedisServer(t)
+	cache := newMockRedisCache(t, server, "app:")
+	other := newMockRedisCache(t, server, "other:")
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "c"} {
+		if err := cache.Set(ctx, key, []byte(key), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := other.Set(ctx, "a", []byte("kept"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys, _ := cache.Keys(ctx, "*"); len(keys) != 0 {
+		t.Fatalf("expected the prefix to be empty, got %v", keys)
+	}
+	if value, err := other.Get(ctx, "a"); err != nil || string(value) != "kept" {
+		t.Fatalf("expected keys of another prefix to survive, got %q, %v", value, err)
+	}
+}
+
+func TestRedisCacheClearRequiresPrefix(t *testing.T) {
+	server := NewMockRedisServer(t)
+	cache := newMockRedisCache(t, server, "")
+	ctx := context.Background()
+
+	if err := cache.Set(ctx, "a", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cache.Clear(ctx); !errors.Is(err, ErrRedisCacheNoPrefix) {
+		t.Fatalf("expected ErrRedisCacheNoPrefix, got %v", err)
+	}
+	if server.Len() != 1 {
+		t.Fatal("expected no key to be deleted")
+	}
+}
+
+func TestRedisCacheEscapesGlobCharactersInPrefix(t *testing.T) {
+	server := NewMockRedisServer(t)
+	cache := newMockRedisCache(t, server, "a*b?[x]\\:")
+	// Matches the prefix when its glob characters are not escaped
+	neighbour := newMockRedisCache(t, server, "a-b-[x]:")
+	ctx := context.Background()
+
+	if err := cache.Set(ctx, "key", []byte("1"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := neighbour.Set(ctx, "key", []byte("2"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := cache.Keys(ctx, "*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "key" {
+		t.Fatalf("expected only the cache's own key, got %v", keys)
+	}
+
+	if err := cache.Clear(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := neighbour.Get(ctx, "key"); err != nil {
+		t.Fatalf("expected a key matching the unescaped prefix to survive, got %v", err)
+	}
+}
+
+func TestRedisCacheKeysPattern(t *testing.T) {
+	cache := newMockRedisCache(t, NewMockRedisServer(t), "app:")
+	ctx := context.Background()
+
+	for _, key := range []string{"user:1", "user:2", "post:1"} {
+		if err := cache.Set(ctx, key, []byte("v"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys, err := cache.Keys(ctx, "user:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if len(keys) != 2 || keys[0] != "user:1" || keys[1] != "user:2" {
+		t.Fatalf("unexpected keys %v", keys)
+	}
+}
+
+func TestRedisRateLimitStoreSharesLimitAcrossClients(t *testing.T) {
+	server := NewMockRedisServer(t)
+	first := NewRedisRateLimitStore(server.Client(), "")
+	second := NewRedisRateLimitStore(server.Client(), "")
+	rule := RateLimitRule{Strategy: FixedWindowStrategy, Limit: 3, Window: time.Minute}
+	ctx := context.Background()
+
+	for i, store := range []*RedisRateLimitStore{first, second, first} {
+		result, err := store.Allow(ctx, "client", rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != int64(2-i) {
+			t.Fatalf("request %d: unexpected result %+v", i, result)
+		}
+	}
+
+	result, err := second.Allow(ctx, "client", rule)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed || result.RetryAfter <= 0 {
+		t.Fatalf("expected the fourth request to be rejected with a retry delay, got %+v", result)
+	}
+}
+
+func TestRedisRateLimitStoreEntries(t *testing.T) {
+	store := NewRedisRateLimitStore(NewMockRedisServer(t).Client(), "")
+	ctx := context.Background()
+
+	if _, err := store.Get(ctx, "missing"); !errors.Is(err, ErrRateLimitEntryNotFound) {
+		t.Fatalf("expected ErrRateLimitEntryNotFound, got %v", err)
+	}
+
+	for i := int64(1); i <= 2; i++ {
+		entry, err := store.Increment(ctx, "counter", time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Count != i {
+			t.Fatalf("expected count %d, got %d", i, entry.Count)
+		}
+	}
+
+	entry, err := store.Get(ctx, "counter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entry.Count != 2 || !entry.ExpiresAt.After(time.Now()) {
+		t.Fatalf("unexpected entry %+v", entry)
+	}
+
+	if err := store.Delete(ctx, "counter"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get(ctx, "counter"); !errors.Is(err, ErrRateLimitEntryNotFound) {
+		t.Fatalf("expected a deleted entry to be missing, got %v", err)
+	}
+}
+
+func TestRateLimitBackendFallsBackOnlyWhenStoreUnreachable(t *testing.T) {
+	server := NewMockRedisServer(t)
+	client := server.Client()
+	t.Cleanup(func() { client.Close() })
+	backend := newRateLimitBackend(NewRedisRateLimitStore(client, ""), nil, nil)
+	rule := RateLimitRule{Strategy: FixedWindowStrategy, Limit: 1, Window: time.Minute}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := backend.check(ctx, "client", rule); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if backend.degraded.Load() {
+		t.Fatal("a cancelled request must not mark the store unavailable")
+	}
+
+	server.Close()
+	result, err := backend.check(context.Background(), "client", rule)
+	if err != nil {
+		t.Fatalf("expected the fallback store to be used, got %v", err)
+	}
+	if !result.Allowed || !backend.degraded.Load() {
+		t.Fatalf("expected a local decision while the store is down, got %+v", result)
+	}
+}
+
+// serveRawRedis accepts connections and hands each to handle with its index
+func serveRawRedis(t *testing.T, handle func(index int, conn net.Conn, reader *bufio.Reader)) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for index := 0; ; index++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func(index int) {
+				defer conn.Close()
+				handle(index, conn, bufio.NewReader(conn))
+			}(index)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestRedisClientRetriesConnectionsClosedWhileIdle(t *testing.T) {
+	var connections atomic.Int32
+	addr := serveRawRedis(t, func(index int, conn net.Conn, reader *bufio.Reader) {
+		connections.Add(1)
+		for {
+			if _, err := readRESP(reader); err != nil {
+				return
+			}
+			conn.Write([]byte("+PONG\r\n"))
+			// The first connection is closed after its first reply
+			if index == 0 {
+				return
+			}
+		}
+	})
+
+	client := NewRedisClient(&RedisConfig{Addr: addr, PoolSize: 1, DialTimeout: time.Second, ReadTimeout: time.Second, WriteTimeout: time.Second})
+	defer client.Close()
+
+	ctx := context.Background()
+	if err := client.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if err := client.Ping(ctx); err != nil {
+		t.Fatalf("expected a retry on a new connection, got %v", err)
+	}
+	if got := connections.Load(); got != 2 {
+		t.Fatalf("expected 2 connections, got %d", got)
+	}
+}
+
+func TestRedisClientDoesNotRetryAfterReadTimeout(t *testing.T) {
+	var commands atomic.Int32
+	addr := serveRawRedis(t, func(index int, conn net.Conn, reader *bufio.Reader) {
+		for {
+			if _, err := readRESP(reader); err != nil {
+				return
+			}
+			// Only the first command is answered, later ones time out
+			if commands.Add(1) == 1 {
+				conn.Write([]byte(":1\r\n"))
+			}
+		}
+	})
+
+	client := NewRedisClient(&RedisConfig{Addr: addr, PoolSize: 1, DialTimeout: time.Second, ReadTimeout: 50 * time.Millisecond, WriteTimeout: 50 * time.Millisecond})
+	defer client.Close()
+
+	ctx := context.Background()
+	if _, err := client.Do(ctx, "INCR", "counter"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(ctx, "INCR", "counter"); err == nil {
+		t.Fatal("expected a read timeout")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := commands.Load(); got != 2 {
+		t.Fatalf("expected the timed out command to be sent once, got %d sends", got)
+	}
+}
+
+// scriptRedis serves the commands the rate limit script uses, with a clock
+// the test controls
+type scriptRedis struct {
+	now     time.Time
+	values  map[string]string
+	expires map[string]time.Time
+}
+
+func newScriptRedis(now time.Time) *scriptRedis {
+	return &scriptRedis{now: now, values: make(map[string]string), expires: make(map[string]time.Time)}
+}
+
+func (sr *scriptRedis) call(args ...string) interface{} {
+	switch args[0] {
+	case "TIME":
+		micros := sr.now.UnixMicro()
+		return []interface{}{
+			[]byte(strconv.FormatInt(micros/1e6, 10)),
+			[]byte(strconv.FormatInt(micros%1e6, 10)),
+		}
+	case "GET":
+		value, exists := sr.values[args[1]]
+		if !exists || !sr.now.Before(sr.expires[args[1]]) {
+			return nil
+		}
+		return []byte(value)
+	case "SET":
+		ttl, err := strconv.ParseInt(args[4], 10, 64)
+		if len(args) != 5 || args[3] != "PX" || err != nil || ttl <= 0 {
+			return RedisError("ERR syntax error")
+		}
+		sr.values[args[1]] = args[2]
+		sr.expires[args[1]] = sr.now.Add(time.Duration(ttl) * time.Millisecond)
+		return "OK"
+	}
+	return RedisError("ERR unexpected command " + args[0])
+}
+
+// TestRedisRateLimitScriptMatchesEmulation runs the Lua rate limit script
+// and its Go emulation, which the mock server and the local fallback rely
+// on, through the same requests and compares every reply and stored state
+func TestRedisRateLimitScriptMatchesEmulation(t *testing.T) {
+	lua, err := newLuaMockRedisScript(redisRateLimitScript.source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type step struct {
+		after time.Duration
+		cost  int64
+		peek  bool
+	}
+	steps := []step{
+		{0, 1, false}, {0, 1, true}, {10 * time.Millisecond, 2, false}, {0, 3, false},
+		{0, 1, false}, {0, 1, true}, {137 * time.Millisecond, 1, false}, {250 * time.Millisecond, 1, false},
+		{400 * time.Millisecond, 4, false}, {999 * time.Millisecond, 1, false}, {time.Millisecond, 2, false},
+		{1500 * time.Millisecond, 1, true}, {0, 5, false}, {3 * time.Second, 1, false},
+	}
+
+	for _, strategy := range []RateLimitStrategy{FixedWindowStrategy, SlidingWindowStrategy, TokenBucketStrategy, LeakyBucketStrategy} {
+		for _, limit := range []int64{1, 4, 7} {
+			start := time.UnixMilli(1700000000123)
+			luaRedis, goRedis := newScriptRedis(start), newScriptRedis(start)
+
+			for i, s := range steps {
+				luaRedis.now = luaRedis.now.Add(s.after)
+				goRedis.now = luaRedis.now
+
+				peek := "0"
+				if s.peek {
+					peek = "1"
+				}
+				args := [][]byte{[]byte(strategy), []byte(strconv.FormatInt(limit, 10)), []byte("1000"),
+					[]byte(strconv.FormatInt(s.cost, 10)), []byte(peek)}
+
+				got := lua(luaRedis.call, []string{"key"}, args)
+				want := mockRedisRateLimitScript(goRedis.call, []string{"key"}, args)
+
+				gotValues, ok := got.([]interface{})
+				if !ok || len(gotValues) != 5 {
+					t.Fatalf("%s limit %d step %d: unexpected script reply %v", strategy, limit, i, got)
+				}
+				wantValues := want.([]interface{})
+				for j := 0; j < 4; j++ {
+					if gotValues[j] != wantValues[j] {
+						t.Fatalf("%s limit %d step %d: script replied %v, emulation %v", strategy, limit, i, gotValues[:4], wantValues[:4])
+					}
+				}
+
+				var gotState, wantState redisRateLimitState
+				if err := json.Unmarshal(gotValues[4].([]byte), &gotState); err != nil {
+					t.Fatalf("%s limit %d step %d: %v", strategy, limit, i, err)
+				}
+				if err := json.Unmarshal(wantValues[4].([]byte), &wantState); err != nil {
+					t.Fatal(err)
+				}
+				if math.Abs(gotState.Tokens-wantState.Tokens) > 1e-9 {
+					t.Fatalf("%s limit %d step %d: script state %+v, emulation %+v", strategy, limit, i, gotState, wantState)
+				}
+				gotState.Tokens = wantState.Tokens
+				if gotState != wantState {
+					t.Fatalf("%s limit %d step %d: script state %+v, emulation %+v", strategy, limit, i, gotState, wantState)
+				}
+				if luaRedis.values["key"] != "" && luaRedis.expires["key"] != goRedis.expires["key"] {
+					t.Fatalf("%s limit %d step %d: script expiry %v, emulation %v", strategy, limit, i, luaRedis.expires["key"], goRedis.expires["key"])
+				}
+			}
+		}
+	}
+}
+
+func TestRedisRateLimitStoreRunsScript(t *testing.T) {
+	lua, err := newLuaMockRedisScript(redisRateLimitScript.source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewMockRedisServer(t)
+	server.RegisterScript(redisRateLimitScript.source, lua)
+
+	store := NewRedisRateLimitStore(server.Client(), "")
+	rule := RateLimitRule{Strategy: SlidingWindowStrategy, Limit: 2, Window: time.Minute}
+	ctx := context.Background()
+
+	for i, want := range []bool{true, true, false} {
+		result, err := store.Allow(ctx, "client", rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Allowed != want {
+			t.Fatalf("request %d: expected allowed=%v, got %+v", i, want, result)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package gonest
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// MetadataKeySkipCSRF is the metadata key marking routes exempt from CSRF protection
+const MetadataKeySkipCSRF = "skip_csrf"
+
+// SkipCSRF creates a metadata entry exempting a route from CSRF protection
+func SkipCSRF() MetadataEntry {
+	return SetMetadata(MetadataKeySkipCSRF, true)
+}
+
+// SecurityConfig configures CORS, security headers and CSRF protection.
+// A nil section disables the corresponding middleware.
+type SecurityConfig struct {
+	CORS    *CORSConfig            `json:"cors"`
+	Headers *SecurityHeadersConfig `json:"headers"`
+	CSRF    *CSRFConfig            `json:"csrf"`
+}
+
+// CORSConfig configures cross-origin resource sharing
+type CORSConfig struct {
+	AllowOrigins     []string `json:"allow_origins"`
+	AllowMethods     []string `json:"allow_methods"`
+	AllowHeaders     []string `json:"allow_headers"`
+	ExposeHeaders    []string `json:"expose_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// MaxAge is how long, in seconds, preflight results may be cached
+	MaxAge int `json:"max_age"`
+}
+
+// SecurityHeadersConfig configures Helmet-style response headers
+type SecurityHeadersConfig struct {
+	ContentSecurityPolicy string `json:"content_security_policy"`
+	CSPReportOnly         bool   `json:"csp_report_only"`
+	// HSTSMaxAge of zero disables Strict-Transport-Security
+	HSTSMaxAge            int    `json:"hsts_max_age"`
+	HSTSExcludeSubdomains bool   `json:"hsts_exclude_subdomains"`
+	HSTSPreload           bool   `json:"hsts_preload"`
+	FrameOptions          string `json:"frame_options"`
+	ReferrerPolicy        string `json:"referrer_policy"`
+	ContentTypeNosniff    bool   `json:"content_type_nosniff"`
+	XSSProtection         string `json:"xss_protection"`
+}
+
+// CSRFConfig configures double-submit cookie CSRF protection. Unsafe requests
+// must echo the token cookie in a header or form field. Requests carrying a
+// bearer token and requests without a session cookie are not checked and get
+// no token cookie, since they cannot be forged with ambient credentials; this
+// also keeps anonymous responses cacheable.
+type CSRFConfig struct {
+	CookieName     string        `json:"cookie_name"`
+	HeaderName     string        `json:"header_name"`
+	FormField      string        `json:"form_field"`
+	CookiePath     string        `json:"cookie_path"`
+	CookieDomain   string        `json:"cookie_domain"`
+	CookieSecure   bool          `json:"cookie_secure"`
+	CookieSameSite http.SameSite `json:"cookie_same_site"`
+	// CookieMaxAge is the token lifetime in seconds
+	CookieMaxAge int `json:"cookie_max_age"`
+	// SessionCookies are the cookies carrying credentials, e.g. the
+	// SessionConfig.CookieName. When empty, any cookie counts.
+	SessionCookies []string `json:"session_cookies"`
+}
+
+// DefaultSecurityConfig returns the security defaults of an environment.
+// Development allows any origin; other environments allow no cross-origin
+// requests until origins are configured and enable HSTS and secure cookies.
+func DefaultSecurityConfig(environment string) *SecurityConfig {
+	production := environment != "development" && environment != "test"
+
+	config := &SecurityConfig{
+		CORS: &CORSConfig{
+			AllowMethods: []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodPost, http.MethodDelete},
+			AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept, echo.HeaderAuthorization, "X-CSRF-Token"},
+			MaxAge:       600,
+		},
+		Headers: &SecurityHeadersConfig{
+			ContentSecurityPolicy: "default-src 'self'; frame-ancestors 'none'; object-src 'none'",
+			FrameOptions:          "DENY",
+			ReferrerPolicy:        "strict-origin-when-cross-origin",
+			ContentTypeNosniff:    true,
+			XSSProtection:         "0",
+		},
+		CSRF: &CSRFConfig{
+			CookieName:     "_csrf",
+			HeaderName:     "X-CSRF-Token",
+			FormField:      "_csrf",
+			CookiePath:     "/",
+			CookieSameSite: http.SameSiteLaxMode,
+			CookieMaxAge:   86400,
+			SessionCookies: []string{"gonest_session"},
+		},
+	}
+
+	if production {
+		config.Headers.HSTSMaxAge = 31536000
+		config.CSRF.CookieSecure = true
+	} else {
+		config.CORS.AllowOrigins = []string{"*"}
+	}
+
+	return config
+}
+
+// CORSMiddleware returns CORS middleware. Without allowed origins only
+// same-origin requests are served.
+func CORSMiddleware(config *CORSConfig) echo.MiddlewareFunc {
+	return middleware.CORSWithConfig(middleware.CORSConfig{
+		AllowOrigins:     config.AllowOrigins,
+		AllowOriginFunc:  corsOriginFunc(config.AllowOrigins),
+		AllowMethods:     config.AllowMethods,
+		AllowHeaders:     config.AllowHeaders,
+		ExposeHeaders:    config.ExposeHeaders,
+		AllowCredentials: config.AllowCredentials,
+		MaxAge:           config.MaxAge,
+	})
+}
+
+// corsOriginFunc rejects every origin when none is configured, since echo
+// treats an empty origin list as "*"
+func corsOriginFunc(origins []string) func(string) (bool, error) {
+	if len(origins) > 0 {
+		return nil
+	}
+	return func(string) (bool, error) {
+		return false, nil
+	}
+}
+
+// SecurityHeadersMiddleware returns middleware setting security headers
+func SecurityHeadersMiddleware(config *SecurityHeadersConfig) echo.MiddlewareFunc {
+	nosniff := ""
+	if config.ContentTypeNosniff {
+		nosniff = "nosniff"
+	}
+
+	return middleware.SecureWithConfig(middleware.SecureConfig{
+		XSSProtection:         config.XSSProtection,
+		ContentTypeNosniff:    nosniff,
+		XFrameOptions:         config.FrameOptions,
+		HSTSMaxAge:            config.HSTSMaxAge,
+		HSTSExcludeSubdomains: config.HSTSExcludeSubdomains,
+		HSTSPreloadEnabled:    config.HSTSPreload,
+		ContentSecurityPolicy: config.ContentSecurityPolicy,
+		CSPReportOnly:         config.CSPReportOnly,
+		ReferrerPolicy:        config.ReferrerPolicy,
+	})
+}
+
+// CSRFMiddleware returns double-submit cookie CSRF middleware honoring SkipCSRF metadata
+func CSRFMiddleware(config *CSRFConfig) echo.MiddlewareFunc {
+	lookup := "header:" + config.HeaderName
+	if config.FormField != "" {
+		lookup += ",form:" + config.FormField
+	}
+
+	return middleware.CSRFWithConfig(middleware.CSRFConfig{
+		Skipper:        csrfSkipper(config.SessionCookies),
+		TokenLookup:    lookup,
+		ContextKey:     "csrf",
+		CookieName:     config.CookieName,
+		CookiePath:     config.CookiePath,
+		CookieDomain:   config.CookieDomain,
+		CookieSecure:   config.CookieSecure,
+		CookieSameSite: config.CookieSameSite,
+		CookieMaxAge:   config.CookieMaxAge,
+		ErrorHandler: func(err error, c echo.Context) error {
+			return echo.NewHTTPError(http.StatusForbidden, "Invalid CSRF token")
+		},
+	})
+}
+
+// csrfSkipper skips routes marked with SkipCSRF, bearer-authenticated
+// requests and requests without a session cookie
+func csrfSkipper(sessionCookies []string) middleware.Skipper {
+	return func(c echo.Context) bool {
+		if skip, ok := GetMetadata(c, MetadataKeySkipCSRF); ok && skip == true {
+			return true
+		}
+
+		req := c.Request()
+		if len(req.Header.Get(echo.HeaderAuthorization)) > 7 &&
+			strings.EqualFold(req.Header.Get(echo.HeaderAuthorization)[:7], "Bearer ") {
+			return true
+		}
+
+		if len(sessionCookies) == 0 {
+			return len(req.Cookies()) == 0
+		}
+		for _, name := range sessionCookies {
+			if _, err := req.Cookie(name); err == nil {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// GetCSRFToken returns the CSRF token of the current request for rendering in forms
+func GetCSRFToken(c echo.Context) string {
+	token, _ := c.Get("csrf").(string)
+	return token
+}
+
+// SecurityMiddleware returns the middleware enabled by a security configuration
+func SecurityMiddleware(config *SecurityConfig) []echo.MiddlewareFunc {
+	var middlewares []echo.MiddlewareFunc
+
+	if config.CORS != nil {
+		middlewares = append(middlewares, CORSMiddleware(config.CORS))
+	}
+	if config.Headers != nil {
+		middlewares = append(middlewares, SecurityHeadersMiddleware(config.Headers))
+	}
+	if config.CSRF != nil {
+		middlewares = append(middlewares, CSRFMiddleware(config.CSRF))
+	}
+
+	return middlewares
+}
+
+// Validate rejects CORS credentials combined with a wildcard origin, which browsers refuse
+func (sc *SecurityConfig) Validate() error {
+	if sc.CORS == nil || !sc.CORS.AllowCredentials {
+		return nil
+	}
+
+	for _, origin := range sc.CORS.AllowOrigins {
+		if origin == "*" {
+			return errors.New("CORS credentials cannot be combined with the '*' origin")
+		}
+	}
+	return nil
+}
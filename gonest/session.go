@@ -0,0 +1,568 @@
+package gonest
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// sessionContextKey is the echo context key of the current session
+const sessionContextKey = "session"
+
+// Session errors
+var (
+	ErrSessionNotFound      = errors.New("session not found")
+	ErrSessionCookieInvalid = errors.New("invalid session cookie")
+)
+
+// Session holds the server-side state of a browser session
+type Session struct {
+	ID             string                 `json:"id"`
+	User           *AuthUser              `json:"user,omitempty"`
+	Values         map[string]interface{} `json:"values"`
+	CreatedAt      time.Time              `json:"created_at"`
+	LastAccessedAt time.Time              `json:"last_accessed_at"`
+
+	isNew      bool
+	modified   bool
+	destroyed  bool
+	previousID string
+}
+
+// Get retrieves a session value
+func (s *Session) Get(key string) (interface{}, bool) {
+	value, exists := s.Values[key]
+	return value, exists
+}
+
+// Set stores a session value
+func (s *Session) Set(key string, value interface{}) {
+	s.Values[key] = value
+	s.modified = true
+}
+
+// Delete removes a session value
+func (s *Session) Delete(key string) {
+	delete(s.Values, key)
+	s.modified = true
+}
+
+// SessionStore persists sessions
+type SessionStore interface {
+	Get(ctx context.Context, id string) (*Session, error)
+	Save(ctx context.Context, session *Session, ttl time.Duration) error
+	Delete(ctx context.Context, id string) error
+}
+
+// MemorySessionStore implements an in-memory session store.
+// Expired sessions are removed when read and swept on writes, at most once
+// per sweep interval.
+type MemorySessionStore struct {
+	sessions  map[string][]byte
+	expiry    map[string]time.Time
+	lastSweep time.Time
+	mutex     sync.RWMutex
+}
+
+// NewMemorySessionStore creates a new memory session store
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions:  make(map[string][]byte),
+		expiry:    make(map[string]time.Time),
+		lastSweep: time.Now(),
+	}
+}
+
+// Get retrieves a session
+func (mss *MemorySessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	mss.mutex.RLock()
+	data, exists := mss.sessions[id]
+	expiresAt := mss.expiry[id]
+	mss.mutex.RUnlock()
+
+	if !exists {
+		return nil, ErrSessionNotFound
+	}
+	if time.Now().After(expiresAt) {
+		mss.mutex.Lock()
+		// The session may have been saved again since it was read
+		if mss.expiry[id].Equal(expiresAt) {
+			delete(mss.sessions, id)
+			delete(mss.expiry, id)
+		}
+		mss.mutex.Unlock()
+		return nil, ErrSessionNotFound
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Save stores a session
+func (mss *MemorySessionStore) Save(ctx context.Context, session *Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	mss.mutex.Lock()
+	defer mss.mutex.Unlock()
+
+	now := time.Now()
+	if now.Sub(mss.lastSweep) >= memoryStoreSweepInterval {
+		mss.lastSweep = now
+		for id, expiresAt := range mss.expiry {
+			if now.After(expiresAt) {
+				delete(mss.sessions, id)
+				delete(mss.expiry, id)
+			}
+		}
+	}
+
+	mss.sessions[session.ID] = data
+	mss.expiry[session.ID] = now.Add(ttl)
+	return nil
+}
+
+// Delete removes a session
+func (mss *MemorySessionStore) Delete(ctx context.Context, id string) error {
+	mss.mutex.Lock()
+	defer mss.mutex.Unlock()
+
+	delete(mss.sessions, id)
+	delete(mss.expiry, id)
+	return nil
+}
+
+// CacheSessionStore stores sessions in a cache provider
+type CacheSessionStore struct {
+	provider  CacheProvider
+	keyPrefix string
+}
+
+// NewCacheSessionStore creates a new cache-backed session store
+func NewCacheSessionStore(provider CacheProvider) *CacheSessionStore {
+	return &CacheSessionStore{
+		provider:  provider,
+		keyPrefix: "session:",
+	}
+}
+
+// Get retrieves a session
+func (css *CacheSessionStore) Get(ctx context.Context, id string) (*Session, error) {
+	data, err := css.provider.Get(ctx, css.keyPrefix+id)
+	if errors.Is(err, ErrCacheMiss) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var session Session
+	if err := json.Unmarshal(data, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// Save stores a session
+func (css *CacheSessionStore) Save(ctx context.Context, session *Session, ttl time.Duration) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return css.provider.Set(ctx, css.keyPrefix+session.ID, data, ttl)
+}
+
+// Delete removes a session
+func (css *CacheSessionStore) Delete(ctx context.Context, id string) error {
+	return css.provider.Delete(ctx, css.keyPrefix+id)
+}
+
+// SessionConfig holds session configuration
+type SessionConfig struct {
+	CookieName string
+	// Secret signs the session cookie and must be at least 32 bytes
+	Secret []byte
+	// EncryptionKey optionally encrypts the cookie with AES-GCM (16, 24 or 32 bytes)
+	EncryptionKey []byte
+	Path          string
+	Domain        string
+	Secure        bool
+	HTTPOnly      bool
+	SameSite      http.SameSite
+	// IdleTimeout ends sessions that have not been used for the duration
+	IdleTimeout time.Duration
+	// AbsoluteTimeout ends sessions this long after they were created
+	AbsoluteTimeout time.Duration
+	Store           SessionStore
+}
+
+// DefaultSessionConfig returns default session configuration
+func DefaultSessionConfig(secret []byte) *SessionConfig {
+	return &SessionConfig{
+		CookieName:      "gonest_session",
+		Secret:          secret,
+		Path:            "/",
+		Secure:          true,
+		HTTPOnly:        true,
+		SameSite:        http.SameSiteLaxMode,
+		IdleTimeout:     30 * time.Minute,
+		AbsoluteTimeout: 24 * time.Hour,
+		Store:           NewMemorySessionStore(),
+	}
+}
+
+// SessionManager loads, saves and rotates cookie sessions
+type SessionManager struct {
+	config *SessionConfig
+	aead   cipher.AEAD
+	logger *logrus.Logger
+}
+
+// NewSessionManager creates a new session manager
+func NewSessionManager(config *SessionConfig, logger *logrus.Logger) (*SessionManager, error) {
+	if len(config.Secret) < 32 {
+		return nil, errors.New("session secret must be at least 32 bytes")
+	}
+	if config.Store == nil {
+		config.Store = NewMemorySessionStore()
+	}
+
+	sm := &SessionManager{
+		config: config,
+		logger: logger,
+	}
+
+	if len(config.EncryptionKey) > 0 {
+		block, err := aes.NewCipher(config.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid session encryption key: %w", err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		sm.aead = aead
+	}
+
+	return sm, nil
+}
+
+// Middleware loads the session of each request and saves it before the response is written
+// when it changed. The user of an authenticated session is available through GetCurrentUser.
+func (sm *SessionManager) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			session, err := sm.Load(c)
+			if err != nil {
+				if !errors.Is(err, ErrNoCredentials) && !errors.Is(err, ErrSessionNotFound) &&
+					!errors.Is(err, ErrSessionCookieInvalid) {
+					sm.logError(err, "Failed to load session")
+				}
+				session = sm.newSession()
+			}
+
+			// The access time is only written back once it is stale enough
+			// to matter for the idle timeout, not on every request
+			now := time.Now()
+			if now.Sub(session.LastAccessedAt) >= sm.touchInterval() {
+				session.LastAccessedAt = now
+				session.modified = true
+			}
+
+			c.Set(sessionContextKey, session)
+			if session.User != nil {
+				SetCurrentUser(c, session.User)
+			}
+
+			c.Response().Before(func() {
+				sm.commit(c, session)
+			})
+
+			return next(c)
+		}
+	}
+}
+
+// Load reads and validates the session referenced by the request cookie
+func (sm *SessionManager) Load(c echo.Context) (*Session, error) {
+	cookie, err := c.Cookie(sm.config.CookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, ErrNoCredentials
+	}
+
+	id, err := sm.decodeCookie(cookie.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := c.Request().Context()
+	session, err := sm.config.Store.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if sm.isExpired(session, time.Now()) {
+		sm.config.Store.Delete(ctx, session.ID)
+		return nil, ErrSessionNotFound
+	}
+
+	if session.Values == nil {
+		session.Values = make(map[string]interface{})
+	}
+	return session, nil
+}
+
+// Login stores the user in the session and rotates the session ID to prevent fixation
+func (sm *SessionManager) Login(c echo.Context, user *AuthUser) *Session {
+	session := sm.current(c)
+
+	if !session.isNew && session.previousID == "" {
+		session.previousID = session.ID
+	}
+	session.ID = generateTokenID()
+	session.User = user
+	session.modified = true
+
+	SetCurrentUser(c, user)
+	return session
+}
+
+// Logout destroys the session
+func (sm *SessionManager) Logout(c echo.Context) {
+	session := sm.current(c)
+	session.destroyed = true
+	session.User = nil
+}
+
+// current returns the session of the request, creating one if the middleware did not run
+func (sm *SessionManager) current(c echo.Context) *Session {
+	if session := GetSession(c); session != nil {
+		return session
+	}
+
+	session := sm.newSession()
+	c.Set(sessionContextKey, session)
+	c.Response().Before(func() {
+		sm.commit(c, session)
+	})
+	return session
+}
+
+// newSession creates an empty session
+func (sm *SessionManager) newSession() *Session {
+	now := time.Now()
+	return &Session{
+		ID:             generateTokenID(),
+		Values:         make(map[string]interface{}),
+		CreatedAt:      now,
+		LastAccessedAt: now,
+		isNew:          true,
+	}
+}
+
+// isExpired checks the idle and absolute timeouts
+func (sm *SessionManager) isExpired(session *Session, now time.Time) bool {
+	if sm.config.IdleTimeout > 0 && now.Sub(session.LastAccessedAt) > sm.config.IdleTimeout {
+		return true
+	}
+	if sm.config.AbsoluteTimeout > 0 && now.Sub(session.CreatedAt) > sm.config.AbsoluteTimeout {
+		return true
+	}
+	return false
+}
+
+// touchInterval returns how stale LastAccessedAt may get before it is saved
+func (sm *SessionManager) touchInterval() time.Duration {
+	if sm.config.IdleTimeout > 0 && sm.config.IdleTimeout/2 < time.Minute {
+		return sm.config.IdleTimeout / 2
+	}
+	return time.Minute
+}
+
+// ttl returns how long the session can live in the store
+func (sm *SessionManager) ttl(session *Session, now time.Time) time.Duration {
+	ttl := sm.config.IdleTimeout
+	if sm.config.AbsoluteTimeout > 0 {
+		remaining := session.CreatedAt.Add(sm.config.AbsoluteTimeout).Sub(now)
+		if ttl <= 0 || remaining < ttl {
+			ttl = remaining
+		}
+	}
+	return ttl
+}
+
+// commit saves or deletes the session and writes the cookie
+func (sm *SessionManager) commit(c echo.Context, session *Session) {
+	ctx := c.Request().Context()
+
+	if session.previousID != "" {
+		if err := sm.config.Store.Delete(ctx, session.previousID); err != nil {
+			sm.logError(err, "Failed to delete rotated session")
+		}
+	}
+
+	if session.destroyed {
+		if !session.isNew {
+			if err := sm.config.Store.Delete(ctx, session.ID); err != nil {
+				sm.logError(err, "Failed to delete session")
+			}
+		}
+		sm.writeCookie(c, "", -1)
+		return
+	}
+
+	// Unchanged sessions, including anonymous ones without data, are not stored
+	if !session.modified {
+		return
+	}
+
+	now := time.Now()
+	if err := sm.config.Store.Save(ctx, session, sm.ttl(session, now)); err != nil {
+		sm.logError(err, "Failed to save session")
+		return
+	}
+
+	if session.isNew || session.previousID != "" {
+		value, err := sm.encodeCookie(session.ID)
+		if err != nil {
+			sm.logError(err, "Failed to encode session cookie")
+			return
+		}
+		sm.writeCookie(c, value, 0)
+	}
+}
+
+// writeCookie sets the session cookie; a negative maxAge deletes it
+func (sm *SessionManager) writeCookie(c echo.Context, value string, maxAge int) {
+	c.SetCookie(&http.Cookie{
+		Name:     sm.config.CookieName,
+		Value:    value,
+		Path:     sm.config.Path,
+		Domain:   sm.config.Domain,
+		MaxAge:   maxAge,
+		Secure:   sm.config.Secure,
+		HttpOnly: sm.config.HTTPOnly,
+		SameSite: sm.config.SameSite,
+	})
+}
+
+// encodeCookie encrypts the session ID if configured and signs it
+func (sm *SessionManager) encodeCookie(id string) (string, error) {
+	payload := []byte(id)
+
+	if sm.aead != nil {
+		nonce := make([]byte, sm.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return "", err
+		}
+		payload = sm.aead.Seal(nonce, nonce, payload, []byte(sm.config.CookieName))
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	return encoded + "." + sm.sign(encoded), nil
+}
+
+// decodeCookie verifies the cookie signature and returns the session ID
+func (sm *SessionManager) decodeCookie(value string) (string, error) {
+	encoded, signature, found := strings.Cut(value, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(sm.sign(encoded))) {
+		return "", ErrSessionCookieInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", ErrSessionCookieInvalid
+	}
+
+	if sm.aead != nil {
+		if len(payload) < sm.aead.NonceSize() {
+			return "", ErrSessionCookieInvalid
+		}
+		nonce, ciphertext := payload[:sm.aead.NonceSize()], payload[sm.aead.NonceSize():]
+		payload, err = sm.aead.Open(nil, nonce, ciphertext, []byte(sm.config.CookieName))
+		if err != nil {
+			return "", ErrSessionCookieInvalid
+		}
+	}
+
+	return string(payload), nil
+}
+
+// sign computes the HMAC-SHA256 signature of a cookie value
+func (sm *SessionManager) sign(value string) string {
+	mac := hmac.New(sha256.New, sm.config.Secret)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// logError logs an error if a logger is configured
+func (sm *SessionManager) logError(err error, message string) {
+	if sm.logger != nil {
+		sm.logger.WithError(err).Error(message)
+	}
+}
+
+// GetSession returns the session of the current request
+func GetSession(c echo.Context) *Session {
+	session, _ := c.Get(sessionContextKey).(*Session)
+	return session
+}
+
+// SessionStrategy authenticates requests carrying a session cookie
+type SessionStrategy struct {
+	manager *SessionManager
+}
+
+// NewSessionStrategy creates a new session strategy
+func NewSessionStrategy(manager *SessionManager) *SessionStrategy {
+	return &SessionStrategy{manager: manager}
+}
+
+// Authenticate returns the user of the session carried by an echo.Context
+func (ss *SessionStrategy) Authenticate(ctx context.Context, credentials interface{}) (*AuthUser, error) {
+	c, ok := credentials.(echo.Context)
+	if !ok {
+		return nil, errors.New("invalid credentials format")
+	}
+
+	session := GetSession(c)
+	if session == nil {
+		loaded, err := ss.manager.Load(c)
+		if errors.Is(err, ErrNoCredentials) {
+			return nil, ErrNoCredentials
+		}
+		if err != nil {
+			return nil, err
+		}
+		session = loaded
+	}
+
+	if session.User == nil {
+		return nil, ErrNoCredentials
+	}
+	return session.User, nil
+}
+
+// GetName returns strategy name
+func (ss *SessionStrategy) GetName() string {
+	return "session"
+}
@@ -0,0 +1,49 @@
+package gonest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemorySessionStoreExpiresSessions(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemorySessionStore()
+
+	expired := &Session{ID: "expired", Values: map[string]interface{}{}}
+	if err := store.Save(ctx, expired, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+	stale := &Session{ID: "stale", Values: map[string]interface{}{}}
+	if err := store.Save(ctx, stale, -time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading an expired session removes it
+	if _, err := store.Get(ctx, "expired"); err != ErrSessionNotFound {
+		t.Fatalf("expected ErrSessionNotFound, got %v", err)
+	}
+	if _, exists := store.sessions["expired"]; exists {
+		t.Fatal("expected the expired session to be removed on read")
+	}
+
+	// Writes only sweep once the sweep interval has passed
+	live := &Session{ID: "live", Values: map[string]interface{}{}}
+	if err := store.Save(ctx, live, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := store.sessions["stale"]; !exists {
+		t.Fatal("expected no sweep before the sweep interval has passed")
+	}
+
+	store.lastSweep = time.Now().Add(-memoryStoreSweepInterval)
+	if err := store.Save(ctx, live, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := store.sessions["stale"]; exists {
+		t.Fatal("expected the stale session to be swept")
+	}
+	if _, err := store.Get(ctx, "live"); err != nil {
+		t.Fatalf("expected the live session to remain, got %v", err)
+	}
+}
@@ -0,0 +1,481 @@
+package gonest
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// Tenant errors
+var (
+	ErrNoTenant        = errors.New("no tenant in context")
+	ErrTenantNotFound  = errors.New("tenant not found")
+	ErrTenantInvalid   = errors.New("invalid tenant ID")
+	ErrTenantForbidden = errors.New("user is not a member of the tenant")
+)
+
+// maxTenantIDLength is the longest tenant ID accepted from a request
+const maxTenantIDLength = 128
+
+// ValidTenantID checks that a tenant ID is safe to embed in keys: not empty,
+// at most 128 characters and free of ':', whitespace and control characters
+func ValidTenantID(tenantID string) bool {
+	if tenantID == "" || len(tenantID) > maxTenantIDLength {
+		return false
+	}
+	for _, r := range tenantID {
+		if r == ':' || unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// tenantContextKey is the request context key of the tenant ID
+type tenantContextKey struct{}
+
+// WithTenant returns a context carrying a tenant ID
+func WithTenant(ctx context.Context, tenantID string) context.Context {
+	return context.WithValue(ctx, tenantContextKey{}, tenantID)
+}
+
+// TenantFromContext returns the tenant ID of a context
+func TenantFromContext(ctx context.Context) (string, bool) {
+	tenantID, ok := ctx.Value(tenantContextKey{}).(string)
+	return tenantID, ok && tenantID != ""
+}
+
+// GetTenant returns the tenant ID of the current request
+func GetTenant(c echo.Context) (string, bool) {
+	return TenantFromContext(c.Request().Context())
+}
+
+// SetTenant stores a tenant ID on the current request
+func SetTenant(c echo.Context, tenantID string) {
+	c.Set("tenant", tenantID)
+	c.SetRequest(c.Request().WithContext(WithTenant(c.Request().Context(), tenantID)))
+}
+
+// TenantResolver extracts a tenant ID from a request.
+// An empty ID without error means the resolver does not apply.
+type TenantResolver interface {
+	Resolve(c echo.Context) (string, error)
+}
+
+// TenantResolverFunc adapts a function to a TenantResolver
+type TenantResolverFunc func(c echo.Context) (string, error)
+
+// Resolve implements TenantResolver
+func (f TenantResolverFunc) Resolve(c echo.Context) (string, error) {
+	return f(c)
+}
+
+// SubdomainTenantResolver resolves the tenant from the first label of the host,
+// e.g. acme.example.com with base domain example.com resolves to "acme"
+type SubdomainTenantResolver struct {
+	BaseDomain string
+	Excluded   []string
+}
+
+// NewSubdomainTenantResolver creates a subdomain resolver ignoring the "www" subdomain
+func NewSubdomainTenantResolver(baseDomain string) *SubdomainTenantResolver {
+	return &SubdomainTenantResolver{
+		BaseDomain: strings.ToLower(strings.TrimPrefix(baseDomain, ".")),
+		Excluded:   []string{"www"},
+	}
+}
+
+// Resolve implements TenantResolver
+func (sr *SubdomainTenantResolver) Resolve(c echo.Context) (string, error) {
+	host := c.Request().Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.ToLower(host)
+
+	subdomain, found := strings.CutSuffix(host, "."+sr.BaseDomain)
+	if !found || subdomain == "" || strings.Contains(subdomain, ".") {
+		return "", nil
+	}
+
+	for _, excluded := range sr.Excluded {
+		if subdomain == excluded {
+			return "", nil
+		}
+	}
+	return subdomain, nil
+}
+
+// HeaderTenantResolver resolves the tenant from a request header.
+// The header is chosen by the client, so combine it with TenantConfig.Authorize,
+// e.g. TenantMembershipAuthorizer, unless a trusted proxy sets it.
+type HeaderTenantResolver struct {
+	Header string
+}
+
+// NewHeaderTenantResolver creates a header resolver; the header defaults to X-Tenant-ID
+func NewHeaderTenantResolver(header string) *HeaderTenantResolver {
+	if header == "" {
+		header = "X-Tenant-ID"
+	}
+	return &HeaderTenantResolver{Header: header}
+}
+
+// Resolve implements TenantResolver
+func (hr *HeaderTenantResolver) Resolve(c echo.Context) (string, error) {
+	return strings.TrimSpace(c.Request().Header.Get(hr.Header)), nil
+}
+
+// JWTClaimTenantResolver resolves the tenant from a claim in the user metadata.
+// It uses the current user when authentication already ran, otherwise it
+// validates the bearer token itself.
+type JWTClaimTenantResolver struct {
+	authService *AuthService
+	claim       string
+}
+
+// NewJWTClaimTenantResolver creates a resolver reading the given metadata claim
+func NewJWTClaimTenantResolver(authService *AuthService, claim string) *JWTClaimTenantResolver {
+	if claim == "" {
+		claim = "tenant_id"
+	}
+	return &JWTClaimTenantResolver{
+		authService: authService,
+		claim:       claim,
+	}
+}
+
+// Resolve implements TenantResolver
+func (jr *JWTClaimTenantResolver) Resolve(c echo.Context) (string, error) {
+	user, err := GetCurrentUser(c)
+	if err != nil {
+		if jr.authService == nil {
+			return "", nil
+		}
+
+		token, err := jr.authService.ExtractToken(c)
+		if err != nil {
+			return "", nil
+		}
+
+		claims, err := jr.authService.AuthenticateToken(c.Request().Context(), token)
+		if err != nil {
+			return "", err
+		}
+		user = claims.ToAuthUser()
+	}
+
+	tenantID, _ := user.Metadata[jr.claim].(string)
+	return tenantID, nil
+}
+
+// TenantMembershipAuthorizer returns a TenantConfig.Authorize function that
+// requires the tenant to be listed in a claim of the user's metadata. The
+// claim may hold a single tenant ID or a list of them. Like
+// JWTClaimTenantResolver, it validates the bearer token when authentication
+// has not run yet.
+func TenantMembershipAuthorizer(authService *AuthService, claim string) func(c echo.Context, tenantID string) error {
+	if claim == "" {
+		claim = "tenant_id"
+	}
+
+	return func(c echo.Context, tenantID string) error {
+		user, err := GetCurrentUser(c)
+		if err != nil {
+			if authService == nil {
+				return ErrTenantForbidden
+			}
+
+			token, err := authService.ExtractToken(c)
+			if err != nil {
+				return ErrTenantForbidden
+			}
+
+			claims, err := authService.AuthenticateToken(c.Request().Context(), token)
+			if err != nil {
+				return ErrTenantForbidden
+			}
+			user = claims.ToAuthUser()
+		}
+
+		switch value := user.Metadata[claim].(type) {
+		case string:
+			if value == tenantID {
+				return nil
+			}
+		case []interface{}:
+			for _, member := range value {
+				if member == tenantID {
+					return nil
+				}
+			}
+		case []string:
+			if containsString(value, tenantID) {
+				return nil
+			}
+		}
+		return ErrTenantForbidden
+	}
+}
+
+// containsString reports whether a slice contains a string
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// TenantConfig configures tenant resolution
+type TenantConfig struct {
+	// Resolvers are tried in order; the first non-empty tenant wins
+	Resolvers []TenantResolver
+	// Required rejects requests without a tenant
+	Required bool
+	// Validate checks that a resolved tenant exists and is active
+	Validate func(ctx context.Context, tenantID string) error
+	// Authorize checks that the caller may act for the tenant, e.g.
+	// TenantMembershipAuthorizer. Returning ErrTenantForbidden responds 403.
+	Authorize func(c echo.Context, tenantID string) error
+	Skipper   func(c echo.Context) bool
+}
+
+// TenantMiddleware resolves the tenant of each request and stores it on the request context
+func TenantMiddleware(config TenantConfig, logger *logrus.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if config.Skipper != nil && config.Skipper(c) {
+				return next(c)
+			}
+
+			tenantID, err := resolveTenant(c, config.Resolvers)
+			if err != nil {
+				if logger != nil {
+					logger.WithError(err).Warn("Tenant resolution failed")
+				}
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid tenant credentials")
+			}
+
+			if tenantID == "" {
+				if config.Required {
+					return echo.NewHTTPError(http.StatusBadRequest, "Tenant is required")
+				}
+				return next(c)
+			}
+
+			if !ValidTenantID(tenantID) {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid tenant")
+			}
+
+			if config.Validate != nil {
+				if err := config.Validate(c.Request().Context(), tenantID); err != nil {
+					if errors.Is(err, ErrTenantNotFound) {
+						return echo.NewHTTPError(http.StatusNotFound, "Tenant not found")
+					}
+					return err
+				}
+			}
+
+			if config.Authorize != nil {
+				if err := config.Authorize(c, tenantID); err != nil {
+					if errors.Is(err, ErrTenantForbidden) {
+						return echo.NewHTTPError(http.StatusForbidden, "Access to tenant denied")
+					}
+					return err
+				}
+			}
+
+			SetTenant(c, tenantID)
+			return next(c)
+		}
+	}
+}
+
+// resolveTenant runs the resolvers in order
+func resolveTenant(c echo.Context, resolvers []TenantResolver) (string, error) {
+	for _, resolver := range resolvers {
+		tenantID, err := resolver.Resolve(c)
+		if err != nil {
+			return "", err
+		}
+		if tenantID != "" {
+			return tenantID, nil
+		}
+	}
+	return "", nil
+}
+
+// defaultMaxTenantInstances bounds the instances a TenantScopedProvider keeps
+const defaultMaxTenantInstances = 1000
+
+// TenantScopedProvider creates and caches one instance per tenant. Instances
+// are created once per tenant even under concurrent requests, and the least
+// recently used ones are dropped beyond MaxInstances; dropped instances are
+// not closed, since requests may still use them.
+type TenantScopedProvider struct {
+	factory      func(ctx context.Context, tenantID string) (interface{}, error)
+	validate     func(ctx context.Context, tenantID string) error
+	maxInstances int
+	instances    map[string]*list.Element
+	recent       *list.List
+	mutex        sync.Mutex
+}
+
+// tenantInstance is the cached instance of a tenant, or its creation in progress
+type tenantInstance struct {
+	tenantID string
+	value    interface{}
+	err      error
+	done     chan struct{}
+}
+
+// NewTenantScopedProvider creates a tenant-scoped provider
+func NewTenantScopedProvider(factory func(ctx context.Context, tenantID string) (interface{}, error)) *TenantScopedProvider {
+	return &TenantScopedProvider{
+		factory:      factory,
+		maxInstances: defaultMaxTenantInstances,
+		instances:    make(map[string]*list.Element),
+		recent:       list.New(),
+	}
+}
+
+// WithValidator sets a check, e.g. TenantConfig.Validate, that a tenant must
+// pass before an instance is created for it
+func (tp *TenantScopedProvider) WithValidator(validate func(ctx context.Context, tenantID string) error) *TenantScopedProvider {
+	tp.validate = validate
+	return tp
+}
+
+// WithMaxInstances sets how many tenant instances are kept
+func (tp *TenantScopedProvider) WithMaxInstances(maxInstances int) *TenantScopedProvider {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
+	tp.maxInstances = maxInstances
+	tp.evictOverflow()
+	return tp
+}
+
+// Get returns the instance of the context's tenant
+func (tp *TenantScopedProvider) Get(ctx context.Context) (interface{}, error) {
+	tenantID, ok := TenantFromContext(ctx)
+	if !ok {
+		return nil, ErrNoTenant
+	}
+	return tp.ForTenant(ctx, tenantID)
+}
+
+// ForTenant returns the instance of a tenant, creating it on first use.
+// The factory runs outside the provider lock, once per tenant.
+func (tp *TenantScopedProvider) ForTenant(ctx context.Context, tenantID string) (interface{}, error) {
+	if !ValidTenantID(tenantID) {
+		return nil, ErrTenantInvalid
+	}
+
+	tp.mutex.Lock()
+	if element, exists := tp.instances[tenantID]; exists {
+		tp.recent.MoveToFront(element)
+		instance := element.Value.(*tenantInstance)
+		tp.mutex.Unlock()
+
+		select {
+		case <-instance.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		return instance.value, instance.err
+	}
+
+	instance := &tenantInstance{tenantID: tenantID, done: make(chan struct{})}
+	tp.instances[tenantID] = tp.recent.PushFront(instance)
+	tp.evictOverflow()
+	tp.mutex.Unlock()
+
+	instance.value, instance.err = tp.create(ctx, tenantID)
+	if instance.err != nil {
+		tp.mutex.Lock()
+		if element, exists := tp.instances[tenantID]; exists && element.Value == instance {
+			tp.recent.Remove(element)
+			delete(tp.instances, tenantID)
+		}
+		tp.mutex.Unlock()
+	}
+	close(instance.done)
+
+	return instance.value, instance.err
+}
+
+// create validates the tenant and runs the factory
+func (tp *TenantScopedProvider) create(ctx context.Context, tenantID string) (interface{}, error) {
+	if tp.validate != nil {
+		if err := tp.validate(ctx, tenantID); err != nil {
+			return nil, err
+		}
+	}
+	return tp.factory(ctx, tenantID)
+}
+
+// evictOverflow drops the least recently used instances beyond the limit.
+// The mutex must be held.
+func (tp *TenantScopedProvider) evictOverflow() {
+	for tp.maxInstances > 0 && tp.recent.Len() > tp.maxInstances {
+		oldest := tp.recent.Back()
+		tp.recent.Remove(oldest)
+		delete(tp.instances, oldest.Value.(*tenantInstance).tenantID)
+	}
+}
+
+// Evict drops the cached instance of a tenant
+func (tp *TenantScopedProvider) Evict(tenantID string) {
+	tp.mutex.Lock()
+	defer tp.mutex.Unlock()
+
+	if element, exists := tp.instances[tenantID]; exists {
+		tp.recent.Remove(element)
+		delete(tp.instances, tenantID)
+	}
+}
+
+// RegisterTenantScoped registers a service with one instance per tenant
+func (sr *ServiceRegistry) RegisterTenantScoped(name string, factory func(ctx context.Context, tenantID string) (interface{}, error)) {
+	sr.Register(name, NewTenantScopedProvider(factory))
+}
+
+// GetScoped retrieves a service by name, resolving tenant-scoped services for the context's tenant
+func (sr *ServiceRegistry) GetScoped(ctx context.Context, name string) (interface{}, error) {
+	service, exists := sr.Get(name)
+	if !exists {
+		return nil, fmt.Errorf("service '%s' not found", name)
+	}
+
+	if provider, ok := service.(*TenantScopedProvider); ok {
+		return provider.Get(ctx)
+	}
+	return service, nil
+}
+
+// tenantKey prefixes a key with the context's tenant, if any
+func tenantKey(ctx context.Context, key string) string {
+	if tenantID, ok := TenantFromContext(ctx); ok {
+		return tenantPrefix(tenantID) + ":" + key
+	}
+	return key
+}
+
+// tenantPrefix returns the key prefix of a tenant. The ID is length-prefixed,
+// so IDs containing ':' cannot produce the keys of another tenant.
+func tenantPrefix(tenantID string) string {
+	return "tenant:" + strconv.Itoa(len(tenantID)) + ":" + tenantID
+}
@@ -1,17 +1,26 @@
 package gonest
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	jwt "github.com/golang-jwt/jwt/v5"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
@@ -704,3 +713,909 @@ func (th *TestHelper) AssertPanic(fn func(), msgAndArgs ...interface{}) {
 
 	fn()
 }
+
+// MockOIDCProvider is an in-process OpenID Connect provider for testing OIDCStrategy.
+// Its authorization endpoint approves every request immediately.
+type MockOIDCProvider struct {
+	Server       *httptest.Server
+	ClientID     string
+	ClientSecret string
+	// Claims are added to ID tokens and returned by the userinfo endpoint
+	Claims map[string]interface{}
+	// UserinfoClaims override Claims in userinfo responses
+	UserinfoClaims map[string]interface{}
+	keys           *KeyManager
+	codes          map[string]*mockOIDCCode
+	tokens         map[string]bool
+	mutex          sync.Mutex
+}
+
+// mockOIDCCode is an authorization code issued by the mock provider
+type mockOIDCCode struct {
+	redirectURI string
+	nonce       string
+	challenge   string
+}
+
+// NewMockOIDCProvider starts a mock OIDC provider that is closed when the test ends
+func NewMockOIDCProvider(t *testing.T) *MockOIDCProvider {
+	keys, err := NewKeyManager(&KeyManagerConfig{Algorithm: "RS256", OverlapWindow: time.Hour}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create mock OIDC keys: %v", err)
+	}
+
+	provider := &MockOIDCProvider{
+		ClientID:     "gonest-test-client",
+		ClientSecret: "gonest-test-secret",
+		Claims: map[string]interface{}{
+			"sub":                "mock-user",
+			"email":              "mock.user@example.com",
+			"preferred_username": "mock.user",
+			"name":               "Mock User",
+		},
+		keys:   keys,
+		codes:  make(map[string]*mockOIDCCode),
+		tokens: make(map[string]bool),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", provider.handleDiscovery)
+	mux.HandleFunc("/authorize", provider.handleAuthorize)
+	mux.HandleFunc("/token", provider.handleToken)
+	mux.HandleFunc("/userinfo", provider.handleUserinfo)
+	mux.HandleFunc("/jwks", provider.handleJWKS)
+
+	provider.Server = httptest.NewServer(mux)
+	t.Cleanup(provider.Server.Close)
+
+	return provider
+}
+
+// Issuer returns the issuer URL of the provider
+func (mop *MockOIDCProvider) Issuer() string {
+	return mop.Server.URL
+}
+
+// Config returns an OIDCConfig for the provider
+func (mop *MockOIDCProvider) Config(name, redirectURL string) *OIDCConfig {
+	return &OIDCConfig{
+		Name:         name,
+		Issuer:       mop.Issuer(),
+		ClientID:     mop.ClientID,
+		ClientSecret: mop.ClientSecret,
+		RedirectURL:  redirectURL,
+		RoleClaim:    "roles",
+	}
+}
+
+// Authorize follows an authorization URL and returns the callback URL with code and state
+func (mop *MockOIDCProvider) Authorize(authURL string) (string, error) {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(authURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusFound {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("authorization failed with status %d: %s", resp.StatusCode, body)
+	}
+	return resp.Header.Get("Location"), nil
+}
+
+// handleDiscovery serves the discovery document
+func (mop *MockOIDCProvider) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	mop.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                           mop.Issuer(),
+		"authorization_endpoint":           mop.Issuer() + "/authorize",
+		"token_endpoint":                   mop.Issuer() + "/token",
+		"userinfo_endpoint":                mop.Issuer() + "/userinfo",
+		"jwks_uri":                         mop.Issuer() + "/jwks",
+		"response_types_supported":         []string{"code"},
+		"code_challenge_methods_supported": []string{"S256"},
+	})
+}
+
+// handleAuthorize approves the authorization request and redirects with a code
+func (mop *MockOIDCProvider) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if query.Get("client_id") != mop.ClientID || query.Get("response_type") != "code" ||
+		query.Get("code_challenge_method") != "S256" || query.Get("state") == "" {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+
+	code := randomURLString(16)
+	mop.mutex.Lock()
+	mop.codes[code] = &mockOIDCCode{
+		redirectURI: query.Get("redirect_uri"),
+		nonce:       query.Get("nonce"),
+		challenge:   query.Get("code_challenge"),
+	}
+	mop.mutex.Unlock()
+
+	callback, err := url.Parse(query.Get("redirect_uri"))
+	if err != nil {
+		http.Error(w, "invalid_request", http.StatusBadRequest)
+		return
+	}
+	params := callback.Query()
+	params.Set("code", code)
+	params.Set("state", query.Get("state"))
+	callback.RawQuery = params.Encode()
+
+	http.Redirect(w, r, callback.String(), http.StatusFound)
+}
+
+// handleToken exchanges an authorization code after checking the PKCE verifier
+func (mop *MockOIDCProvider) handleToken(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil || r.PostForm.Get("grant_type") != "authorization_code" {
+		mop.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_request"})
+		return
+	}
+
+	clientID, clientSecret, ok := r.BasicAuth()
+	if ok {
+		clientID, _ = url.QueryUnescape(clientID)
+		clientSecret, _ = url.QueryUnescape(clientSecret)
+	}
+	if clientID != mop.ClientID || clientSecret != mop.ClientSecret {
+		mop.writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	mop.mutex.Lock()
+	code, exists := mop.codes[r.PostForm.Get("code")]
+	delete(mop.codes, r.PostForm.Get("code"))
+	mop.mutex.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostForm.Get("code_verifier")))
+	if !exists || code.redirectURI != r.PostForm.Get("redirect_uri") ||
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != code.challenge {
+		mop.writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	for key, value := range mop.Claims {
+		claims[key] = value
+	}
+	claims["iss"] = mop.Issuer()
+	claims["aud"] = mop.ClientID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(5 * time.Minute).Unix()
+	if code.nonce != "" {
+		claims["nonce"] = code.nonce
+	}
+
+	key := mop.keys.ActiveKey()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	token.Header["kid"] = key.ID
+	idToken, err := token.SignedString(key.PrivateKey)
+	if err != nil {
+		mop.writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "server_error"})
+		return
+	}
+
+	accessToken := randomURLString(16)
+	mop.mutex.Lock()
+	mop.tokens[accessToken] = true
+	mop.mutex.Unlock()
+
+	mop.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"access_token": accessToken,
+		"id_token":     idToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+	})
+}
+
+// handleUserinfo returns the configured claims
+func (mop *MockOIDCProvider) handleUserinfo(w http.ResponseWriter, r *http.Request) {
+	accessToken := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	mop.mutex.Lock()
+	valid := mop.tokens[accessToken]
+	mop.mutex.Unlock()
+
+	if !valid {
+		mop.writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token"})
+		return
+	}
+
+	claims := make(map[string]interface{}, len(mop.Claims))
+	for key, value := range mop.Claims {
+		claims[key] = value
+	}
+	for key, value := range mop.UserinfoClaims {
+		claims[key] = value
+	}
+	mop.writeJSON(w, http.StatusOK, claims)
+}
+
+// handleJWKS serves the signing keys
+func (mop *MockOIDCProvider) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	mop.writeJSON(w, http.StatusOK, mop.keys.JWKS())
+}
+
+// writeJSON writes a JSON response
+func (mop *MockOIDCProvider) writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// MockRedisServer is an in-process server speaking the Redis protocol (RESP),
+// for testing Redis-backed providers without a real Redis. It supports the
+// string, key, SCAN and pub/sub commands used by gonest. Lua scripts cannot
+// be run; instead EVAL and EVALSHA run Go emulations registered for the
+// script source, which the scripts of gonest have by default.
+type MockRedisServer struct {
+	password string
+	listener net.Listener
+	data     map[string]*mockRedisEntry
+	cursors  map[int]string
+	scripts  map[string]MockRedisScript
+	loaded   map[string]bool
+	channels map[string]map[*mockRedisClient]struct{}
+	conns    map[net.Conn]struct{}
+	closed   bool
+	mutex    sync.Mutex
+	wg       sync.WaitGroup
+}
+
+// mockRedisClient is a connection of the mock Redis server. Writes are
+// locked because published messages are written from other connections.
+type mockRedisClient struct {
+	writer *bufio.Writer
+	mutex  sync.Mutex
+}
+
+// send writes a reply, flushing unless more pipelined requests are buffered
+func (mrc *mockRedisClient) send(reply interface{}, flush bool) error {
+	mrc.mutex.Lock()
+	defer mrc.mutex.Unlock()
+
+	writeMockRedisReply(mrc.writer, reply)
+	if !flush {
+		return nil
+	}
+	return mrc.writer.Flush()
+}
+
+// MockRedisScript emulates a Lua script. It runs atomically and calls
+// commands through call, like redis.call in Lua.
+type MockRedisScript func(call func(args ...string) interface{}, keys []string, args [][]byte) interface{}
+
+// mockRedisEntry is a value stored by the mock Redis server
+type mockRedisEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+// NewMockRedisServer starts a mock Redis server that is closed when the test ends
+func NewMockRedisServer(t *testing.T) *MockRedisServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to start mock Redis server: %v", err)
+	}
+
+	server := &MockRedisServer{
+		listener: listener,
+		data:     make(map[string]*mockRedisEntry),
+		cursors:  make(map[int]string),
+		scripts:  make(map[string]MockRedisScript),
+		loaded:   make(map[string]bool),
+		channels: make(map[string]map[*mockRedisClient]struct{}),
+		conns:    make(map[net.Conn]struct{}),
+	}
+	server.RegisterScript(redisRateLimitScript.source, mockRedisRateLimitScript)
+
+	server.wg.Add(1)
+	go server.serve()
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+// Addr returns the address the server listens on
+func (mrs *MockRedisServer) Addr() string {
+	return mrs.listener.Addr().String()
+}
+
+// Client returns a client connected to the server
+func (mrs *MockRedisServer) Client() *RedisClient {
+	mrs.mutex.Lock()
+	defer mrs.mutex.Unlock()
+
+	config := DefaultRedisConfig()
+	config.Addr = mrs.Addr()
+	config.Password = mrs.password
+	return NewRedisClient(config)
+}
+
+// RegisterScript registers the emulation run for a Lua script source
+func (mrs *MockRedisServer) RegisterScript(source string, script MockRedisScript) {
+	mrs.mutex.Lock()
+	defer mrs.mutex.Unlock()
+
+	mrs.scripts[NewRedisScript(source).Hash()] = script
+}
+
+// RequirePass makes new connections authenticate with a password
+func (mrs *MockRedisServer) RequirePass(password string) {
+	mrs.mutex.Lock()
+	defer mrs.mutex.Unlock()
+
+	mrs.password = password
+}
+
+// Len returns the number of live keys
+func (mrs *MockRedisServer) Len() int {
+	mrs.mutex.Lock()
+	defer mrs.mutex.Unlock()
+
+	count := 0
+	for key := range mrs.data {
+		if mrs.lookup(key) != nil {
+			count++
+		}
+	}
+	return count
+}
+
+// Close stops the server and closes all client connections
+func (mrs *MockRedisServer) Close() {
+	mrs.mutex.Lock()
+	if mrs.closed {
+		mrs.mutex.Unlock()
+		return
+	}
+	mrs.closed = true
+	mrs.listener.Close()
+	for conn := range mrs.conns {
+		conn.Close()
+	}
+	mrs.mutex.Unlock()
+
+	mrs.wg.Wait()
+}
+
+// serve accepts connections until the server is closed
+func (mrs *MockRedisServer) serve() {
+	defer mrs.wg.Done()
+
+	for {
+		conn, err := mrs.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		mrs.mutex.Lock()
+		if mrs.closed {
+			mrs.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		mrs.conns[conn] = struct{}{}
+		mrs.mutex.Unlock()
+
+		mrs.wg.Add(1)
+		go mrs.handle(conn)
+	}
+}
+
+// handle executes the commands of a connection
+func (mrs *MockRedisServer) handle(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	client := &mockRedisClient{writer: bufio.NewWriter(conn)}
+
+	defer mrs.wg.Done()
+	defer func() {
+		mrs.mutex.Lock()
+		delete(mrs.conns, conn)
+		for _, subscribers := range mrs.channels {
+			delete(subscribers, client)
+		}
+		mrs.mutex.Unlock()
+		conn.Close()
+	}()
+
+	mrs.mutex.Lock()
+	password := mrs.password
+	mrs.mutex.Unlock()
+	authenticated := password == ""
+
+	for {
+		request, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+
+		parts, ok := request.([]interface{})
+		if !ok || len(parts) == 0 {
+			client.send(RedisError("ERR protocol error"), true)
+			return
+		}
+
+		args := make([][]byte, len(parts))
+		for i, part := range parts {
+			args[i], _ = redisBytes(part)
+		}
+
+		var reply interface{}
+		command := strings.ToUpper(string(args[0]))
+		switch {
+		case command == "AUTH":
+			if len(args) == 2 && string(args[1]) == password {
+				authenticated = true
+				reply = "OK"
+			} else {
+				reply = RedisError("WRONGPASS invalid password")
+			}
+		case !authenticated:
+			reply = RedisError("NOAUTH Authentication required.")
+		case command == "SUBSCRIBE":
+			reply = mrs.subscribe(client, args[1:])
+		case command == "PUBLISH":
+			reply = mrs.publish(args[1:])
+		default:
+			mrs.mutex.Lock()
+			reply = mrs.exec(command, args[1:])
+			mrs.mutex.Unlock()
+		}
+
+		if err := client.send(reply, reader.Buffered() == 0); err != nil {
+			return
+		}
+	}
+}
+
+// subscribe subscribes a connection to channels. The confirmations of all
+// but the last channel are written directly; the last is returned.
+func (mrs *MockRedisServer) subscribe(client *mockRedisClient, channels [][]byte) interface{} {
+	if len(channels) == 0 {
+		return RedisError("ERR wrong number of arguments for 'subscribe' command")
+	}
+
+	mrs.mutex.Lock()
+	defer mrs.mutex.Unlock()
+
+	var reply interface{}
+	for i, channel := range channels {
+		subscribers, exists := mrs.channels[string(channel)]
+		if !exists {
+			subscribers = make(map[*mockRedisClient]struct{})
+			mrs.channels[string(channel)] = subscribers
+		}
+		subscribers[client] = struct{}{}
+
+		reply = []interface{}{[]byte("subscribe"), channel, int64(i + 1)}
+		if i < len(channels)-1 {
+			client.send(reply, false)
+		}
+	}
+	return reply
+}
+
+// publish delivers a message to the subscribers of a channel
+func (mrs *MockRedisServer) publish(args [][]byte) interface{} {
+	if len(args) != 2 {
+		return RedisError("ERR wrong number of arguments for 'publish' command")
+	}
+
+	mrs.mutex.Lock()
+	subscribers := make([]*mockRedisClient, 0, len(mrs.channels[string(args[0])]))
+	for subscriber := range mrs.channels[string(args[0])] {
+		subscribers = append(subscribers, subscriber)
+	}
+	mrs.mutex.Unlock()
+
+	message := []interface{}{[]byte("message"), args[0], args[1]}
+	for _, subscriber := range subscribers {
+		subscriber.send(message, true)
+	}
+	return int64(len(subscribers))
+}
+
+// lookup returns a live entry, dropping it if expired. The mutex must be held.
+func (mrs *MockRedisServer) lookup(key string) *mockRedisEntry {
+	entry, exists := mrs.data[key]
+	if !exists {
+		return nil
+	}
+	if !entry.expiresAt.IsZero() && !time.Now().Before(entry.expiresAt) {
+		delete(mrs.data, key)
+		return nil
+	}
+	return entry
+}
+
+// exec executes a command. The mutex must be held.
+func (mrs *MockRedisServer) exec(command string, args [][]byte) interface{} {
+	wrongArgs := RedisError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+
+	switch command {
+	case "PING":
+		return "PONG"
+	case "TIME":
+		now := time.Now()
+		return []interface{}{
+			[]byte(strconv.FormatInt(now.Unix(), 10)),
+			[]byte(strconv.FormatInt(int64(now.Nanosecond()/1000), 10)),
+		}
+	case "SELECT":
+		return "OK"
+	case "GET":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		if entry := mrs.lookup(string(args[0])); entry != nil {
+			return entry.value
+		}
+		return nil
+	case "MGET":
+		values := make([]interface{}, len(args))
+		for i, key := range args {
+			if entry := mrs.lookup(string(key)); entry != nil {
+				values[i] = entry.value
+			}
+		}
+		return values
+	case "SET":
+		return mrs.execSet(args)
+	case "DEL", "UNLINK":
+		var count int64
+		for _, key := range args {
+			if mrs.lookup(string(key)) != nil {
+				delete(mrs.data, string(key))
+				count++
+			}
+		}
+		return count
+	case "EXISTS":
+		var count int64
+		for _, key := range args {
+			if mrs.lookup(string(key)) != nil {
+				count++
+			}
+		}
+		return count
+	case "INCR", "INCRBY":
+		if len(args) < 1 {
+			return wrongArgs
+		}
+		delta := int64(1)
+		if command == "INCRBY" {
+			if len(args) != 2 {
+				return wrongArgs
+			}
+			var err error
+			if delta, err = strconv.ParseInt(string(args[1]), 10, 64); err != nil {
+				return RedisError("ERR value is not an integer or out of range")
+			}
+		}
+		entry := mrs.lookup(string(args[0]))
+		if entry == nil {
+			entry = &mockRedisEntry{value: []byte("0")}
+			mrs.data[string(args[0])] = entry
+		}
+		current, err := strconv.ParseInt(string(entry.value), 10, 64)
+		if err != nil {
+			return RedisError("ERR value is not an integer or out of range")
+		}
+		current += delta
+		entry.value = []byte(strconv.FormatInt(current, 10))
+		return current
+	case "PEXPIRE", "EXPIRE":
+		if len(args) != 2 {
+			return wrongArgs
+		}
+		amount, err := strconv.ParseInt(string(args[1]), 10, 64)
+		if err != nil {
+			return RedisError("ERR value is not an integer or out of range")
+		}
+		entry := mrs.lookup(string(args[0]))
+		if entry == nil {
+			return int64(0)
+		}
+		unit := time.Millisecond
+		if command == "EXPIRE" {
+			unit = time.Second
+		}
+		entry.expiresAt = time.Now().Add(time.Duration(amount) * unit)
+		return int64(1)
+	case "PTTL", "TTL":
+		if len(args) != 1 {
+			return wrongArgs
+		}
+		entry := mrs.lookup(string(args[0]))
+		switch {
+		case entry == nil:
+			return int64(-2)
+		case entry.expiresAt.IsZero():
+			return int64(-1)
+		case command == "TTL":
+			return int64(time.Until(entry.expiresAt).Round(time.Second) / time.Second)
+		}
+		return time.Until(entry.expiresAt).Milliseconds()
+	case "SCAN":
+		return mrs.execScan(args)
+	case "FLUSHDB", "FLUSHALL":
+		mrs.data = make(map[string]*mockRedisEntry)
+		return "OK"
+	case "EVAL", "EVALSHA":
+		return mrs.execEval(command, args)
+	case "SCRIPT":
+		return mrs.execScript(args)
+	}
+
+	return RedisError(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(command)))
+}
+
+// execSet executes SET key value [EX seconds|PX milliseconds] [NX|XX]
+func (mrs *MockRedisServer) execSet(args [][]byte) interface{} {
+	if len(args) < 2 {
+		return RedisError("ERR wrong number of arguments for 'set' command")
+	}
+
+	key := string(args[0])
+	entry := &mockRedisEntry{value: append([]byte{}, args[1]...)}
+	onlyIfMissing, onlyIfExists := false, false
+
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(string(args[i])); option {
+		case "EX", "PX":
+			if i+1 >= len(args) {
+				return RedisError("ERR syntax error")
+			}
+			amount, err := strconv.ParseInt(string(args[i+1]), 10, 64)
+			if err != nil || amount <= 0 {
+				return RedisError("ERR invalid expire time in 'set' command")
+			}
+			unit := time.Millisecond
+			if option == "EX" {
+				unit = time.Second
+			}
+			entry.expiresAt = time.Now().Add(time.Duration(amount) * unit)
+			i++
+		case "NX":
+			onlyIfMissing = true
+		case "XX":
+			onlyIfExists = true
+		default:
+			return RedisError("ERR syntax error")
+		}
+	}
+
+	exists := mrs.lookup(key) != nil
+	if (onlyIfMissing && exists) || (onlyIfExists && !exists) {
+		return nil
+	}
+
+	mrs.data[key] = entry
+	return "OK"
+}
+
+// execEval executes EVAL script numkeys [key ...] [arg ...] and EVALSHA sha1 numkeys ...
+func (mrs *MockRedisServer) execEval(command string, args [][]byte) interface{} {
+	if len(args) < 2 {
+		return RedisError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+	}
+
+	hash := string(args[0])
+	if command == "EVAL" {
+		hash = NewRedisScript(hash).Hash()
+	} else if !mrs.loaded[hash] {
+		return RedisError("NOSCRIPT No matching script. Please use EVAL.")
+	}
+
+	script, exists := mrs.scripts[hash]
+	if !exists {
+		return RedisError("ERR mock Redis has no emulation registered for script " + hash)
+	}
+	mrs.loaded[hash] = true
+
+	numKeys, err := strconv.Atoi(string(args[1]))
+	if err != nil || numKeys < 0 || numKeys > len(args)-2 {
+		return RedisError("ERR Number of keys can't be greater than number of args")
+	}
+	keys := make([]string, numKeys)
+	for i := range keys {
+		keys[i] = string(args[2+i])
+	}
+
+	call := func(callArgs ...string) interface{} {
+		commandArgs := make([][]byte, len(callArgs)-1)
+		for i, arg := range callArgs[1:] {
+			commandArgs[i] = []byte(arg)
+		}
+		return mrs.exec(strings.ToUpper(callArgs[0]), commandArgs)
+	}
+	return script(call, keys, args[2+numKeys:])
+}
+
+// execScript executes SCRIPT LOAD, EXISTS and FLUSH
+func (mrs *MockRedisServer) execScript(args [][]byte) interface{} {
+	if len(args) < 1 {
+		return RedisError("ERR wrong number of arguments for 'script' command")
+	}
+
+	switch strings.ToUpper(string(args[0])) {
+	case "LOAD":
+		if len(args) != 2 {
+			return RedisError("ERR wrong number of arguments for 'script|load' command")
+		}
+		hash := NewRedisScript(string(args[1])).Hash()
+		if _, exists := mrs.scripts[hash]; !exists {
+			return RedisError("ERR mock Redis has no emulation registered for script " + hash)
+		}
+		mrs.loaded[hash] = true
+		return []byte(hash)
+	case "EXISTS":
+		exists := make([]interface{}, len(args)-1)
+		for i, hash := range args[1:] {
+			exists[i] = int64(0)
+			if mrs.loaded[string(hash)] {
+				exists[i] = int64(1)
+			}
+		}
+		return exists
+	case "FLUSH":
+		mrs.loaded = make(map[string]bool)
+		return "OK"
+	}
+	return RedisError("ERR unknown subcommand '" + string(args[0]) + "'")
+}
+
+// mockRedisRateLimitScript emulates redisRateLimitScript with evaluateRateLimit.
+// Tests run the script itself against this emulation to keep them in step.
+func mockRedisRateLimitScript(call func(args ...string) interface{}, keys []string, args [][]byte) interface{} {
+	if len(keys) != 1 || len(args) != 5 {
+		return RedisError("ERR invalid rate limit script arguments")
+	}
+	limit, err := strconv.ParseInt(string(args[1]), 10, 64)
+	if err != nil {
+		return RedisError("ERR invalid limit")
+	}
+	window, err := strconv.ParseInt(string(args[2]), 10, 64)
+	if err != nil {
+		return RedisError("ERR invalid window")
+	}
+	cost, err := strconv.ParseInt(string(args[3]), 10, 64)
+	if err != nil {
+		return RedisError("ERR invalid cost")
+	}
+
+	// The server clock is read like the script does
+	clock, ok := call("TIME").([]interface{})
+	if !ok || len(clock) != 2 {
+		return RedisError("ERR invalid TIME reply")
+	}
+	seconds, _ := strconv.ParseInt(string(clock[0].([]byte)), 10, 64)
+	micros, _ := strconv.ParseInt(string(clock[1].([]byte)), 10, 64)
+	now := time.UnixMilli(seconds*1000 + micros/1000)
+
+	var entry *RateLimitEntry
+	if value, ok := call("GET", keys[0]).([]byte); ok {
+		var state redisRateLimitState
+		if err := json.Unmarshal(value, &state); err == nil && state.ExpiresAt > now.UnixMilli() {
+			entry = state.entry()
+		}
+	}
+
+	result, next := evaluateRateLimit(entry, RateLimitRule{
+		Strategy: RateLimitStrategy(args[0]),
+		Limit:    limit,
+		Window:   time.Duration(window) * time.Millisecond,
+		Cost:     cost,
+	}, now)
+
+	encoded, err := json.Marshal(newRedisRateLimitState(next))
+	if err != nil {
+		return RedisError("ERR " + err.Error())
+	}
+	ttl := max(1, next.ExpiresAt.UnixMilli()-now.UnixMilli())
+	if string(args[4]) != "1" {
+		call("SET", keys[0], string(encoded), "PX", strconv.FormatInt(ttl, 10))
+	}
+
+	allowed := int64(0)
+	if result.Allowed {
+		allowed = 1
+	}
+	return []interface{}{allowed, result.Remaining, result.ResetAt.UnixMilli(), result.RetryAfter.Milliseconds(), encoded}
+}
+
+// execScan executes SCAN cursor [MATCH pattern] [COUNT count]. Cursors
+// remember the last key returned, so keys deleted during a scan do not
+// cause others to be skipped.
+func (mrs *MockRedisServer) execScan(args [][]byte) interface{} {
+	if len(args) < 1 {
+		return RedisError("ERR wrong number of arguments for 'scan' command")
+	}
+
+	cursor, err := strconv.Atoi(string(args[0]))
+	if err != nil || cursor < 0 {
+		return RedisError("ERR invalid cursor")
+	}
+
+	pattern, count := "*", 10
+	for i := 1; i+1 < len(args); i += 2 {
+		switch strings.ToUpper(string(args[i])) {
+		case "MATCH":
+			pattern = string(args[i+1])
+		case "COUNT":
+			if count, err = strconv.Atoi(string(args[i+1])); err != nil || count <= 0 {
+				return RedisError("ERR syntax error")
+			}
+		default:
+			return RedisError("ERR syntax error")
+		}
+	}
+
+	after, resumed := mrs.cursors[cursor]
+	if cursor != 0 && !resumed {
+		return RedisError("ERR invalid cursor")
+	}
+	delete(mrs.cursors, cursor)
+
+	keys := make([]string, 0, len(mrs.data))
+	for key := range mrs.data {
+		if !resumed || key > after {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var matched []interface{}
+	visited := 0
+	for ; visited < len(keys) && visited < count; visited++ {
+		if matchGlob(pattern, keys[visited]) && mrs.lookup(keys[visited]) != nil {
+			matched = append(matched, []byte(keys[visited]))
+		}
+	}
+
+	next := 0
+	if visited < len(keys) {
+		next = len(mrs.cursors) + 1
+		for mrs.cursors[next] != "" {
+			next++
+		}
+		mrs.cursors[next] = keys[visited-1]
+	}
+
+	return []interface{}{[]byte(strconv.Itoa(next)), matched}
+}
+
+// writeMockRedisReply encodes a reply in RESP
+func writeMockRedisReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		w.WriteString("+" + v + "\r\n")
+	case RedisError:
+		w.WriteString("-" + string(v) + "\r\n")
+	case int64:
+		w.WriteString(":" + strconv.FormatInt(v, 10) + "\r\n")
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n", len(v))
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeMockRedisReply(w, item)
+		}
+	default:
+		w.WriteString("-ERR unsupported reply type\r\n")
+	}
+}
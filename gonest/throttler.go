@@ -0,0 +1,409 @@
+package gonest
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// A Throttler applies several named rate limits, e.g. a short burst limit
+// and a long daily quota, to every route with one middleware. Limits are
+// counted per client across routes. Controllers and routes override
+// profiles with Throttle, which counts them per route, and opt out with
+// SkipThrottle metadata.
+
+// ThrottlerProfile is a named rate limit
+type ThrottlerProfile struct {
+	Name     string
+	Limit    int64
+	Window   time.Duration
+	Strategy RateLimitStrategy
+	// KeyGenerator identifies the client, defaulting to the throttler's
+	KeyGenerator func(echo.Context) string
+	// PerRoute counts the limit separately on each route; profiles
+	// overridden with Throttle always are
+	PerRoute bool
+}
+
+// ThrottlerConfig configures a Throttler
+type ThrottlerConfig struct {
+	Profiles []ThrottlerProfile
+	// Strategy is used by profiles without one. ConcurrencyStrategy is not
+	// supported; checks of such profiles fail with ErrRateLimitStrategyUnsupported.
+	Strategy       RateLimitStrategy
+	KeyGenerator   func(echo.Context) string
+	ErrorMessage   string
+	Headers        bool
+	SkipFunc       func(echo.Context) bool
+	OnLimitReached func(echo.Context) error
+	Store          RateLimitStore
+	FallbackStore  RateLimitStore
+	// CostFunc computes the cost of a request; RateLimitCost metadata of
+	// the route takes precedence
+	CostFunc func(echo.Context) int64
+}
+
+// DefaultThrottlerConfig returns a throttler configuration with short, medium and long profiles
+func DefaultThrottlerConfig() *ThrottlerConfig {
+	return &ThrottlerConfig{
+		Profiles: []ThrottlerProfile{
+			{Name: "short", Limit: 10, Window: time.Second},
+			{Name: "medium", Limit: 100, Window: time.Minute},
+			{Name: "long", Limit: 10000, Window: 24 * time.Hour},
+		},
+		Strategy:     FixedWindowStrategy,
+		KeyGenerator: IPKeyGenerator,
+		ErrorMessage: "Too many requests",
+		Headers:      true,
+	}
+}
+
+// Throttler enforces named rate limit profiles on all routes
+type Throttler struct {
+	config  *ThrottlerConfig
+	logger  *logrus.Logger
+	backend *rateLimitBackend
+}
+
+// NewThrottler creates a throttler
+func NewThrottler(config *ThrottlerConfig, logger *logrus.Logger) *Throttler {
+	if config == nil {
+		config = DefaultThrottlerConfig()
+	}
+	if config.Strategy == "" {
+		config.Strategy = FixedWindowStrategy
+	}
+	if config.KeyGenerator == nil {
+		config.KeyGenerator = IPKeyGenerator
+	}
+	if config.ErrorMessage == "" {
+		config.ErrorMessage = "Too many requests"
+	}
+	if config.Store == nil {
+		config.Store = NewMemoryRateLimitStore()
+	}
+
+	return &Throttler{
+		config:  config,
+		logger:  logger,
+		backend: newRateLimitBackend(config.Store, config.FallbackStore, logger),
+	}
+}
+
+// MetadataKeyThrottle is the metadata key for profile overrides of a controller or route
+const MetadataKeyThrottle = "throttle"
+
+// MetadataKeySkipThrottle is the metadata key for profiles skipped by a controller or route
+const MetadataKeySkipThrottle = "skip_throttle"
+
+// Throttle overrides profiles for a controller or route. Zero fields keep
+// the configured values; overrides of profiles a throttler does not have are
+// ignored by it, so several throttlers on a route never apply each other's
+// profiles. Route overrides are applied after controller overrides.
+func Throttle(profiles ...ThrottlerProfile) MetadataEntry {
+	return SetMetadata(MetadataKeyThrottle, profiles)
+}
+
+// SkipThrottle skips the named profiles for a controller or route, or all profiles if none are named
+func SkipThrottle(names ...string) MetadataEntry {
+	return SetMetadata(MetadataKeySkipThrottle, names)
+}
+
+// Middleware returns middleware applying the profiles to every request
+func (t *Throttler) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if t.config.SkipFunc != nil && t.config.SkipFunc(c) {
+				return next(c)
+			}
+
+			if !t.allow(c) {
+				if t.config.OnLimitReached != nil {
+					return t.config.OnLimitReached(c)
+				}
+				return echo.NewHTTPError(http.StatusTooManyRequests, t.config.ErrorMessage)
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// CanActivate lets a throttler be used as a guard
+func (t *Throttler) CanActivate(ctx echo.Context) (bool, error) {
+	if t.config.SkipFunc != nil && t.config.SkipFunc(ctx) {
+		return true, nil
+	}
+	if !t.allow(ctx) {
+		return false, echo.NewHTTPError(http.StatusTooManyRequests, t.config.ErrorMessage)
+	}
+	return true, nil
+}
+
+// allow checks the profiles of the current route. The request is only
+// recorded once no profile would reject it, so a request rejected by one
+// profile does not use up the others.
+func (t *Throttler) allow(c echo.Context) bool {
+	ctx := c.Request().Context()
+	profiles := t.routeProfiles(c)
+	keys := make([]string, len(profiles))
+	rules := make([]RateLimitRule, len(profiles))
+	cost := requestCost(c, 1, t.config.CostFunc)
+	for i, profile := range profiles {
+		keys[i] = t.profileKey(c, profile)
+		rules[i] = RateLimitRule{
+			Strategy: profile.Strategy,
+			Limit:    profile.Limit,
+			Window:   profile.Window,
+			Cost:     cost,
+		}
+	}
+
+	var closest *RateLimitResult
+	var policies []string
+	defer func() {
+		if t.config.Headers && closest != nil {
+			setStandardRateLimitHeaders(c, closest, policies...)
+		}
+	}()
+
+	// report records the result of a profile for the headers
+	report := func(profile ThrottlerProfile, result *RateLimitResult) {
+		if t.config.Headers {
+			suffix := ""
+			if profile.Name != "default" {
+				suffix = "-" + profile.Name
+			}
+			setRateLimitHeaders(c, result, suffix)
+		}
+
+		// The standard headers describe the profile closest to its limit
+		policies = append(policies, rateLimitPolicy(profile.Limit, profile.Window))
+		if closest == nil || !result.Allowed || result.Remaining < closest.Remaining {
+			closest = result
+		}
+	}
+
+	for i, profile := range profiles {
+		result, err := t.backend.peek(ctx, keys[i], rules[i])
+		if err == nil && result != nil && !result.Allowed {
+			report(profile, result)
+			return false
+		}
+	}
+
+	for i, profile := range profiles {
+		result, err := t.backend.check(ctx, keys[i], rules[i])
+		if err != nil {
+			if t.logger != nil {
+				t.logger.WithError(err).WithField("profile", profile.Name).Error("Rate limit check failed")
+			}
+			continue
+		}
+
+		report(profile, result)
+		if !result.Allowed {
+			return false
+		}
+	}
+	return true
+}
+
+// profileKey returns the store key of a profile for the current client
+func (t *Throttler) profileKey(c echo.Context, profile ThrottlerProfile) string {
+	keyGenerator := profile.KeyGenerator
+	if keyGenerator == nil {
+		keyGenerator = t.config.KeyGenerator
+	}
+
+	if profile.PerRoute {
+		return "throttle:route:" + profile.Name + ":" + rateLimitRoute(c) + ":" + keyGenerator(c)
+	}
+	return "throttle:global:" + profile.Name + ":" + keyGenerator(c)
+}
+
+// routeProfiles returns the configured profiles with the overrides and skips of the current route applied
+func (t *Throttler) routeProfiles(c echo.Context) []ThrottlerProfile {
+	profiles := append([]ThrottlerProfile(nil), t.config.Profiles...)
+	for _, lookup := range []func(echo.Context, string) (interface{}, bool){GetControllerMetadata, GetHandlerMetadata} {
+		if value, ok := lookup(c, MetadataKeyThrottle); ok {
+			overrides, _ := value.([]ThrottlerProfile)
+			profiles = overrideProfiles(profiles, overrides)
+		}
+	}
+
+	if value, ok := GetMetadata(c, MetadataKeySkipThrottle); ok {
+		skipped, _ := value.([]string)
+		if len(skipped) == 0 {
+			return nil
+		}
+
+		kept := profiles[:0]
+		for _, profile := range profiles {
+			if !containsString(skipped, profile.Name) {
+				kept = append(kept, profile)
+			}
+		}
+		profiles = kept
+	}
+
+	for i := range profiles {
+		if profiles[i].Strategy == "" {
+			profiles[i].Strategy = t.config.Strategy
+		}
+	}
+	return profiles
+}
+
+// overrideProfiles merges overrides into profiles by name, ignoring
+// overrides of unknown profiles
+func overrideProfiles(profiles, overrides []ThrottlerProfile) []ThrottlerProfile {
+	for _, override := range overrides {
+		for i := range profiles {
+			if profiles[i].Name != override.Name {
+				continue
+			}
+			profiles[i].PerRoute = true
+
+			if override.Limit > 0 {
+				profiles[i].Limit = override.Limit
+			}
+			if override.Window > 0 {
+				profiles[i].Window = override.Window
+			}
+			if override.Strategy != "" {
+				profiles[i].Strategy = override.Strategy
+			}
+			if override.KeyGenerator != nil {
+				profiles[i].KeyGenerator = override.KeyGenerator
+			}
+		}
+	}
+	return profiles
+}
+
+// throttlerWindowUnits maps window units to durations
+var throttlerWindowUnits = map[string]time.Duration{
+	"ms": time.Millisecond,
+	"s":  time.Second, "sec": time.Second, "second": time.Second, "seconds": time.Second,
+	"m": time.Minute, "min": time.Minute, "minute": time.Minute, "minutes": time.Minute,
+	"h": time.Hour, "hour": time.Hour, "hours": time.Hour,
+	"d": 24 * time.Hour, "day": 24 * time.Hour, "days": 24 * time.Hour,
+	"w": 7 * 24 * time.Hour, "week": 7 * 24 * time.Hour, "weeks": 7 * 24 * time.Hour,
+}
+
+// ParseThrottlerProfile parses a profile written as limit/window, e.g.
+// 10/s, 100/min, 10k/day or 500/15m
+func ParseThrottlerProfile(name, spec string) (ThrottlerProfile, error) {
+	count, period, ok := strings.Cut(strings.TrimSpace(spec), "/")
+	if !ok {
+		return ThrottlerProfile{}, fmt.Errorf("invalid throttler profile %q: expected limit/window", spec)
+	}
+
+	limit, err := parseThrottlerLimit(count)
+	if err != nil {
+		return ThrottlerProfile{}, fmt.Errorf("invalid throttler profile %q: %w", spec, err)
+	}
+	window, err := parseThrottlerWindow(period)
+	if err != nil {
+		return ThrottlerProfile{}, fmt.Errorf("invalid throttler profile %q: %w", spec, err)
+	}
+
+	return ThrottlerProfile{Name: name, Limit: limit, Window: window}, nil
+}
+
+// parseThrottlerLimit parses a request count with an optional k or M suffix
+func parseThrottlerLimit(value string) (int64, error) {
+	value = strings.TrimSpace(value)
+	multiplier := 1.0
+	switch {
+	case strings.HasSuffix(value, "k"), strings.HasSuffix(value, "K"):
+		multiplier, value = 1e3, value[:len(value)-1]
+	case strings.HasSuffix(value, "M"):
+		multiplier, value = 1e6, value[:len(value)-1]
+	}
+
+	count, err := strconv.ParseFloat(value, 64)
+	limit := int64(count * multiplier)
+	if err != nil || limit <= 0 || float64(limit) != count*multiplier {
+		return 0, fmt.Errorf("invalid limit %q", value)
+	}
+	return limit, nil
+}
+
+// parseThrottlerWindow parses a window such as s, min, 15m or 1h30m
+func parseThrottlerWindow(value string) (time.Duration, error) {
+	value = strings.TrimSpace(value)
+	digits := strings.IndexFunc(value, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if digits >= 0 {
+		if unit, exists := throttlerWindowUnits[strings.ToLower(value[digits:])]; exists {
+			amount := 1.0
+			if digits > 0 {
+				var err error
+				if amount, err = strconv.ParseFloat(value[:digits], 64); err != nil {
+					return 0, fmt.Errorf("invalid window %q", value)
+				}
+			}
+			if window := time.Duration(amount * float64(unit)); window > 0 {
+				return window, nil
+			}
+			return 0, fmt.Errorf("invalid window %q", value)
+		}
+	}
+
+	window, err := time.ParseDuration(value)
+	if err != nil || window <= 0 {
+		return 0, fmt.Errorf("invalid window %q", value)
+	}
+	return window, nil
+}
+
+// LoadThrottlerProfiles reads profiles from a configuration section mapping
+// names to limit/window strings, or to maps with limit, window and strategy
+// fields. Profiles are ordered by window, shortest first.
+func LoadThrottlerProfiles(configService *ConfigService, key string) ([]ThrottlerProfile, error) {
+	section, ok := configService.Get(key).(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("throttler configuration %q not found", key)
+	}
+
+	profiles := make([]ThrottlerProfile, 0, len(section))
+	for name, value := range section {
+		var profile ThrottlerProfile
+		switch v := value.(type) {
+		case string:
+			var err error
+			if profile, err = ParseThrottlerProfile(name, v); err != nil {
+				return nil, err
+			}
+		case map[string]interface{}:
+			limit, ok := convertToInt(v["limit"])
+			if !ok || limit <= 0 {
+				return nil, fmt.Errorf("invalid limit for throttler profile %q", name)
+			}
+			window, err := parseThrottlerWindow(fmt.Sprint(v["window"]))
+			if err != nil {
+				return nil, fmt.Errorf("throttler profile %q: %w", name, err)
+			}
+			strategy, _ := v["strategy"].(string)
+			profile = ThrottlerProfile{Name: name, Limit: limit, Window: window, Strategy: RateLimitStrategy(strategy)}
+		default:
+			return nil, fmt.Errorf("invalid throttler profile %q", name)
+		}
+		profiles = append(profiles, profile)
+	}
+
+	sort.Slice(profiles, func(i, j int) bool {
+		if profiles[i].Window != profiles[j].Window {
+			return profiles[i].Window < profiles[j].Window
+		}
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles, nil
+}
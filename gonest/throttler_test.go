@@ -0,0 +1,22 @@
+package gonest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOverrideProfilesIgnoresUnknownNames(t *testing.T) {
+	profiles := []ThrottlerProfile{{Name: "short", Limit: 10, Window: time.Second}}
+	overrides := []ThrottlerProfile{
+		{Name: "short", Limit: 3},
+		{Name: "other", Limit: 1, Window: time.Minute},
+	}
+
+	got := overrideProfiles(profiles, overrides)
+	if len(got) != 1 {
+		t.Fatalf("expected overrides of unknown profiles to be ignored, got %+v", got)
+	}
+	if got[0].Limit != 3 || got[0].Window != time.Second || !got[0].PerRoute {
+		t.Fatalf("unexpected overridden profile %+v", got[0])
+	}
+}
@@ -0,0 +1,339 @@
+package gonest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// CacheInvalidation is broadcast when a replica changes the shared cache
+type CacheInvalidation struct {
+	// Source identifies the publishing cache so it can ignore its own messages
+	Source string   `json:"source"`
+	Keys   []string `json:"keys,omitempty"`
+	Clear  bool     `json:"clear,omitempty"`
+}
+
+// InvalidationBus broadcasts cache invalidations between replicas
+type InvalidationBus interface {
+	Publish(ctx context.Context, message CacheInvalidation) error
+	// Subscribe registers a handler and returns a function removing it
+	Subscribe(handler func(CacheInvalidation)) (func(), error)
+}
+
+// MemoryInvalidationBus delivers invalidations synchronously within the process,
+// e.g. between caches in tests
+type MemoryInvalidationBus struct {
+	handlers map[int]func(CacheInvalidation)
+	nextID   int
+	mutex    sync.RWMutex
+}
+
+// NewMemoryInvalidationBus creates an in-process invalidation bus
+func NewMemoryInvalidationBus() *MemoryInvalidationBus {
+	return &MemoryInvalidationBus{
+		handlers: make(map[int]func(CacheInvalidation)),
+	}
+}
+
+// Publish delivers a message to all subscribers
+func (mb *MemoryInvalidationBus) Publish(ctx context.Context, message CacheInvalidation) error {
+	mb.mutex.RLock()
+	handlers := make([]func(CacheInvalidation), 0, len(mb.handlers))
+	for _, handler := range mb.handlers {
+		handlers = append(handlers, handler)
+	}
+	mb.mutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(message)
+	}
+	return nil
+}
+
+// Subscribe registers a handler
+func (mb *MemoryInvalidationBus) Subscribe(handler func(CacheInvalidation)) (func(), error) {
+	mb.mutex.Lock()
+	defer mb.mutex.Unlock()
+
+	id := mb.nextID
+	mb.nextID++
+	mb.handlers[id] = handler
+
+	return func() {
+		mb.mutex.Lock()
+		defer mb.mutex.Unlock()
+		delete(mb.handlers, id)
+	}, nil
+}
+
+// RedisInvalidationBus broadcasts invalidations over Redis pub/sub
+type RedisInvalidationBus struct {
+	client  *RedisClient
+	channel string
+	logger  *logrus.Logger
+}
+
+// NewRedisInvalidationBus creates a Redis invalidation bus; the channel defaults to gonest:cache:invalidate
+func NewRedisInvalidationBus(client *RedisClient, channel string, logger *logrus.Logger) *RedisInvalidationBus {
+	if channel == "" {
+		channel = "gonest:cache:invalidate"
+	}
+	return &RedisInvalidationBus{
+		client:  client,
+		channel: channel,
+		logger:  logger,
+	}
+}
+
+// Publish publishes a message on the channel
+func (rb *RedisInvalidationBus) Publish(ctx context.Context, message CacheInvalidation) error {
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	_, err = rb.client.Publish(ctx, rb.channel, payload)
+	return err
+}
+
+// Subscribe subscribes a handler to the channel. Messages may be lost while
+// the connection is down, so the handler receives a Clear message after
+// every reconnect.
+func (rb *RedisInvalidationBus) Subscribe(handler func(CacheInvalidation)) (func(), error) {
+	ctx, cancel := context.WithTimeout(context.Background(), rb.client.config.DialTimeout+rb.client.config.ReadTimeout)
+	defer cancel()
+
+	subscription, err := rb.client.Subscribe(ctx, rb.channel, func(payload []byte) {
+		if payload == nil {
+			handler(CacheInvalidation{Clear: true})
+			return
+		}
+
+		var message CacheInvalidation
+		if err := json.Unmarshal(payload, &message); err != nil {
+			if rb.logger != nil {
+				rb.logger.WithError(err).Warn("Invalid cache invalidation message")
+			}
+			return
+		}
+		handler(message)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { subscription.Close() }, nil
+}
+
+// ttlGetter is implemented by providers reading a value and its time-to-live in one round trip
+type ttlGetter interface {
+	GetWithTTL(ctx context.Context, key string) ([]byte, time.Duration, error)
+}
+
+// TieredCacheConfig configures a TieredCache
+type TieredCacheConfig struct {
+	// L1TTL caps how long values stay in the local cache, bounding
+	// staleness should an invalidation be missed
+	L1TTL time.Duration
+}
+
+// DefaultTieredCacheConfig returns the default tiered cache configuration
+func DefaultTieredCacheConfig() *TieredCacheConfig {
+	return &TieredCacheConfig{
+		L1TTL: time.Minute,
+	}
+}
+
+// TieredCache is a CacheProvider combining a local MemoryCache (L1) with a
+// shared provider (L2). Writes go to both tiers and are broadcast on the
+// invalidation bus so other replicas drop their L1 copies.
+type TieredCache struct {
+	l1          *MemoryCache
+	l2          CacheProvider
+	bus         InvalidationBus
+	config      *TieredCacheConfig
+	logger      *logrus.Logger
+	source      string
+	unsubscribe func()
+	// generation changes with every write and invalidation, so a Get racing with one
+	// does not fill L1 with the value it replaced
+	generation atomic.Uint64
+}
+
+// NewTieredCache creates a tiered cache and subscribes it to the bus
+func NewTieredCache(l1 *MemoryCache, l2 CacheProvider, bus InvalidationBus, config *TieredCacheConfig, logger *logrus.Logger) (*TieredCache, error) {
+	if config == nil {
+		config = DefaultTieredCacheConfig()
+	}
+
+	tc := &TieredCache{
+		l1:     l1,
+		l2:     l2,
+		bus:    bus,
+		config: config,
+		logger: logger,
+		source: generateTokenID(),
+	}
+
+	if bus != nil {
+		unsubscribe, err := bus.Subscribe(tc.invalidate)
+		if err != nil {
+			return nil, err
+		}
+		tc.unsubscribe = unsubscribe
+	}
+
+	return tc, nil
+}
+
+// invalidate applies an invalidation published by another replica
+func (tc *TieredCache) invalidate(message CacheInvalidation) {
+	if message.Source == tc.source {
+		return
+	}
+
+	tc.generation.Add(1)
+	ctx := context.Background()
+	if message.Clear {
+		tc.l1.Clear(ctx)
+		return
+	}
+	for _, key := range message.Keys {
+		tc.l1.Delete(ctx, key)
+	}
+}
+
+// publish broadcasts an invalidation, logging failures since L2 is already updated
+func (tc *TieredCache) publish(ctx context.Context, message CacheInvalidation) {
+	if tc.bus == nil {
+		return
+	}
+
+	message.Source = tc.source
+	if err := tc.bus.Publish(ctx, message); err != nil && tc.logger != nil {
+		tc.logger.WithError(err).Warn("Failed to publish cache invalidation")
+	}
+}
+
+// Get reads from L1, then from L2, populating L1 on an L2 hit unless an
+// invalidation arrived meanwhile
+func (tc *TieredCache) Get(ctx context.Context, key string) ([]byte, error) {
+	if value, err := tc.l1.Get(ctx, key); err == nil {
+		return value, nil
+	}
+
+	generation := tc.generation.Load()
+	value, ttl, err := tc.getL2(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if tc.generation.Load() != generation {
+		return value, nil
+	}
+
+	expiration := tc.config.L1TTL
+	if ttl > 0 && (expiration <= 0 || ttl < expiration) {
+		expiration = ttl
+	}
+	if err := tc.l1.Set(ctx, key, value, expiration); err != nil && !errors.Is(err, ErrCacheValueTooLarge) && tc.logger != nil {
+		tc.logger.WithError(err).Warn("Failed to populate L1 cache")
+	}
+	// An invalidation between the check and the write drops the fresh entry
+	if tc.generation.Load() != generation {
+		tc.l1.Delete(ctx, key)
+	}
+
+	return value, nil
+}
+
+// getL2 reads a value and its time-to-live from L2, 0 if unknown
+func (tc *TieredCache) getL2(ctx context.Context, key string) ([]byte, time.Duration, error) {
+	if provider, ok := tc.l2.(ttlGetter); ok {
+		return provider.GetWithTTL(ctx, key)
+	}
+
+	value, err := tc.l2.Get(ctx, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	ttl, err := tc.l2.TTL(ctx, key)
+	if err != nil {
+		ttl = 0
+	}
+	return value, ttl, nil
+}
+
+// Set writes to L2 and L1 and invalidates other replicas
+func (tc *TieredCache) Set(ctx context.Context, key string, value []byte, expiration time.Duration) error {
+	if err := tc.l2.Set(ctx, key, value, expiration); err != nil {
+		return err
+	}
+	tc.generation.Add(1)
+
+	l1Expiration := tc.config.L1TTL
+	if expiration > 0 && (l1Expiration <= 0 || expiration < l1Expiration) {
+		l1Expiration = expiration
+	}
+	if err := tc.l1.Set(ctx, key, value, l1Expiration); err != nil {
+		tc.l1.Delete(ctx, key)
+	}
+
+	tc.publish(ctx, CacheInvalidation{Keys: []string{key}})
+	return nil
+}
+
+// Delete removes a key from both tiers and invalidates other replicas
+func (tc *TieredCache) Delete(ctx context.Context, key string) error {
+	if err := tc.l2.Delete(ctx, key); err != nil {
+		return err
+	}
+	tc.generation.Add(1)
+	tc.l1.Delete(ctx, key)
+
+	tc.publish(ctx, CacheInvalidation{Keys: []string{key}})
+	return nil
+}
+
+// Clear clears both tiers and invalidates other replicas
+func (tc *TieredCache) Clear(ctx context.Context) error {
+	if err := tc.l2.Clear(ctx); err != nil {
+		return err
+	}
+	tc.generation.Add(1)
+	tc.l1.Clear(ctx)
+
+	tc.publish(ctx, CacheInvalidation{Clear: true})
+	return nil
+}
+
+// Exists checks L1, then L2
+func (tc *TieredCache) Exists(ctx context.Context, key string) (bool, error) {
+	if exists, _ := tc.l1.Exists(ctx, key); exists {
+		return true, nil
+	}
+	return tc.l2.Exists(ctx, key)
+}
+
+// TTL returns the remaining time to live in L2
+func (tc *TieredCache) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return tc.l2.TTL(ctx, key)
+}
+
+// Keys returns the keys of L2 matching a pattern
+func (tc *TieredCache) Keys(ctx context.Context, pattern string) ([]string, error) {
+	return tc.l2.Keys(ctx, pattern)
+}
+
+// Close unsubscribes from the bus and stops the L1 cache
+func (tc *TieredCache) Close() error {
+	if tc.unsubscribe != nil {
+		tc.unsubscribe()
+	}
+	return tc.l1.Close()
+}
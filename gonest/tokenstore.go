@@ -0,0 +1,409 @@
+package gonest
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Token store errors
+var (
+	ErrRefreshTokenNotFound = errors.New("refresh token not found")
+	ErrRefreshTokenReused   = errors.New("refresh token reuse detected")
+	ErrTokenRevoked         = errors.New("token has been revoked")
+)
+
+// RefreshTokenRecord tracks an issued refresh token.
+// Tokens issued by rotating another token share its FamilyID.
+type RefreshTokenRecord struct {
+	ID         string
+	FamilyID   string
+	UserID     string
+	IssuedAt   time.Time
+	ExpiresAt  time.Time
+	UsedAt     time.Time
+	ReplacedBy string
+	Revoked    bool
+}
+
+// IsUsed checks if the refresh token was already exchanged
+func (rtr *RefreshTokenRecord) IsUsed() bool {
+	return !rtr.UsedAt.IsZero()
+}
+
+// TokenStore persists refresh token families and revoked access tokens
+type TokenStore interface {
+	SaveRefreshToken(ctx context.Context, record *RefreshTokenRecord) error
+	GetRefreshToken(ctx context.Context, id string) (*RefreshTokenRecord, error)
+	// ConsumeRefreshToken atomically marks a refresh token as used and returns
+	// ErrRefreshTokenReused if it had already been used
+	ConsumeRefreshToken(ctx context.Context, id, replacedBy string) (*RefreshTokenRecord, error)
+	RevokeFamily(ctx context.Context, familyID string) error
+	// RevokeUser revokes all refresh tokens of a user and records the time of
+	// revocation, invalidating access tokens issued up to that moment
+	RevokeUser(ctx context.Context, userID string, at time.Time) error
+	UserRevokedAt(ctx context.Context, userID string) (time.Time, error)
+	DenyAccessToken(ctx context.Context, id string, expiresAt time.Time) error
+	IsAccessTokenDenied(ctx context.Context, id string) (bool, error)
+}
+
+// memoryStoreSweepInterval is the minimum time between sweeps of expired
+// entries by the in-memory stores, which sweep on writes
+const memoryStoreSweepInterval = time.Minute
+
+// MemoryTokenStore implements an in-memory token store.
+// Expired entries are swept on writes, at most once per sweep interval.
+type MemoryTokenStore struct {
+	refreshTokens map[string]*RefreshTokenRecord
+	deniedTokens  map[string]time.Time
+	userRevokedAt map[string]time.Time
+	// retention is how long user revocations are kept, which must cover
+	// the lifetime of the access tokens they invalidate
+	retention time.Duration
+	lastSweep time.Time
+	mutex     sync.RWMutex
+}
+
+// NewMemoryTokenStore creates a new memory token store
+func NewMemoryTokenStore() *MemoryTokenStore {
+	return &MemoryTokenStore{
+		refreshTokens: make(map[string]*RefreshTokenRecord),
+		deniedTokens:  make(map[string]time.Time),
+		userRevokedAt: make(map[string]time.Time),
+		retention:     7 * 24 * time.Hour,
+		lastSweep:     time.Now(),
+	}
+}
+
+// WithRevocationRetention sets how long user revocations are kept.
+// It must be at least the access token lifetime.
+func (mts *MemoryTokenStore) WithRevocationRetention(retention time.Duration) *MemoryTokenStore {
+	mts.mutex.Lock()
+	defer mts.mutex.Unlock()
+
+	mts.retention = retention
+	return mts
+}
+
+// extendRetention keeps user revocations for at least the given duration
+func (mts *MemoryTokenStore) extendRetention(retention time.Duration) {
+	mts.mutex.Lock()
+	defer mts.mutex.Unlock()
+
+	if retention > mts.retention {
+		mts.retention = retention
+	}
+}
+
+// maybeSweep removes expired entries once the sweep interval has passed.
+// The caller must hold the write lock.
+func (mts *MemoryTokenStore) maybeSweep(now time.Time) {
+	if now.Sub(mts.lastSweep) < memoryStoreSweepInterval {
+		return
+	}
+	mts.sweep(now)
+}
+
+// sweep removes expired refresh tokens, denylist entries and user
+// revocations. The caller must hold the write lock.
+func (mts *MemoryTokenStore) sweep(now time.Time) {
+	mts.lastSweep = now
+	for id, record := range mts.refreshTokens {
+		if now.After(record.ExpiresAt) {
+			delete(mts.refreshTokens, id)
+		}
+	}
+	for id, expiresAt := range mts.deniedTokens {
+		if now.After(expiresAt) {
+			delete(mts.deniedTokens, id)
+		}
+	}
+	for userID, revokedAt := range mts.userRevokedAt {
+		if now.Sub(revokedAt) > mts.retention {
+			delete(mts.userRevokedAt, userID)
+		}
+	}
+}
+
+// SaveRefreshToken stores a refresh token record
+func (mts *MemoryTokenStore) SaveRefreshToken(ctx context.Context, record *RefreshTokenRecord) error {
+	mts.mutex.Lock()
+	defer mts.mutex.Unlock()
+
+	mts.maybeSweep(time.Now())
+	stored := *record
+	mts.refreshTokens[record.ID] = &stored
+	return nil
+}
+
+// GetRefreshToken retrieves a refresh token record
+func (mts *MemoryTokenStore) GetRefreshToken(ctx context.Context, id string) (*RefreshTokenRecord, error) {
+	mts.mutex.RLock()
+	defer mts.mutex.RUnlock()
+
+	record, exists := mts.refreshTokens[id]
+	if !exists {
+		return nil, ErrRefreshTokenNotFound
+	}
+
+	result := *record
+	return &result, nil
+}
+
+// ConsumeRefreshToken marks a refresh token as used
+func (mts *MemoryTokenStore) ConsumeRefreshToken(ctx context.Context, id, replacedBy string) (*RefreshTokenRecord, error) {
+	mts.mutex.Lock()
+	defer mts.mutex.Unlock()
+
+	record, exists := mts.refreshTokens[id]
+	if !exists {
+		return nil, ErrRefreshTokenNotFound
+	}
+
+	if record.IsUsed() {
+		result := *record
+		return &result, ErrRefreshTokenReused
+	}
+
+	record.UsedAt = time.Now()
+	record.ReplacedBy = replacedBy
+
+	result := *record
+	return &result, nil
+}
+
+// RevokeFamily revokes every refresh token of a family
+func (mts *MemoryTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	mts.mutex.Lock()
+	defer mts.mutex.Unlock()
+
+	for _, record := range mts.refreshTokens {
+		if record.FamilyID == familyID {
+			record.Revoked = true
+		}
+	}
+	return nil
+}
+
+// RevokeUser revokes every refresh token of a user
+func (mts *MemoryTokenStore) RevokeUser(ctx context.Context, userID string, at time.Time) error {
+	mts.mutex.Lock()
+	defer mts.mutex.Unlock()
+
+	for _, record := range mts.refreshTokens {
+		if record.UserID == userID {
+			record.Revoked = true
+		}
+	}
+	mts.userRevokedAt[userID] = at
+	mts.maybeSweep(time.Now())
+	return nil
+}
+
+// UserRevokedAt returns when all tokens of a user were last revoked
+func (mts *MemoryTokenStore) UserRevokedAt(ctx context.Context, userID string) (time.Time, error) {
+	mts.mutex.RLock()
+	defer mts.mutex.RUnlock()
+
+	return mts.userRevokedAt[userID], nil
+}
+
+// DenyAccessToken adds an access token ID to the denylist until it expires
+func (mts *MemoryTokenStore) DenyAccessToken(ctx context.Context, id string, expiresAt time.Time) error {
+	mts.mutex.Lock()
+	defer mts.mutex.Unlock()
+
+	mts.maybeSweep(time.Now())
+	mts.deniedTokens[id] = expiresAt
+	return nil
+}
+
+// IsAccessTokenDenied checks if an access token ID is on the denylist
+func (mts *MemoryTokenStore) IsAccessTokenDenied(ctx context.Context, id string) (bool, error) {
+	mts.mutex.RLock()
+	defer mts.mutex.RUnlock()
+
+	expiresAt, exists := mts.deniedTokens[id]
+	if !exists {
+		return false, nil
+	}
+	return time.Now().Before(expiresAt), nil
+}
+
+// Cleanup removes expired refresh tokens, denylist entries and user
+// revocations without waiting for the next sweep
+func (mts *MemoryTokenStore) Cleanup(ctx context.Context) error {
+	mts.mutex.Lock()
+	defer mts.mutex.Unlock()
+
+	mts.sweep(time.Now())
+	return nil
+}
+
+// SQLTokenStore implements a token store on top of database/sql.
+// Queries use PostgreSQL syntax, matching the default database driver.
+type SQLTokenStore struct {
+	db *sql.DB
+}
+
+// NewSQLTokenStore creates a new SQL token store
+func NewSQLTokenStore(db *sql.DB) *SQLTokenStore {
+	return &SQLTokenStore{db: db}
+}
+
+// CreateTables creates the tables used by the token store
+func (sts *SQLTokenStore) CreateTables(ctx context.Context) error {
+	queries := []string{
+		`CREATE TABLE IF NOT EXISTS gonest_refresh_tokens (
+			id VARCHAR(64) PRIMARY KEY,
+			family_id VARCHAR(64) NOT NULL,
+			user_id VARCHAR(255) NOT NULL,
+			issued_at TIMESTAMP NOT NULL,
+			expires_at TIMESTAMP NOT NULL,
+			used_at TIMESTAMP NULL,
+			replaced_by VARCHAR(64) NOT NULL DEFAULT '',
+			revoked BOOLEAN NOT NULL DEFAULT FALSE
+		)`,
+		`CREATE INDEX IF NOT EXISTS gonest_refresh_tokens_family_idx ON gonest_refresh_tokens (family_id)`,
+		`CREATE INDEX IF NOT EXISTS gonest_refresh_tokens_user_idx ON gonest_refresh_tokens (user_id)`,
+		`CREATE TABLE IF NOT EXISTS gonest_denied_tokens (
+			id VARCHAR(64) PRIMARY KEY,
+			expires_at TIMESTAMP NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS gonest_user_revocations (
+			user_id VARCHAR(255) PRIMARY KEY,
+			revoked_at TIMESTAMP NOT NULL
+		)`,
+	}
+
+	for _, query := range queries {
+		if _, err := sts.db.ExecContext(ctx, query); err != nil {
+			return fmt.Errorf("failed to create token store tables: %w", err)
+		}
+	}
+	return nil
+}
+
+// SaveRefreshToken stores a refresh token record
+func (sts *SQLTokenStore) SaveRefreshToken(ctx context.Context, record *RefreshTokenRecord) error {
+	query := `INSERT INTO gonest_refresh_tokens (id, family_id, user_id, issued_at, expires_at, revoked)
+		VALUES ($1, $2, $3, $4, $5, $6)`
+	_, err := sts.db.ExecContext(ctx, query, record.ID, record.FamilyID, record.UserID,
+		record.IssuedAt, record.ExpiresAt, record.Revoked)
+	return err
+}
+
+// GetRefreshToken retrieves a refresh token record
+func (sts *SQLTokenStore) GetRefreshToken(ctx context.Context, id string) (*RefreshTokenRecord, error) {
+	query := `SELECT id, family_id, user_id, issued_at, expires_at, used_at, replaced_by, revoked
+		FROM gonest_refresh_tokens WHERE id = $1`
+
+	var record RefreshTokenRecord
+	var usedAt sql.NullTime
+	err := sts.db.QueryRowContext(ctx, query, id).Scan(&record.ID, &record.FamilyID, &record.UserID,
+		&record.IssuedAt, &record.ExpiresAt, &usedAt, &record.ReplacedBy, &record.Revoked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrRefreshTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if usedAt.Valid {
+		record.UsedAt = usedAt.Time
+	}
+	return &record, nil
+}
+
+// ConsumeRefreshToken marks a refresh token as used with a conditional update
+func (sts *SQLTokenStore) ConsumeRefreshToken(ctx context.Context, id, replacedBy string) (*RefreshTokenRecord, error) {
+	query := `UPDATE gonest_refresh_tokens SET used_at = $1, replaced_by = $2 WHERE id = $3 AND used_at IS NULL`
+	result, err := sts.db.ExecContext(ctx, query, time.Now(), replacedBy, id)
+	if err != nil {
+		return nil, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return nil, err
+	}
+
+	record, err := sts.GetRefreshToken(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if affected == 0 {
+		return record, ErrRefreshTokenReused
+	}
+	return record, nil
+}
+
+// RevokeFamily revokes every refresh token of a family
+func (sts *SQLTokenStore) RevokeFamily(ctx context.Context, familyID string) error {
+	_, err := sts.db.ExecContext(ctx, `UPDATE gonest_refresh_tokens SET revoked = TRUE WHERE family_id = $1`, familyID)
+	return err
+}
+
+// RevokeUser revokes every refresh token of a user
+func (sts *SQLTokenStore) RevokeUser(ctx context.Context, userID string, at time.Time) error {
+	if _, err := sts.db.ExecContext(ctx, `UPDATE gonest_refresh_tokens SET revoked = TRUE WHERE user_id = $1`, userID); err != nil {
+		return err
+	}
+
+	query := `INSERT INTO gonest_user_revocations (user_id, revoked_at) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET revoked_at = EXCLUDED.revoked_at`
+	_, err := sts.db.ExecContext(ctx, query, userID, at)
+	return err
+}
+
+// UserRevokedAt returns when all tokens of a user were last revoked
+func (sts *SQLTokenStore) UserRevokedAt(ctx context.Context, userID string) (time.Time, error) {
+	var revokedAt time.Time
+	err := sts.db.QueryRowContext(ctx, `SELECT revoked_at FROM gonest_user_revocations WHERE user_id = $1`, userID).Scan(&revokedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, nil
+	}
+	return revokedAt, err
+}
+
+// DenyAccessToken adds an access token ID to the denylist until it expires
+func (sts *SQLTokenStore) DenyAccessToken(ctx context.Context, id string, expiresAt time.Time) error {
+	query := `INSERT INTO gonest_denied_tokens (id, expires_at) VALUES ($1, $2) ON CONFLICT (id) DO NOTHING`
+	_, err := sts.db.ExecContext(ctx, query, id, expiresAt)
+	return err
+}
+
+// IsAccessTokenDenied checks if an access token ID is on the denylist
+func (sts *SQLTokenStore) IsAccessTokenDenied(ctx context.Context, id string) (bool, error) {
+	var count int
+	query := `SELECT COUNT(*) FROM gonest_denied_tokens WHERE id = $1 AND expires_at > $2`
+	if err := sts.db.QueryRowContext(ctx, query, id, time.Now()).Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+// Cleanup removes expired refresh tokens and denylist entries
+func (sts *SQLTokenStore) Cleanup(ctx context.Context) error {
+	now := time.Now()
+	if _, err := sts.db.ExecContext(ctx, `DELETE FROM gonest_refresh_tokens WHERE expires_at < $1`, now); err != nil {
+		return err
+	}
+	_, err := sts.db.ExecContext(ctx, `DELETE FROM gonest_denied_tokens WHERE expires_at < $1`, now)
+	return err
+}
+
+// generateTokenID generates a random identifier for tokens
+func generateTokenID() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		panic(fmt.Sprintf("failed to generate token ID: %v", err))
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,49 @@
+package gonest
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryTokenStoreSweepsOnWrite(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryTokenStore().WithRevocationRetention(time.Hour)
+	past := time.Now().Add(-2 * time.Hour)
+
+	if err := store.SaveRefreshToken(ctx, &RefreshTokenRecord{ID: "expired", ExpiresAt: past}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.DenyAccessToken(ctx, "denied", past); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.RevokeUser(ctx, "user", past); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes before the sweep interval has passed leave entries in place
+	if _, err := store.GetRefreshToken(ctx, "expired"); err != nil {
+		t.Fatalf("expected expired token before sweep, got %v", err)
+	}
+
+	store.mutex.Lock()
+	store.lastSweep = time.Now().Add(-memoryStoreSweepInterval)
+	store.mutex.Unlock()
+
+	if err := store.SaveRefreshToken(ctx, &RefreshTokenRecord{ID: "live", ExpiresAt: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.GetRefreshToken(ctx, "expired"); err != ErrRefreshTokenNotFound {
+		t.Errorf("expected expired token to be swept, got %v", err)
+	}
+	if _, err := store.GetRefreshToken(ctx, "live"); err != nil {
+		t.Errorf("expected live token to remain, got %v", err)
+	}
+	if len(store.deniedTokens) != 0 {
+		t.Errorf("expected denylist to be swept, got %d entries", len(store.deniedTokens))
+	}
+	if revokedAt, _ := store.UserRevokedAt(ctx, "user"); !revokedAt.IsZero() {
+		t.Errorf("expected user revocation past retention to be swept, got %v", revokedAt)
+	}
+}